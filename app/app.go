@@ -30,13 +30,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/liangdas/mqant/broker"
 	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/event"
 	"github.com/liangdas/mqant/log"
 	"github.com/liangdas/mqant/module"
 	basemodule "github.com/liangdas/mqant/module/base"
 	"github.com/liangdas/mqant/module/modules"
 	"github.com/liangdas/mqant/registry"
 	mqrpc "github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/transport"
 	"github.com/liangdas/mqant/selector"
 	"github.com/liangdas/mqant/selector/cache"
 	"github.com/nats-io/nats.go"
@@ -91,13 +94,16 @@ func newOptions(opts ...module.Option) module.Options {
 		flag.Parse() //解析输入的参数
 	}
 
-	if opt.Nats == nil {
-		nc, err := nats.Connect(nats.DefaultURL)
-		if err != nil {
-			log.Error("nats agent: %s", err.Error())
-			//panic(fmt.Sprintf("nats agent: %s", err.Error()))
+	if opt.Transport == nil {
+		if opt.Nats == nil {
+			nc, err := nats.Connect(nats.DefaultURL)
+			if err != nil {
+				log.Error("nats agent: %s", err.Error())
+				//panic(fmt.Sprintf("nats agent: %s", err.Error()))
+			}
+			opt.Nats = nc
 		}
-		opt.Nats = nc
+		opt.Transport = transport.NewNatsTransport(opt.Nats)
 	}
 
 	if opt.WorkDir == "" {
@@ -179,6 +185,7 @@ func NewApp(opts ...module.Option) module.App {
 	app.opts = options
 	options.Selector.Init(selector.SetWatcher(app.Watcher))
 	app.rpcserializes = map[string]module.RPCSerialize{}
+	app.eventBus = event.NewBus()
 	return app
 }
 
@@ -197,6 +204,11 @@ type DefaultApp struct {
 	startup             func(app module.App)
 	moduleInited        func(app module.App, module module.Module)
 	protocolMarshal     func(Trace string, Result interface{}, Error string) (module.ProtocolMarshal, string)
+	brokerLock          sync.Mutex
+	ownBroker           bool           //Broker由应用创建,退出时需要关闭
+	brokerServer        *broker.Server //BrokerServer节点为其他节点提供的服务
+	brokerBackend       broker.Broker  //brokerServer保存消息使用的Broker
+	eventBus            event.Bus
 }
 
 // Run 运行应用
@@ -234,10 +246,17 @@ func (app *DefaultApp) Run(mods ...module.Module) error {
 		manager.Register(mods[i])
 	}
 	app.OnInit(app.settings)
+	if app.opts.Broker == nil && app.opts.BrokerMode == broker.ModeTransport && app.opts.BrokerServer {
+		//保存消息的节点在模块初始化之前开始提供服务
+		if _, err := app.getBroker(); err != nil {
+			log.Error("broker server start error %v", err)
+		}
+	}
 	manager.Init(app, app.opts.ProcessID)
 	if app.startup != nil {
 		app.startup(app)
 	}
+	app.eventBus.Publish(module.AppStartupEvent{App: app})
 	log.Info("mqant %v started", app.opts.Version)
 	// close
 	c := make(chan os.Signal, 1)
@@ -249,6 +268,7 @@ func (app *DefaultApp) Run(mods ...module.Module) error {
 	timeout := time.NewTimer(app.opts.KillWaitTTL)
 	wait := make(chan struct{})
 	go func() {
+		app.eventBus.Publish(module.AppDestroyEvent{App: app})
 		manager.Destroy()
 		app.OnDestroy()
 		wait <- struct{}{}
@@ -291,9 +311,9 @@ func (app *DefaultApp) Options() module.Options {
 	return app.opts
 }
 
-// Transport Transport
-func (app *DefaultApp) Transport() *nats.Conn {
-	return app.opts.Nats
+// Transport RPC传输层
+func (app *DefaultApp) Transport() mqrpc.Transport {
+	return app.opts.Transport
 }
 
 // Registry Registry
@@ -319,6 +339,7 @@ func (app *DefaultApp) Watcher(node *registry.Node) {
 // Configure 重设应用配置
 func (app *DefaultApp) Configure(settings conf.Config) error {
 	app.settings = settings
+	app.eventBus.Publish(module.ConfChangedEvent{Settings: settings})
 	return nil
 }
 
@@ -330,7 +351,25 @@ func (app *DefaultApp) OnInit(settings conf.Config) error {
 
 // OnDestroy 应用退出
 func (app *DefaultApp) OnDestroy() error {
-
+	app.eventBus.Close()
+	app.brokerLock.Lock()
+	defer app.brokerLock.Unlock()
+	if app.ownBroker && app.opts.Broker != nil {
+		if err := app.opts.Broker.Close(); err != nil {
+			log.Warning("broker close error %v", err)
+		}
+		app.opts.Broker = nil
+		app.ownBroker = false
+	}
+	if app.brokerServer != nil {
+		if err := app.brokerServer.Close(); err != nil {
+			log.Warning("broker server close error %v", err)
+		}
+		if err := app.brokerBackend.Close(); err != nil {
+			log.Warning("broker close error %v", err)
+		}
+		app.brokerServer, app.brokerBackend = nil, nil
+	}
 	return nil
 }
 
@@ -389,12 +428,24 @@ func (app *DefaultApp) GetServerBySelector(serviceName string, opts ...selector.
 
 // GetServersByType 通过服务类型获取服务实例列表
 func (app *DefaultApp) GetServersByType(serviceName string) []module.ServerSession {
+	return app.getServers(serviceName)
+}
+
+// getServers 获取服务的所有实例,可以用selector.WithFilter过滤
+func (app *DefaultApp) getServers(serviceName string, opts ...selector.SelectOption) []module.ServerSession {
 	sessions := make([]module.ServerSession, 0)
 	services, err := app.opts.Selector.GetService(serviceName)
 	if err != nil {
 		log.Warning("GetServersByType %v", err)
 		return sessions
 	}
+	sopts := selector.SelectOptions{}
+	for _, opt := range opts {
+		opt(&sopts)
+	}
+	for _, filter := range sopts.Filters {
+		services = filter(services)
+	}
 	for _, service := range services {
 		//log.TInfo(nil,"GetServersByType3 %v %v",Type,service.Nodes)
 		for _, node := range service.Nodes {
@@ -498,12 +549,161 @@ func (app *DefaultApp) RpcInvokeNR(module module.RPCModule, moduleType string, _
 
 // Call Call
 func (app *DefaultApp) Call(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (result interface{}, errstr string) {
-	server, err := app.GetRouteServer(moduleType, opts...)
+	result, err := app.CallWithError(ctx, moduleType, _func, param, opts...)
 	if err != nil {
 		errstr = err.Error()
-		return
 	}
-	return server.Call(ctx, _func, param()...)
+	return
+}
+
+// CallWithError 与Call相同,返回的错误为 *mqrpc.Error
+// 幂等的handler调用失败时按重试策略重新选择其他节点调用
+func (app *DefaultApp) CallWithError(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, error) {
+	server, err := app.GetRouteServer(moduleType, opts...)
+	if err != nil {
+		return nil, mqrpc.NewError(mqrpc.CodeUnavailable, err.Error())
+	}
+	params := param()
+	policy, ok := mqrpc.RetryFromContext(ctx)
+	if !ok {
+		policy = app.opts.RetryPolicy
+	}
+	if policy.MaxAttempts <= 1 || !(policy.Force || mqrpc.IsIdempotent(server.GetNode().Metadata, _func)) {
+		return server.CallWithError(ctx, _func, params...)
+	}
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), app.opts.RPCExpired)
+		defer cancel()
+	}
+	tried := []string{server.GetID()}
+	return mqrpc.Retry(ctx, policy, func(ctx context.Context, attempt int) (interface{}, error) {
+		if attempt > 0 {
+			//重新选择一个还没有失败过的节点
+			sopts := append([]selector.SelectOption{selector.WithFilter(selector.FilterExclude(tried...))}, opts...)
+			s, err := app.GetRouteServer(moduleType, sopts...)
+			if err != nil {
+				return nil, mqrpc.NewError(mqrpc.CodeUnavailable, err.Error())
+			}
+			server = s
+			tried = append(tried, server.GetID())
+			log.Warning("rpc Call ServerId = %v Func = %v retry %d", server.GetID(), _func, attempt)
+		}
+		//重试由这里处理,节点上不再重试
+		return server.CallWithError(mqrpc.WithRetry(ctx, mqrpc.RetryPolicy{}), _func, params...)
+	})
+}
+
+// CallAll 并发调用moduleType的所有节点,共用ctx的超时时间,返回每个节点的结果
+func (app *DefaultApp) CallAll(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) []mqrpc.NodeResult {
+	servers, ids := app.fanoutServers(moduleType, opts...)
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), app.opts.RPCExpired)
+		defer cancel()
+	}
+	params := param()
+	return mqrpc.CallAll(ctx, ids, func(ctx context.Context, serverID string) (interface{}, error) {
+		return servers[serverID].CallWithError(ctx, _func, params...)
+	})
+}
+
+// CallAny 调用moduleType的节点,返回第一个成功的结果,其他调用会被取消
+// 可以用 mqrpc.WithHedgeDelay 设置对冲间隔,否则同时调用所有节点
+func (app *DefaultApp) CallAny(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) mqrpc.NodeResult {
+	servers, ids := app.fanoutServers(moduleType, opts...)
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), app.opts.RPCExpired)
+		defer cancel()
+	}
+	params := param()
+	return mqrpc.CallAny(ctx, ids, func(ctx context.Context, serverID string) (interface{}, error) {
+		return servers[serverID].CallWithError(ctx, _func, params...)
+	})
+}
+
+func (app *DefaultApp) fanoutServers(moduleType string, opts ...selector.SelectOption) (map[string]module.ServerSession, []string) {
+	sessions := app.getServers(moduleType, opts...)
+	servers := make(map[string]module.ServerSession, len(sessions))
+	ids := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		servers[s.GetID()] = s
+		ids = append(ids, s.GetID())
+	}
+	return servers, ids
+}
+
+// Stream 流式调用
+func (app *DefaultApp) Stream(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (mqrpc.Stream, error) {
+	server, err := app.GetRouteServer(moduleType, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return server.Stream(ctx, _func, param()...)
+}
+
+// EventBus 进程内的事件总线
+func (app *DefaultApp) EventBus() event.Bus {
+	return app.eventBus
+}
+
+// getBroker 没有设置 module.Broker 时按 module.Options.BrokerMode 创建
+func (app *DefaultApp) getBroker() (broker.Broker, error) {
+	app.brokerLock.Lock()
+	defer app.brokerLock.Unlock()
+	if app.opts.Broker != nil {
+		return app.opts.Broker, nil
+	}
+	dir := filepath.Join(app.opts.WorkDir, "data", "broker")
+	var (
+		b   broker.Broker
+		err error
+	)
+	switch app.opts.BrokerMode {
+	case broker.ModeTransport:
+		if app.opts.BrokerServer && app.brokerServer == nil {
+			backend, err := broker.NewFileBroker(dir)
+			if err != nil {
+				return nil, err
+			}
+			server, err := broker.NewServer(app.Transport(), backend)
+			if err != nil {
+				backend.Close()
+				return nil, err
+			}
+			app.brokerServer, app.brokerBackend = server, backend
+		}
+		b, err = broker.NewTransportBroker(app.Transport())
+	case "", broker.ModeFile:
+		b, err = broker.NewFileBroker(dir)
+	default:
+		err = fmt.Errorf("unknown broker mode %q", app.opts.BrokerMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	app.opts.Broker = b
+	app.ownBroker = true
+	return b, nil
+}
+
+// Publish 发布持久化的异步消息
+func (app *DefaultApp) Publish(topic string, msg *broker.Message) error {
+	b, err := app.getBroker()
+	if err != nil {
+		return err
+	}
+	return b.Publish(topic, msg)
+}
+
+// Subscribe 以消费组group订阅topic
+func (app *DefaultApp) Subscribe(topic, group string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	b, err := app.getBroker()
+	if err != nil {
+		return nil, err
+	}
+	return b.Subscribe(topic, group, handler, opts...)
 }
 
 // RpcCall RpcCall
@@ -0,0 +1,83 @@
+// Package broker 模块间持久化的异步消息
+//
+// 消息至少投递一次: 订阅者处理完成后必须调用 Event.Ack, 超过AckWait没有确认或调用 Event.Nack 的消息会重新投递。
+// 同一个消费组内的订阅者分担消息,不同的消费组各自收到全部消息。
+//
+// 单节点部署使用 NewFileBroker; 多节点部署时由一个节点运行 NewServer 保存消息,
+// 所有节点通过 NewTransportBroker 经 mqrpc.Transport 发布与订阅,同一个消费组可以分布在不同节点上。
+package broker
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+// DeadLetterSuffix 超过最大投递次数的消息转发到 topic+DeadLetterSuffix
+const DeadLetterSuffix = ".dead"
+
+// Broker的实现, 见 module.Options.BrokerMode
+const (
+	ModeFile      = "file"      //本地文件,只适用于单节点
+	ModeTransport = "transport" //经 mqrpc.Transport 访问保存消息的节点
+)
+
+var (
+	// ErrClosed Broker已经关闭
+	ErrClosed = errors.New("broker closed")
+	// ErrInvalidName topic或消费组的名称只能包含字母、数字和 _ . -
+	ErrInvalidName = errors.New("broker invalid topic or group name")
+	// ErrTimeout 等待保存消息的节点应答超时
+	ErrTimeout = errors.New("broker server timeout")
+	// ErrUnknownDelivery 确认的消息不存在,已经确认过或者超过AckWait已经重新投递
+	ErrUnknownDelivery = errors.New("broker unknown delivery")
+)
+
+// Broker 持久化的消息队列,与 mqrpc.Transport 一样可以替换实现
+type Broker interface {
+	// Publish 发布消息,返回时消息已经持久化, msg.ID与msg.Timestamp由Broker填写
+	Publish(topic string, msg *Message) error
+	// Subscribe 以消费组group订阅topic, 新的消费组从最早保留的消息开始消费
+	Subscribe(topic, group string, handler Handler, opts ...SubscribeOption) (Subscriber, error)
+	Close() error
+	String() string
+}
+
+// Message 消息
+type Message struct {
+	ID        string            `json:"id"`
+	Header    map[string]string `json:"header,omitempty"`
+	Body      []byte            `json:"body"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Event 投递给订阅者的消息
+type Event interface {
+	Topic() string
+	Group() string
+	Message() *Message
+	// Attempts 第几次投递,从1开始
+	Attempts() int
+	// Ack 确认消息已经处理,不会再投递
+	Ack() error
+	// Nack 处理失败,delay后重新投递
+	Nack(delay time.Duration) error
+}
+
+// Handler 处理消息, handler panic时消息会立即重新投递
+type Handler func(event Event)
+
+// Subscriber 订阅
+type Subscriber interface {
+	Topic() string
+	Group() string
+	// Unsubscribe 取消订阅,未确认的消息会投递给同组的其他订阅者
+	Unsubscribe() error
+}
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// validName topic与消费组的名称会作为文件名使用
+func validName(name string) bool {
+	return nameRegexp.MatchString(name) && name != "." && name != ".."
+}
@@ -0,0 +1,676 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+)
+
+const (
+	messagesFile = "messages.log"
+	offsetSuffix = ".offset"
+	// trimBatch 已被所有消费组确认的消息达到该数量时才从内存中释放
+	trimBatch = 1024
+)
+
+// fileBroker 基于本地文件的Broker,适用于单节点部署与测试,同一个目录只能由一个进程使用
+//
+//	dir/<topic>/messages.log    每行一条json消息,只追加
+//	dir/<topic>/<group>.offset  消费组已经连续确认的最大序号
+type fileBroker struct {
+	dir    string
+	opts   Options
+	mu     sync.Mutex
+	topics map[string]*fileTopic
+	closed bool
+}
+
+// NewFileBroker 在dir目录中保存消息,目录不存在时自动创建
+func NewFileBroker(dir string, opts ...Option) (Broker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	b := &fileBroker{
+		dir:    dir,
+		topics: map[string]*fileTopic{},
+	}
+	for _, o := range opts {
+		o(&b.opts)
+	}
+	return b, nil
+}
+
+func (b *fileBroker) String() string {
+	return "file"
+}
+
+type fileTopic struct {
+	name     string
+	dir      string
+	file     *os.File
+	size     int64      //文件中完整消息的字节数
+	last     uint64     //最后一条消息的序号
+	first    uint64     //messages[0]的序号
+	messages []*Message //内存中保留的消息
+	groups   map[string]*fileGroup
+}
+
+// topic 打开topic,恢复消息与消费组的进度,调用方需要持有锁
+func (b *fileBroker) topic(name string) (*fileTopic, error) {
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+	t := &fileTopic{
+		name:   name,
+		dir:    filepath.Join(b.dir, name),
+		groups: map[string]*fileGroup{},
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		t.file.Close()
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, offsetSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(t.dir, name))
+		if err != nil {
+			t.file.Close()
+			return nil, err
+		}
+		committed, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			t.file.Close()
+			return nil, fmt.Errorf("broker %s: invalid offset file %s", t.name, name)
+		}
+		if committed > t.last {
+			//消息文件被清理过,新消息的序号从消费组的进度之后开始
+			t.last, t.first, t.messages = committed, committed+1, nil
+		}
+		t.groups[strings.TrimSuffix(name, offsetSuffix)] = newFileGroup(b, t, strings.TrimSuffix(name, offsetSuffix), committed)
+	}
+	t.trim(0)
+	b.topics[t.name] = t
+	return t, nil
+}
+
+// load 读取消息文件,最后一行不完整时(写入时进程退出)截断
+func (t *fileTopic) load() error {
+	f, err := os.OpenFile(filepath.Join(t.dir, messagesFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		msg := new(Message)
+		if err := json.Unmarshal(line, msg); err != nil {
+			f.Close()
+			return fmt.Errorf("broker %s: corrupted message at offset %d: %v", t.name, t.size, err)
+		}
+		seq, err := strconv.ParseUint(msg.ID, 10, 64)
+		if err != nil || seq <= t.last {
+			f.Close()
+			return fmt.Errorf("broker %s: invalid message id %q at offset %d", t.name, msg.ID, t.size)
+		}
+		if len(t.messages) == 0 {
+			t.first = seq
+		}
+		t.messages = append(t.messages, msg)
+		t.last = seq
+		t.size += int64(len(line))
+	}
+	if err := f.Truncate(t.size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(t.size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if len(t.messages) == 0 {
+		t.first = t.last + 1
+	}
+	t.file = f
+	return nil
+}
+
+// message 获取内存中的消息,已经释放时返回nil
+func (t *fileTopic) message(seq uint64) *Message {
+	if seq < t.first || seq >= t.first+uint64(len(t.messages)) {
+		return nil
+	}
+	return t.messages[seq-t.first]
+}
+
+// trim 释放已经被所有消费组确认的消息,数量达到batch时才释放,没有消费组时保留所有消息
+func (t *fileTopic) trim(batch int) {
+	if len(t.groups) == 0 {
+		return
+	}
+	min := t.last
+	for _, g := range t.groups {
+		if g.committed < min {
+			min = g.committed
+		}
+	}
+	if min < t.first {
+		return
+	}
+	n := min - t.first + 1
+	if n > uint64(len(t.messages)) {
+		n = uint64(len(t.messages))
+	}
+	if n == 0 || n < uint64(batch) {
+		return
+	}
+	t.messages = append([]*Message(nil), t.messages[n:]...)
+	t.first += n
+}
+
+func (b *fileBroker) Publish(topic string, msg *Message) error {
+	if !validName(topic) {
+		return ErrInvalidName
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	t, err := b.topic(topic)
+	if err != nil {
+		return err
+	}
+	return b.publish(t, msg)
+}
+
+// publish 写入消息文件并通知消费组,调用方需要持有锁
+func (b *fileBroker) publish(t *fileTopic, msg *Message) error {
+	seq := t.last + 1
+	stored := &Message{
+		ID:        strconv.FormatUint(seq, 10),
+		Header:    msg.Header,
+		Body:      append([]byte(nil), msg.Body...),
+		Timestamp: time.Now(),
+	}
+	line, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := t.file.Write(line); err != nil {
+		//去掉写了一半的消息
+		t.file.Truncate(t.size)
+		t.file.Seek(t.size, io.SeekStart)
+		return err
+	}
+	if b.opts.Sync {
+		if err := t.file.Sync(); err != nil {
+			return err
+		}
+	}
+	t.size += int64(len(line))
+	t.last = seq
+	t.messages = append(t.messages, stored)
+	msg.ID, msg.Timestamp = stored.ID, stored.Timestamp
+	for _, g := range t.groups {
+		g.notify()
+	}
+	return nil
+}
+
+func (b *fileBroker) Subscribe(topic, group string, handler Handler, opts ...SubscribeOption) (Subscriber, error) {
+	if !validName(topic) || !validName(group) {
+		return nil, ErrInvalidName
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	t, err := b.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	g, ok := t.groups[group]
+	if !ok {
+		//新的消费组从最早保留的消息开始消费,立即记录进度,之后的消息在消费组确认前不会被释放
+		g = newFileGroup(b, t, group, t.first-1)
+		if err := g.save(); err != nil {
+			return nil, err
+		}
+		t.groups[group] = g
+	}
+	sub := &fileSubscriber{
+		group:   g,
+		handler: handler,
+		opts:    newSubscribeOptions(opts...),
+		signal:  make(chan struct{}, 1),
+	}
+	g.subs = append(g.subs, sub)
+	go sub.run()
+	if !g.running {
+		g.running = true
+		go g.dispatch()
+	}
+	g.notify()
+	return sub, nil
+}
+
+func (b *fileBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	var err error
+	for _, t := range b.topics {
+		for _, g := range t.groups {
+			for _, sub := range g.subs {
+				sub.close()
+			}
+			g.subs = nil
+			g.notify()
+		}
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// delivery 一条消息在消费组中的投递状态
+type delivery struct {
+	seq      uint64
+	attempts int
+	sub      *fileSubscriber
+	deadline time.Time //已投递时为确认的超时时间,等待重新投递时为重新投递的时间
+}
+
+type fileGroup struct {
+	broker    *fileBroker
+	topic     *fileTopic
+	name      string
+	committed uint64               //小于等于committed的消息都已确认
+	acked     map[uint64]bool      //大于committed且已经确认的消息
+	next      uint64               //下一条没有投递过的消息
+	pending   map[uint64]*delivery //已投递未确认的消息
+	retry     []*delivery          //等待重新投递的消息
+	subs      []*fileSubscriber
+	rr        int
+	running   bool
+	wake      chan struct{}
+}
+
+func newFileGroup(b *fileBroker, t *fileTopic, name string, committed uint64) *fileGroup {
+	return &fileGroup{
+		broker:    b,
+		topic:     t,
+		name:      name,
+		committed: committed,
+		acked:     map[uint64]bool{},
+		next:      committed + 1,
+		pending:   map[uint64]*delivery{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (g *fileGroup) notify() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save 记录消费进度,先写临时文件再改名
+func (g *fileGroup) save() error {
+	path := filepath.Join(g.topic.dir, g.name+offsetSuffix)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatUint(g.committed, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// dispatch 把消息投递给订阅者,没有订阅者时退出
+func (g *fileGroup) dispatch() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		g.broker.mu.Lock()
+		if len(g.subs) == 0 {
+			g.running = false
+			g.broker.mu.Unlock()
+			return
+		}
+		wait := g.deliver(time.Now())
+		g.broker.mu.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-g.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// deliver 投递所有可以投递的消息,返回下一次需要检查超时的等待时间,调用方需要持有锁
+func (g *fileGroup) deliver(now time.Time) time.Duration {
+	for seq, d := range g.pending {
+		if !d.deadline.After(now) {
+			//确认超时,重新投递
+			delete(g.pending, seq)
+			d.sub.inflight--
+			d.deadline = now
+			g.retry = append(g.retry, d)
+		}
+	}
+	for {
+		sub := g.subscriber()
+		if sub == nil {
+			break
+		}
+		d := g.take(now)
+		if d == nil {
+			break
+		}
+		msg := g.topic.message(d.seq)
+		if msg == nil {
+			//不会发生: 未确认的消息不会被释放
+			g.settle(d.seq)
+			continue
+		}
+		//每次投递使用新的delivery,之前投递的Nack不会影响这一次
+		d = &delivery{seq: d.seq, attempts: d.attempts + 1, sub: sub, deadline: now.Add(sub.opts.AckWait)}
+		if sub.opts.MaxDeliver > 0 && d.attempts > sub.opts.MaxDeliver {
+			g.dead(d, msg)
+			continue
+		}
+		g.pending[d.seq] = d
+		sub.inflight++
+		sub.push(&fileEvent{group: g, d: d, msg: msg})
+	}
+	wait := time.Hour
+	for _, d := range g.pending {
+		if w := d.deadline.Sub(now); w < wait {
+			wait = w
+		}
+	}
+	for _, d := range g.retry {
+		if w := d.deadline.Sub(now); w < wait {
+			wait = w
+		}
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// subscriber 按轮询选择一个还能接收消息的订阅者
+func (g *fileGroup) subscriber() *fileSubscriber {
+	for i := 0; i < len(g.subs); i++ {
+		sub := g.subs[(g.rr+i)%len(g.subs)]
+		if sub.inflight < sub.opts.MaxInFlight {
+			g.rr = (g.rr + i + 1) % len(g.subs)
+			return sub
+		}
+	}
+	return nil
+}
+
+// take 取出下一条需要投递的消息: 先重新投递序号最小的到期消息,再投递新消息
+func (g *fileGroup) take(now time.Time) *delivery {
+	index := -1
+	for i, d := range g.retry {
+		if !d.deadline.After(now) && (index < 0 || d.seq < g.retry[index].seq) {
+			index = i
+		}
+	}
+	if index >= 0 {
+		d := g.retry[index]
+		g.retry = append(g.retry[:index], g.retry[index+1:]...)
+		return d
+	}
+	if g.next <= g.topic.last {
+		d := &delivery{seq: g.next}
+		g.next++
+		return d
+	}
+	return nil
+}
+
+// dead 超过最大投递次数,转发到死信topic后确认
+func (g *fileGroup) dead(d *delivery, msg *Message) {
+	header := map[string]string{}
+	for k, v := range msg.Header {
+		header[k] = v
+	}
+	header["dead-topic"] = g.topic.name
+	header["dead-group"] = g.name
+	header["dead-id"] = msg.ID
+	t, err := g.broker.topic(g.topic.name + DeadLetterSuffix)
+	if err == nil {
+		err = g.broker.publish(t, &Message{Header: header, Body: msg.Body})
+	}
+	if err != nil {
+		log.Warning("broker %s/%s dead letter %s error %v", g.topic.name, g.name, msg.ID, err)
+		d.deadline = time.Now().Add(time.Second)
+		g.retry = append(g.retry, d)
+		return
+	}
+	g.settle(d.seq)
+}
+
+// settle 确认消息,推进并保存消费进度,调用方需要持有锁
+func (g *fileGroup) settle(seq uint64) {
+	if seq <= g.committed || g.acked[seq] {
+		return
+	}
+	if d, ok := g.pending[seq]; ok {
+		delete(g.pending, seq)
+		d.sub.inflight--
+	}
+	for i, d := range g.retry {
+		if d.seq == seq {
+			g.retry = append(g.retry[:i], g.retry[i+1:]...)
+			break
+		}
+	}
+	g.acked[seq] = true
+	committed := g.committed
+	for g.acked[g.committed+1] {
+		delete(g.acked, g.committed+1)
+		g.committed++
+	}
+	if g.committed != committed {
+		if err := g.save(); err != nil {
+			log.Warning("broker %s/%s save offset error %v", g.topic.name, g.name, err)
+		}
+		g.topic.trim(trimBatch)
+	}
+	g.notify()
+}
+
+func (g *fileGroup) nack(d *delivery, delay time.Duration) {
+	if g.pending[d.seq] != d {
+		//已经确认或超时后重新投递了
+		return
+	}
+	delete(g.pending, d.seq)
+	d.sub.inflight--
+	d.deadline = time.Now().Add(delay)
+	g.retry = append(g.retry, d)
+	g.notify()
+}
+
+type fileSubscriber struct {
+	group    *fileGroup
+	handler  Handler
+	opts     SubscribeOptions
+	inflight int          //已投递未确认的消息数
+	queue    []*fileEvent //已投递等待handler处理的消息
+	signal   chan struct{}
+	closed   bool
+}
+
+func (s *fileSubscriber) Topic() string {
+	return s.group.topic.name
+}
+
+func (s *fileSubscriber) Group() string {
+	return s.group.name
+}
+
+// push 调用方需要持有锁
+func (s *fileSubscriber) push(event *fileEvent) {
+	s.queue = append(s.queue, event)
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// close 调用方需要持有锁
+func (s *fileSubscriber) close() {
+	s.closed = true
+	s.queue = nil
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *fileSubscriber) run() {
+	mu := &s.group.broker.mu
+	for range s.signal {
+		for {
+			mu.Lock()
+			if s.closed {
+				mu.Unlock()
+				return
+			}
+			if len(s.queue) == 0 {
+				mu.Unlock()
+				break
+			}
+			event := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			mu.Unlock()
+			s.handle(event)
+		}
+	}
+}
+
+func (s *fileSubscriber) handle(event *fileEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("broker %s/%s handler panic %v", event.Topic(), event.Group(), r)
+			event.Nack(0)
+		}
+	}()
+	s.handler(event)
+}
+
+func (s *fileSubscriber) Unsubscribe() error {
+	g := s.group
+	g.broker.mu.Lock()
+	defer g.broker.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.close()
+	for i, sub := range g.subs {
+		if sub == s {
+			g.subs = append(g.subs[:i], g.subs[i+1:]...)
+			break
+		}
+	}
+	//未确认的消息投递给同组的其他订阅者
+	now := time.Now()
+	for seq, d := range g.pending {
+		if d.sub == s {
+			delete(g.pending, seq)
+			d.deadline = now
+			g.retry = append(g.retry, d)
+		}
+	}
+	s.inflight = 0
+	g.notify()
+	return nil
+}
+
+type fileEvent struct {
+	group *fileGroup
+	d     *delivery
+	msg   *Message
+}
+
+func (e *fileEvent) Topic() string {
+	return e.group.topic.name
+}
+
+func (e *fileEvent) Group() string {
+	return e.group.name
+}
+
+func (e *fileEvent) Message() *Message {
+	return e.msg
+}
+
+func (e *fileEvent) Attempts() int {
+	return e.d.attempts
+}
+
+func (e *fileEvent) Ack() error {
+	b := e.group.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	e.group.settle(e.d.seq)
+	return nil
+}
+
+func (e *fileEvent) Nack(delay time.Duration) error {
+	b := e.group.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	e.group.nack(e.d, delay)
+	return nil
+}
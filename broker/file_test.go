@@ -0,0 +1,185 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func publish(t *testing.T, b Broker, topic string, bodies ...string) {
+	for _, body := range bodies {
+		if err := b.Publish(topic, &Message{Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func receive(t *testing.T, ch chan Event, n int) []Event {
+	events := make([]Event, 0, n)
+	for len(events) < n {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		case <-time.After(time.Second * 3):
+			t.Fatalf("receive timeout, got %d of %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func collect(ch chan Event) Handler {
+	return func(e Event) {
+		ch <- e
+	}
+}
+
+func TestFileBrokerGroups(t *testing.T) {
+	b, err := NewFileBroker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	publish(t, b, "purchase", "1", "2", "3", "4")
+	shop := make(chan Event, 10)
+	stats := make(chan Event, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := b.Subscribe("purchase", "shop", collect(shop)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Subscribe("purchase", "stats", collect(stats), MaxInFlight(10)); err != nil {
+		t.Fatal(err)
+	}
+	//同组的订阅者分担消息,不同组各自收到全部消息
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		e := receive(t, shop, 1)[0]
+		got[string(e.Message().Body)]++
+		if err := e.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range receive(t, stats, 4) {
+		got[string(e.Message().Body)]++
+		e.Ack()
+	}
+	for i := 1; i <= 4; i++ {
+		if got[strconv.Itoa(i)] != 2 {
+			t.Fatalf("deliveries %v", got)
+		}
+	}
+	select {
+	case e := <-shop:
+		t.Fatalf("unexpected redelivery %s", e.Message().Body)
+	case <-time.After(time.Millisecond * 50):
+	}
+	if _, err := b.Subscribe("purchase", "../x", collect(shop)); err != ErrInvalidName {
+		t.Fatalf("invalid group got %v", err)
+	}
+}
+
+func TestFileBrokerRedelivery(t *testing.T) {
+	b, err := NewFileBroker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	ch := make(chan Event, 10)
+	if _, err := b.Subscribe("orders", "billing", collect(ch), AckWait(time.Millisecond*100), MaxDeliver(3)); err != nil {
+		t.Fatal(err)
+	}
+	dead := make(chan Event, 10)
+	if _, err := b.Subscribe("orders"+DeadLetterSuffix, "ops", collect(dead)); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "orders", "a")
+	e := receive(t, ch, 1)[0]
+	if e.Attempts() != 1 {
+		t.Fatalf("attempts %d", e.Attempts())
+	}
+	//Nack后重新投递
+	e.Nack(0)
+	e = receive(t, ch, 1)[0]
+	if e.Attempts() != 2 {
+		t.Fatalf("attempts %d", e.Attempts())
+	}
+	//不确认,超时后重新投递
+	e = receive(t, ch, 1)[0]
+	if e.Attempts() != 3 {
+		t.Fatalf("attempts %d", e.Attempts())
+	}
+	//超过最大投递次数,转发到死信topic
+	e.Nack(0)
+	d := receive(t, dead, 1)[0]
+	if string(d.Message().Body) != "a" || d.Message().Header["dead-topic"] != "orders" || d.Message().Header["dead-group"] != "billing" {
+		t.Fatalf("dead letter %+v", d.Message())
+	}
+	d.Ack()
+	//过期的Nack不影响之后的投递
+	publish(t, b, "orders", "b")
+	e2 := receive(t, ch, 1)[0]
+	e.Nack(0)
+	e2.Ack()
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected redelivery %s", e.Message().Body)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestFileBrokerRestart(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewFileBroker(dir, Sync(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Event, 10)
+	if _, err := b.Subscribe("events", "g", collect(ch), MaxInFlight(3)); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "events", "1", "2", "3")
+	events := receive(t, ch, 3)
+	//只确认第1、3条
+	events[0].Ack()
+	events[2].Ack()
+	b.Close()
+	if err := events[1].Ack(); err != ErrClosed {
+		t.Fatalf("ack after close got %v", err)
+	}
+	//模拟写入时进程退出,最后一行不完整
+	f, err := os.OpenFile(filepath.Join(dir, "events", messagesFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"4","bo`)
+	f.Close()
+
+	b, err = NewFileBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var mu sync.Mutex
+	var bodies []string
+	ch = make(chan Event, 10)
+	if _, err := b.Subscribe("events", "g", func(e Event) {
+		mu.Lock()
+		bodies = append(bodies, string(e.Message().Body))
+		mu.Unlock()
+		e.Ack()
+		ch <- e
+	}); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "events", "4")
+	events = receive(t, ch, 3)
+	mu.Lock()
+	defer mu.Unlock()
+	//至少投递一次: 第3条虽然确认过,但第2条没有确认,重启后会再次投递
+	if len(bodies) != 3 || bodies[0] != "2" || bodies[1] != "3" || bodies[2] != "4" || events[2].Message().ID != "4" {
+		t.Fatalf("after restart got %v", bodies)
+	}
+}
@@ -0,0 +1,113 @@
+package broker
+
+import "time"
+
+// Options FileBroker的配置
+type Options struct {
+	// Sync 每条消息写入后调用fsync,保证机器掉电时不丢消息
+	Sync bool
+}
+
+// Option FileBroker的配置项
+type Option func(*Options)
+
+// Sync 每条消息写入后调用fsync
+func Sync(b bool) Option {
+	return func(o *Options) {
+		o.Sync = b
+	}
+}
+
+// DefaultSubject 保存消息的节点订阅的subject
+const DefaultSubject = "mqant.broker"
+
+// TransportOptions NewTransportBroker 与 NewServer 的配置,两端需要使用相同的Subject
+type TransportOptions struct {
+	Subject   string        //保存消息的节点订阅的subject,默认 DefaultSubject
+	Timeout   time.Duration //等待应答的时间,默认10秒
+	Heartbeat time.Duration //订阅的心跳间隔,服务端超过3个间隔没有收到心跳时取消订阅,默认5秒
+}
+
+// TransportOption NewTransportBroker 与 NewServer 的配置项
+type TransportOption func(*TransportOptions)
+
+func newTransportOptions(opts ...TransportOption) TransportOptions {
+	opt := TransportOptions{
+		Subject:   DefaultSubject,
+		Timeout:   time.Second * 10,
+		Heartbeat: time.Second * 5,
+	}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return opt
+}
+
+// Subject 保存消息的节点订阅的subject
+func Subject(s string) TransportOption {
+	return func(o *TransportOptions) {
+		o.Subject = s
+	}
+}
+
+// Timeout 等待应答的时间
+func Timeout(d time.Duration) TransportOption {
+	return func(o *TransportOptions) {
+		o.Timeout = d
+	}
+}
+
+// Heartbeat 订阅的心跳间隔
+func Heartbeat(d time.Duration) TransportOption {
+	return func(o *TransportOptions) {
+		o.Heartbeat = d
+	}
+}
+
+// SubscribeOptions 订阅选项
+type SubscribeOptions struct {
+	MaxInFlight int           //同时处理(未确认)的最大消息数,默认1即按顺序处理
+	AckWait     time.Duration //投递后等待确认的时间,超时后重新投递,默认30秒
+	MaxDeliver  int           //最多投递次数,超过后转发到 topic+DeadLetterSuffix 并确认; 为0时不限制
+}
+
+// SubscribeOption 订阅选项
+type SubscribeOption func(*SubscribeOptions)
+
+func newSubscribeOptions(opts ...SubscribeOption) SubscribeOptions {
+	opt := SubscribeOptions{
+		MaxInFlight: 1,
+		AckWait:     time.Second * 30,
+	}
+	for _, o := range opts {
+		o(&opt)
+	}
+	if opt.MaxInFlight < 1 {
+		opt.MaxInFlight = 1
+	}
+	if opt.AckWait <= 0 {
+		opt.AckWait = time.Second * 30
+	}
+	return opt
+}
+
+// MaxInFlight 同时处理的最大消息数
+func MaxInFlight(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.MaxInFlight = n
+	}
+}
+
+// AckWait 等待确认的时间
+func AckWait(d time.Duration) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.AckWait = d
+	}
+}
+
+// MaxDeliver 最多投递次数
+func MaxDeliver(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.MaxDeliver = n
+	}
+}
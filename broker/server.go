@@ -0,0 +1,285 @@
+package broker
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/rpc"
+)
+
+// Server 在本节点上用backend保存消息,经 mqrpc.Transport 为 NewTransportBroker 提供服务
+// 同一个Subject只能有一个Server; 消费组、重新投递与死信都由backend处理
+type Server struct {
+	t       mqrpc.Transport
+	backend Broker
+	opts    TransportOptions
+	in      mqrpc.Subscription
+	mu      sync.Mutex
+	subs    map[string]*remoteSubscriber
+	seq     uint64 //投递的序号
+	closed  bool
+	done    chan struct{}
+}
+
+// remoteSubscriber 其他节点的一个订阅,在backend中对应一个订阅者
+type remoteSubscriber struct {
+	id       string
+	inbox    string
+	sub      Subscriber
+	timeout  time.Duration //超过timeout没有心跳时取消订阅
+	lastSeen time.Time
+	ackWait  time.Duration
+	events   map[string]*remoteEvent //已投递未确认的消息
+}
+
+type remoteEvent struct {
+	event    Event
+	deadline time.Time //超过deadline后backend已经重新投递,不再接受确认
+}
+
+// NewServer 在t上提供backend的服务, Close时不会关闭backend
+func NewServer(t mqrpc.Transport, backend Broker, opts ...TransportOption) (*Server, error) {
+	s := &Server{
+		t:       t,
+		backend: backend,
+		opts:    newTransportOptions(opts...),
+		subs:    map[string]*remoteSubscriber{},
+		done:    make(chan struct{}),
+	}
+	in, err := t.Subscribe(s.opts.Subject, s.serve)
+	if err != nil {
+		return nil, err
+	}
+	s.in = in
+	go s.reap()
+	return s, nil
+}
+
+// serve 处理一个请求,同一个Subject上的请求按顺序处理
+func (s *Server) serve(data []byte) {
+	p := new(packet)
+	if err := json.Unmarshal(data, p); err != nil {
+		log.Warning("broker invalid packet %v", err)
+		return
+	}
+	r := &packet{Op: opReply, ID: p.ID}
+	var err error
+	switch p.Op {
+	case opPublish:
+		if p.Message == nil {
+			p.Message = new(Message)
+		}
+		if err = s.backend.Publish(p.Topic, p.Message); err == nil {
+			r.Message = &Message{ID: p.Message.ID, Timestamp: p.Message.Timestamp}
+		}
+	case opSubscribe:
+		err = s.subscribe(p)
+	case opUnsubscribe:
+		err = s.unsubscribe(p.Sub)
+	case opAck, opNack:
+		err = s.settle(p)
+	case opPing:
+		r.Subs = s.ping(p.Subs)
+	default:
+		return
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.reply(p.ReplyTo, r)
+}
+
+func (s *Server) reply(to string, r *packet) {
+	if to == "" {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = s.t.Publish(to, data)
+	}
+	if err != nil {
+		log.Warning("broker reply error %v", err)
+	}
+}
+
+// subscribe 重复的订阅请求(重新订阅)只更新心跳时间
+func (s *Server) subscribe(p *packet) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	if rs, ok := s.subs[p.Sub]; ok {
+		rs.lastSeen = time.Now()
+		s.mu.Unlock()
+		return nil
+	}
+	heartbeat := p.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = s.opts.Heartbeat
+	}
+	rs := &remoteSubscriber{
+		id:       p.Sub,
+		inbox:    p.ReplyTo,
+		timeout:  heartbeat * 3,
+		lastSeen: time.Now(),
+		ackWait:  newSubscribeOptions(AckWait(p.AckWait)).AckWait,
+		events:   map[string]*remoteEvent{},
+	}
+	s.subs[rs.id] = rs
+	s.mu.Unlock()
+	sub, err := s.backend.Subscribe(p.Topic, p.Group, func(e Event) {
+		s.forward(rs, e)
+	}, MaxInFlight(p.MaxInFlight), AckWait(p.AckWait), MaxDeliver(p.MaxDeliver))
+	if err != nil {
+		s.mu.Lock()
+		delete(s.subs, rs.id)
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	if s.subs[rs.id] != rs {
+		//订阅期间服务已经关闭
+		s.mu.Unlock()
+		sub.Unsubscribe()
+		return ErrClosed
+	}
+	rs.sub = sub
+	s.mu.Unlock()
+	return nil
+}
+
+// forward 把backend投递的消息转发给订阅的节点
+func (s *Server) forward(rs *remoteSubscriber, e Event) {
+	s.mu.Lock()
+	if s.subs[rs.id] != rs {
+		//订阅已经取消,backend会把消息投递给其他订阅者
+		s.mu.Unlock()
+		return
+	}
+	s.seq++
+	id := strconv.FormatUint(s.seq, 10)
+	rs.events[id] = &remoteEvent{event: e, deadline: time.Now().Add(rs.ackWait)}
+	s.mu.Unlock()
+	data, err := json.Marshal(&packet{
+		Op:       opDeliver,
+		Sub:      rs.id,
+		Delivery: id,
+		Attempts: e.Attempts(),
+		Message:  e.Message(),
+	})
+	if err == nil {
+		err = s.t.Publish(rs.inbox, data)
+	}
+	if err != nil {
+		log.Warning("broker %s/%s deliver error %v", e.Topic(), e.Group(), err)
+		s.mu.Lock()
+		delete(rs.events, id)
+		s.mu.Unlock()
+		e.Nack(time.Second)
+	}
+}
+
+func (s *Server) settle(p *packet) error {
+	s.mu.Lock()
+	rs, ok := s.subs[p.Sub]
+	if !ok {
+		s.mu.Unlock()
+		return ErrUnknownDelivery
+	}
+	re, ok := rs.events[p.Delivery]
+	delete(rs.events, p.Delivery)
+	s.mu.Unlock()
+	if !ok {
+		return ErrUnknownDelivery
+	}
+	if p.Op == opNack {
+		return re.event.Nack(p.Delay)
+	}
+	return re.event.Ack()
+}
+
+func (s *Server) unsubscribe(id string) error {
+	s.mu.Lock()
+	rs, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mu.Unlock()
+	if !ok || rs.sub == nil {
+		return nil
+	}
+	//未确认的消息由backend投递给同组的其他订阅者
+	return rs.sub.Unsubscribe()
+}
+
+// ping 更新心跳时间,返回不存在的订阅
+func (s *Server) ping(ids []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unknown []string
+	now := time.Now()
+	for _, id := range ids {
+		if rs, ok := s.subs[id]; ok {
+			rs.lastSeen = now
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown
+}
+
+// reap 取消超时没有心跳的订阅(节点已经退出),释放超过AckWait的投递
+func (s *Server) reap() {
+	ticker := time.NewTicker(s.opts.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		var expired []string
+		now := time.Now()
+		s.mu.Lock()
+		for id, rs := range s.subs {
+			if now.Sub(rs.lastSeen) > rs.timeout {
+				expired = append(expired, id)
+			}
+			for did, re := range rs.events {
+				if now.After(re.deadline) {
+					delete(rs.events, did)
+				}
+			}
+		}
+		s.mu.Unlock()
+		for _, id := range expired {
+			log.Warning("broker subscriber %s heartbeat timeout", id)
+			if err := s.unsubscribe(id); err != nil {
+				log.Warning("broker unsubscribe %s error %v", id, err)
+			}
+		}
+	}
+}
+
+// Close 停止服务并取消其他节点的订阅, backend需要由调用方关闭
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	subs := s.subs
+	s.subs = map[string]*remoteSubscriber{}
+	s.mu.Unlock()
+	err := s.in.Unsubscribe()
+	for _, rs := range subs {
+		if rs.sub != nil {
+			rs.sub.Unsubscribe()
+		}
+	}
+	return err
+}
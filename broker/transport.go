@@ -0,0 +1,406 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/utils/uuid"
+)
+
+// 节点间的消息类型
+const (
+	opPublish     = "publish"
+	opSubscribe   = "subscribe"
+	opUnsubscribe = "unsubscribe"
+	opAck         = "ack"
+	opNack        = "nack"
+	opPing        = "ping"
+	opReply       = "reply"
+	opDeliver     = "deliver"
+)
+
+// packet NewTransportBroker 与 NewServer 之间的消息, json编码
+type packet struct {
+	Op          string        `json:"op"`
+	ID          string        `json:"id,omitempty"`       //请求的ID,应答中原样返回
+	ReplyTo     string        `json:"reply_to,omitempty"` //应答与投递的地址
+	Topic       string        `json:"topic,omitempty"`
+	Group       string        `json:"group,omitempty"`
+	Sub         string        `json:"sub,omitempty"`      //订阅的ID
+	Subs        []string      `json:"subs,omitempty"`     //心跳中的订阅,应答中为服务端不存在的订阅
+	Delivery    string        `json:"delivery,omitempty"` //一次投递的ID,用于确认
+	Attempts    int           `json:"attempts,omitempty"`
+	Delay       time.Duration `json:"delay,omitempty"`
+	MaxInFlight int           `json:"max_inflight,omitempty"`
+	AckWait     time.Duration `json:"ack_wait,omitempty"`
+	MaxDeliver  int           `json:"max_deliver,omitempty"`
+	Heartbeat   time.Duration `json:"heartbeat,omitempty"`
+	Message     *Message      `json:"message,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// remoteError 还原对端返回的错误,已知的错误返回同一个变量
+func remoteError(s string) error {
+	for _, err := range []error{ErrClosed, ErrInvalidName, ErrUnknownDelivery} {
+		if s == err.Error() {
+			return err
+		}
+	}
+	return errors.New(s)
+}
+
+// transportBroker 经 mqrpc.Transport 访问 NewServer 的Broker
+// 每个实例有一个inbox接收应答与投递的消息,订阅定时发送心跳,服务端重启后自动重新订阅
+type transportBroker struct {
+	t      mqrpc.Transport
+	opts   TransportOptions
+	inbox  string
+	in     mqrpc.Subscription
+	mu     sync.Mutex
+	calls  map[string]chan *packet
+	subs   map[string]*transportSubscriber
+	closed bool
+	done   chan struct{}
+}
+
+// NewTransportBroker 经t访问保存消息的节点(NewServer),可以在任意多个节点上创建
+func NewTransportBroker(t mqrpc.Transport, opts ...TransportOption) (Broker, error) {
+	b := &transportBroker{
+		t:     t,
+		opts:  newTransportOptions(opts...),
+		inbox: t.NewInbox(),
+		calls: map[string]chan *packet{},
+		subs:  map[string]*transportSubscriber{},
+		done:  make(chan struct{}),
+	}
+	in, err := t.Subscribe(b.inbox, b.receive)
+	if err != nil {
+		return nil, err
+	}
+	b.in = in
+	go b.heartbeat()
+	return b, nil
+}
+
+func (b *transportBroker) String() string {
+	return ModeTransport
+}
+
+// receive inbox收到的应答与投递
+func (b *transportBroker) receive(data []byte) {
+	p := new(packet)
+	if err := json.Unmarshal(data, p); err != nil {
+		log.Warning("broker invalid packet %v", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch p.Op {
+	case opReply:
+		if ch, ok := b.calls[p.ID]; ok {
+			delete(b.calls, p.ID)
+			ch <- p
+		}
+	case opDeliver:
+		sub, ok := b.subs[p.Sub]
+		if !ok || sub.closed {
+			//已经取消的订阅,服务端超过AckWait后重新投递
+			return
+		}
+		sub.push(&transportEvent{
+			sub:      sub,
+			delivery: p.Delivery,
+			attempts: p.Attempts,
+			msg:      p.Message,
+		})
+	}
+}
+
+// send 发送不需要应答的请求
+func (b *transportBroker) send(p *packet) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return b.t.Publish(b.opts.Subject, data)
+}
+
+// call 发送请求并等待应答
+func (b *transportBroker) call(p *packet) (*packet, error) {
+	p.ID = uuid.Rand().Hex()
+	p.ReplyTo = b.inbox
+	ch := make(chan *packet, 1)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrClosed
+	}
+	b.calls[p.ID] = ch
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.calls, p.ID)
+		b.mu.Unlock()
+	}()
+	if err := b.send(p); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(b.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		if r.Error != "" {
+			return nil, remoteError(r.Error)
+		}
+		return r, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	case <-b.done:
+		return nil, ErrClosed
+	}
+}
+
+func (b *transportBroker) Publish(topic string, msg *Message) error {
+	if !validName(topic) {
+		return ErrInvalidName
+	}
+	r, err := b.call(&packet{Op: opPublish, Topic: topic, Message: msg})
+	if err != nil {
+		return err
+	}
+	if r.Message != nil {
+		msg.ID, msg.Timestamp = r.Message.ID, r.Message.Timestamp
+	}
+	return nil
+}
+
+func (b *transportBroker) Subscribe(topic, group string, handler Handler, opts ...SubscribeOption) (Subscriber, error) {
+	if !validName(topic) || !validName(group) {
+		return nil, ErrInvalidName
+	}
+	sub := &transportSubscriber{
+		broker:  b,
+		id:      uuid.Rand().Hex(),
+		topic:   topic,
+		group:   group,
+		handler: handler,
+		opts:    newSubscribeOptions(opts...),
+		signal:  make(chan struct{}, 1),
+	}
+	//先登记,服务端订阅后立即投递的消息不会丢失
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrClosed
+	}
+	b.subs[sub.id] = sub
+	b.mu.Unlock()
+	if _, err := b.call(sub.request()); err != nil {
+		b.mu.Lock()
+		delete(b.subs, sub.id)
+		b.mu.Unlock()
+		return nil, err
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// heartbeat 定时告诉服务端订阅仍然存在,服务端不认识的订阅(服务端重启过)重新订阅
+func (b *transportBroker) heartbeat() {
+	ticker := time.NewTicker(b.opts.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		ids := make([]string, 0, len(b.subs))
+		for id := range b.subs {
+			ids = append(ids, id)
+		}
+		b.mu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+		r, err := b.call(&packet{Op: opPing, Subs: ids})
+		if err != nil {
+			log.Warning("broker heartbeat error %v", err)
+			continue
+		}
+		for _, id := range r.Subs {
+			b.mu.Lock()
+			sub, ok := b.subs[id]
+			b.mu.Unlock()
+			if !ok {
+				continue
+			}
+			if _, err := b.call(sub.request()); err != nil {
+				log.Warning("broker %s/%s resubscribe error %v", sub.topic, sub.group, err)
+			}
+		}
+	}
+}
+
+func (b *transportBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	subs := b.subs
+	b.subs = map[string]*transportSubscriber{}
+	for _, sub := range subs {
+		sub.close()
+	}
+	b.mu.Unlock()
+	//未确认的消息由服务端投递给同组的其他订阅者
+	for _, sub := range subs {
+		if err := b.send(&packet{Op: opUnsubscribe, Sub: sub.id}); err != nil {
+			log.Warning("broker %s/%s unsubscribe error %v", sub.topic, sub.group, err)
+		}
+	}
+	return b.in.Unsubscribe()
+}
+
+type transportSubscriber struct {
+	broker  *transportBroker
+	id      string
+	topic   string
+	group   string
+	handler Handler
+	opts    SubscribeOptions
+	queue   []*transportEvent //等待handler处理的消息
+	signal  chan struct{}
+	closed  bool
+}
+
+func (s *transportSubscriber) Topic() string {
+	return s.topic
+}
+
+func (s *transportSubscriber) Group() string {
+	return s.group
+}
+
+// request 订阅请求,重新订阅时使用同一个ID
+func (s *transportSubscriber) request() *packet {
+	return &packet{
+		Op:          opSubscribe,
+		Topic:       s.topic,
+		Group:       s.group,
+		Sub:         s.id,
+		MaxInFlight: s.opts.MaxInFlight,
+		AckWait:     s.opts.AckWait,
+		MaxDeliver:  s.opts.MaxDeliver,
+		Heartbeat:   s.broker.opts.Heartbeat,
+	}
+}
+
+// push 调用方需要持有锁
+func (s *transportSubscriber) push(event *transportEvent) {
+	s.queue = append(s.queue, event)
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// close 调用方需要持有锁
+func (s *transportSubscriber) close() {
+	s.closed = true
+	s.queue = nil
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *transportSubscriber) run() {
+	mu := &s.broker.mu
+	for range s.signal {
+		for {
+			mu.Lock()
+			if s.closed {
+				mu.Unlock()
+				return
+			}
+			if len(s.queue) == 0 {
+				mu.Unlock()
+				break
+			}
+			event := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			mu.Unlock()
+			s.handle(event)
+		}
+	}
+}
+
+func (s *transportSubscriber) handle(event *transportEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("broker %s/%s handler panic %v", event.Topic(), event.Group(), r)
+			event.Nack(0)
+		}
+	}()
+	s.handler(event)
+}
+
+func (s *transportSubscriber) Unsubscribe() error {
+	b := s.broker
+	b.mu.Lock()
+	if s.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	s.close()
+	delete(b.subs, s.id)
+	b.mu.Unlock()
+	_, err := b.call(&packet{Op: opUnsubscribe, Sub: s.id})
+	if err == ErrClosed {
+		return nil
+	}
+	return err
+}
+
+type transportEvent struct {
+	sub      *transportSubscriber
+	delivery string
+	attempts int
+	msg      *Message
+}
+
+func (e *transportEvent) Topic() string {
+	return e.sub.topic
+}
+
+func (e *transportEvent) Group() string {
+	return e.sub.group
+}
+
+func (e *transportEvent) Message() *Message {
+	return e.msg
+}
+
+func (e *transportEvent) Attempts() int {
+	return e.attempts
+}
+
+func (e *transportEvent) Ack() error {
+	_, err := e.sub.broker.call(&packet{Op: opAck, Sub: e.sub.id, Delivery: e.delivery})
+	return err
+}
+
+func (e *transportEvent) Nack(delay time.Duration) error {
+	_, err := e.sub.broker.call(&packet{Op: opNack, Sub: e.sub.id, Delivery: e.delivery, Delay: delay})
+	return err
+}
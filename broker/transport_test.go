@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/rpc/transport"
+)
+
+// newCluster 一个保存消息的节点和n个经Transport访问的节点
+func newCluster(t *testing.T, dir string, n int, opts ...TransportOption) (*transport.LocalTransport, *Server, Broker, []Broker) {
+	tr := transport.NewLocalTransport()
+	backend, err := NewFileBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(tr, backend, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]Broker, n)
+	for i := range nodes {
+		if nodes[i], err = NewTransportBroker(tr, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, b := range nodes {
+			b.Close()
+		}
+		server.Close()
+		backend.Close()
+		tr.Close()
+	})
+	return tr, server, backend, nodes
+}
+
+func TestTransportBrokerGroups(t *testing.T) {
+	_, _, _, nodes := newCluster(t, t.TempDir(), 2)
+	shop := [2]chan Event{make(chan Event, 10), make(chan Event, 10)}
+	stats := make(chan Event, 10)
+	//同一个消费组分布在两个节点上
+	for i, b := range nodes {
+		if _, err := b.Subscribe("purchase", "shop", collect(shop[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := nodes[1].Subscribe("purchase", "stats", collect(stats), MaxInFlight(10)); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{Body: []byte("1")}
+	if err := nodes[0].Publish("purchase", msg); err != nil || msg.ID != "1" {
+		t.Fatalf("publish id %q error %v", msg.ID, err)
+	}
+	publish(t, nodes[1], "purchase", "2", "3", "4")
+	got := map[string]int{}
+	perNode := [2]int{}
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-shop[0]:
+			perNode[0]++
+			got[string(e.Message().Body)]++
+			if err := e.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		case e := <-shop[1]:
+			perNode[1]++
+			got[string(e.Message().Body)]++
+			if err := e.Ack(); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("receive timeout, got %v", got)
+		}
+	}
+	if len(got) != 4 || perNode[0] == 0 || perNode[1] == 0 {
+		t.Fatalf("shop got %v per node %v", got, perNode)
+	}
+	for i, e := range receive(t, stats, 4) {
+		if string(e.Message().Body) != string(rune('1'+i)) {
+			t.Fatalf("stats order %d got %s", i, e.Message().Body)
+		}
+		if err := e.Ack(); err != nil {
+			t.Fatal(err)
+		}
+		//已经确认的消息不能再确认
+		if err := e.Ack(); err != ErrUnknownDelivery {
+			t.Fatalf("ack twice got %v", err)
+		}
+	}
+	if err := nodes[0].Publish("bad/topic", &Message{}); err != ErrInvalidName {
+		t.Fatalf("invalid topic got %v", err)
+	}
+}
+
+func TestTransportBrokerRedeliver(t *testing.T) {
+	_, _, backend, nodes := newCluster(t, t.TempDir(), 1)
+	ch := make(chan Event, 10)
+	if _, err := nodes[0].Subscribe("task", "worker", collect(ch), AckWait(time.Millisecond*100), MaxDeliver(3)); err != nil {
+		t.Fatal(err)
+	}
+	dead := make(chan Event, 1)
+	if _, err := backend.Subscribe("task"+DeadLetterSuffix, "ops", collect(dead)); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, nodes[0], "task", "x")
+	e := receive(t, ch, 1)[0]
+	if err := e.Nack(0); err != nil {
+		t.Fatal(err)
+	}
+	//第二次不确认,超过AckWait后重新投递
+	if e = receive(t, ch, 1)[0]; e.Attempts() != 2 {
+		t.Fatalf("attempts %d", e.Attempts())
+	}
+	if e = receive(t, ch, 1)[0]; e.Attempts() != 3 {
+		t.Fatalf("attempts %d", e.Attempts())
+	}
+	d := receive(t, dead, 1)[0]
+	if d.Message().Header["dead-group"] != "worker" || string(d.Message().Body) != "x" {
+		t.Fatalf("dead letter %+v", d.Message())
+	}
+}
+
+func TestTransportBrokerNodeFailure(t *testing.T) {
+	_, _, _, nodes := newCluster(t, t.TempDir(), 2, Heartbeat(time.Millisecond*50))
+	first := make(chan Event, 10)
+	if _, err := nodes[0].Subscribe("match", "room", collect(first), AckWait(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, nodes[1], "match", "m1")
+	receive(t, first, 1)
+	//节点0异常退出: 没有取消订阅,也不再发送心跳
+	crashed := nodes[0].(*transportBroker)
+	crashed.mu.Lock()
+	crashed.closed = true
+	close(crashed.done)
+	crashed.mu.Unlock()
+	crashed.in.Unsubscribe()
+	second := make(chan Event, 10)
+	if _, err := nodes[1].Subscribe("match", "room", collect(second), AckWait(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	//没有等到AckWait,服务端发现心跳超时后把消息投递给同组的其他节点
+	e := receive(t, second, 1)[0]
+	if string(e.Message().Body) != "m1" || e.Attempts() != 2 {
+		t.Fatalf("redelivered %s attempts %d", e.Message().Body, e.Attempts())
+	}
+	if err := e.Ack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportBrokerServerRestart(t *testing.T) {
+	dir := t.TempDir()
+	tr, server, backend, nodes := newCluster(t, dir, 1, Heartbeat(time.Millisecond*50))
+	ch := make(chan Event, 10)
+	if _, err := nodes[0].Subscribe("mail", "inbox", collect(ch)); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	backend.Close()
+	backend, err := NewFileBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	server, err = NewServer(tr, backend, Heartbeat(time.Millisecond*50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	//心跳发现服务端不认识订阅后重新订阅
+	if err := backend.Publish("mail", &Message{Body: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, ch, 1)[0]; string(e.Message().Body) != "hi" {
+		t.Fatalf("after restart got %s", e.Message().Body)
+	}
+}
+
+func TestTransportBrokerTimeout(t *testing.T) {
+	tr := transport.NewLocalTransport()
+	defer tr.Close()
+	b, err := NewTransportBroker(tr, Timeout(time.Millisecond*50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Publish("orphan", &Message{}); err != ErrTimeout {
+		t.Fatalf("publish without server got %v", err)
+	}
+	if _, err := b.Subscribe("orphan", "g", collect(make(chan Event))); err != ErrTimeout {
+		t.Fatalf("subscribe without server got %v", err)
+	}
+}
@@ -72,10 +72,14 @@ type ModuleSettings struct {
 
 // Mqtt mqtt协议配置
 type Mqtt struct {
-	WirteLoopChanNum int // Should > 1 	    // 最大写入包队列缓存
-	ReadPackLoop     int // 最大读取包队列缓存
-	ReadTimeout      int // 读取超时
-	WriteTimeout     int // 写入超时
+	WirteLoopChanNum  int // Should > 1 	    // 最大写入包队列缓存
+	ReadPackLoop      int // 最大读取包队列缓存
+	ReadTimeout       int // 读取超时
+	WriteTimeout      int // 写入超时
+	Qos               int // 下行消息的QoS,默认0不等待客户端确认
+	MaxInflight       int // QoS 1/2 每个连接最多等待确认的下行消息数,默认20,达到后写入立即返回错误
+	RetryInterval     int // QoS 1/2 超过该时间(秒)没有确认的消息设置DUP后重发,默认10秒
+	TopicAliasMaximum int // MQTT 5.0 允许客户端使用的上行主题别名数,默认16,小于0时不允许
 }
 
 func readFileInto(path string) error {
@@ -0,0 +1,304 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package event 进程内的事件总线
+//
+// topic以 . 分隔, 订阅时 * 匹配一段, > 匹配之后的一段或多段(只能出现在最后), 例如 gate.session.* 或 module.>
+package event
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/liangdas/mqant/log"
+)
+
+var (
+	// ErrInvalidPattern 订阅的topic格式不正确
+	ErrInvalidPattern = errors.New("event invalid topic pattern")
+	// ErrClosed 事件总线已经关闭
+	ErrClosed = errors.New("event bus closed")
+)
+
+// Event 事件, 订阅者可以用类型断言或 Handle 取得具体的事件类型
+type Event interface {
+	Topic() string
+}
+
+// Handler 处理事件
+type Handler func(e Event)
+
+// Subscription 订阅
+type Subscription interface {
+	Pattern() string
+	// Unsubscribe 取消订阅,异步订阅还未处理的事件会被丢弃
+	Unsubscribe()
+}
+
+// Bus 事件总线
+type Bus interface {
+	// Publish 发布事件, 同步订阅在当前协程中按订阅顺序执行完成后返回
+	Publish(e Event)
+	// Subscribe 订阅匹配pattern的事件
+	Subscribe(pattern string, handler Handler, opts ...SubscribeOption) (Subscription, error)
+	// Close 取消所有订阅
+	Close()
+}
+
+// SubscribeOptions 订阅选项
+type SubscribeOptions struct {
+	Async bool //在独立的协程中按发布顺序处理,不阻塞发布者
+}
+
+// SubscribeOption 订阅选项
+type SubscribeOption func(*SubscribeOptions)
+
+// Async 异步处理事件
+func Async() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Async = true
+	}
+}
+
+// Handle 只处理类型为T的事件, 例如 event.Handle(func(e module.ModuleInitedEvent){...})
+func Handle[T Event](f func(e T)) Handler {
+	return func(e Event) {
+		if t, ok := e.(T); ok {
+			f(t)
+		}
+	}
+}
+
+type simpleEvent struct {
+	topic string
+	data  interface{}
+}
+
+func (e *simpleEvent) Topic() string {
+	return e.topic
+}
+
+func (e *simpleEvent) Data() interface{} {
+	return e.data
+}
+
+// NewEvent 不需要定义类型的简单事件, 订阅者通过 interface{ Data() interface{} } 获取data
+func NewEvent(topic string, data interface{}) Event {
+	return &simpleEvent{topic: topic, data: data}
+}
+
+// NewBus 创建事件总线
+func NewBus() Bus {
+	return &bus{}
+}
+
+type bus struct {
+	lock   sync.RWMutex
+	subs   []*subscription
+	closed bool
+}
+
+type subscription struct {
+	bus     *bus
+	pattern string
+	tokens  []string
+	handler Handler
+	async   bool
+
+	lock   sync.Mutex
+	queue  []Event
+	signal chan struct{}
+	done   bool
+}
+
+func (b *bus) Publish(e Event) {
+	if e == nil {
+		return
+	}
+	topic := strings.Split(e.Topic(), ".")
+	b.lock.RLock()
+	subs := make([]*subscription, 0, len(b.subs))
+	for _, sub := range b.subs {
+		if match(sub.tokens, topic) {
+			subs = append(subs, sub)
+		}
+	}
+	b.lock.RUnlock()
+	for _, sub := range subs {
+		if sub.async {
+			sub.push(e)
+		} else {
+			sub.call(e)
+		}
+	}
+}
+
+func (b *bus) Subscribe(pattern string, handler Handler, opts ...SubscribeOption) (Subscription, error) {
+	tokens, ok := parsePattern(pattern)
+	if !ok || handler == nil {
+		return nil, ErrInvalidPattern
+	}
+	opt := SubscribeOptions{}
+	for _, o := range opts {
+		o(&opt)
+	}
+	sub := &subscription{
+		bus:     b,
+		pattern: pattern,
+		tokens:  tokens,
+		handler: handler,
+		async:   opt.Async,
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if sub.async {
+		sub.signal = make(chan struct{}, 1)
+		go sub.run()
+	}
+	b.subs = append(b.subs, sub)
+	return sub, nil
+}
+
+func (b *bus) Close() {
+	b.lock.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.closed = true
+	b.lock.Unlock()
+	for _, sub := range subs {
+		sub.stop()
+	}
+}
+
+func (b *bus) remove(sub *subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, s := range b.subs {
+		if s == sub {
+			//复制一份,Publish中可能正在使用旧的切片
+			subs := make([]*subscription, 0, len(b.subs)-1)
+			subs = append(subs, b.subs[:i]...)
+			b.subs = append(subs, b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *subscription) Pattern() string {
+	return s.pattern
+}
+
+func (s *subscription) Unsubscribe() {
+	s.bus.remove(s)
+	s.stop()
+}
+
+func (s *subscription) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.queue = nil
+	if s.signal != nil {
+		close(s.signal)
+	}
+}
+
+func (s *subscription) push(e Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return
+	}
+	s.queue = append(s.queue, e)
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) run() {
+	for range s.signal {
+		for {
+			s.lock.Lock()
+			if s.done || len(s.queue) == 0 {
+				s.lock.Unlock()
+				break
+			}
+			e := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.lock.Unlock()
+			s.call(e)
+		}
+	}
+}
+
+func (s *subscription) call(e Event) {
+	s.lock.Lock()
+	done := s.done
+	s.lock.Unlock()
+	if done {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			buff := make([]byte, 1024)
+			buff = buff[:runtime.Stack(buff, false)]
+			log.Error("event handler %v panic(%v)\n info:%s", e.Topic(), r, string(buff))
+		}
+	}()
+	s.handler(e)
+}
+
+func parsePattern(pattern string) ([]string, bool) {
+	if pattern == "" {
+		return nil, false
+	}
+	tokens := strings.Split(pattern, ".")
+	for i, t := range tokens {
+		if t == "" || (t == ">" && i != len(tokens)-1) {
+			return nil, false
+		}
+	}
+	return tokens, true
+}
+
+// Match topic是否匹配pattern
+func Match(pattern, topic string) bool {
+	tokens, ok := parsePattern(pattern)
+	if !ok {
+		return false
+	}
+	return match(tokens, strings.Split(topic, "."))
+}
+
+func match(pattern, topic []string) bool {
+	for i, t := range pattern {
+		if t == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (t != "*" && t != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
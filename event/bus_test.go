@@ -0,0 +1,115 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+type loginEvent struct {
+	UserID string
+}
+
+func (e loginEvent) Topic() string {
+	return "user.login"
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		ok             bool
+	}{
+		{"user.login", "user.login", true},
+		{"user.*", "user.login", true},
+		{"user.*", "user.login.web", false},
+		{"*.login", "user.login", true},
+		{"user.>", "user.login.web", true},
+		{"user.>", "user", false},
+		{">", "user", true},
+		{"user.login", "user", false},
+		{"user..login", "user..login", false},
+		{"user.>.web", "user.login.web", false},
+	}
+	for _, c := range cases {
+		if Match(c.pattern, c.topic) != c.ok {
+			t.Errorf("Match(%q, %q) != %v", c.pattern, c.topic, c.ok)
+		}
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	defer bus.Close()
+	var got []string
+	if _, err := bus.Subscribe("user.*", func(e Event) {
+		got = append(got, e.Topic())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	typed, err := bus.Subscribe("user.>", Handle(func(e loginEvent) {
+		users = append(users, e.UserID)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	async := make(chan string, 10)
+	if _, err := bus.Subscribe(">", func(e Event) {
+		async <- e.Topic()
+	}, Async()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bus.Subscribe("user.>.x", func(e Event) {}); err != ErrInvalidPattern {
+		t.Fatalf("invalid pattern got %v", err)
+	}
+	//handler panic不影响其他订阅者
+	if _, err := bus.Subscribe("user.login", func(e Event) {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Publish(loginEvent{UserID: "u1"})
+	bus.Publish(NewEvent("user.logout", "u1"))
+	bus.Publish(NewEvent("room.create", 1))
+	//同步订阅在Publish返回前已经执行
+	if len(got) != 2 || got[0] != "user.login" || got[1] != "user.logout" {
+		t.Fatalf("sync got %v", got)
+	}
+	if len(users) != 1 || users[0] != "u1" {
+		t.Fatalf("typed got %v", users)
+	}
+	for _, want := range []string{"user.login", "user.logout", "room.create"} {
+		select {
+		case topic := <-async:
+			if topic != want {
+				t.Fatalf("async got %v want %v", topic, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("async timeout waiting %v", want)
+		}
+	}
+
+	typed.Unsubscribe()
+	bus.Publish(loginEvent{UserID: "u2"})
+	if len(users) != 1 {
+		t.Fatalf("unsubscribed got %v", users)
+	}
+	bus.Close()
+	if _, err := bus.Subscribe(">", func(e Event) {}); err != ErrClosed {
+		t.Fatalf("subscribe after close got %v", err)
+	}
+}
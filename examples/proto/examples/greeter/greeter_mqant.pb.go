@@ -16,12 +16,10 @@ import (
 // generated mqant method
 type Greeter interface {
 	Hello(in *Request) (out *Response, err error)
-	Stream(in *Request) (out *Response, err error)
 }
 
 func RegisterGreeterTcpHandler(m *basemodule.BaseModule, ser Greeter) {
 	m.GetServer().RegisterGO("hello", ser.Hello)
-	m.GetServer().RegisterGO("stream", ser.Stream)
 }
 
 // generated proxxy handle
@@ -48,13 +46,3 @@ func (proxy *ClientProxyService) Hello(req *Request) (rsp *Response, err error)
 	})
 	return rsp, err
 }
-func (proxy *ClientProxyService) Stream(req *Request) (rsp *Response, err error) {
-	if proxy == nil {
-		return nil, ClientProxyIsNil
-	}
-	rsp = &Response{}
-	err = mqrpc.Proto(rsp, func() (reply interface{}, err interface{}) {
-		return proxy.cli.Call(context.TODO(), proxy.name, "stream", mqrpc.Param(req))
-	})
-	return rsp, err
-}
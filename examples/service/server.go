@@ -17,9 +17,6 @@ func (g *Greeter) Hello(in *greeter.Request) (out *greeter.Response, err error)
 	}
 	return
 }
-func (g *Greeter) Stream(in *greeter.Request) (out *greeter.Response, err error) {
-	return
-}
 func main() {
 
 	// 服务实例
@@ -19,8 +19,11 @@ import (
 	"fmt"
 	"runtime"
 
+	"github.com/liangdas/mqant/event"
 	"github.com/liangdas/mqant/gate"
+	"github.com/liangdas/mqant/gate/base/mqtt"
 	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
 	"github.com/pkg/errors"
 	"strings"
 	"sync"
@@ -33,12 +36,14 @@ type handler struct {
 	gate     gate.Gate
 	sessions sync.Map //连接列表
 	agentNum int
+	subs     *subscriptionTree //客户端的订阅
 }
 
 // NewGateHandler NewGateHandler
 func NewGateHandler(gate gate.Gate) *handler {
 	handler := &handler{
 		gate: gate,
+		subs: newSubscriptionTree(),
 	}
 	return handler
 }
@@ -54,6 +59,12 @@ func (h *handler) Connect(a gate.Agent) {
 	}()
 	if a.GetSession() != nil {
 		h.sessions.Store(a.GetSession().GetSessionID(), a)
+		if s, ok := a.(interface{ Subscriptions() []gate.Subscription }); ok {
+			//持久会话恢复的订阅
+			for _, sub := range s.Subscriptions() {
+				h.subs.add(a.GetSession().GetSessionID(), sub.Topic, sub.Qos)
+			}
+		}
 		//已经建联成功的才计算
 		if a.ProtocolOK() {
 			h.lock.Lock()
@@ -66,6 +77,9 @@ func (h *handler) Connect(a gate.Agent) {
 			h.gate.GetSessionLearner().Connect(a.GetSession())
 		}()
 	}
+	if a.GetSession() != nil {
+		h.publish(gate.SessionConnectEvent{Session: a.GetSession()})
+	}
 }
 
 //当连接关闭	或者客户端主动发送MQTT DisConnect命令
@@ -77,7 +91,14 @@ func (h *handler) DisConnect(a gate.Agent) {
 			log.Error("handler DisConnect panic(%v)\n info:%s", err, string(buff))
 		}
 		if a.GetSession() != nil {
-			h.sessions.Delete(a.GetSession().GetSessionID())
+			//持久会话重连后新的连接使用同一个Sessionid,不能删除新的连接
+			if v, ok := h.sessions.Load(a.GetSession().GetSessionID()); ok && v == a {
+				h.sessions.Delete(a.GetSession().GetSessionID())
+				//离线的持久会话保留订阅,匹配的消息保存为离线消息
+				if _, state, _ := h.loadPersistent(a.GetSession().GetSessionID()); state == nil || state.ServerID != "" {
+					h.subs.removeSession(a.GetSession().GetSessionID())
+				}
+			}
 			//已经建联成功的才计算
 			if a.ProtocolOK() {
 				h.lock.Lock()
@@ -92,11 +113,35 @@ func (h *handler) DisConnect(a gate.Agent) {
 			h.gate.GetSessionLearner().DisConnect(a.GetSession())
 		}
 	}
+	if a.GetSession() != nil {
+		h.publish(gate.SessionDisconnectEvent{Session: a.GetSession()})
+	}
+}
+
+// publish 发布到应用的事件总线
+func (h *handler) publish(e event.Event) {
+	if m, ok := h.gate.(interface{ GetApp() module.App }); ok && m.GetApp() != nil {
+		m.GetApp().EventBus().Publish(e)
+	}
+}
+
+// disconnecter 支持MQTT 5.0 服务端DISCONNECT的Agent
+type disconnecter interface {
+	Disconnect(reason byte, reasonString string)
+}
+
+// disconnect 断开连接, 支持的Agent会告诉客户端断开的原因
+func disconnect(agent gate.Agent, reason byte, reasonString string) {
+	if d, ok := agent.(disconnecter); ok {
+		d.Disconnect(reason, reasonString)
+		return
+	}
+	agent.Close()
 }
 
 func (h *handler) OnDestroy() {
 	h.sessions.Range(func(key, value interface{}) bool {
-		value.(gate.Agent).Close()
+		disconnect(value.(gate.Agent), mqtt.ReasonServerShuttingDown, "")
 		h.sessions.Delete(key)
 		return true
 	})
@@ -280,8 +325,7 @@ func (h *handler) Remove(span log.TraceSpan, Sessionid string, key string) (resu
 func (h *handler) Send(span log.TraceSpan, Sessionid string, topic string, body []byte) (result interface{}, err string) {
 	agent, ok := h.sessions.Load(Sessionid)
 	if !ok || agent == nil {
-		err = "No Sesssion found"
-		return
+		return h.sendOffline(span, Sessionid, topic, body)
 	}
 	e := agent.(gate.Agent).WriteMsg(topic, body)
 	if e != nil {
@@ -292,6 +336,63 @@ func (h *handler) Send(span log.TraceSpan, Sessionid string, topic string, body
 	return
 }
 
+// sendOffline 持久会话的客户端不在当前网关时,转发给客户端所在的网关或者保存为离线消息
+func (h *handler) sendOffline(span log.TraceSpan, Sessionid string, topic string, body []byte) (result interface{}, err string) {
+	clientID, state, e := h.loadPersistent(Sessionid)
+	if e != nil {
+		err = e.Error()
+		return
+	}
+	if state == nil {
+		err = "No Sesssion found"
+		return
+	}
+	if m, ok := h.gate.(interface {
+		GetServerID() string
+		GetApp() module.App
+	}); ok && state.ServerID != "" && state.ServerID != m.GetServerID() {
+		//客户端已经重连到其他网关
+		if server, e := m.GetApp().GetServerByID(state.ServerID); e == nil {
+			return server.Call(nil, "Send", span, Sessionid, topic, body)
+		}
+	}
+	if e := h.enqueue(clientID, state, topic, body, 0); e != nil {
+		err = e.Error()
+		return
+	}
+	result = "success"
+	return
+}
+
+// loadPersistent 查找Sessionid对应的持久会话,不存在时返回nil
+func (h *handler) loadPersistent(Sessionid string) (string, *gate.PersistentSession, error) {
+	store := h.gate.Options().SessionStore
+	if store == nil {
+		return "", nil, nil
+	}
+	clientID, err := store.ClientID(Sessionid)
+	if err != nil || clientID == "" {
+		return "", nil, err
+	}
+	state, err := store.Load(clientID)
+	return clientID, state, err
+}
+
+// enqueue 保存离线消息,与在线时一样先经过SendMessageHook
+func (h *handler) enqueue(clientID string, state *gate.PersistentSession, topic string, body []byte, qos byte) error {
+	if hook := h.gate.Options().SendMessageHook; hook != nil {
+		session, err := h.gate.NewSession(state.Session)
+		if err != nil {
+			return err
+		}
+		session.SetSessionID(state.SessionID)
+		if body, err = hook(session, topic, body); err != nil {
+			return err
+		}
+	}
+	return h.gate.Options().SessionStore.Enqueue(clientID, gate.OfflineMessage{Topic: topic, Body: body, Qos: qos})
+}
+
 /**
  *批量发送消息,sessionid之间用,分割
  */
@@ -326,6 +427,73 @@ func (h *handler) BroadCast(span log.TraceSpan, topic string, body []byte) (int6
 	return count, ""
 }
 
+// Publish 发布消息给订阅了匹配topic的客户端,返回送达(或者保存为离线消息)的客户端数
+func (h *handler) Publish(span log.TraceSpan, topic string, body []byte) (int64, string) {
+	return h.publishQos(span, topic, body, 2)
+}
+
+// publishQos 按订阅的QoS下发消息,不超过消息发布的QoS
+func (h *handler) publishQos(span log.TraceSpan, topic string, body []byte, maxQos byte) (int64, string) {
+	if !mqtt.ValidTopicName(topic) {
+		return 0, fmt.Sprintf("Topic(%s) is invalid", topic)
+	}
+	var count int64 = 0
+	for sessionID, qos := range h.subs.match(topic) {
+		if qos > maxQos {
+			qos = maxQos
+		}
+		agent, ok := h.sessions.Load(sessionID)
+		if ok && agent != nil {
+			if e := publishTo(agent.(gate.Agent), topic, body, qos); e != nil {
+				log.Warning("WriteMsg error:", e.Error())
+			} else {
+				count++
+			}
+			continue
+		}
+		clientID, state, e := h.loadPersistent(sessionID)
+		if e != nil {
+			log.Warning("Load session error:", e.Error())
+			continue
+		}
+		if state == nil || state.ServerID != "" {
+			//会话已经过期或者已经在其他网关上线
+			h.subs.removeSession(sessionID)
+			continue
+		}
+		if qos == 0 {
+			//离线时不保存QoS 0 的消息
+			continue
+		}
+		if e := h.enqueue(clientID, state, topic, body, qos); e != nil {
+			log.Warning("Enqueue error:", e.Error())
+		} else {
+			count++
+		}
+	}
+	return count, ""
+}
+
+// publishTo 按订阅的QoS下发消息
+func publishTo(agent gate.Agent, topic string, body []byte, qos byte) error {
+	if p, ok := agent.(interface {
+		WriteMsgQos(topic string, body []byte, qos byte) error
+	}); ok {
+		return p.WriteMsgQos(topic, body, qos)
+	}
+	return agent.WriteMsg(topic, body)
+}
+
+// subscribe 客户端订阅, 由agent在收到SUBSCRIBE时调用
+func (h *handler) subscribe(sessionID, filter string, qos byte) {
+	h.subs.add(sessionID, filter, qos)
+}
+
+// unsubscribe 客户端取消订阅
+func (h *handler) unsubscribe(sessionID, filter string) {
+	h.subs.remove(sessionID, filter)
+}
+
 /**
  *主动关闭连接
  */
@@ -335,6 +503,6 @@ func (h *handler) Close(span log.TraceSpan, Sessionid string) (result interface{
 		err = "No Sesssion found"
 		return
 	}
-	agent.(gate.Agent).Close()
+	disconnect(agent.(gate.Agent), mqtt.ReasonAdministrativeAction, "")
 	return
 }
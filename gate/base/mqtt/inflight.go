@@ -0,0 +1,214 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/conf"
+)
+
+// 下行消息QoS的默认配置
+const (
+	DefaultMaxInflight   = 20
+	DefaultRetryInterval = time.Second * 10
+)
+
+// ErrInflightFull 等待确认的下行消息达到上限,写入不等待窗口空出,由调用方决定丢弃或稍后重发
+var ErrInflightFull = errors.New("mqtt inflight window is full")
+
+// inflightMsg 等待客户端确认的下行消息
+type inflightMsg struct {
+	pack *Pack
+	rel  bool      //QoS 2 已经收到PUBREC,等待PUBCOMP
+	sent time.Time //最后一次发送的时间
+}
+
+// inflight 一个连接上等待确认的下行消息
+type inflight struct {
+	lock          sync.Mutex
+	msgs          map[int]*inflightMsg
+	order         []int //按发送顺序重发
+	currID        int
+	slots         chan struct{}
+	done          chan struct{}
+	stopped       bool
+	retryInterval time.Duration
+}
+
+func newInflight(conf conf.Mqtt) *inflight {
+	max := conf.MaxInflight
+	if max < 1 {
+		max = DefaultMaxInflight
+	}
+	in := &inflight{
+		msgs:          map[int]*inflightMsg{},
+		slots:         make(chan struct{}, max),
+		done:          make(chan struct{}),
+		retryInterval: time.Duration(conf.RetryInterval) * time.Second,
+	}
+	if in.retryInterval <= 0 {
+		in.retryInterval = DefaultRetryInterval
+	}
+	return in
+}
+
+// acquire 占用一个发送窗口,窗口已满时立即返回 ErrInflightFull
+func (in *inflight) acquire() error {
+	select {
+	case in.slots <- struct{}{}:
+		return nil
+	case <-in.done:
+		return notAlive
+	default:
+		return ErrInflightFull
+	}
+}
+
+// limit 客户端的接收窗口(MQTT 5.0 Receive Maximum)比配置小时缩小发送窗口,只能在开始发送前调用
+func (in *inflight) limit(max int) {
+	if max > 0 && max < cap(in.slots) {
+		in.slots = make(chan struct{}, max)
+	}
+}
+
+// add 分配报文ID并记录消息,调用前需要 acquire
+func (in *inflight) add(qos byte, topic string, body []byte, props *Properties) (*Pack, error) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.stopped {
+		<-in.slots
+		return nil, notAlive
+	}
+	//跳过还在等待确认的报文ID,窗口小于65535所以一定能找到
+	for {
+		if in.currID == math.MaxUint16 {
+			in.currID = 0
+		}
+		in.currID++
+		if _, ok := in.msgs[in.currID]; !ok {
+			break
+		}
+	}
+	pack := GetPubPack(qos, 0, in.currID, &topic, body)
+	pack.GetVariable().(*Publish).SetProperties(props)
+	in.msgs[in.currID] = &inflightMsg{pack: pack, sent: time.Now()}
+	in.order = append(in.order, in.currID)
+	return pack, nil
+}
+
+// remove 删除消息并释放窗口
+func (in *inflight) remove(mid int) bool {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if _, ok := in.msgs[mid]; !ok {
+		return false
+	}
+	delete(in.msgs, mid)
+	for i, id := range in.order {
+		if id == mid {
+			in.order = append(in.order[:i], in.order[i+1:]...)
+			break
+		}
+	}
+	<-in.slots
+	return true
+}
+
+// puback QoS 1 的消息已经确认
+func (in *inflight) puback(mid int) {
+	in.lock.Lock()
+	msg, ok := in.msgs[mid]
+	in.lock.Unlock()
+	if ok && msg.pack.GetQos() == 1 {
+		in.remove(mid)
+	}
+}
+
+// pubrec QoS 2 的消息已经送达,之后重发PUBREL
+func (in *inflight) pubrec(mid int) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if msg, ok := in.msgs[mid]; ok && msg.pack.GetQos() == 2 {
+		msg.rel = true
+		msg.sent = time.Now()
+	}
+}
+
+// pubcomp QoS 2 的消息已经完成
+func (in *inflight) pubcomp(mid int) {
+	in.lock.Lock()
+	msg, ok := in.msgs[mid]
+	in.lock.Unlock()
+	if ok && msg.rel {
+		in.remove(mid)
+	}
+}
+
+// expired 超过重发时间的消息, PUBLISH设置DUP, QoS 2 已经收到PUBREC的重发PUBREL
+func (in *inflight) expired(now time.Time) []*Pack {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	var packs []*Pack
+	for _, mid := range in.order {
+		msg := in.msgs[mid]
+		if now.Sub(msg.sent) < in.retryInterval {
+			continue
+		}
+		msg.sent = now
+		if msg.rel {
+			packs = append(packs, GetPubRELPack(mid))
+			continue
+		}
+		dup := *msg.pack
+		dup.SetDup(1)
+		packs = append(packs, &dup)
+	}
+	return packs
+}
+
+// pending 还没有送达的消息(QoS 2 已经收到PUBREC的消息已经送达),按发送顺序
+func (in *inflight) pending() []*Pack {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	var packs []*Pack
+	for _, mid := range in.order {
+		if msg := in.msgs[mid]; !msg.rel {
+			packs = append(packs, msg.pack)
+		}
+	}
+	return packs
+}
+
+// len 等待确认的消息数
+func (in *inflight) len() int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return len(in.msgs)
+}
+
+// stop 连接断开,唤醒等待窗口的写入
+func (in *inflight) stop() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.stopped {
+		return
+	}
+	in.stopped = true
+	close(in.done)
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/liangdas/mqant/log"
 	"io"
+	"math"
 )
 
 const (
@@ -103,6 +104,10 @@ type Connect struct {
 	will_msg   *string
 	uname      *string
 	upassword  *string
+
+	// MQTT 5.0
+	properties      *Properties
+	will_properties *Properties
 }
 
 func (c *Connect) GetUserName() *string {
@@ -128,6 +133,16 @@ func (c *Connect) GetWillMsg() (bool, *string, *string) {
 	return true, c.will_topic, c.will_msg
 }
 
+// GetWillQos 遗嘱消息的QoS
+func (c *Connect) GetWillQos() byte {
+	return byte(c.will_qos)
+}
+
+// GetWillRetain 遗嘱消息是否为保留消息
+func (c *Connect) GetWillRetain() bool {
+	return c.will_retain
+}
+
 func (c *Connect) GetReturnCode() byte {
 	return c.return_code
 }
@@ -149,10 +164,42 @@ func (c *Connect) GetProtocol() *string {
 func (c *Connect) GetVersion() byte {
 	return c.version
 }
+func (c *Connect) GetClientID() *string {
+	return c.id
+}
+
+// GetProperties CONNECT中的属性, 只有MQTT 5.0才有
+func (c *Connect) GetProperties() *Properties {
+	return c.properties
+}
+
+// GetWillProperties 遗嘱消息的属性, 只有MQTT 5.0才有
+func (c *Connect) GetWillProperties() *Properties {
+	return c.will_properties
+}
+
+// GetSessionExpiry 会话过期时间(秒), MQTT 3.1.1 中CleanSession为false时会话不过期
+func (c *Connect) GetSessionExpiry() uint32 {
+	if c.version < MQTT5 {
+		if c.clean_session {
+			return 0
+		}
+		return math.MaxUint32
+	}
+	if c.properties == nil || c.properties.SessionExpiryInterval == nil {
+		return 0
+	}
+	return *c.properties.SessionExpiryInterval
+}
 
 type Connack struct {
 	reserved    byte
 	return_code byte
+	properties  *Properties
+}
+
+func (c *Connack) GetProperties() *Properties {
+	return c.properties
 }
 
 func (c *Connack) GetReturnCode() byte {
@@ -166,6 +213,14 @@ type Publish struct {
 	topic_name *string
 	mid        int
 	msg        []byte
+	properties *Properties
+}
+
+func (pub *Publish) GetProperties() *Properties {
+	return pub.properties
+}
+func (pub *Publish) SetProperties(props *Properties) {
+	pub.properties = props
 }
 
 func (pub *Publish) GetTopic() *string {
@@ -188,7 +243,17 @@ func (pub *Publish) SetMsg(msg []byte) {
 }
 
 type Puback struct {
-	mid int
+	mid        int
+	reason     byte
+	properties *Properties
+}
+
+// GetReason MQTT 5.0 的原因码, 大于等于0x80表示失败
+func (ack *Puback) GetReason() byte {
+	return ack.reason
+}
+func (ack *Puback) GetProperties() *Properties {
+	return ack.properties
 }
 
 func (ack *Puback) SetMid(id int) {
@@ -199,8 +264,9 @@ func (ack *Puback) GetMid() int {
 }
 
 type Topics struct {
-	name *string
-	Qos  byte
+	name    *string
+	Qos     byte
+	options byte //MQTT 5.0 订阅选项, 低两位是Qos
 }
 
 func (top *Topics) SetQos(Qos byte) {
@@ -213,9 +279,19 @@ func (top *Topics) GetName() *string {
 	return top.name
 }
 
+// GetOptions MQTT 5.0 订阅选项, 包括No Local, Retain As Published, Retain Handling
+func (top *Topics) GetOptions() byte {
+	return top.options
+}
+
 type Subscribe struct {
-	mid    int
-	topics []Topics
+	mid        int
+	topics     []Topics
+	properties *Properties
+}
+
+func (sub *Subscribe) GetProperties() *Properties {
+	return sub.properties
 }
 
 func (sub *Subscribe) SetMid(id int) {
@@ -237,8 +313,14 @@ func (sub *Subscribe) GetTopics() []Topics {
 }
 
 type Suback struct {
-	mid int
-	Qos byte //0  2
+	mid        int
+	Qos        byte   //0  2
+	codes      []byte //每个订阅的结果
+	properties *Properties
+}
+
+func (ack *Suback) GetCodes() []byte {
+	return ack.codes
 }
 
 type UNTopics struct {
@@ -250,8 +332,9 @@ func (top *UNTopics) GetName() *string {
 }
 
 type UNSubscribe struct {
-	mid    int
-	topics []Topics
+	mid        int
+	topics     []Topics
+	properties *Properties
 }
 
 func (sub *UNSubscribe) SetMid(id int) {
@@ -273,7 +356,13 @@ func (sub *UNSubscribe) GetTopics() []Topics {
 }
 
 type UNSuback struct {
-	mid int
+	mid        int
+	codes      []byte //MQTT 5.0 每个取消订阅的结果
+	properties *Properties
+}
+
+func (ack *UNSuback) GetCodes() []byte {
+	return ack.codes
 }
 
 // Parse the connect flags
@@ -302,6 +391,11 @@ func parse_flags(b byte, flag *Connect) {
 
 // Read and Write a mqtt pack
 func ReadPack(r *bufio.Reader, max_pack_length int) (pack *Pack, err error) {
+	return ReadPackVersion(r, max_pack_length, MQTT311)
+}
+
+// ReadPackVersion 按协商的协议版本读取报文, CONNECT报文按其中的版本解析
+func ReadPackVersion(r *bufio.Reader, max_pack_length int, version byte) (pack *Pack, err error) {
 	// Read the fixed header
 	var (
 		fixed     byte
@@ -346,6 +440,10 @@ func ReadPack(r *bufio.Reader, max_pack_length int) (pack *Pack, err error) {
 		err = fmt.Errorf("pack out of max length:%v", max_pack_length)
 		return
 	}
+	if version >= MQTT5 && pack.msg_type != CONNECT {
+		err = readPackV5(r, pack)
+		return
+	}
 	// Read the Variable header and the playload
 	// Check the msg type
 	switch pack.msg_type {
@@ -379,22 +477,37 @@ func ReadPack(r *bufio.Reader, max_pack_length int) (pack *Pack, err error) {
 		parse_flags(flags, conn)
 		// Read the playload
 		playload_len := pack.length - 2 - n - 4
+		if conn.version >= MQTT5 {
+			conn.properties, n, err = readProperties(r, playload_len)
+			if err != nil {
+				break
+			}
+			playload_len -= n
+		}
 		// Read the Client Identifier
 		conn.id, n, err = readString(r)
 		if err != nil {
 			break
 		}
-		if n > 64 || n < 1 {
+		//MQTT 5.0 允许空的Client Identifier,由服务端分配
+		if n > 64 || (n < 1 && conn.version < MQTT5) {
 			err = fmt.Errorf("Identifier Rejected length is:%v", n)
 			conn.return_code = 2
 			break
 		}
 		playload_len -= n
-		if n < 1 && (conn.will_flag || conn.password || n < 0) {
+		if n < 1 && conn.version < MQTT5 && (conn.will_flag || conn.password || n < 0) {
 			err = fmt.Errorf("length error : %v", playload_len)
 			break
 		}
 		if conn.will_flag {
+			if conn.version >= MQTT5 {
+				conn.will_properties, n, err = readProperties(r, playload_len)
+				if err != nil {
+					break
+				}
+				playload_len -= n
+			}
 			// Read the will topic and the will message
 			conn.will_topic, n, err = readString(r)
 			if err != nil {
@@ -542,19 +655,22 @@ func ReadPack(r *bufio.Reader, max_pack_length int) (pack *Pack, err error) {
 			sub.addTopics(*top)
 		}
 	case SUBACK:
-		if pack.length == 3 {
+		if pack.length >= 3 {
 			ack := new(Suback)
 			ack.mid, err = readInt(r, 2)
 			if err != nil {
 				break
 			}
-			ack.Qos, err = r.ReadByte()
+			//每个订阅一个返回码
+			ack.codes = make([]byte, pack.length-2)
+			_, err = io.ReadFull(r, ack.codes)
 			if err != nil {
 				break
 			}
+			ack.Qos = ack.codes[0]
 			pack.variable = ack
 		} else {
-			err = fmt.Errorf("Pack(%v) length(%v) != 3", pack.msg_type, pack.length)
+			err = fmt.Errorf("Pack(%v) length(%v) < 3", pack.msg_type, pack.length)
 		}
 	case UNSUBSCRIBE:
 		sub := new(UNSubscribe)
@@ -641,13 +757,26 @@ func readInt(r *bufio.Reader, length int) (int, error) {
 }
 
 func WritePack(pack *Pack, w *bufio.Writer) error {
-	if err := DelayWritePack(pack, w); err != nil {
+	return WritePackVersion(pack, w, MQTT311)
+}
+
+// WritePackVersion 按协商的协议版本写入报文并Flush
+func WritePackVersion(pack *Pack, w *bufio.Writer, version byte) error {
+	if err := DelayWritePackVersion(pack, w, version); err != nil {
 		return err
 	}
 	return w.Flush()
 }
 
 func DelayWritePack(pack *Pack, w *bufio.Writer) (err error) {
+	return DelayWritePackVersion(pack, w, MQTT311)
+}
+
+// DelayWritePackVersion 按协商的协议版本写入报文
+func DelayWritePackVersion(pack *Pack, w *bufio.Writer, version byte) (err error) {
+	if version >= MQTT5 {
+		return writePackV5(pack, w)
+	}
 	// Write the fixed header
 	var fixed byte
 	// Byte 1
@@ -735,8 +864,8 @@ func DelayWritePack(pack *Pack, w *bufio.Writer) (err error) {
 		for _, top := range sub.topics {
 			tnum = tnum + 2 + len([]byte(*top.name)) + 1 //Qos
 		}
-		//The length of the payload. It can be a multibyte field.
-		if err = w.WriteByte(getRemainingLength(tnum)[0]); err != nil {
+		//The length of the msg id and the payload. It can be a multibyte field.
+		if err = writeFull(w, getRemainingLength(2+tnum)); err != nil {
 			return
 		}
 		if err = writeInt(w, sub.mid, 2); err != nil {
@@ -756,14 +885,18 @@ func DelayWritePack(pack *Pack, w *bufio.Writer) (err error) {
 		}
 	case SUBACK:
 		ack := pack.variable.(*Suback)
-		if err = w.WriteByte(getRemainingLength(3)[0]); err != nil {
+		codes := ack.codes
+		if len(codes) == 0 {
+			codes = []byte{ack.Qos}
+		}
+		if err = writeFull(w, getRemainingLength(2+len(codes))); err != nil {
 			return
 		}
 		// Write the variable
 		if err = writeInt(w, ack.mid, 2); err != nil {
 			return
 		}
-		if err = w.WriteByte(ack.Qos); err != nil {
+		if err = writeFull(w, codes); err != nil {
 			return
 		}
 	case UNSUBSCRIBE:
@@ -773,8 +906,8 @@ func DelayWritePack(pack *Pack, w *bufio.Writer) (err error) {
 		for _, top := range sub.topics {
 			tnum = tnum + 2 + len([]byte(*top.name)) //
 		}
-		//The length of the payload. It can be a multibyte field.
-		if err = w.WriteByte(getRemainingLength(tnum)[0]); err != nil {
+		//The length of the msg id and the payload. It can be a multibyte field.
+		if err = writeFull(w, getRemainingLength(2+tnum)); err != nil {
 			return
 		}
 		if err = writeInt(w, sub.mid, 2); err != nil {
@@ -798,7 +931,7 @@ func DelayWritePack(pack *Pack, w *bufio.Writer) (err error) {
 		if err = writeInt(w, ack.mid, 2); err != nil {
 			return
 		}
-	case PINGRESP:
+	case PINGREQ, PINGRESP, DISCONNECT:
 		err = w.WriteByte(0)
 	}
 	return
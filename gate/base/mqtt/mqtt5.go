@@ -0,0 +1,743 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 协议版本, CONNECT报文中的Protocol Level
+const (
+	MQTT31  = 3
+	MQTT311 = 4
+	MQTT5   = 5
+)
+
+// AUTH MQTT 5.0 增强认证报文
+const AUTH = 15
+
+// MQTT 5.0 原因码
+const (
+	ReasonSuccess                     = 0x00
+	ReasonNormalDisconnection         = 0x00
+	ReasonGrantedQos1                 = 0x01
+	ReasonGrantedQos2                 = 0x02
+	ReasonDisconnectWithWill          = 0x04
+	ReasonNoMatchingSubscribers       = 0x10
+	ReasonNoSubscriptionExisted       = 0x11
+	ReasonUnspecifiedError            = 0x80
+	ReasonMalformedPacket             = 0x81
+	ReasonProtocolError               = 0x82
+	ReasonImplementationSpecificError = 0x83
+	ReasonUnsupportedProtocolVersion  = 0x84
+	ReasonClientIdentifierNotValid    = 0x85
+	ReasonBadUserNameOrPassword       = 0x86
+	ReasonNotAuthorized               = 0x87
+	ReasonServerUnavailable           = 0x88
+	ReasonServerBusy                  = 0x89
+	ReasonBanned                      = 0x8A
+	ReasonServerShuttingDown          = 0x8B
+	ReasonBadAuthenticationMethod     = 0x8C
+	ReasonKeepAliveTimeout            = 0x8D
+	ReasonSessionTakenOver            = 0x8E
+	ReasonTopicFilterInvalid          = 0x8F
+	ReasonTopicNameInvalid            = 0x90
+	ReasonPacketIdentifierInUse       = 0x91
+	ReasonPacketIdentifierNotFound    = 0x92
+	ReasonReceiveMaximumExceeded      = 0x93
+	ReasonTopicAliasInvalid           = 0x94
+	ReasonPacketTooLarge              = 0x95
+	ReasonMessageRateTooHigh          = 0x96
+	ReasonQuotaExceeded               = 0x97
+	ReasonAdministrativeAction        = 0x98
+	ReasonPayloadFormatInvalid        = 0x99
+	ReasonRetainNotSupported          = 0x9A
+	ReasonQosNotSupported             = 0x9B
+	ReasonUseAnotherServer            = 0x9C
+	ReasonServerMoved                 = 0x9D
+	ReasonSharedSubNotSupported       = 0x9E
+	ReasonConnectionRateExceeded      = 0x9F
+	ReasonMaximumConnectTime          = 0xA0
+	ReasonSubIDNotSupported           = 0xA1
+	ReasonWildcardSubNotSupported     = 0xA2
+)
+
+// 属性标识符
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiryInterval  = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthMethod             = 0x15
+	propAuthData               = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelayInterval      = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInfo           = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQos             = 0x24
+	propRetainAvailable        = 0x25
+	propUser                   = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardSubAvailable   = 0x28
+	propSubIDAvailable         = 0x29
+	propSharedSubAvailable     = 0x2A
+)
+
+// UserProperty 用户属性,同一个Key可以出现多次
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties MQTT 5.0 属性, 数值为0(指针为nil)的属性不会写入报文
+type Properties struct {
+	PayloadFormat          byte
+	MessageExpiry          uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32 //DISCONNECT中为0时表示会话立即过期,需要和没有设置区分
+	AssignedClientID       string
+	ServerKeepAlive        uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         uint16
+	TopicAliasMaximum      uint16
+	TopicAlias             uint16
+	MaximumQos             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+// GetUser 返回Key对应的第一个用户属性
+func (p *Properties) GetUser(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, u := range p.User {
+		if u.Key == key {
+			return u.Value, true
+		}
+	}
+	return "", false
+}
+
+// Byte 用于设置 *byte 类型的属性
+func Byte(b byte) *byte {
+	return &b
+}
+
+// Uint32 用于设置 *uint32 类型的属性
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+func (p *Properties) encode() []byte {
+	if p == nil {
+		return nil
+	}
+	b := new(bytes.Buffer)
+	putByte := func(id byte, v *byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	putUint16 := func(id byte, v uint16) {
+		if v > 0 {
+			b.WriteByte(id)
+			putInt(b, int(v))
+		}
+	}
+	putUint32 := func(id byte, v uint32) {
+		if v > 0 {
+			b.WriteByte(id)
+			binary.Write(b, binary.BigEndian, v)
+		}
+	}
+	putUint32Ptr := func(id byte, v *uint32) {
+		if v != nil {
+			b.WriteByte(id)
+			binary.Write(b, binary.BigEndian, *v)
+		}
+	}
+	putString := func(id byte, v string) {
+		if v != "" {
+			b.WriteByte(id)
+			putBinary(b, []byte(v))
+		}
+	}
+	putData := func(id byte, v []byte) {
+		if v != nil {
+			b.WriteByte(id)
+			putBinary(b, v)
+		}
+	}
+	if p.PayloadFormat > 0 {
+		putByte(propPayloadFormat, &p.PayloadFormat)
+	}
+	putUint32(propMessageExpiry, p.MessageExpiry)
+	putString(propContentType, p.ContentType)
+	putString(propResponseTopic, p.ResponseTopic)
+	putData(propCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		b.WriteByte(propSubscriptionIdentifier)
+		b.Write(getRemainingLength(id))
+	}
+	putUint32Ptr(propSessionExpiryInterval, p.SessionExpiryInterval)
+	putString(propAssignedClientID, p.AssignedClientID)
+	putUint16(propServerKeepAlive, p.ServerKeepAlive)
+	putString(propAuthMethod, p.AuthMethod)
+	putData(propAuthData, p.AuthData)
+	putByte(propRequestProblemInfo, p.RequestProblemInfo)
+	putUint32(propWillDelayInterval, p.WillDelayInterval)
+	putByte(propRequestResponseInfo, p.RequestResponseInfo)
+	putString(propResponseInfo, p.ResponseInfo)
+	putString(propServerReference, p.ServerReference)
+	putString(propReasonString, p.ReasonString)
+	putUint16(propReceiveMaximum, p.ReceiveMaximum)
+	putUint16(propTopicAliasMaximum, p.TopicAliasMaximum)
+	putUint16(propTopicAlias, p.TopicAlias)
+	putByte(propMaximumQos, p.MaximumQos)
+	putByte(propRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		b.WriteByte(propUser)
+		putBinary(b, []byte(u.Key))
+		putBinary(b, []byte(u.Value))
+	}
+	putUint32(propMaximumPacketSize, p.MaximumPacketSize)
+	putByte(propWildcardSubAvailable, p.WildcardSubAvailable)
+	putByte(propSubIDAvailable, p.SubIDAvailable)
+	putByte(propSharedSubAvailable, p.SharedSubAvailable)
+	return b.Bytes()
+}
+
+// writeProperties 写入属性长度和属性
+func writeProperties(b *bytes.Buffer, p *Properties) {
+	data := p.encode()
+	b.Write(getRemainingLength(len(data)))
+	b.Write(data)
+}
+
+// decodeProperties 解析属性,没有任何属性时返回nil
+func decodeProperties(data []byte) (*Properties, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	p := new(Properties)
+	b := newBuffer(data)
+	for b.remaining() > 0 {
+		id, err := b.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat, err = b.readByte()
+		case propMessageExpiry:
+			p.MessageExpiry, err = b.readUint32()
+		case propContentType:
+			p.ContentType, err = b.readUTF()
+		case propResponseTopic:
+			p.ResponseTopic, err = b.readUTF()
+		case propCorrelationData:
+			p.CorrelationData, err = b.readBinary()
+		case propSubscriptionIdentifier:
+			var sid int
+			sid, err = b.readVarInt()
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, sid)
+		case propSessionExpiryInterval:
+			p.SessionExpiryInterval, err = b.readUint32Ptr()
+		case propAssignedClientID:
+			p.AssignedClientID, err = b.readUTF()
+		case propServerKeepAlive:
+			p.ServerKeepAlive, err = b.readUint16()
+		case propAuthMethod:
+			p.AuthMethod, err = b.readUTF()
+		case propAuthData:
+			p.AuthData, err = b.readBinary()
+		case propRequestProblemInfo:
+			p.RequestProblemInfo, err = b.readBytePtr()
+		case propWillDelayInterval:
+			p.WillDelayInterval, err = b.readUint32()
+		case propRequestResponseInfo:
+			p.RequestResponseInfo, err = b.readBytePtr()
+		case propResponseInfo:
+			p.ResponseInfo, err = b.readUTF()
+		case propServerReference:
+			p.ServerReference, err = b.readUTF()
+		case propReasonString:
+			p.ReasonString, err = b.readUTF()
+		case propReceiveMaximum:
+			p.ReceiveMaximum, err = b.readUint16()
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum, err = b.readUint16()
+		case propTopicAlias:
+			p.TopicAlias, err = b.readUint16()
+		case propMaximumQos:
+			p.MaximumQos, err = b.readBytePtr()
+		case propRetainAvailable:
+			p.RetainAvailable, err = b.readBytePtr()
+		case propUser:
+			var u UserProperty
+			if u.Key, err = b.readUTF(); err == nil {
+				u.Value, err = b.readUTF()
+			}
+			p.User = append(p.User, u)
+		case propMaximumPacketSize:
+			p.MaximumPacketSize, err = b.readUint32()
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable, err = b.readBytePtr()
+		case propSubIDAvailable:
+			p.SubIDAvailable, err = b.readBytePtr()
+		case propSharedSubAvailable:
+			p.SharedSubAvailable, err = b.readBytePtr()
+		default:
+			return nil, fmt.Errorf("unknown property identifier:%v", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// readProperties CONNECT报文中按流读取属性,返回读取的字节数
+// remain为报文中剩余的字节数,属性长度超过remain时不分配内存直接返回错误
+func readProperties(r *bufio.Reader, remain int) (p *Properties, n int, err error) {
+	length, n, err := readVarInt(r)
+	if err != nil {
+		return
+	}
+	if n+length > remain {
+		err = fmt.Errorf("properties length error : %v remain %v", length, remain-n)
+		return
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	p, err = decodeProperties(data)
+	return p, n + length, err
+}
+
+func readVarInt(r *bufio.Reader) (value int, n int, err error) {
+	multiplier := 1
+	for n < 4 {
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		n++
+		value += int(b&127) * multiplier
+		if b&128 == 0 {
+			return
+		}
+		multiplier *= 128
+	}
+	err = fmt.Errorf("malformed variable byte integer")
+	return
+}
+
+func (b *buffer) remaining() int {
+	return len(b.data) - b.index
+}
+
+func (b *buffer) readBytePtr() (*byte, error) {
+	c, err := b.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (b *buffer) readUint32Ptr() (*uint32, error) {
+	v, err := b.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (b *buffer) readUint16() (uint16, error) {
+	if b.remaining() < 2 {
+		return 0, fmt.Errorf("Out of range error")
+	}
+	v := binary.BigEndian.Uint16(b.data[b.index:])
+	b.index += 2
+	return v, nil
+}
+
+func (b *buffer) readUint32() (uint32, error) {
+	if b.remaining() < 4 {
+		return 0, fmt.Errorf("Out of range error")
+	}
+	v := binary.BigEndian.Uint32(b.data[b.index:])
+	b.index += 4
+	return v, nil
+}
+
+func (b *buffer) readVarInt() (int, error) {
+	value, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		c, err := b.readByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(c&127) * multiplier
+		if c&128 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, fmt.Errorf("malformed variable byte integer")
+}
+
+func (b *buffer) readBinary() ([]byte, error) {
+	n, err := b.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > b.remaining() {
+		return nil, fmt.Errorf("Out of range error:%v", n)
+	}
+	data := make([]byte, n)
+	copy(data, b.data[b.index:])
+	b.index += int(n)
+	return data, nil
+}
+
+func (b *buffer) readUTF() (string, error) {
+	n, err := b.readUint16()
+	if err != nil {
+		return "", err
+	}
+	return b.readString(int(n))
+}
+
+func (b *buffer) readProperties() (*Properties, error) {
+	n, err := b.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+	if n > b.remaining() {
+		return nil, fmt.Errorf("Out of range error:%v", n)
+	}
+	data := b.data[b.index : b.index+n]
+	b.index += n
+	return decodeProperties(data)
+}
+
+func (b *buffer) rest() []byte {
+	data := b.data[b.index:]
+	b.index = len(b.data)
+	return data
+}
+
+func putInt(b *bytes.Buffer, i int) {
+	b.WriteByte(byte(i >> 8))
+	b.WriteByte(byte(i))
+}
+
+func putBinary(b *bytes.Buffer, data []byte) {
+	putInt(b, len(data))
+	b.Write(data)
+}
+
+// readPackV5 解析MQTT 5.0报文的可变报头和载荷, CONNECT报文在ReadPack中处理
+func readPackV5(r *bufio.Reader, pack *Pack) (err error) {
+	data := make([]byte, pack.length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	b := newBuffer(data)
+	readMid := func() (int, error) {
+		mid, err := b.readUint16()
+		return int(mid), err
+	}
+	switch pack.msg_type {
+	case CONNACK:
+		ack := new(Connack)
+		pack.variable = ack
+		if ack.reserved, err = b.readByte(); err != nil {
+			return
+		}
+		if ack.return_code, err = b.readByte(); err != nil {
+			return
+		}
+		ack.properties, err = b.readProperties()
+	case PUBLISH:
+		pub := new(Publish)
+		pack.variable = pub
+		var topic string
+		if topic, err = b.readUTF(); err != nil {
+			return
+		}
+		pub.topic_name = &topic
+		if pack.GetQos() > 0 {
+			if pub.mid, err = readMid(); err != nil {
+				return
+			}
+		}
+		if pub.properties, err = b.readProperties(); err != nil {
+			return
+		}
+		pub.msg = b.rest()
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		ack := new(Puback)
+		pack.variable = ack
+		if ack.mid, err = readMid(); err != nil {
+			return
+		}
+		if b.remaining() > 0 {
+			if ack.reason, err = b.readByte(); err != nil {
+				return
+			}
+		}
+		if b.remaining() > 0 {
+			ack.properties, err = b.readProperties()
+		}
+	case SUBSCRIBE:
+		sub := new(Subscribe)
+		sub.topics = make([]Topics, 0)
+		pack.variable = sub
+		if sub.mid, err = readMid(); err != nil {
+			return
+		}
+		if sub.properties, err = b.readProperties(); err != nil {
+			return
+		}
+		for b.remaining() > 0 {
+			var name string
+			if name, err = b.readUTF(); err != nil {
+				return
+			}
+			var opts byte
+			if opts, err = b.readByte(); err != nil {
+				return
+			}
+			sub.addTopics(Topics{name: &name, Qos: opts & 3, options: opts})
+		}
+	case UNSUBSCRIBE:
+		sub := new(UNSubscribe)
+		sub.topics = make([]Topics, 0)
+		pack.variable = sub
+		if sub.mid, err = readMid(); err != nil {
+			return
+		}
+		if sub.properties, err = b.readProperties(); err != nil {
+			return
+		}
+		for b.remaining() > 0 {
+			var name string
+			if name, err = b.readUTF(); err != nil {
+				return
+			}
+			sub.addTopics(Topics{name: &name})
+		}
+	case SUBACK:
+		ack := new(Suback)
+		pack.variable = ack
+		if ack.mid, err = readMid(); err != nil {
+			return
+		}
+		if ack.properties, err = b.readProperties(); err != nil {
+			return
+		}
+		ack.codes = b.rest()
+		if len(ack.codes) > 0 {
+			ack.Qos = ack.codes[0]
+		}
+	case UNSUBACK:
+		ack := new(UNSuback)
+		pack.variable = ack
+		if ack.mid, err = readMid(); err != nil {
+			return
+		}
+		if ack.properties, err = b.readProperties(); err != nil {
+			return
+		}
+		ack.codes = b.rest()
+	case DISCONNECT, AUTH:
+		d := new(Disconnect)
+		pack.variable = d
+		if b.remaining() > 0 {
+			if d.reason, err = b.readByte(); err != nil {
+				return
+			}
+		}
+		if b.remaining() > 0 {
+			d.properties, err = b.readProperties()
+		}
+	case PINGREQ, PINGRESP:
+		// Nothing to do
+	default:
+		err = fmt.Errorf("No Find Pack(%v) length(%v)", pack.msg_type, pack.length)
+	}
+	return
+}
+
+// writePackV5 按MQTT 5.0格式写入报文
+func writePackV5(pack *Pack, w *bufio.Writer) (err error) {
+	b := new(bytes.Buffer)
+	// Reason Code为0并且没有属性时可以省略
+	writeReason := func(reason byte, p *Properties) {
+		if reason == ReasonSuccess && p == nil {
+			return
+		}
+		b.WriteByte(reason)
+		if p != nil {
+			writeProperties(b, p)
+		}
+	}
+	switch pack.msg_type {
+	case CONNACK:
+		ack := pack.variable.(*Connack)
+		b.WriteByte(ack.reserved)
+		b.WriteByte(ack.return_code)
+		writeProperties(b, ack.properties)
+	case PUBLISH:
+		pub := pack.variable.(*Publish)
+		putBinary(b, []byte(*pub.topic_name))
+		if pack.GetQos() > 0 {
+			putInt(b, pub.mid)
+		}
+		writeProperties(b, pub.properties)
+		b.Write(pub.msg)
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		ack := pack.variable.(*Puback)
+		putInt(b, ack.mid)
+		writeReason(ack.reason, ack.properties)
+	case SUBSCRIBE:
+		sub := pack.variable.(*Subscribe)
+		putInt(b, sub.mid)
+		writeProperties(b, sub.properties)
+		for _, top := range sub.topics {
+			putBinary(b, []byte(*top.name))
+			b.WriteByte(top.options&^3 | top.Qos)
+		}
+	case UNSUBSCRIBE:
+		sub := pack.variable.(*UNSubscribe)
+		putInt(b, sub.mid)
+		writeProperties(b, sub.properties)
+		for _, top := range sub.topics {
+			putBinary(b, []byte(*top.name))
+		}
+	case SUBACK:
+		ack := pack.variable.(*Suback)
+		putInt(b, ack.mid)
+		writeProperties(b, ack.properties)
+		if len(ack.codes) > 0 {
+			b.Write(ack.codes)
+		} else {
+			b.WriteByte(ack.Qos)
+		}
+	case UNSUBACK:
+		ack := pack.variable.(*UNSuback)
+		putInt(b, ack.mid)
+		writeProperties(b, ack.properties)
+		b.Write(ack.codes)
+	case DISCONNECT, AUTH:
+		d := pack.variable.(*Disconnect)
+		writeReason(d.reason, d.properties)
+	case PINGREQ, PINGRESP:
+	default:
+		return fmt.Errorf("No Find Pack(%v)", pack.msg_type)
+	}
+	// Write the fixed header
+	fixed := pack.msg_type << 4
+	fixed |= (pack.dup_flag << 3)
+	fixed |= (pack.qos_level << 1)
+	fixed |= pack.retain
+	if err = w.WriteByte(fixed); err != nil {
+		return
+	}
+	if err = writeFull(w, getRemainingLength(b.Len())); err != nil {
+		return
+	}
+	return writeFull(w, b.Bytes())
+}
+
+// Disconnect DISCONNECT报文, MQTT 5.0 中AUTH报文也使用这个结构
+type Disconnect struct {
+	reason     byte
+	properties *Properties
+}
+
+func (d *Disconnect) GetReason() byte {
+	return d.reason
+}
+func (d *Disconnect) GetProperties() *Properties {
+	return d.properties
+}
+
+// GetDisconnectPack 服务端主动断开连接, 只在MQTT 5.0中发送
+func GetDisconnectPack(reason byte, props *Properties) *Pack {
+	pack := new(Pack)
+	pack.SetType(DISCONNECT)
+	pack.variable = &Disconnect{reason: reason, properties: props}
+	return pack
+}
+
+// GetConnAckPackProperties MQTT 5.0 的CONNACK, 带有属性
+func GetConnAckPackProperties(reason byte, sessionPresent bool, props *Properties) *Pack {
+	pack := GetConnAckPack(reason)
+	ack := pack.variable.(*Connack)
+	if sessionPresent {
+		ack.reserved = 1
+	}
+	ack.properties = props
+	return pack
+}
+
+// GetSubAckPackCodes 每个订阅对应一个原因码的SUBACK
+func GetSubAckPackCodes(mid int, codes []byte) *Pack {
+	pack := GetSubAckPack(mid)
+	pack.variable.(*Suback).codes = codes
+	return pack
+}
+
+// GetUNSubAckPackCodes 每个取消订阅对应一个原因码的UNSUBACK, 只在MQTT 5.0中发送
+func GetUNSubAckPackCodes(mid int, codes []byte) *Pack {
+	pack := GetUNSubAckPack(mid)
+	pack.variable.(*UNSuback).codes = codes
+	return pack
+}
@@ -22,10 +22,17 @@ import (
 	"github.com/liangdas/mqant/network"
 	"math"
 	"sync"
+	"time"
 )
 
 var notAlive = errors.New("Connection was dead")
 
+// errClientDisconnect 客户端发送了DISCONNECT
+var errClientDisconnect = errors.New("client disconnect")
+
+// DefaultTopicAliasMaximum MQTT 5.0 默认允许客户端使用的上行主题别名数
+const DefaultTopicAliasMaximum = 16
+
 type PackRecover interface {
 	OnRecover(*Pack)
 }
@@ -40,6 +47,18 @@ type Client struct {
 
 	// Online msg id
 	curr_id int
+
+	qos       byte      //下行消息的QoS
+	inflight  *inflight //QoS 1/2 等待客户端确认的下行消息
+	retryOnce sync.Once
+
+	version       byte              //协商的协议版本
+	aliasMax      uint16            //MQTT 5.0 允许客户端使用的主题别名数
+	aliases       map[uint16]string //MQTT 5.0 客户端设置的主题别名,只在读协程中访问
+	sessionExpiry uint32            //MQTT 5.0 会话过期时间(秒),客户端DISCONNECT时可以修改
+
+	disconnected     bool //收到了客户端的DISCONNECT
+	disconnectReason byte //MQTT 5.0 DISCONNECT的原因码
 }
 
 func NewClient(conf conf.Mqtt, recover PackRecover, r *bufio.Reader, w *bufio.Writer, conn network.Conn, alive, MaxPackSize int) *Client {
@@ -47,11 +66,118 @@ func NewClient(conf conf.Mqtt, recover PackRecover, r *bufio.Reader, w *bufio.Wr
 		recover: recover,
 		lock:    new(sync.Mutex),
 		curr_id: 0,
+		version: MQTT311,
 	}
+	if conf.TopicAliasMaximum == 0 {
+		client.aliasMax = DefaultTopicAliasMaximum
+	} else if conf.TopicAliasMaximum > 0 && conf.TopicAliasMaximum <= math.MaxUint16 {
+		client.aliasMax = uint16(conf.TopicAliasMaximum)
+	}
+	if conf.Qos > 0 {
+		client.qos = byte(conf.Qos)
+		if client.qos > 2 {
+			client.qos = 2
+		}
+	}
+	client.inflight = newInflight(conf)
 	client.queue = NewPackQueue(conf, r, w, conn, client.waitPack, alive, MaxPackSize)
 	return client
 }
 
+// Negotiate 按CONNECT中的协议版本协商, 在Listen_loop之前调用
+// MQTT 5.0 连接返回需要在CONNACK中告诉客户端的属性
+func (c *Client) Negotiate(conn *Connect) *Properties {
+	c.version = conn.GetVersion()
+	if c.version < MQTT5 {
+		c.version = MQTT311
+		return nil
+	}
+	c.queue.version = MQTT5
+	props := &Properties{
+		RetainAvailable:    Byte(0),
+		SharedSubAvailable: Byte(0),
+	}
+	if cp := conn.GetProperties(); cp != nil {
+		//不能超过客户端愿意同时处理的QoS 1/2 消息数
+		c.inflight.limit(int(cp.ReceiveMaximum))
+		if cp.SessionExpiryInterval != nil {
+			c.sessionExpiry = *cp.SessionExpiryInterval
+		}
+	}
+	if c.aliasMax > 0 {
+		c.aliases = make(map[uint16]string)
+		props.TopicAliasMaximum = c.aliasMax
+	}
+	if c.queue.MaxPackSize > 0 {
+		props.MaximumPacketSize = uint32(c.queue.MaxPackSize)
+	}
+	return props
+}
+
+// Qos 下行消息默认的QoS
+func (c *Client) Qos() byte {
+	return c.qos
+}
+
+// NormalDisconnect 客户端发送了DISCONNECT正常断开,这时不发布遗嘱消息
+// MQTT 5.0 原因码为 0x04 (Disconnect with Will Message) 时仍然需要发布遗嘱消息
+func (c *Client) NormalDisconnect() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.disconnected && c.disconnectReason != ReasonDisconnectWithWill
+}
+
+// Version 协商的协议版本
+func (c *Client) Version() byte {
+	return c.version
+}
+
+// SessionExpiry MQTT 5.0 会话过期时间(秒)
+func (c *Client) SessionExpiry() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sessionExpiry
+}
+
+// Disconnect 断开连接, MQTT 5.0 的客户端会先收到带原因码的DISCONNECT
+func (c *Client) Disconnect(reason byte, reasonString string) error {
+	if c.version >= MQTT5 {
+		var props *Properties
+		if reasonString != "" {
+			props = &Properties{ReasonString: reasonString}
+		}
+		if err := c.queue.WritePack(GetDisconnectPack(reason, props)); err == nil {
+			c.queue.flush()
+		}
+	}
+	return c.queue.Close(fmt.Errorf("disconnect reason code 0x%02X %s", reason, reasonString))
+}
+
+// resolveAlias MQTT 5.0 用主题别名还原PUBLISH的topic
+func (c *Client) resolveAlias(pub *Publish) error {
+	props := pub.GetProperties()
+	if props == nil || props.TopicAlias == 0 {
+		if *pub.GetTopic() == "" {
+			return fmt.Errorf("topic name is empty")
+		}
+		return nil
+	}
+	alias := props.TopicAlias
+	if alias > c.aliasMax {
+		return fmt.Errorf("topic alias %d out of maximum %d", alias, c.aliasMax)
+	}
+	if *pub.GetTopic() != "" {
+		c.aliases[alias] = *pub.GetTopic()
+		return nil
+	}
+	topic, ok := c.aliases[alias]
+	if !ok {
+		return fmt.Errorf("topic alias %d not found", alias)
+	}
+	pub.SetTopic(&topic)
+	return nil
+}
+
 // Push the msg and response the heart beat
 func (c *Client) Listen_loop() (e error) {
 	defer func() {
@@ -68,9 +194,38 @@ func (c *Client) Listen_loop() (e error) {
 	c.lock.Lock()
 	c.isStop = true
 	c.lock.Unlock()
+	c.inflight.stop()
 	return
 }
 
+// retryLoop 重发超时没有确认的下行消息,直到连接断开
+func (c *Client) retryLoop() {
+	ticker := time.NewTicker(c.inflight.retryInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.inflight.done:
+			return
+		case now := <-ticker.C:
+			for _, pack := range c.inflight.expired(now) {
+				if err := c.queue.WritePack(pack); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Inflight 等待客户端确认的下行消息数
+func (c *Client) Inflight() int {
+	return c.inflight.len()
+}
+
+// Pending 还没有送达客户端的QoS 1/2 消息,连接断开后用于保存到持久会话
+func (c *Client) Pending() []*Pack {
+	return c.inflight.pending()
+}
+
 // Setting a mqtt pack's id.
 func (c *Client) GetError() error {
 	if c.queue == nil {
@@ -114,6 +269,12 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 		err = c.queue.WritePack(GetConnAckPack(0))
 	case PUBLISH:
 		pub := pAndErr.pack.GetVariable().(*Publish)
+		if c.version >= MQTT5 {
+			if err = c.resolveAlias(pub); err != nil {
+				c.Disconnect(ReasonTopicAliasInvalid, err.Error())
+				return
+			}
+		}
 		//// Del the msg
 		//c.delMsg(ack.GetMid())
 		//这里向上层转发消息
@@ -134,12 +295,18 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 		c.recover.OnRecover(pAndErr.pack)
 	case PUBACK: //4
 		//用于 Qos =1 的消息
-		//ack := pAndErr.pack.GetVariable().(*mqtt.Puback)
-		//log.Debug("Client Ack Qos(%d) Dup(%d) mid(%d) \n",pAndErr.pack.GetQos(),pAndErr.pack.GetDup(), ack.GetMid())
+		ack := pAndErr.pack.GetVariable().(*Puback)
+		c.inflight.puback(ack.GetMid())
 	case PUBREC: //5
 		//log.Debug("Ack To Client By PUBREL \n")
 		//用于 Qos =2 的消息 回复 PUBREL
 		ack := pAndErr.pack.GetVariable().(*Puback)
+		if ack.GetReason() >= ReasonUnspecifiedError {
+			//MQTT 5.0 客户端拒绝了这条消息,流程结束
+			c.inflight.remove(ack.GetMid())
+			break
+		}
+		c.inflight.pubrec(ack.GetMid())
 		err = c.queue.WritePack(GetPubRELPack(ack.GetMid()))
 	case PUBREL: //6
 		//log.Debug("Ack To Client By PUBCOMP \n")
@@ -148,31 +315,44 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 		err = c.queue.WritePack(GetPubCOMPPack(ack.GetMid()))
 	case PUBCOMP: //7
 		//消息发送端最终确认这条消息
-		//log.Debug("消息最终确认")
-	case SUBSCRIBE: //7
-		//消息发送端最终确认这条消息
+		ack := pAndErr.pack.GetVariable().(*Puback)
+		c.inflight.pubcomp(ack.GetMid())
+	case SUBSCRIBE: //8
+		//先交给上层记录订阅,客户端收到SUBACK后就能收到匹配的消息
 		sub := pAndErr.pack.GetVariable().(*Subscribe)
-		for _, top := range sub.GetTopics() {
-			//log.Debug("Subscribe %s",*top.GetName())
-			if top.Qos == 2 {
-				//log.Debug("Ack To Client By Suback \n")
-				//用于 Qos =2 的消息 回复 PUBCOMP
-				err = c.queue.WritePack(GetSubAckPack(sub.GetMid()))
-			}
-		}
-		//目前这个版本暂时先不保证消息的Qos 默认用Qos=1吧
 		c.recover.OnRecover(pAndErr.pack)
-	case UNSUBSCRIBE: //7
-		//消息发送端最终确认这条消息
+		//每个订阅一个返回码
+		err = c.queue.WritePack(GetSubAckPackCodes(sub.GetMid(), sub.ReasonCodes(c.version)))
+	case UNSUBSCRIBE: //10
 		sub := pAndErr.pack.GetVariable().(*UNSubscribe)
-		err = c.queue.WritePack(GetUNSubAckPack(sub.GetMid()))
-		//目前这个版本暂时先不保证消息的Qos 默认用Qos=1吧
 		c.recover.OnRecover(pAndErr.pack)
+		if c.version >= MQTT5 {
+			err = c.queue.WritePack(GetUNSubAckPackCodes(sub.GetMid(), make([]byte, len(sub.GetTopics()))))
+		} else {
+			err = c.queue.WritePack(GetUNSubAckPack(sub.GetMid()))
+		}
 	case PINGREQ:
 		// Reply the heart beat
 		//log.Debug("hb msg")
 		err = c.queue.WritePack(GetPingResp(0, pAndErr.pack.GetDup()))
 		c.recover.OnRecover(pAndErr.pack)
+	case DISCONNECT:
+		c.lock.Lock()
+		c.disconnected = true
+		if d, ok := pAndErr.pack.GetVariable().(*Disconnect); ok {
+			c.disconnectReason = d.GetReason()
+			//MQTT 5.0 客户端断开时可以修改会话过期时间,设置为0时会话立即过期
+			if p := d.GetProperties(); p != nil && p.SessionExpiryInterval != nil {
+				c.sessionExpiry = *p.SessionExpiryInterval
+			}
+		}
+		c.lock.Unlock()
+		//客户端正常断开,服务端关闭连接
+		err = errClientDisconnect
+	case AUTH:
+		//不支持增强认证
+		c.Disconnect(ReasonProtocolError, "enhanced authentication is not supported")
+		err = fmt.Errorf("enhanced authentication is not supported")
 	default:
 		// Not define pack type
 		//log.Debug("其他类型的数据包")
@@ -182,9 +362,48 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 }
 
 func (c *Client) WriteMsg(topic string, body []byte) error {
+	return c.Publish(topic, body, c.qos, nil)
+}
+
+// WriteMsgQos 按指定的QoS下发消息, QoS 1/2 的消息在客户端确认前占用发送窗口,超时未确认时重发
+func (c *Client) WriteMsgQos(topic string, body []byte, qos byte) error {
+	return c.Publish(topic, body, qos, nil)
+}
+
+// WriteMsgProperties 按默认QoS下发带属性的消息, 属性只会发给MQTT 5.0的客户端
+func (c *Client) WriteMsgProperties(topic string, body []byte, props *Properties) error {
+	return c.Publish(topic, body, c.qos, props)
+}
+
+// Publish 下发消息
+func (c *Client) Publish(topic string, body []byte, qos byte, props *Properties) error {
 	if c.isStop {
 		return fmt.Errorf("connection is closed")
 	}
-	pack := GetPubPack(0, 0, c.getOnlineMsgId(), &topic, body)
-	return c.queue.WritePack(pack)
+	if qos == 0 {
+		c.lock.Lock()
+		mid := c.getOnlineMsgId()
+		c.lock.Unlock()
+		pack := GetPubPack(0, 0, mid, &topic, body)
+		pack.GetVariable().(*Publish).SetProperties(props)
+		return c.queue.WritePack(pack)
+	}
+	if qos > 2 {
+		qos = 2
+	}
+	c.retryOnce.Do(func() {
+		go c.retryLoop()
+	})
+	if err := c.inflight.acquire(); err != nil {
+		return err
+	}
+	pack, err := c.inflight.add(qos, topic, body, props)
+	if err != nil {
+		return err
+	}
+	if err := c.queue.WritePack(pack); err != nil {
+		c.inflight.remove(pack.GetVariable().(*Publish).GetMid())
+		return err
+	}
+	return nil
 }
@@ -15,9 +15,16 @@ package mqtt
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/network"
 )
 
 func TestConnet(t *testing.T) {
@@ -74,3 +81,354 @@ func TestConnet(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// pipeConn 用net.Pipe模拟客户端连接
+type pipeConn struct {
+	network.Conn
+	conn net.Conn
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+func (c *pipeConn) Close() error                  { return c.conn.Close() }
+
+type nopRecover struct{}
+
+func (nopRecover) OnRecover(*Pack) {}
+
+type chanRecover chan *Pack
+
+func (r chanRecover) OnRecover(pack *Pack) { r <- pack }
+
+func newPipeClient(t *testing.T, cfg conf.Mqtt) (*Client, *bufio.Writer, chan *Pack) {
+	return newPipeClientConnect(t, cfg, nopRecover{}, &Connect{version: MQTT311})
+}
+
+// newPipeClientConnect 按conn协商协议版本
+func newPipeClientConnect(t *testing.T, cfg conf.Mqtt, recover PackRecover, conn *Connect) (*Client, *bufio.Writer, chan *Pack) {
+	server, peer := net.Pipe()
+	c := NewClient(cfg, recover, bufio.NewReader(server), bufio.NewWriter(server), &pipeConn{conn: server}, 60, 2048)
+	c.Negotiate(conn)
+	go c.Listen_loop()
+	t.Cleanup(func() {
+		peer.Close()
+	})
+	packs := make(chan *Pack, 16)
+	go func() {
+		r := bufio.NewReader(peer)
+		for {
+			pack, err := ReadPackVersion(r, 2048, c.Version())
+			if err != nil {
+				close(packs)
+				return
+			}
+			packs <- pack
+		}
+	}()
+	return c, bufio.NewWriter(peer), packs
+}
+
+func readPack(t *testing.T, packs chan *Pack, typ byte) *Pack {
+	select {
+	case pack, ok := <-packs:
+		if !ok || pack.GetType() != typ {
+			t.Fatalf("want pack type %d got %v", typ, pack)
+		}
+		return pack
+	case <-time.After(time.Second * 3):
+		t.Fatalf("wait pack type %d timeout", typ)
+	}
+	return nil
+}
+
+func waitInflight(t *testing.T, c *Client, n int) {
+	for i := 0; i < 100 && c.Inflight() != n; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if c.Inflight() != n {
+		t.Fatalf("inflight %d want %d", c.Inflight(), n)
+	}
+}
+
+func TestQos(t *testing.T) {
+	c, w, packs := newPipeClient(t, conf.Mqtt{MaxInflight: 1, RetryInterval: 1, WriteTimeout: 1})
+	//QoS 1: 超时没有确认时设置DUP重发
+	if err := c.WriteMsgQos("a", []byte("1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	pub := readPack(t, packs, PUBLISH)
+	mid := pub.GetVariable().(*Publish).GetMid()
+	if pub.GetQos() != 1 || pub.GetDup() != 0 {
+		t.Fatalf("publish qos %d dup %d", pub.GetQos(), pub.GetDup())
+	}
+	//窗口已满时不等待
+	start := time.Now()
+	if err := c.WriteMsgQos("a", []byte("2"), 1); err != ErrInflightFull {
+		t.Fatalf("inflight full got %v", err)
+	}
+	if d := time.Since(start); d > time.Millisecond*100 {
+		t.Fatalf("inflight full blocked %v", d)
+	}
+	dup := readPack(t, packs, PUBLISH)
+	if dup.GetDup() != 1 || dup.GetVariable().(*Publish).GetMid() != mid {
+		t.Fatalf("retransmit dup %d mid %d", dup.GetDup(), dup.GetVariable().(*Publish).GetMid())
+	}
+	if pending := c.Pending(); len(pending) != 1 || pending[0].GetVariable().(*Publish).GetMid() != mid {
+		t.Fatalf("pending %v", pending)
+	}
+	if err := WritePack(GetPubAckPack(mid), w); err != nil {
+		t.Fatal(err)
+	}
+	waitInflight(t, c, 0)
+
+	//QoS 2: PUBLISH -> PUBREC -> PUBREL -> PUBCOMP
+	if err := c.WriteMsgQos("b", []byte("3"), 2); err != nil {
+		t.Fatal(err)
+	}
+	pub = readPack(t, packs, PUBLISH)
+	mid = pub.GetVariable().(*Publish).GetMid()
+	if pub.GetQos() != 2 {
+		t.Fatalf("publish qos %d", pub.GetQos())
+	}
+	if err := WritePack(GetPubRECPack(mid), w); err != nil {
+		t.Fatal(err)
+	}
+	rel := readPack(t, packs, PUBREL)
+	if rel.GetVariable().(*Puback).GetMid() != mid {
+		t.Fatalf("pubrel mid %d", rel.GetVariable().(*Puback).GetMid())
+	}
+	waitInflight(t, c, 1)
+	//已经收到PUBREC的消息已经送达
+	if pending := c.Pending(); len(pending) != 0 {
+		t.Fatalf("pending after pubrec %v", pending)
+	}
+	if err := WritePack(GetPubCOMPPack(mid), w); err != nil {
+		t.Fatal(err)
+	}
+	waitInflight(t, c, 0)
+}
+
+func TestMqtt5(t *testing.T) {
+	//CONNECT 带有属性,没有Client Identifier
+	body := new(bytes.Buffer)
+	putBinary(body, []byte("MQTT"))
+	body.Write([]byte{MQTT5, 0x02, 0, 60})
+	writeProperties(body, &Properties{SessionExpiryInterval: Uint32(30), ReceiveMaximum: 1})
+	putBinary(body, nil)
+	data := append([]byte{CONNECT << 4}, getRemainingLength(body.Len())...)
+	pack, err := ReadPack(bufio.NewReader(bytes.NewReader(append(data, body.Bytes()...))), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := pack.GetVariable().(*Connect)
+	if conn.GetVersion() != MQTT5 || *conn.GetClientID() != "" || conn.GetSessionExpiry() != 30 {
+		t.Fatalf("connect version %d id %q expiry %d", conn.GetVersion(), *conn.GetClientID(), conn.GetSessionExpiry())
+	}
+
+	//PUBLISH 属性编解码
+	props := &Properties{
+		ResponseTopic:          "reply",
+		CorrelationData:        []byte{1, 2},
+		TopicAlias:             3,
+		SubscriptionIdentifier: []int{200},
+		MaximumQos:             Byte(0),
+		User:                   []UserProperty{{"k", "v1"}, {"k", "v2"}},
+	}
+	topic := "a/b"
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	pub := GetPubPack(1, 0, 7, &topic, []byte("hello"))
+	pub.GetVariable().(*Publish).SetProperties(props)
+	if err := WritePackVersion(pub, w, MQTT5); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePackVersion(GetPubAckPack(7), w, MQTT5); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(buf)
+	pack, err = ReadPackVersion(r, 2048, MQTT5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := pack.GetVariable().(*Publish)
+	if *got.GetTopic() != topic || got.GetMid() != 7 || string(got.GetMsg()) != "hello" || !reflect.DeepEqual(got.GetProperties(), props) {
+		t.Fatalf("publish %v %d %s %+v", *got.GetTopic(), got.GetMid(), got.GetMsg(), got.GetProperties())
+	}
+	if pack, err = ReadPackVersion(r, 2048, MQTT5); err != nil || pack.GetVariable().(*Puback).GetMid() != 7 {
+		t.Fatalf("puback %v %v", pack, err)
+	}
+
+	recv := make(chanRecover, 4)
+	c, pw, packs := newPipeClientConnect(t, conf.Mqtt{MaxInflight: 5}, recv, conn)
+	if cap(c.inflight.slots) != 1 {
+		t.Fatalf("receive maximum not applied: %d", cap(c.inflight.slots))
+	}
+	//下行消息带上Correlation Data
+	if err := c.WriteMsgProperties("reply", []byte("ok"), &Properties{CorrelationData: []byte("id")}); err != nil {
+		t.Fatal(err)
+	}
+	if p := readPack(t, packs, PUBLISH).GetVariable().(*Publish); string(p.GetProperties().CorrelationData) != "id" {
+		t.Fatalf("correlation data %+v", p.GetProperties())
+	}
+	//主题别名
+	send := func(topic string, alias uint16) {
+		pack := GetPubPack(0, 0, 0, &topic, []byte("x"))
+		pack.GetVariable().(*Publish).SetProperties(&Properties{TopicAlias: alias})
+		if err := WritePackVersion(pack, pw, MQTT5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("a/HD_b", 1)
+	send("", 1)
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-recv:
+			if *p.GetVariable().(*Publish).GetTopic() != "a/HD_b" {
+				t.Fatalf("alias topic %s", *p.GetVariable().(*Publish).GetTopic())
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait publish timeout")
+		}
+	}
+	//未知的别名由服务端断开连接
+	send("", 2)
+	if d := readPack(t, packs, DISCONNECT).GetVariable().(*Disconnect); d.GetReason() != ReasonTopicAliasInvalid {
+		t.Fatalf("disconnect reason %x", d.GetReason())
+	}
+}
+
+func TestMqtt5DisconnectExpiry(t *testing.T) {
+	//DISCONNECT中的Session Expiry Interval为0时会话立即过期,没有设置时保持CONNECT中的值
+	for want, props := range map[uint32]*Properties{0: {SessionExpiryInterval: Uint32(0)}, 30: nil, 60: {SessionExpiryInterval: Uint32(60)}} {
+		conn := &Connect{version: MQTT5, properties: &Properties{SessionExpiryInterval: Uint32(30)}}
+		c, w, _ := newPipeClientConnect(t, conf.Mqtt{}, nopRecover{}, conn)
+		if c.SessionExpiry() != 30 {
+			t.Fatalf("connect expiry %d", c.SessionExpiry())
+		}
+		if err := WritePackVersion(GetDisconnectPack(ReasonSuccess, props), w, MQTT5); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100 && !c.NormalDisconnect(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if !c.NormalDisconnect() || c.SessionExpiry() != want {
+			t.Fatalf("disconnect %v expiry %d want %d", c.NormalDisconnect(), c.SessionExpiry(), want)
+		}
+	}
+}
+
+func TestMqtt5PropertiesLength(t *testing.T) {
+	//属性长度超过报文剩余长度时不分配内存,直接返回错误
+	huge := []byte{0xff, 0xff, 0xff, 0x7f}
+	for name, flags := range map[string]byte{"connect": 0x02, "will": 0x06} {
+		body := new(bytes.Buffer)
+		putBinary(body, []byte("MQTT"))
+		body.Write([]byte{MQTT5, flags, 0, 60})
+		if flags == 0x02 {
+			body.Write(huge)
+		} else {
+			body.WriteByte(0)
+			putBinary(body, []byte("c"))
+			body.Write(huge)
+		}
+		data := append([]byte{CONNECT << 4}, getRemainingLength(body.Len())...)
+		if _, err := ReadPack(bufio.NewReader(bytes.NewReader(append(data, body.Bytes()...))), 2048); err == nil || !strings.Contains(err.Error(), "properties length") {
+			t.Fatalf("%s properties length error %v", name, err)
+		}
+	}
+}
+
+func TestTopic(t *testing.T) {
+	for filter, ok := range map[string]bool{"a/+/b": true, "#": true, "a/#": true, "a/#/b": false, "a+": false, "a/b#": false, "": false} {
+		if ValidTopicFilter(filter) != ok {
+			t.Errorf("filter %q valid %v", filter, !ok)
+		}
+	}
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/+", "a/", true},
+		{"#", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+	} {
+		if MatchTopic(c.filter, c.topic) != c.match {
+			t.Errorf("filter %s topic %s match %v", c.filter, c.topic, !c.match)
+		}
+	}
+
+	//每个订阅一个返回码
+	recv := make(chanRecover, 4)
+	_, w, packs := newPipeClientConnect(t, conf.Mqtt{}, recv, &Connect{version: MQTT311})
+	a, b, share := "a/+", "a/#/b", "$share/g/a"
+	sub := &Pack{msg_type: SUBSCRIBE, qos_level: 1, variable: &Subscribe{mid: 3, topics: []Topics{{name: &a, Qos: 2}, {name: &b, Qos: 1}, {name: &share}}}}
+	if err := WritePack(sub, w); err != nil {
+		t.Fatal(err)
+	}
+	ack := readPack(t, packs, SUBACK).GetVariable().(*Suback)
+	if ack.mid != 3 || !bytes.Equal(ack.GetCodes(), []byte{2, SubackFailure, SubackFailure}) {
+		t.Fatalf("suback %d %v", ack.mid, ack.GetCodes())
+	}
+	if codes := sub.GetVariable().(*Subscribe).ReasonCodes(MQTT5); !bytes.Equal(codes, []byte{2, ReasonTopicFilterInvalid, ReasonSharedSubNotSupported}) {
+		t.Fatalf("mqtt5 codes %v", codes)
+	}
+}
+
+func TestWill(t *testing.T) {
+	//CONNECT 带有遗嘱消息和Will Delay Interval
+	body := new(bytes.Buffer)
+	putBinary(body, []byte("MQTT"))
+	//Will Flag, Will QoS 1, Will Retain, Clean Start
+	body.Write([]byte{MQTT5, 0x2E, 0, 60})
+	writeProperties(body, &Properties{})
+	putBinary(body, []byte("c1"))
+	writeProperties(body, &Properties{WillDelayInterval: 5})
+	putBinary(body, []byte("player/c1/status"))
+	putBinary(body, []byte("offline"))
+	data := append([]byte{CONNECT << 4}, getRemainingLength(body.Len())...)
+	pack, err := ReadPack(bufio.NewReader(bytes.NewReader(append(data, body.Bytes()...))), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := pack.GetVariable().(*Connect)
+	ok, topic, msg := conn.GetWillMsg()
+	if !ok || *topic != "player/c1/status" || *msg != "offline" || conn.GetWillProperties().WillDelayInterval != 5 {
+		t.Fatalf("will %v %s %s %+v", ok, *topic, *msg, conn.GetWillProperties())
+	}
+	if conn.GetWillQos() != 1 || !conn.GetWillRetain() || !conn.IsCleanSession() {
+		t.Fatalf("will qos %d retain %v clean %v", conn.GetWillQos(), conn.GetWillRetain(), conn.IsCleanSession())
+	}
+
+	//客户端发送DISCONNECT后由服务端关闭连接, 原因码0x04时仍然需要发送遗嘱
+	for _, tc := range []struct {
+		version byte
+		reason  byte
+		normal  bool
+	}{
+		{MQTT311, 0, true},
+		{MQTT5, ReasonSuccess, true},
+		{MQTT5, ReasonDisconnectWithWill, false},
+	} {
+		c, w, packs := newPipeClientConnect(t, conf.Mqtt{}, nopRecover{}, &Connect{version: tc.version})
+		if c.NormalDisconnect() {
+			t.Fatal("normal disconnect before DISCONNECT")
+		}
+		if err := WritePackVersion(GetDisconnectPack(tc.reason, nil), w, tc.version); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case _, ok := <-packs:
+			if ok {
+				t.Fatal("unexpected pack after DISCONNECT")
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("connection not closed after DISCONNECT")
+		}
+		if c.NormalDisconnect() != tc.normal {
+			t.Fatalf("version %d reason %x normal disconnect %v", tc.version, tc.reason, !tc.normal)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/liangdas/mqant/network"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,7 +45,9 @@ type PackQueue struct {
 
 	MaxPackSize int // mqtt包最大长度
 
-	status int
+	version byte // 协商的协议版本, 在开始读写前设置
+
+	status int32
 }
 
 type packAndErr struct {
@@ -89,11 +92,12 @@ func NewPackQueue(conf conf.Mqtt, r *bufio.Reader, w *bufio.Writer, conn network
 		recover:     recover,
 		fch:         make(chan struct{}, 256),
 		status:      CONNECTED,
+		version:     MQTT311,
 	}
 }
 
 func (queue *PackQueue) isConnected() bool {
-	return queue.status == CONNECTED
+	return atomic.LoadInt32(&queue.status) == CONNECTED
 }
 
 // Get a read pack queue
@@ -143,7 +147,7 @@ func (queue *PackQueue) WritePack(pack *Pack) (err error) {
 		queue.writelock.Unlock()
 		return fmt.Errorf("bufio.Writer is full")
 	}
-	err = DelayWritePack(pack, queue.w)
+	err = DelayWritePackVersion(pack, queue.w, queue.version)
 	queue.writelock.Unlock()
 	queue.fch <- struct{}{}
 	if err != nil {
@@ -154,6 +158,16 @@ func (queue *PackQueue) WritePack(pack *Pack) (err error) {
 	return err
 }
 
+// flush 立即写出缓存的数据, 用于断开连接前发送最后的报文
+func (queue *PackQueue) flush() error {
+	queue.writelock.Lock()
+	defer queue.writelock.Unlock()
+	if !queue.isConnected() {
+		return errors.New("disconnect")
+	}
+	return queue.w.Flush()
+}
+
 func (queue *PackQueue) SetAlive(alive int) error {
 	if alive < 1 {
 		alive = queue.conf.ReadTimeout
@@ -181,7 +195,7 @@ loop:
 		} else {
 			queue.conn.SetDeadline(time.Now().Add(time.Second * 90))
 		}
-		p.pack, p.err = ReadPack(queue.r, queue.MaxPackSize)
+		p.pack, p.err = ReadPackVersion(queue.r, queue.MaxPackSize, queue.version)
 		if p.err != nil {
 			queue.Close(p.err)
 			break loop
@@ -210,7 +224,7 @@ func (queue *PackQueue) CloseFch() {
 func (queue *PackQueue) Close(err error) error {
 	queue.writeError = err
 	queue.CloseFch()
-	queue.status = CLOSED
+	atomic.StoreInt32(&queue.status, CLOSED)
 	if queue.conn != nil {
 		//再关闭一下,防止文件描述符发生泄漏
 		queue.conn.Close()
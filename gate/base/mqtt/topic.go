@@ -0,0 +1,86 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"strings"
+)
+
+// SubackFailure MQTT 3.1.1 SUBACK中订阅失败的返回码
+const SubackFailure = 0x80
+
+// ValidTopicName 发布消息的topic不能为空也不能包含通配符
+func ValidTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// ValidTopicFilter 订阅的topic, + 必须占据一整层, # 必须占据一整层并且在最后一层
+func ValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTopic topic是否匹配订阅的filter, 以$开头的topic不匹配第一层的通配符
+func MatchTopic(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// ReasonCodes 每个订阅的结果, 成功时为授予的QoS
+func (sub *Subscribe) ReasonCodes(version byte) []byte {
+	codes := make([]byte, len(sub.topics))
+	for i, top := range sub.topics {
+		filter := *top.GetName()
+		switch {
+		case !ValidTopicFilter(filter) || top.GetQos() > 2:
+			codes[i] = SubackFailure
+			if version >= MQTT5 {
+				codes[i] = ReasonTopicFilterInvalid
+			}
+		case strings.HasPrefix(filter, "$share/"):
+			//不支持共享订阅
+			codes[i] = SubackFailure
+			if version >= MQTT5 {
+				codes[i] = ReasonSharedSubNotSupported
+			}
+		default:
+			codes[i] = top.GetQos()
+		}
+	}
+	return codes
+}
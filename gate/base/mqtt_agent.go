@@ -55,6 +55,10 @@ type agent struct {
 	revNum                       int64
 	sendNum                      int64
 	connTime                     time.Time
+	clientID                     string          //持久会话的clientID,非持久会话为空
+	connectionID                 string          //持久会话当前连接的标识
+	subscriptions                map[string]byte //客户端的订阅
+	will                         *will           //遗嘱消息
 }
 
 func NewMqttAgent(module module.RPCModule) *agent {
@@ -155,15 +159,37 @@ func (age *agent) Run() (err error) {
 	//psw := info.GetPassword()
 	//log.Debug("Read login pack %s %s %s %s",*id,*psw,info.GetProtocol(),info.GetVersion())
 	c := mqtt.NewClient(conf.Conf.Mqtt, age, age.r, age.w, age.conn, conn.GetKeepAlive(), age.gate.Options().MaxPackSize)
+	ackProps := c.Negotiate(conn)
+	if props := conn.GetProperties(); props != nil && props.AuthMethod != "" {
+		//不支持MQTT 5.0 增强认证
+		mqtt.WritePackVersion(mqtt.GetConnAckPackProperties(mqtt.ReasonBadAuthenticationMethod, false, nil), age.w, c.Version())
+		return
+	}
 	age.client = c
+	age.will = newWill(conn)
 	addr := age.conn.RemoteAddr()
-	age.session, err = NewSessionByMap(age.module.GetApp(), map[string]interface{}{
-		"Sessionid": mqanttools.GenerateID().String(),
-		"Network":   addr.Network(),
-		"IP":        addr.String(),
-		"Serverid":  age.module.GetServerID(),
-		"Settings":  make(map[string]string),
-	})
+	persistent, present := age.restoreSession(conn)
+	if persistent != nil && len(persistent.Session) > 0 {
+		//恢复持久会话中的Session,包括绑定的Userid和Settings
+		age.session, err = NewSession(age.module.GetApp(), persistent.Session)
+		if err == nil {
+			age.session.SetNetwork(addr.Network())
+			age.session.SetIP(addr.String())
+			age.session.SetServerID(age.module.GetServerID())
+		}
+	} else {
+		sessionID := mqanttools.GenerateID().String()
+		if persistent != nil {
+			sessionID = persistent.SessionID
+		}
+		age.session, err = NewSessionByMap(age.module.GetApp(), map[string]interface{}{
+			"Sessionid": sessionID,
+			"Network":   addr.Network(),
+			"IP":        addr.String(),
+			"Serverid":  age.module.GetServerID(),
+			"Settings":  make(map[string]string),
+		})
+	}
 	netConn, ok := age.conn.(*network.WSConn)
 	if ok {
 		//如果是websocket连接 提取 User-Agent
@@ -176,7 +202,13 @@ func (age *agent) Run() (err error) {
 	age.session.JudgeGuest(age.gate.GetJudgeGuest())
 	age.session.CreateTrace() //代码跟踪
 	//回复客户端 CONNECT
-	err = mqtt.WritePack(mqtt.GetConnAckPack(0), age.w)
+	if ackProps != nil && *conn.GetClientID() == "" {
+		//MQTT 5.0 客户端没有提供Client Identifier时使用Sessionid
+		ackProps.AssignedClientID = age.session.GetSessionID()
+	}
+	//MQTT 3.1 的CONNACK没有Session Present
+	present = present && conn.GetVersion() >= mqtt.MQTT311
+	err = mqtt.WritePackVersion(mqtt.GetConnAckPackProperties(0, present, ackProps), age.w, c.Version())
 	if err != nil {
 		log.Error("ConnAckPack error %v", err.Error())
 		return
@@ -184,7 +216,10 @@ func (age *agent) Run() (err error) {
 	age.connTime = time.Now()
 	age.protocol_ok = true
 	age.gate.GetAgentLearner().Connect(age) //发送连接成功的事件
-	c.Listen_loop()                         //开始监听,直到连接中断
+	if persistent != nil {
+		go age.deliverOffline()
+	}
+	c.Listen_loop() //开始监听,直到连接中断
 	return nil
 }
 
@@ -197,7 +232,13 @@ func (age *agent) OnClose() error {
 		}
 	}()
 	age.isclose = true
+	if age.client != nil {
+		age.saveSession()
+	}
 	age.gate.GetAgentLearner().DisConnect(age) //发送连接断开的事件
+	if age.client != nil && age.protocol_ok {
+		age.sendWill() //连接异常断开时发送遗嘱消息
+	}
 	return nil
 }
 
@@ -215,30 +256,51 @@ func (age *agent) ConnTime() time.Time {
 	return age.connTime
 }
 func (age *agent) OnRecover(pack *mqtt.Pack) {
+	switch pack.GetType() {
+	case mqtt.SUBSCRIBE, mqtt.UNSUBSCRIBE:
+		age.trackSubscriptions(pack)
+	}
 	err := age.Wait()
 	if err != nil {
 		log.Error("Gate OnRecover error [%v]", err)
-		pub := pack.GetVariable().(*mqtt.Publish)
-		age.toResult(age, *pub.GetTopic(), nil, err.Error())
+		if pub, ok := pack.GetVariable().(*mqtt.Publish); ok {
+			age.resultWriter(pub)(age, *pub.GetTopic(), nil, err.Error())
+		}
 	} else {
 		go age.recoverworker(pack)
 	}
 }
 
 func (age *agent) toResult(a *agent, Topic string, Result interface{}, Error string) error {
+	return a.writeResult(Topic, nil, Result, Error)
+}
+
+// resultWriter 请求的应答方式, MQTT 5.0 带有Response Topic的请求应答发往Response Topic并带上Correlation Data
+func (age *agent) resultWriter(pub *mqtt.Publish) func(a *agent, Topic string, Result interface{}, Error string) error {
+	props := pub.GetProperties()
+	if props == nil || props.ResponseTopic == "" {
+		return age.toResult
+	}
+	reply := &mqtt.Properties{CorrelationData: props.CorrelationData}
+	return func(a *agent, Topic string, Result interface{}, Error string) error {
+		return a.writeResult(props.ResponseTopic, reply, Result, Error)
+	}
+}
+
+func (age *agent) writeResult(Topic string, props *mqtt.Properties, Result interface{}, Error string) error {
 	switch v2 := Result.(type) {
 	case module.ProtocolMarshal:
-		return a.WriteMsg(Topic, v2.GetData())
+		return age.writeMsg(Topic, v2.GetData(), props)
 	}
-	b, err := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), Result, Error)
+	b, err := age.module.GetApp().ProtocolMarshal(age.session.TraceId(), Result, Error)
 	if err == "" {
 		if b != nil {
-			return a.WriteMsg(Topic, b.GetData())
+			return age.writeMsg(Topic, b.GetData(), props)
 		}
 		return nil
 	}
-	br, _ := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), nil, err)
-	return a.WriteMsg(Topic, br.GetData())
+	br, _ := age.module.GetApp().ProtocolMarshal(age.session.TraceId(), nil, err)
+	return age.writeMsg(Topic, br.GetData(), props)
 }
 
 func (age *agent) recoverworker(pack *mqtt.Pack) {
@@ -270,6 +332,9 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 		age.revNum = age.revNum + 1
 		age.lock.Unlock()
 		pub := pack.GetVariable().(*mqtt.Publish)
+		toResult = age.resultWriter(pub)
+		//MQTT 5.0 带有Response Topic的消息需要应答
+		needReply := pub.GetProperties() != nil && pub.GetProperties().ResponseTopic != ""
 		if age.gate.GetRouteHandler() != nil {
 			needreturn, result, err := age.gate.GetRouteHandler().OnRoute(age.GetSession(), *pub.GetTopic(), pub.GetMsg())
 			if err != nil {
@@ -283,18 +348,17 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 			}
 		} else {
 			topics := strings.Split(*pub.GetTopic(), "/")
-			var msgid string
 			if len(topics) < 2 {
 				errorstr := "Topic must be [moduleType@moduleID]/[handler]|[moduleType@moduleID]/[handler]/[msgid]"
 				log.Error(errorstr)
 				toResult(age, *pub.GetTopic(), nil, errorstr)
 				return
 			} else if len(topics) == 3 {
-				msgid = topics[2]
+				needReply = true
 			}
 			startsWith := strings.HasPrefix(topics[1], "HD_")
 			if !startsWith {
-				if msgid != "" {
+				if needReply {
 					toResult(age, *pub.GetTopic(), nil, fmt.Sprintf("Method(%s) must begin with 'HD_'", topics[1]))
 				}
 				return
@@ -303,7 +367,7 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 			var args [][]byte = make([][]byte, 2)
 			serverSession, err := age.module.GetRouteServer(topics[0])
 			if err != nil {
-				if msgid != "" {
+				if needReply {
 					toResult(age, *pub.GetTopic(), nil, fmt.Sprintf("Service(type:%s) not found", topics[0]))
 				}
 				return
@@ -313,7 +377,7 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 				var obj interface{} // var obj map[string]interface{}
 				err := json.Unmarshal(pub.GetMsg(), &obj)
 				if err != nil {
-					if msgid != "" {
+					if needReply {
 						toResult(age, *pub.GetTopic(), nil, "The JSON format is incorrect")
 					}
 					return
@@ -326,7 +390,7 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 			}
 			session := age.GetSession().Clone()
 			session.SetTopic(*pub.GetTopic())
-			if msgid != "" {
+			if needReply {
 				ArgsType[0] = RPCParamSessionType
 				b, err := session.Serializable()
 				if err != nil {
@@ -370,9 +434,25 @@ func (age *agent) recoverworker(pack *mqtt.Pack) {
 }
 
 func (age *agent) WriteMsg(topic string, body []byte) error {
+	return age.writeMsg(topic, body, nil)
+}
+
+func (age *agent) writeMsg(topic string, body []byte, props *mqtt.Properties) error {
+	if age.client == nil {
+		return errors.New("mqtt.Client nil")
+	}
+	return age.publish(topic, body, age.client.Qos(), props)
+}
+
+// WriteMsgQos 按指定的QoS下发消息, 用于按订阅的QoS投递
+func (age *agent) WriteMsgQos(topic string, body []byte, qos byte) error {
 	if age.client == nil {
 		return errors.New("mqtt.Client nil")
 	}
+	return age.publish(topic, body, qos, nil)
+}
+
+func (age *agent) publish(topic string, body []byte, qos byte, props *mqtt.Properties) error {
 	age.sendNum++
 	if age.gate.Options().SendMessageHook != nil {
 		bb, err := age.gate.Options().SendMessageHook(age.GetSession(), topic, body)
@@ -381,7 +461,15 @@ func (age *agent) WriteMsg(topic string, body []byte) error {
 		}
 		body = bb
 	}
-	return age.client.WriteMsg(topic, body)
+	return age.client.Publish(topic, body, qos, props)
+}
+
+// Disconnect 断开连接, MQTT 5.0 的客户端会先收到带原因码的DISCONNECT
+func (age *agent) Disconnect(reason byte, reasonString string) {
+	if age.client != nil && age.protocol_ok {
+		age.client.Disconnect(reason, reasonString)
+	}
+	age.Close()
 }
 
 func (age *agent) Close() {
@@ -264,8 +264,10 @@ func (gt *Gate) OnInit(subclass module.RPCModule, app module.App, settings *conf
 	gt.GetServer().RegisterGO("Send", gt.opts.GateHandler.Send)
 	gt.GetServer().RegisterGO("SendBatch", gt.opts.GateHandler.SendBatch)
 	gt.GetServer().RegisterGO("BroadCast", gt.opts.GateHandler.BroadCast)
+	gt.GetServer().RegisterGO("Publish", gt.opts.GateHandler.Publish)
 	gt.GetServer().RegisterGO("IsConnect", gt.opts.GateHandler.IsConnect)
 	gt.GetServer().RegisterGO("Close", gt.opts.GateHandler.Close)
+	gt.GetServer().RegisterGO("DeliverOffline", gt.deliverOffline)
 }
 
 func (gt *Gate) Run(closeSig chan bool) {
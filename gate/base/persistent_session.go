@@ -0,0 +1,267 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"sort"
+	"time"
+
+	"github.com/liangdas/mqant/gate"
+	"github.com/liangdas/mqant/gate/base/mqtt"
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/utils"
+)
+
+// restoreSession 恢复clientID的持久会话, 不需要保存会话时返回nil, present表示之前的会话仍然存在
+func (age *agent) restoreSession(conn *mqtt.Connect) (state *gate.PersistentSession, present bool) {
+	store := age.gate.Options().SessionStore
+	clientID := *conn.GetClientID()
+	if store == nil || clientID == "" {
+		return nil, false
+	}
+	state, err := store.Load(clientID)
+	if err != nil {
+		log.Warning("Load session(%s) fail %v", clientID, err)
+		return nil, false
+	}
+	if state != nil {
+		age.takeover(state)
+	}
+	expiry := conn.GetSessionExpiry()
+	if state != nil && (conn.IsCleanSession() || expiry == 0) {
+		//CleanSession(MQTT 5.0 Clean Start) 丢弃之前的会话
+		if err := store.Delete(clientID); err != nil {
+			log.Warning("Delete session(%s) fail %v", clientID, err)
+		}
+		state = nil
+	}
+	if expiry == 0 {
+		return nil, false
+	}
+	present = state != nil
+	if state == nil {
+		state = &gate.PersistentSession{
+			ClientID:  clientID,
+			SessionID: mqanttools.GenerateID().String(),
+		}
+	}
+	state.ServerID = age.module.GetServerID()
+	state.ConnectionID = mqanttools.GenerateID().String()
+	state.Expiry = expiry
+	if err := store.Save(state); err != nil {
+		log.Warning("Save session(%s) fail %v", clientID, err)
+		return nil, false
+	}
+	age.clientID = clientID
+	age.connectionID = state.ConnectionID
+	age.subscriptions = make(map[string]byte, len(state.Subscriptions))
+	for _, sub := range state.Subscriptions {
+		age.subscriptions[sub.Topic] = sub.Qos
+	}
+	return state, present
+}
+
+// takeover 同一个clientID的旧连接还在线时断开旧连接
+func (age *agent) takeover(state *gate.PersistentSession) {
+	if state.ServerID == "" {
+		return
+	}
+	if state.ServerID == age.module.GetServerID() {
+		if old, err := age.gate.GetGateHandler().GetAgent(state.SessionID); err == nil {
+			disconnect(old, mqtt.ReasonSessionTakenOver, "")
+		}
+		return
+	}
+	server, err := age.module.GetApp().GetServerByID(state.ServerID)
+	if err != nil {
+		//旧连接所在的网关已经不存在了
+		return
+	}
+	if _, e := server.Call(nil, "Close", log.CreateRootTrace(), state.SessionID); e != "" {
+		log.Warning("Close session(%s) on %s fail %s", state.SessionID, state.ServerID, e)
+	}
+}
+
+// deliverOffline 重连后下发离线消息
+func (age *agent) deliverOffline() {
+	store := age.gate.Options().SessionStore
+	msgs, err := store.Drain(age.clientID)
+	if err != nil {
+		log.Warning("Drain session(%s) fail %v", age.clientID, err)
+		return
+	}
+	for i, msg := range msgs {
+		qos := msg.Qos
+		if qos < age.client.Qos() {
+			qos = age.client.Qos()
+		}
+		if err := age.client.WriteMsgQos(msg.Topic, msg.Body, qos); err != nil {
+			//没有发出去的消息放回队列,下次重连时发送
+			if err := store.Enqueue(age.clientID, msgs[i:]...); err != nil {
+				log.Warning("Enqueue session(%s) fail %v", age.clientID, err)
+			}
+			return
+		}
+		age.sendNum++
+	}
+}
+
+// saveSession 连接断开后保存持久会话, 没有送达的QoS 1/2 消息在重连后重发
+func (age *agent) saveSession() {
+	store := age.gate.Options().SessionStore
+	if store == nil || age.clientID == "" {
+		return
+	}
+	var msgs []gate.OfflineMessage
+	for _, pack := range age.client.Pending() {
+		pub := pack.GetVariable().(*mqtt.Publish)
+		msgs = append(msgs, gate.OfflineMessage{Topic: *pub.GetTopic(), Body: pub.GetMsg(), Qos: pack.GetQos()})
+	}
+	state, err := store.Load(age.clientID)
+	if err != nil {
+		log.Warning("Load session(%s) fail %v", age.clientID, err)
+		return
+	}
+	if state == nil || state.ConnectionID != age.connectionID {
+		//会话已经被新的连接接管或者已经删除
+		if state != nil && len(msgs) > 0 {
+			if err := store.Enqueue(age.clientID, msgs...); err != nil {
+				log.Warning("Enqueue session(%s) fail %v", age.clientID, err)
+				return
+			}
+			//新的连接可能已经取走了离线消息,通知它下发刚保存的消息
+			age.notifyTakeover(state)
+		}
+		return
+	}
+	expiry := state.Expiry
+	if age.client.Version() >= mqtt.MQTT5 {
+		//MQTT 5.0 客户端可以在DISCONNECT中修改会话过期时间
+		expiry = age.client.SessionExpiry()
+	}
+	if expiry == 0 {
+		if err := store.Delete(age.clientID); err != nil {
+			log.Warning("Delete session(%s) fail %v", age.clientID, err)
+		}
+		return
+	}
+	if len(msgs) > 0 {
+		if err := store.Enqueue(age.clientID, msgs...); err != nil {
+			log.Warning("Enqueue session(%s) fail %v", age.clientID, err)
+		}
+	}
+	state.ServerID = ""
+	state.ConnectionID = ""
+	state.Expiry = expiry
+	state.OfflineAt = time.Now()
+	state.Subscriptions = age.Subscriptions()
+	if age.session != nil {
+		if b, err := age.session.Serializable(); err == nil {
+			state.Session = b
+		}
+	}
+	if err := store.Save(state); err != nil {
+		log.Warning("Save session(%s) fail %v", age.clientID, err)
+	}
+}
+
+// notifyTakeover 接管会话的连接在线时,由它下发离线队列中的消息
+func (age *agent) notifyTakeover(state *gate.PersistentSession) {
+	if state.ServerID == "" {
+		//新的连接也已经断开,下次重连时下发
+		return
+	}
+	if state.ServerID == age.module.GetServerID() {
+		if a, err := age.gate.GetGateHandler().GetAgent(state.SessionID); err == nil {
+			if live, ok := a.(*agent); ok && live != age && live.connectionID == state.ConnectionID {
+				go live.deliverOffline()
+			}
+		}
+		return
+	}
+	server, err := age.module.GetApp().GetServerByID(state.ServerID)
+	if err != nil {
+		//新的连接所在的网关已经不存在了
+		return
+	}
+	if _, e := server.Call(nil, "DeliverOffline", log.CreateRootTrace(), state.SessionID); e != "" {
+		log.Warning("DeliverOffline session(%s) on %s fail %s", state.SessionID, state.ServerID, e)
+	}
+}
+
+// deliverOffline 其他网关上被接管的旧连接保存了没有送达的消息,由这个网关上的新连接下发
+func (gt *Gate) deliverOffline(span log.TraceSpan, Sessionid string) (result interface{}, err string) {
+	a, e := gt.GetGateHandler().GetAgent(Sessionid)
+	if e != nil {
+		err = e.Error()
+		return
+	}
+	if live, ok := a.(*agent); ok && live.clientID != "" {
+		go live.deliverOffline()
+	}
+	result = "success"
+	return
+}
+
+// subscriptionTable 网关上的订阅表
+type subscriptionTable interface {
+	subscribe(sessionID, filter string, qos byte)
+	unsubscribe(sessionID, filter string)
+}
+
+// trackSubscriptions 记录客户端的订阅, 持久会话重连后恢复
+func (age *agent) trackSubscriptions(pack *mqtt.Pack) {
+	table, _ := age.gate.GetGateHandler().(subscriptionTable)
+	age.lock.Lock()
+	defer age.lock.Unlock()
+	if age.subscriptions == nil {
+		age.subscriptions = map[string]byte{}
+	}
+	sessionID := age.session.GetSessionID()
+	switch v := pack.GetVariable().(type) {
+	case *mqtt.Subscribe:
+		codes := v.ReasonCodes(age.client.Version())
+		for i, top := range v.GetTopics() {
+			if codes[i] >= mqtt.SubackFailure {
+				continue
+			}
+			age.subscriptions[*top.GetName()] = codes[i]
+			if table != nil {
+				table.subscribe(sessionID, *top.GetName(), codes[i])
+			}
+		}
+	case *mqtt.UNSubscribe:
+		for _, top := range v.GetTopics() {
+			delete(age.subscriptions, *top.GetName())
+			if table != nil {
+				table.unsubscribe(sessionID, *top.GetName())
+			}
+		}
+	}
+}
+
+// Subscriptions 客户端当前的订阅
+func (age *agent) Subscriptions() []gate.Subscription {
+	age.lock.Lock()
+	defer age.lock.Unlock()
+	subs := make([]gate.Subscription, 0, len(age.subscriptions))
+	for topic, qos := range age.subscriptions {
+		subs = append(subs, gate.Subscription{Topic: topic, Qos: qos})
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Topic < subs[j].Topic
+	})
+	return subs
+}
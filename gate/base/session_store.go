@@ -0,0 +1,132 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/gate"
+)
+
+// DefaultMaxOfflineQueue 每个会话默认最多保存的离线消息数
+const DefaultMaxOfflineQueue = 1000
+
+// memorySessionStore 保存在当前进程中的持久会话,只适用于单个网关节点
+type memorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*gate.PersistentSession
+	ids      map[string]string //SessionID -> ClientID
+	queues   map[string][]gate.OfflineMessage
+	maxQueue int
+}
+
+// NewMemorySessionStore 创建内存中的持久会话存储, maxQueue为每个会话最多保存的离线消息数,超过后丢弃最早的消息
+func NewMemorySessionStore(maxQueue int) gate.SessionStore {
+	if maxQueue < 1 {
+		maxQueue = DefaultMaxOfflineQueue
+	}
+	return &memorySessionStore{
+		sessions: map[string]*gate.PersistentSession{},
+		ids:      map[string]string{},
+		queues:   map[string][]gate.OfflineMessage{},
+		maxQueue: maxQueue,
+	}
+}
+
+// load 读取会话,已经过期的会话会被删除
+func (s *memorySessionStore) load(clientID string) *gate.PersistentSession {
+	session, ok := s.sessions[clientID]
+	if !ok {
+		return nil
+	}
+	if session.Expired(time.Now()) {
+		s.delete(clientID)
+		return nil
+	}
+	return session
+}
+
+func (s *memorySessionStore) delete(clientID string) {
+	if session, ok := s.sessions[clientID]; ok {
+		delete(s.ids, session.SessionID)
+	}
+	delete(s.sessions, clientID)
+	delete(s.queues, clientID)
+}
+
+func (s *memorySessionStore) Load(clientID string) (*gate.PersistentSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := s.load(clientID)
+	if session == nil {
+		return nil, nil
+	}
+	c := *session
+	c.Subscriptions = append([]gate.Subscription(nil), session.Subscriptions...)
+	return &c, nil
+}
+
+func (s *memorySessionStore) ClientID(sessionID string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clientID, ok := s.ids[sessionID]
+	if !ok || s.load(clientID) == nil {
+		return "", nil
+	}
+	return clientID, nil
+}
+
+func (s *memorySessionStore) Save(session *gate.PersistentSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old, ok := s.sessions[session.ClientID]; ok && old.SessionID != session.SessionID {
+		delete(s.ids, old.SessionID)
+	}
+	c := *session
+	c.Subscriptions = append([]gate.Subscription(nil), session.Subscriptions...)
+	s.sessions[session.ClientID] = &c
+	s.ids[session.SessionID] = session.ClientID
+	return nil
+}
+
+func (s *memorySessionStore) Delete(clientID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delete(clientID)
+	return nil
+}
+
+func (s *memorySessionStore) Enqueue(clientID string, msgs ...gate.OfflineMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.load(clientID) == nil {
+		return nil
+	}
+	queue := append(s.queues[clientID], msgs...)
+	if len(queue) > s.maxQueue {
+		queue = append([]gate.OfflineMessage(nil), queue[len(queue)-s.maxQueue:]...)
+	}
+	s.queues[clientID] = queue
+	return nil
+}
+
+func (s *memorySessionStore) Drain(clientID string) ([]gate.OfflineMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queue := s.queues[clientID]
+	delete(s.queues, clientID)
+	return queue, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/gate"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(2)
+	state := &gate.PersistentSession{
+		ClientID:      "c1",
+		SessionID:     "s1",
+		ServerID:      "gate@1",
+		Subscriptions: []gate.Subscription{{Topic: "a", Qos: 1}},
+		Expiry:        60,
+	}
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if clientID, _ := store.ClientID("s1"); clientID != "c1" {
+		t.Fatalf("client id %q", clientID)
+	}
+	//离线消息超过上限时丢弃最早的消息
+	for _, topic := range []string{"1", "2", "3"} {
+		if err := store.Enqueue("c1", gate.OfflineMessage{Topic: topic}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, _ := store.Drain("c1")
+	if len(msgs) != 2 || msgs[0].Topic != "2" || msgs[1].Topic != "3" {
+		t.Fatalf("drain %v", msgs)
+	}
+	if msgs, _ = store.Drain("c1"); len(msgs) != 0 {
+		t.Fatalf("drain again %v", msgs)
+	}
+	//保存的是副本
+	loaded, _ := store.Load("c1")
+	loaded.Subscriptions[0].Topic = "b"
+	if loaded, _ = store.Load("c1"); loaded.Subscriptions[0].Topic != "a" {
+		t.Fatalf("subscriptions %v", loaded.Subscriptions)
+	}
+	//离线超过Expiry后过期
+	state.ServerID = ""
+	state.OfflineAt = time.Now().Add(-time.Minute * 2)
+	store.Save(state)
+	if loaded, _ = store.Load("c1"); loaded != nil {
+		t.Fatalf("expired session %v", loaded)
+	}
+	if clientID, _ := store.ClientID("s1"); clientID != "" {
+		t.Fatalf("expired client id %q", clientID)
+	}
+	state.Expiry = gate.NeverExpire
+	store.Save(state)
+	if loaded, _ = store.Load("c1"); loaded == nil {
+		t.Fatal("session never expire")
+	}
+}
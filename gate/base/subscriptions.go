@@ -0,0 +1,155 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"strings"
+	"sync"
+)
+
+// subNode topic树的一层
+type subNode struct {
+	children map[string]*subNode
+	subs     map[string]byte //Sessionid -> QoS
+}
+
+func newSubNode() *subNode {
+	return &subNode{
+		children: map[string]*subNode{},
+		subs:     map[string]byte{},
+	}
+}
+
+// subscriptionTree 网关上所有客户端的订阅,按topic分层保存, 支持 + # 通配符
+type subscriptionTree struct {
+	lock     sync.RWMutex
+	root     *subNode
+	sessions map[string]map[string]byte //Sessionid -> filter -> QoS
+}
+
+func newSubscriptionTree() *subscriptionTree {
+	return &subscriptionTree{
+		root:     newSubNode(),
+		sessions: map[string]map[string]byte{},
+	}
+}
+
+// add 添加订阅, 同一个filter重复订阅时更新QoS
+func (t *subscriptionTree) add(sessionID, filter string, qos byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newSubNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subs[sessionID] = qos
+	filters, ok := t.sessions[sessionID]
+	if !ok {
+		filters = map[string]byte{}
+		t.sessions[sessionID] = filters
+	}
+	filters[filter] = qos
+}
+
+// remove 取消订阅
+func (t *subscriptionTree) remove(sessionID, filter string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.removeLocked(sessionID, filter)
+}
+
+// removeSession 取消客户端的所有订阅
+func (t *subscriptionTree) removeSession(sessionID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for filter := range t.sessions[sessionID] {
+		t.removeLocked(sessionID, filter)
+	}
+}
+
+func (t *subscriptionTree) removeLocked(sessionID, filter string) {
+	levels := strings.Split(filter, "/")
+	path := make([]*subNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	delete(node.subs, sessionID)
+	if filters, ok := t.sessions[sessionID]; ok {
+		delete(filters, filter)
+		if len(filters) == 0 {
+			delete(t.sessions, sessionID)
+		}
+	}
+	//删除没有订阅的分支
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.subs) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// match 匹配topic的客户端, 一个客户端有多个订阅匹配时取最大的QoS
+func (t *subscriptionTree) match(topic string) map[string]byte {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	result := map[string]byte{}
+	levels := strings.Split(topic, "/")
+	//以$开头的topic不匹配第一层的通配符
+	t.matchNode(t.root, levels, 0, strings.HasPrefix(topic, "$"), result)
+	return result
+}
+
+func (t *subscriptionTree) matchNode(node *subNode, levels []string, i int, system bool, result map[string]byte) {
+	collect := func(n *subNode) {
+		for sessionID, qos := range n.subs {
+			if old, ok := result[sessionID]; !ok || qos > old {
+				result[sessionID] = qos
+			}
+		}
+	}
+	wildcard := !(system && i == 0)
+	if wildcard {
+		// # 匹配当前层以及之后的所有层, a/# 也匹配 a
+		if child, ok := node.children["#"]; ok {
+			collect(child)
+		}
+	}
+	if i == len(levels) {
+		collect(node)
+		return
+	}
+	if child, ok := node.children[levels[i]]; ok {
+		t.matchNode(child, levels, i+1, system, result)
+	}
+	if wildcard {
+		if child, ok := node.children["+"]; ok {
+			t.matchNode(child, levels, i+1, system, result)
+		}
+	}
+}
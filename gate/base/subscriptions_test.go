@@ -0,0 +1,57 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"testing"
+
+	"github.com/liangdas/mqant/gate/base/mqtt"
+)
+
+func TestSubscriptionTree(t *testing.T) {
+	filters := []string{"room/1", "room/+", "room/#", "#", "+/+", "+", "room/+/chat", "$SYS/#", "room//x"}
+	topics := []string{"room/1", "room/2", "room", "room/1/chat", "lobby", "$SYS/load", "room//x", "a/b/c"}
+	tree := newSubscriptionTree()
+	for i, filter := range filters {
+		tree.add(filter, filter, byte(i%3))
+	}
+	//与 mqtt.MatchTopic 的结果一致
+	for _, topic := range topics {
+		matched := tree.match(topic)
+		for _, filter := range filters {
+			_, ok := matched[filter]
+			if ok != mqtt.MatchTopic(filter, topic) {
+				t.Errorf("filter %s topic %s tree %v", filter, topic, ok)
+			}
+		}
+	}
+	//同一个客户端多个订阅匹配时取最大QoS
+	tree.add("s", "chat/+", 0)
+	tree.add("s", "chat/#", 2)
+	if qos := tree.match("chat/1")["s"]; qos != 2 {
+		t.Fatalf("qos %d", qos)
+	}
+	tree.remove("s", "chat/#")
+	if qos := tree.match("chat/1")["s"]; qos != 0 {
+		t.Fatalf("qos after remove %d", qos)
+	}
+	for _, filter := range filters {
+		tree.removeSession(filter)
+	}
+	tree.removeSession("s")
+	if len(tree.root.children) != 0 || len(tree.sessions) != 0 {
+		t.Fatalf("tree not empty %v %v", tree.root.children, tree.sessions)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"time"
+
+	"github.com/liangdas/mqant/gate/base/mqtt"
+	"github.com/liangdas/mqant/log"
+)
+
+// will CONNECT中的遗嘱消息
+type will struct {
+	topic  string
+	msg    []byte
+	qos    byte          //发布的QoS,投递给订阅者时取与订阅QoS中较小的
+	retain bool          //网关不保存保留消息,交给WillModule处理
+	delay  time.Duration //MQTT 5.0 Will Delay Interval
+}
+
+// newWill 读取CONNECT中的遗嘱消息,没有遗嘱或者topic不合法时返回nil
+func newWill(conn *mqtt.Connect) *will {
+	ok, topic, msg := conn.GetWillMsg()
+	if !ok || !mqtt.ValidTopicName(*topic) {
+		return nil
+	}
+	w := &will{
+		topic:  *topic,
+		msg:    []byte(*msg),
+		qos:    conn.GetWillQos(),
+		retain: conn.GetWillRetain(),
+	}
+	if w.qos > 2 {
+		w.qos = 2
+	}
+	if props := conn.GetWillProperties(); props != nil {
+		w.delay = time.Duration(props.WillDelayInterval) * time.Second
+	}
+	return w
+}
+
+// sendWill 连接没有通过DISCONNECT正常断开时发送遗嘱消息
+// 持久会话在Will Delay Interval和会话过期时间中较早的时间之后发送,期间客户端重连则不再发送
+func (age *agent) sendWill() {
+	w := age.will
+	if w == nil || age.client.NormalDisconnect() {
+		return
+	}
+	store := age.gate.Options().SessionStore
+	if w.delay == 0 || store == nil || age.clientID == "" {
+		age.publishWill()
+		return
+	}
+	state, err := store.Load(age.clientID)
+	if err != nil {
+		log.Warning("Load session(%s) fail %v", age.clientID, err)
+	}
+	if state == nil || state.ServerID != "" {
+		//会话已经结束或者已经被新的连接接管
+		if state == nil {
+			age.publishWill()
+		}
+		return
+	}
+	delay := w.delay
+	if expiry := time.Duration(state.Expiry) * time.Second; state.Expiry != 0 && expiry < delay {
+		delay = expiry
+	}
+	offlineAt := state.OfflineAt
+	time.AfterFunc(delay, func() {
+		state, err := store.Load(age.clientID)
+		if err != nil {
+			log.Warning("Load session(%s) fail %v", age.clientID, err)
+			return
+		}
+		if state != nil && (state.ServerID != "" || !state.OfflineAt.Equal(offlineAt)) {
+			//客户端已经重连
+			return
+		}
+		age.publishWill()
+	})
+}
+
+// qosPublisher 按指定的最大QoS发布消息
+type qosPublisher interface {
+	publishQos(span log.TraceSpan, topic string, body []byte, qos byte) (int64, string)
+}
+
+// publishWill 把遗嘱消息按遗嘱的QoS发布给订阅者,并通知配置的后端模块
+func (age *agent) publishWill() {
+	opts := age.gate.Options()
+	span := age.session.ExtractSpan()
+	if opts.PublishWill {
+		var e string
+		if p, ok := age.gate.GetGateHandler().(qosPublisher); ok {
+			_, e = p.publishQos(span, age.will.topic, age.will.msg, age.will.qos)
+		} else {
+			_, e = age.gate.GetGateHandler().Publish(span, age.will.topic, age.will.msg)
+		}
+		if e != "" {
+			log.Warning("Publish will(%s) fail %s", age.will.topic, e)
+		}
+	}
+	if opts.WillModule == "" {
+		return
+	}
+	server, err := age.module.GetRouteServer(opts.WillModule)
+	if err != nil {
+		log.Warning("Will handler(%s) not found %v", opts.WillModule, err)
+		return
+	}
+	if err := server.CallNR(opts.WillMethod, age.session, age.will.topic, age.will.msg, int32(age.will.qos), age.will.retain); err != nil {
+		log.Warning("Call will handler(%s.%s) fail %v", opts.WillModule, opts.WillMethod, err)
+	}
+}
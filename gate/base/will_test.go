@@ -0,0 +1,78 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package basegate
+
+import (
+	"testing"
+
+	"github.com/liangdas/mqant/gate"
+)
+
+// willGate 只实现了发布遗嘱用到的方法
+type willGate struct {
+	gate.Gate
+	handler gate.GateHandler
+}
+
+func (g *willGate) Options() gate.Options            { return gate.Options{PublishWill: true} }
+func (g *willGate) GetGateHandler() gate.GateHandler { return g.handler }
+
+// qosAgent 记录下发消息的QoS
+type qosAgent struct {
+	gate.Agent
+	qos chan byte
+}
+
+func (a *qosAgent) WriteMsgQos(topic string, body []byte, qos byte) error {
+	a.qos <- qos
+	return nil
+}
+
+func TestWillQos(t *testing.T) {
+	g := &willGate{}
+	h := NewGateHandler(g)
+	g.handler = h
+	session, err := NewSessionByMap(nil, map[string]interface{}{"Sessionid": "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		will, sub, want byte
+	}{
+		{0, 2, 0},
+		{1, 2, 1},
+		{2, 2, 2},
+		{2, 1, 1},
+	} {
+		subscriber := &qosAgent{qos: make(chan byte, 1)}
+		h.sessions.Store("subscriber", subscriber)
+		h.subs.add("subscriber", "player/+/status", tc.sub)
+		owner := &agent{
+			gate:    g,
+			session: session,
+			will:    &will{topic: "player/c1/status", msg: []byte("offline"), qos: tc.will},
+		}
+		owner.publishWill()
+		select {
+		case qos := <-subscriber.qos:
+			if qos != tc.want {
+				t.Fatalf("will qos %d sub %d delivered %d want %d", tc.will, tc.sub, qos, tc.want)
+			}
+		default:
+			t.Fatalf("will qos %d sub %d not delivered", tc.will, tc.sub)
+		}
+		h.subs.removeSession("subscriber")
+	}
+}
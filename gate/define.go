@@ -42,6 +42,7 @@ type GateHandler interface {
 	Send(span log.TraceSpan, Sessionid string, topic string, body []byte) (result interface{}, err string) //Send message
 	SendBatch(span log.TraceSpan, Sessionids string, topic string, body []byte) (int64, string)            //批量发送
 	BroadCast(span log.TraceSpan, topic string, body []byte) (int64, string)                               //广播消息给网关所有在连客户端
+	Publish(span log.TraceSpan, topic string, body []byte) (int64, string)                                 //发布消息给网关上订阅了匹配topic的客户端,支持MQTT的 + # 通配符
 	//查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，如果有多个网关就需要遍历了
 	IsConnect(span log.TraceSpan, Sessionid string, Userid string) (result bool, err string)
 	Close(span log.TraceSpan, Sessionid string) (result interface{}, err string) //主动关闭连接
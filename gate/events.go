@@ -0,0 +1,41 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gate
+
+// 网关连接事件的topic, 通过 module.App.EventBus 订阅, 例如 gate.session.*
+const (
+	TopicSessionConnect    = "gate.session.connect"
+	TopicSessionDisconnect = "gate.session.disconnect"
+)
+
+// SessionConnectEvent 连接建立并且MQTT协议握手成功
+type SessionConnectEvent struct {
+	Session Session
+}
+
+// Topic TopicSessionConnect
+func (e SessionConnectEvent) Topic() string {
+	return TopicSessionConnect
+}
+
+// SessionDisconnectEvent 连接关闭
+type SessionDisconnectEvent struct {
+	Session Session
+}
+
+// Topic TopicSessionDisconnect
+func (e SessionDisconnectEvent) Topic() string {
+	return TopicSessionDisconnect
+}
@@ -41,6 +41,10 @@ type Options struct {
 	SessionLearner  SessionLearner
 	GateHandler     GateHandler
 	SendMessageHook SendMessageHook
+	SessionStore    SessionStore
+	PublishWill     bool   //连接异常断开时把遗嘱消息发布给网关上的订阅者
+	WillModule      string //连接异常断开时通过RPC通知的模块类型
+	WillMethod      string //WillModule中处理遗嘱消息的方法
 	Opts            []server.Option
 }
 
@@ -54,6 +58,7 @@ func NewOptions(opts ...Option) Options {
 		Heartbeat:       time.Minute,
 		OverTime:        time.Second * 10,
 		TLS:             false,
+		PublishWill:     true,
 	}
 
 	for _, o := range opts {
@@ -112,6 +117,29 @@ func SetStorageHandler(s StorageHandler) Option {
 	}
 }
 
+//SetSessionStore 设置持久会话的存储,设置后支持CleanSession=false的客户端
+func SetSessionStore(s SessionStore) Option {
+	return func(o *Options) {
+		o.SessionStore = s
+	}
+}
+
+//PublishWill 连接异常断开时是否把遗嘱消息发布给网关上订阅了匹配topic的客户端,默认true
+func PublishWill(s bool) Option {
+	return func(o *Options) {
+		o.PublishWill = s
+	}
+}
+
+//SetWillHandler 连接异常断开时通过RPC调用moduleType模块的method处理遗嘱消息
+//method的参数为 (session gate.Session, topic string, msg []byte, qos int32, retain bool)
+func SetWillHandler(moduleType, method string) Option {
+	return func(o *Options) {
+		o.WillModule = moduleType
+		o.WillMethod = method
+	}
+}
+
 //SetAgentLearner SetAgentLearner(不要使用,建议用SetSessionLearner)
 func SetAgentLearner(s AgentLearner) Option {
 	return func(o *Options) {
@@ -0,0 +1,72 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gate
+
+import (
+	"math"
+	"time"
+)
+
+// NeverExpire 会话不过期, MQTT 3.1.1 CleanSession=false 的会话
+const NeverExpire = math.MaxUint32
+
+// Subscription 客户端的订阅
+type Subscription struct {
+	Topic string
+	Qos   byte
+}
+
+// OfflineMessage 客户端离线时没有送达的消息
+type OfflineMessage struct {
+	Topic string
+	Body  []byte
+	Qos   byte
+}
+
+// PersistentSession 持久会话(CleanSession=false 或 MQTT 5.0 Session Expiry Interval>0)的状态
+type PersistentSession struct {
+	ClientID      string
+	SessionID     string         //重连后继续使用,其他模块保存的Session仍然可以发送消息
+	ServerID      string         //客户端当前连接的网关,离线时为空
+	ConnectionID  string         //当前连接的标识,旧连接断开时不会覆盖新连接的状态
+	Session       []byte         //gate.Session 序列化后的数据,包括绑定的Userid和Settings
+	Subscriptions []Subscription //客户端的订阅
+	Expiry        uint32         //离线后会话保留的时间(秒)
+	OfflineAt     time.Time      //离线的时间
+}
+
+// Expired 离线超过Expiry的会话已经过期
+func (s *PersistentSession) Expired(now time.Time) bool {
+	if s.ServerID != "" || s.Expiry == NeverExpire {
+		return false
+	}
+	return now.Sub(s.OfflineAt) >= time.Duration(s.Expiry)*time.Second
+}
+
+// SessionStore 持久会话的存储,多个网关节点使用同一个存储时客户端可以重连到任意节点
+type SessionStore interface {
+	// Load 读取clientID的会话,不存在时返回nil
+	Load(clientID string) (*PersistentSession, error)
+	// ClientID 查找SessionID对应的clientID,不存在时返回空字符串
+	ClientID(sessionID string) (string, error)
+	// Save 保存会话,不包括离线消息
+	Save(session *PersistentSession) error
+	// Delete 删除会话和离线消息
+	Delete(clientID string) error
+	// Enqueue 在离线消息队列末尾添加消息
+	Enqueue(clientID string, msgs ...OfflineMessage) error
+	// Drain 取出并清空离线消息
+	Drain(clientID string) ([]OfflineMessage, error)
+}
@@ -81,6 +81,7 @@ func (mer *ModuleManager) Init(app module.App, ProcessID string) {
 		if app.GetModuleInited() != nil {
 			app.GetModuleInited()(app, m.mi)
 		}
+		app.EventBus().Publish(module.ModuleInitedEvent{Module: m.mi})
 
 		m.wg.Add(1)
 		go run(m)
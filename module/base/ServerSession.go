@@ -84,6 +84,13 @@ func (c *serverSession) Call(ctx context.Context, _func string, params ...interf
 	return c.rpc.Call(ctx, _func, params...)
 }
 
+/**
+消息请求 需要回复,返回的错误为 *mqrpc.Error
+*/
+func (c *serverSession) CallWithError(ctx context.Context, _func string, params ...interface{}) (interface{}, error) {
+	return c.rpc.CallWithError(ctx, _func, params...)
+}
+
 /**
 消息请求 不需要回复
 */
@@ -104,3 +111,10 @@ func (c *serverSession) CallArgs(ctx context.Context, _func string, ArgsType []s
 func (c *serverSession) CallNRArgs(_func string, ArgsType []string, args [][]byte) (err error) {
 	return c.rpc.CallNRArgs(_func, ArgsType, args)
 }
+
+/**
+流式请求
+*/
+func (c *serverSession) Stream(ctx context.Context, _func string, params ...interface{}) (mqrpc.Stream, error) {
+	return c.rpc.Stream(ctx, _func, params...)
+}
@@ -18,6 +18,7 @@ package basemodule
 import (
 	"context"
 	"fmt"
+	"github.com/liangdas/mqant/broker"
 	"github.com/liangdas/mqant/conf"
 	"github.com/liangdas/mqant/log"
 	"github.com/liangdas/mqant/module"
@@ -27,8 +28,8 @@ import (
 	"github.com/liangdas/mqant/server"
 	"github.com/liangdas/mqant/service"
 	"github.com/liangdas/mqant/utils"
-	"github.com/pkg/errors"
 	"os"
+	"sync"
 )
 
 // BaseModule 默认的RPCModule实现
@@ -41,6 +42,8 @@ type BaseModule struct {
 	settings       *conf.ModuleSettings
 	service        service.Service
 	listener       mqrpc.RPCListener
+	subscribeLock  sync.Mutex
+	subscribers    []broker.Subscriber
 }
 
 // GetServerId GetServerId
@@ -155,6 +158,15 @@ func (m *BaseModule) OnInit(subclass module.RPCModule, app module.App, settings
 
 // OnDestroy 当模块注销时调用
 func (m *BaseModule) OnDestroy() {
+	//先取消订阅,未确认的消息会投递给其他节点
+	m.subscribeLock.Lock()
+	for _, sub := range m.subscribers {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Warning("unsubscribe %v/%v error %v", sub.Topic(), sub.Group(), err)
+		}
+	}
+	m.subscribers = nil
+	m.subscribeLock.Unlock()
 	//注销模块
 	//一定别忘了关闭RPC
 	m.exit()
@@ -165,6 +177,11 @@ func (m *BaseModule) OnDestroy() {
 	_ = m.GetServer().OnDestroy()
 }
 
+// Use 添加handler中间件,在OnInit之后调用
+func (m *BaseModule) Use(middlewares ...mqrpc.Middleware) {
+	m.GetServer().Use(middlewares...)
+}
+
 // SetListener  mqrpc.RPCListener
 func (m *BaseModule) SetListener(listener mqrpc.RPCListener) {
 	m.listener = listener
@@ -238,6 +255,43 @@ func (m *BaseModule) Call(ctx context.Context, moduleType, _func string, param m
 	return m.App.Call(ctx, moduleType, _func, param, opts...)
 }
 
+// CallWithError  CallWithError
+func (m *BaseModule) CallWithError(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, error) {
+	return m.App.CallWithError(ctx, moduleType, _func, param, opts...)
+}
+
+// CallAll  CallAll
+func (m *BaseModule) CallAll(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) []mqrpc.NodeResult {
+	return m.App.CallAll(ctx, moduleType, _func, param, opts...)
+}
+
+// CallAny  CallAny
+func (m *BaseModule) CallAny(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) mqrpc.NodeResult {
+	return m.App.CallAny(ctx, moduleType, _func, param, opts...)
+}
+
+// Stream  Stream
+func (m *BaseModule) Stream(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (mqrpc.Stream, error) {
+	return m.App.Stream(ctx, moduleType, _func, param, opts...)
+}
+
+// Publish  发布持久化的异步消息
+func (m *BaseModule) Publish(topic string, msg *broker.Message) error {
+	return m.App.Publish(topic, msg)
+}
+
+// Subscribe  以消费组group订阅topic,模块销毁时自动取消订阅
+func (m *BaseModule) Subscribe(topic, group string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	sub, err := m.App.Subscribe(topic, group, handler, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.subscribeLock.Lock()
+	m.subscribers = append(m.subscribers, sub)
+	m.subscribeLock.Unlock()
+	return sub, nil
+}
+
 // RpcCall  RpcCall
 // Deprecated: 因为命名规范问题函数将废弃,请用Call代替
 func (m *BaseModule) RpcCall(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, string) {
@@ -249,7 +303,7 @@ func (m *BaseModule) NoFoundFunction(fn string) (*mqrpc.FunctionInfo, error) {
 	if m.listener != nil {
 		return m.listener.NoFoundFunction(fn)
 	}
-	return nil, errors.Errorf("Remote function(%s) not found", fn)
+	return nil, mqrpc.NotFound("Remote function(%s) not found", fn)
 }
 
 // BeforeHandle  hander执行前调用
@@ -0,0 +1,65 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import "github.com/liangdas/mqant/conf"
+
+// 应用生命周期事件的topic, 通过 App.EventBus 订阅
+const (
+	TopicConfChanged  = "app.conf.changed"
+	TopicAppStartup   = "app.startup"
+	TopicAppDestroy   = "app.destroy"
+	TopicModuleInited = "module.inited"
+)
+
+// ConfChangedEvent 应用配置加载或变更
+type ConfChangedEvent struct {
+	Settings conf.Config
+}
+
+// Topic TopicConfChanged
+func (e ConfChangedEvent) Topic() string {
+	return TopicConfChanged
+}
+
+// AppStartupEvent 所有模块初始化完成,应用启动
+type AppStartupEvent struct {
+	App App
+}
+
+// Topic TopicAppStartup
+func (e AppStartupEvent) Topic() string {
+	return TopicAppStartup
+}
+
+// AppDestroyEvent 应用开始退出,模块还未销毁
+type AppDestroyEvent struct {
+	App App
+}
+
+// Topic TopicAppDestroy
+func (e AppDestroyEvent) Topic() string {
+	return TopicAppDestroy
+}
+
+// ModuleInitedEvent 模块OnInit完成
+type ModuleInitedEvent struct {
+	Module Module
+}
+
+// Topic TopicModuleInited
+func (e ModuleInitedEvent) Topic() string {
+	return TopicModuleInited
+}
@@ -17,11 +17,12 @@ package module
 
 import (
 	"context"
+	"github.com/liangdas/mqant/broker"
 	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/event"
 	"github.com/liangdas/mqant/registry"
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/selector"
-	"github.com/nats-io/nats.go"
 )
 
 // ProtocolMarshal 数据包装
@@ -42,9 +43,11 @@ type ServerSession interface {
 	GetNode() *registry.Node
 	SetNode(node *registry.Node) (err error)
 	Call(ctx context.Context, _func string, params ...interface{}) (interface{}, string)
+	CallWithError(ctx context.Context, _func string, params ...interface{}) (interface{}, error)
 	CallNR(_func string, params ...interface{}) (err error)
 	CallArgs(ctx context.Context, _func string, ArgsType []string, args [][]byte) (interface{}, string)
 	CallNRArgs(_func string, ArgsType []string, args [][]byte) (err error)
+	Stream(ctx context.Context, _func string, params ...interface{}) (mqrpc.Stream, error)
 }
 
 //App mqant应用定义
@@ -56,7 +59,7 @@ type App interface {
 	OnInit(settings conf.Config) error
 	OnDestroy() error
 	Options() Options
-	Transport() *nats.Conn
+	Transport() mqrpc.Transport
 	Registry() registry.Registry
 	// Deprecated: 因为命名规范问题函数将废弃,请用GetServerByID代替
 	GetServerById(id string) (ServerSession, error)
@@ -79,6 +82,17 @@ type App interface {
 	Invoke(module RPCModule, moduleType string, _func string, params ...interface{}) (interface{}, string)
 	InvokeNR(module RPCModule, moduleType string, _func string, params ...interface{}) error
 	Call(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, string)
+	CallWithError(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, error)
+	CallAll(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) []mqrpc.NodeResult
+	CallAny(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) mqrpc.NodeResult
+	Stream(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (mqrpc.Stream, error)
+
+	// Publish 发布持久化的异步消息,返回时消息已经写入 Options.Broker
+	Publish(topic string, msg *broker.Message) error
+	// Subscribe 以消费组group订阅topic,消息处理完成后必须调用 broker.Event.Ack
+	Subscribe(topic, group string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error)
+	// EventBus 进程内的事件总线, 生命周期事件见 TopicModuleInited 等
+	EventBus() event.Bus
 
 	/**
 	添加一个 自定义参数序列化接口
@@ -145,6 +159,18 @@ type RPCModule interface {
 	//	param 		mqrpc.ParamOption			方法传参
 	//	opts ...selector.SelectOption			服务发现模块过滤，可以用来选择调用哪个服务节点
 	Call(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, string)
+	//	CallWithError 与Call相同,返回的错误为 *mqrpc.Error,可以用 mqrpc.ErrorCode 区分错误类型
+	CallWithError(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (interface{}, error)
+	//	CallAll 并发调用moduleType的所有节点(如清除缓存),返回每个节点的结果
+	CallAll(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) []mqrpc.NodeResult
+	//	CallAny 调用moduleType的节点,返回第一个成功的结果(如查询用户所在的网关)
+	CallAny(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) mqrpc.NodeResult
+	//	Stream 流式RPC调用,参数与Call相同,ctx取消时会通知服务端
+	Stream(ctx context.Context, moduleType, _func string, param mqrpc.ParamOption, opts ...selector.SelectOption) (mqrpc.Stream, error)
+	//	Publish 发布持久化的异步消息
+	Publish(topic string, msg *broker.Message) error
+	//	Subscribe 以消费组group订阅topic,模块销毁时自动取消订阅
+	Subscribe(topic, group string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error)
 	GetModuleSettings() (settings *conf.ModuleSettings)
 	/**
 	filter		 调用者服务类型    moduleType|moduleType@moduleID
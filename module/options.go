@@ -1,8 +1,10 @@
 package module
 
 import (
+	"reflect"
 	"time"
 
+	"github.com/liangdas/mqant/broker"
 	"github.com/liangdas/mqant/registry"
 	mqrpc "github.com/liangdas/mqant/rpc"
 	rpcpb "github.com/liangdas/mqant/rpc/pb"
@@ -16,6 +18,8 @@ type Option func(*Options)
 // Options 应用级别配置项
 type Options struct {
 	Nats        *nats.Conn
+	Transport   mqrpc.Transport
+	Broker      broker.Broker //持久化消息队列,为nil时按BrokerMode创建
 	Version     string
 	Debug       bool
 	Parse       bool //是否由框架解析启动环境变量,默认为true
@@ -31,10 +35,23 @@ type Options struct {
 	RegisterInterval   time.Duration
 	RegisterTTL        time.Duration
 	ClientRPChandler   ClientRPCHandler
+	ClientInterceptors []mqrpc.ClientInterceptor
 	ServerRPCHandler   ServerRPCHandler
+	ServerMiddlewares  []mqrpc.Middleware
 	RpcCompleteHandler RpcCompleteHandler
+	RPCRecorder        RPCRecorder
 	RPCExpired         time.Duration
+	RetryPolicy        mqrpc.RetryPolicy //默认的重试策略,调用时可以用 mqrpc.WithRetry 覆盖
 	RPCMaxCoroutine    int
+	Compression        string                //压缩消息使用的算法 mqrpc.CompressGzip ...,为空时不压缩
+	CompressThreshold  int                   //Args或Result的大小(字节)达到该值时才压缩
+	RPCMaxPayload      int64                 //单条rpc消息的最大字节数,超过时分块发送,为0时使用 mqrpc.PayloadLimiter 的限制
+	RPCChunkMemory     int64                 //等待重组的分块总字节数上限,默认64M
+	RPCChunkTimeout    time.Duration         //分块重组的超时时间,默认为RPCExpired
+	DisableLocalCall   bool                  //调用同一个进程中的模块时也经过传输层
+	LocalPassthrough   map[reflect.Type]bool //本地调用时不经过序列化直接传递的参数与结果类型
+	BrokerMode         string                //broker.ModeFile(默认,只适用于单节点)或 broker.ModeTransport(经Transport访问保存消息的节点)
+	BrokerServer       bool                  //ModeTransport时由本节点在 data/broker 下保存消息,集群中只能有一个节点开启
 	// 自定义日志文件名字
 	// 主要作用方便k8s映射日志不会被冲突，建议使用k8s pod实现
 	LogFileName FileNameHandler
@@ -53,6 +70,12 @@ type ServerRPCHandler func(app App, module Module, callInfo *mqrpc.CallInfo)
 // ServerRPCHandler 服务方RPC监控
 type RpcCompleteHandler func(app App, module Module, callInfo *mqrpc.CallInfo, input []interface{}, out []interface{}, execTime time.Duration)
 
+// RPCRecorder 记录服务方处理的请求与结果,用于线上问题的复现,见 rpcrecord.Recorder
+// 请求与结果都已经解压、重组, Record返回后不能再持有它们
+type RPCRecorder interface {
+	Record(moduleType string, rpcInfo *rpcpb.RPCInfo, result *rpcpb.ResultInfo, execTime time.Duration)
+}
+
 // Version 应用版本
 func Version(v string) Option {
 	return func(o *Options) {
@@ -109,6 +132,13 @@ func Nats(nc *nats.Conn) Option {
 	}
 }
 
+// Transport RPC传输层,未设置时使用Nats连接
+func Transport(t mqrpc.Transport) Option {
+	return func(o *Options) {
+		o.Transport = t
+	}
+}
+
 // Registry sets the registry for the service
 // and the underlying components
 func Registry(r registry.Registry) Option {
@@ -153,6 +183,13 @@ func SetClientRPChandler(t ClientRPCHandler) Option {
 	}
 }
 
+// WithClientInterceptor 添加客户端拦截器,按添加顺序执行,作用于 Call/CallNR/CallArgs/CallNRArgs
+func WithClientInterceptor(interceptors ...mqrpc.ClientInterceptor) Option {
+	return func(o *Options) {
+		o.ClientInterceptors = append(o.ClientInterceptors, interceptors...)
+	}
+}
+
 // SetServerRPCHandler 配置服务方监控器
 func SetServerRPCHandler(t ServerRPCHandler) Option {
 	return func(o *Options) {
@@ -160,6 +197,13 @@ func SetServerRPCHandler(t ServerRPCHandler) Option {
 	}
 }
 
+// WithServerMiddleware 添加所有模块共用的handler中间件,先于模块自己添加的中间件执行
+func WithServerMiddleware(middlewares ...mqrpc.Middleware) Option {
+	return func(o *Options) {
+		o.ServerMiddlewares = append(o.ServerMiddlewares, middlewares...)
+	}
+}
+
 // SetServerRPCCompleteHandler 服务RPC执行结果监控器
 func SetRpcCompleteHandler(t RpcCompleteHandler) Option {
 	return func(o *Options) {
@@ -167,6 +211,13 @@ func SetRpcCompleteHandler(t RpcCompleteHandler) Option {
 	}
 }
 
+// SetRPCRecorder 记录服务方处理的请求与结果
+func SetRPCRecorder(r RPCRecorder) Option {
+	return func(o *Options) {
+		o.RPCRecorder = r
+	}
+}
+
 // Parse mqant框架是否解析环境参数
 func Parse(t bool) Option {
 	return func(o *Options) {
@@ -181,6 +232,64 @@ func RPCExpired(t time.Duration) Option {
 	}
 }
 
+// WithRetryPolicy 默认的RPC重试策略,只对幂等的handler生效
+func WithRetryPolicy(policy mqrpc.RetryPolicy) Option {
+	return func(o *Options) {
+		o.RetryPolicy = policy
+	}
+}
+
+// WithCompression 大小达到threshold字节的Args/Result使用name算法压缩,只有对端能够解压时才会压缩
+func WithCompression(name string, threshold int) Option {
+	return func(o *Options) {
+		o.Compression = name
+		o.CompressThreshold = threshold
+	}
+}
+
+// RPCMaxPayload 单条rpc消息的最大字节数,超过时分块发送
+func RPCMaxPayload(n int64) Option {
+	return func(o *Options) {
+		o.RPCMaxPayload = n
+	}
+}
+
+// RPCChunkLimit 接收分块消息时的内存上限与重组超时时间
+func RPCChunkLimit(memory int64, timeout time.Duration) Option {
+	return func(o *Options) {
+		o.RPCChunkMemory = memory
+		o.RPCChunkTimeout = timeout
+	}
+}
+
+// BrokerMode 持久化消息队列的实现, mode为broker.ModeTransport时server表示是否由本节点保存消息
+func BrokerMode(mode string, server bool) Option {
+	return func(o *Options) {
+		o.BrokerMode = mode
+		o.BrokerServer = server
+	}
+}
+
+// LocalCall 调用同一个进程中的模块时是否直接交给它的RPCServer处理,默认开启
+func LocalCall(enable bool) Option {
+	return func(o *Options) {
+		o.DisableLocalCall = !enable
+	}
+}
+
+// LocalPassthrough 本地调用时这些类型的参数与结果不经过序列化,调用方与handler共享同一个值
+// 只适用于不会被修改的类型,这些调用不会被 RPCRecorder 记录参数
+func LocalPassthrough(samples ...interface{}) Option {
+	return func(o *Options) {
+		if o.LocalPassthrough == nil {
+			o.LocalPassthrough = map[reflect.Type]bool{}
+		}
+		for _, sample := range samples {
+			o.LocalPassthrough[reflect.TypeOf(sample)] = true
+		}
+	}
+}
+
 //单个节点RPC同时并发协程数
 func RPCMaxCoroutine(t int) Option {
 	return func(o *Options) {
@@ -0,0 +1,244 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/utils/uuid"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultChunkMemory 等待重组的分块总字节数上限
+	DefaultChunkMemory = 64 * 1024 * 1024
+	// chunkOverhead 分块消息中除分块数据外的字段(Cid、ChunkId等)预留的字节数
+	chunkOverhead = 1024
+	// maxChunks 一条消息最多的分块数
+	maxChunks = 1 << 16
+	// partSize 每个分块在重组缓存中占用的额外字节数([]byte的切片头)
+	partSize = 24
+)
+
+// maxPayload 单条消息的最大字节数, 0为不限制
+func maxPayload(app module.App) int64 {
+	if n := app.Options().RPCMaxPayload; n > 0 {
+		return n
+	}
+	if l, ok := app.Transport().(mqrpc.PayloadLimiter); ok {
+		return l.MaxPayload()
+	}
+	return 0
+}
+
+// splitChunks 把超过max的消息分块, 不需要分块时返回nil
+func splitChunks(body []byte, max int64) [][]byte {
+	if max <= 0 || int64(len(body)) <= max {
+		return nil
+	}
+	size := int(max - chunkOverhead)
+	if size <= 0 {
+		size = int(max) / 2
+	}
+	if size <= 0 {
+		size = 1
+	}
+	chunks := make([][]byte, 0, (len(body)+size-1)/size)
+	for len(body) > 0 {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		chunks = append(chunks, body[:n])
+		body = body[n:]
+	}
+	return chunks
+}
+
+// publish 发送消息,超过 maxPayload 时分块发送, wrap 把一个分块包装为 RPCInfo/ResultInfo
+func publish(app module.App, subject string, body []byte, wrap func(id string, index, total int32, data []byte) ([]byte, error)) error {
+	chunks := splitChunks(body, maxPayload(app))
+	if chunks == nil {
+		return app.Transport().Publish(subject, body)
+	}
+	id := uuid.Rand().Hex()
+	for i, chunk := range chunks {
+		b, err := wrap(id, int32(i), int32(len(chunks)), chunk)
+		if err != nil {
+			return err
+		}
+		if err := app.Transport().Publish(subject, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkMemory 等待重组的分块总字节数上限,同时也是解压后消息的大小上限
+func chunkMemory(app module.App) int64 {
+	if n := app.Options().RPCChunkMemory; n > 0 {
+		return n
+	}
+	return DefaultChunkMemory
+}
+
+type chunkBuffer struct {
+	parts     [][]byte
+	received  int
+	size      int64 //占用的内存,包括parts
+	chunkSize int   //除最后一块外每个分块的大小
+	timer     *time.Timer
+}
+
+// chunkAssembler 重组分块消息,超过内存上限或超时未收齐的消息会被丢弃
+type chunkAssembler struct {
+	app     module.App
+	mu      sync.Mutex
+	pending map[string]*chunkBuffer
+	dropped map[string]*time.Timer //已丢弃的消息,后续的分块直接忽略
+	size    int64                  //所有等待重组的分块大小
+}
+
+func newChunkAssembler(app module.App) *chunkAssembler {
+	return &chunkAssembler{
+		app:     app,
+		pending: map[string]*chunkBuffer{},
+		dropped: map[string]*time.Timer{},
+	}
+}
+
+func (a *chunkAssembler) memory() int64 {
+	return chunkMemory(a.app)
+}
+
+func (a *chunkAssembler) timeout() time.Duration {
+	if t := a.app.Options().RPCChunkTimeout; t > 0 {
+		return t
+	}
+	if t := a.app.Options().RPCExpired; t > 0 {
+		return t
+	}
+	return 10 * time.Second
+}
+
+// add 收到一个分块,全部收到时返回完整的消息
+// 返回错误时整条消息被丢弃,同一条消息只会返回一次错误
+func (a *chunkAssembler) add(id string, index, total int32, data []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.dropped[id]; ok {
+		return nil, nil
+	}
+	full, err := a.addLocked(id, index, total, data)
+	if err != nil {
+		a.remove(id)
+		a.dropped[id] = time.AfterFunc(a.timeout(), func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			delete(a.dropped, id)
+		})
+	}
+	return full, err
+}
+
+func (a *chunkAssembler) addLocked(id string, index, total int32, data []byte) ([]byte, error) {
+	if total <= 0 || index < 0 || index >= total {
+		return nil, fmt.Errorf("chunk [%s] invalid index %d/%d", id, index, total)
+	}
+	limit := a.memory()
+	if total > maxChunks || int64(total)*partSize > limit {
+		return nil, fmt.Errorf("chunk [%s] too many chunks %d", id, total)
+	}
+	buf, ok := a.pending[id]
+	if ok && int(total) != len(buf.parts) {
+		return nil, fmt.Errorf("chunk [%s] total changed %d != %d", id, total, len(buf.parts))
+	}
+	//按已知的分块大小估算整条消息的大小,每个分块至少1个字节
+	chunkSize := 1
+	if index < total-1 {
+		chunkSize = len(data)
+		if ok && buf.chunkSize > 0 && buf.chunkSize != chunkSize {
+			return nil, fmt.Errorf("chunk [%s] size changed %d != %d", id, chunkSize, buf.chunkSize)
+		}
+	} else if ok && buf.chunkSize > 0 {
+		chunkSize = buf.chunkSize
+	}
+	if size := int64(total-1)*int64(chunkSize) + int64(len(data)); size > limit {
+		return nil, fmt.Errorf("chunk [%s] message size exceeds the limit %d", id, limit)
+	}
+	if !ok {
+		//切片本身也计入内存
+		overhead := int64(total) * partSize
+		if a.size+overhead > limit {
+			return nil, fmt.Errorf("chunk [%s] pending chunks exceed the limit %d", id, limit)
+		}
+		buf = &chunkBuffer{parts: make([][]byte, total), size: overhead}
+		a.size += overhead
+		buf.timer = time.AfterFunc(a.timeout(), func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if a.pending[id] == buf {
+				log.Warning("rpc chunk [%s] timeout, received %d/%d", id, buf.received, len(buf.parts))
+				a.remove(id)
+			}
+		})
+		a.pending[id] = buf
+	}
+	if index < total-1 {
+		buf.chunkSize = len(data)
+	}
+	if buf.parts[index] != nil {
+		//重复的分块
+		return nil, nil
+	}
+	if a.size+int64(len(data)) > limit {
+		return nil, fmt.Errorf("chunk [%s] pending chunks exceed the limit %d", id, limit)
+	}
+	buf.parts[index] = data
+	buf.received++
+	buf.size += int64(len(data))
+	a.size += int64(len(data))
+	if buf.received < len(buf.parts) {
+		return nil, nil
+	}
+	a.remove(id)
+	return bytes.Join(buf.parts, nil), nil
+}
+
+func (a *chunkAssembler) remove(id string) {
+	buf, ok := a.pending[id]
+	if !ok {
+		return
+	}
+	buf.timer.Stop()
+	a.size -= buf.size
+	delete(a.pending, id)
+}
+
+// close 丢弃所有等待重组的消息
+func (a *chunkAssembler) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id := range a.pending {
+		a.remove(id)
+	}
+	for id, timer := range a.dropped {
+		timer.Stop()
+		delete(a.dropped, id)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import (
+	"fmt"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/rpc"
+	"strings"
+)
+
+// acceptCompression 本节点能够解压的算法,随请求发给服务端
+func acceptCompression() string {
+	return strings.Join(mqrpc.CompressorNames(), ",")
+}
+
+// compression 大小为size的数据应该使用的压缩算法,对端不能解压或数据太小时返回""
+func compression(app module.App, accept string, size int) string {
+	name := app.Options().Compression
+	if size < app.Options().CompressThreshold || !mqrpc.AcceptCompression(accept, name) {
+		return ""
+	}
+	return name
+}
+
+func compressArgs(name string, args [][]byte) ([][]byte, error) {
+	c := mqrpc.GetCompressor(name)
+	if c == nil {
+		return nil, fmt.Errorf("compressor [%s] not registered", name)
+	}
+	compressed := make([][]byte, len(args))
+	for i, arg := range args {
+		b, err := c.Compress(arg)
+		if err != nil {
+			return nil, err
+		}
+		compressed[i] = b
+	}
+	return compressed, nil
+}
+
+// decompressArgs 解压, 解压后的总字节数不能超过max
+func decompressArgs(name string, args [][]byte, max int64) ([][]byte, error) {
+	c := mqrpc.GetCompressor(name)
+	if c == nil {
+		return nil, fmt.Errorf("compressor [%s] not registered", name)
+	}
+	raw := make([][]byte, len(args))
+	remaining := max
+	for i, arg := range args {
+		if max > 0 && remaining <= 0 {
+			return nil, mqrpc.ErrDecompressSize
+		}
+		b, err := c.Decompress(arg, remaining)
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = b
+		remaining -= int64(len(b))
+	}
+	return raw, nil
+}
+
+func argsSize(args [][]byte) int {
+	size := 0
+	for _, arg := range args {
+		size += len(arg)
+	}
+	return size
+}
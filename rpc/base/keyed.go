@@ -0,0 +1,63 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import "sync"
+
+// keyedExecutor 相同key的任务按提交顺序在同一个协程中依次执行,不同key的任务并发执行
+// 每个key的协程在队列为空时退出
+type keyedExecutor struct {
+	mu     sync.Mutex
+	queues map[string][]func()
+}
+
+func (e *keyedExecutor) submit(key string, task func()) {
+	e.mu.Lock()
+	if e.queues == nil {
+		e.queues = map[string][]func(){}
+	}
+	if q, ok := e.queues[key]; ok {
+		e.queues[key] = append(q, task)
+		e.mu.Unlock()
+		return
+	}
+	e.queues[key] = nil
+	e.mu.Unlock()
+	go e.run(key, task)
+}
+
+// busy key是否有正在执行或排队的任务
+func (e *keyedExecutor) busy(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.queues[key]
+	return ok
+}
+
+func (e *keyedExecutor) run(key string, task func()) {
+	for task != nil {
+		task()
+		e.mu.Lock()
+		q := e.queues[key]
+		if len(q) == 0 {
+			delete(e.queues, key)
+			task = nil
+		} else {
+			task = q[0]
+			q[0] = nil
+			e.queues[key] = q[1:]
+		}
+		e.mu.Unlock()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/pb"
+)
+
+// LocalPendingLimit 每个RPCServer最多缓存的未处理本地请求数
+var LocalPendingLimit = 65536
+
+// localServers 当前进程中的RPCServer, 服务地址 -> *RPCServer
+var localServers sync.Map
+
+// localArgsKey 不经过序列化直接传递的参数, CallInfo.Props[localArgsKey] 为 []interface{}
+const localArgsKey = "local_args"
+
+func registerLocal(addr string, s *RPCServer) {
+	localServers.Store(addr, s)
+}
+
+func unregisterLocal(addr string, s *RPCServer) {
+	if v, ok := localServers.Load(addr); ok && v == s {
+		localServers.Delete(addr)
+	}
+}
+
+// lookupLocal 查找同一个进程中的服务节点,未开启本地调用或服务节点不在当前进程时返回nil
+func lookupLocal(app module.App, addr string) *RPCServer {
+	if app.Options().DisableLocalCall {
+		return nil
+	}
+	if v, ok := localServers.Load(addr); ok {
+		if s := v.(*RPCServer); s.app == app {
+			return s
+		}
+	}
+	return nil
+}
+
+// localAgent 本地调用的应答直接投递给调用方
+type localAgent struct {
+	callback chan *rpcpb.ResultInfo
+	result   interface{} //不经过序列化的结果
+}
+
+func (a *localAgent) Callback(callInfo *mqrpc.CallInfo) (err error) {
+	if a.callback == nil {
+		return nil
+	}
+	defer func() {
+		if recover() != nil {
+			//调用方已经超时并关闭了callback
+			err = fmt.Errorf("local callback closed")
+		}
+	}()
+	select {
+	case a.callback <- callInfo.Result:
+	default:
+	}
+	return nil
+}
+
+// streamAgent 本地流式调用的应答直接投递给客户端的流
+type streamAgent struct {
+	stream *rpcStream
+}
+
+func (a *streamAgent) Callback(callInfo *mqrpc.CallInfo) error {
+	resultInfo := callInfo.Result
+	if resultInfo == nil || resultInfo.StreamType == mqrpc.StreamNone {
+		return nil
+	}
+	a.stream.onChunk(&streamChunk{
+		typ:      resultInfo.StreamType,
+		seq:      resultInfo.Seq,
+		credit:   resultInfo.Credit,
+		argsType: resultInfo.ResultType,
+		data:     resultInfo.Result,
+		err:      mqrpc.ResultError(resultInfo),
+	})
+	return nil
+}
+
+// passthrough 参数是否都是 module.LocalPassthrough 中的类型
+func passthrough(app module.App, params []interface{}) bool {
+	types := app.Options().LocalPassthrough
+	if len(types) == 0 {
+		return false
+	}
+	for _, param := range params {
+		if param == nil || !types[reflect.TypeOf(param)] {
+			return false
+		}
+	}
+	return true
+}
+
+// localQueue 本地请求在独立的协程中按到达顺序分发,与传输层订阅的投递方式一致
+type localQueue struct {
+	pending chan func()
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newLocalQueue() *localQueue {
+	q := &localQueue{
+		pending: make(chan func(), LocalPendingLimit),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *localQueue) push(f func()) error {
+	select {
+	case <-q.done:
+		return fmt.Errorf("local server closed")
+	case q.pending <- f:
+		return nil
+	default:
+		return fmt.Errorf("local server queue is full")
+	}
+}
+
+func (q *localQueue) run() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case f := <-q.pending:
+			q.call(f)
+		}
+	}
+}
+
+func (q *localQueue) call(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 1024)
+			l := runtime.Stack(buf, false)
+			log.Error("rpc local call %v\n ----Stack----\n%s", r, string(buf[:l]))
+		}
+	}()
+	f()
+}
+
+func (q *localQueue) close() {
+	q.once.Do(func() {
+		close(q.done)
+	})
+}
+
+// callLocal 把请求交给本进程中的服务节点处理, agent为nil时不需要回复
+func (s *RPCServer) callLocal(callInfo *mqrpc.CallInfo, agent mqrpc.MQServer) error {
+	if agent == nil {
+		agent = &localAgent{}
+	}
+	callInfo.Agent = agent
+	if callInfo.RPCInfo.StreamType > mqrpc.StreamOpen {
+		//取消请求等控制消息不需要排队
+		s.onStreamMessage(callInfo.RPCInfo)
+		return nil
+	}
+	return s.local.push(func() {
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+		s.Call(callInfo)
+	})
+}
+
+// streamLocal 本地流的后续消息与打开流的请求经过同一个队列,保证服务端已经登记了这个流
+func (s *RPCServer) streamLocal(rpcInfo *rpcpb.RPCInfo) error {
+	return s.local.push(func() {
+		s.onStreamMessage(rpcInfo)
+	})
+}
+
+// localArgs 本地调用时不经过序列化的参数
+func localArgs(callInfo *mqrpc.CallInfo) []interface{} {
+	if callInfo.Props == nil {
+		return nil
+	}
+	args, _ := callInfo.Props[localArgsKey].([]interface{})
+	return args
+}
@@ -20,11 +20,10 @@ import (
 	"github.com/liangdas/mqant/module"
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/rpc/pb"
+	"github.com/liangdas/mqant/rpc/util"
 	"github.com/liangdas/mqant/utils"
-	"github.com/nats-io/nats.go"
 	"runtime"
 	"sync"
-	"time"
 )
 
 type NatsClient struct {
@@ -33,10 +32,10 @@ type NatsClient struct {
 	cmutex            sync.Mutex //操作callinfos的锁
 	callbackqueueName string
 	app               module.App
-	done              chan error
-	subs              *nats.Subscription
-	isClose           bool
+	subs              mqrpc.Subscription
 	session           module.ServerSession
+	streams           sync.Map //正在进行的流式调用 Cid -> *rpcStream
+	chunks            *chunkAssembler
 }
 
 func NewNatsClient(app module.App, session module.ServerSession) (client *NatsClient, err error) {
@@ -44,10 +43,12 @@ func NewNatsClient(app module.App, session module.ServerSession) (client *NatsCl
 	client.session = session
 	client.app = app
 	client.callinfos = mqanttools.NewBeeMap()
-	client.callbackqueueName = nats.NewInbox()
-	client.done = make(chan error)
-	client.isClose = false
-	go client.on_request_handle()
+	client.chunks = newChunkAssembler(app)
+	client.callbackqueueName = app.Transport().NewInbox()
+	client.subs, err = app.Transport().Subscribe(client.callbackqueueName, client.on_request_handle)
+	if err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
@@ -65,10 +66,15 @@ func (c *NatsClient) CloseFch(fch chan *rpcpb.ResultInfo) {
 	close(fch) // panic if ch is closed
 }
 func (c *NatsClient) Done() (err error) {
-	//关闭amqp链接通道
-	//close(c.send_chan)
-	//c.send_done<-nil
-
+	//注销应答队列
+	if c.subs != nil {
+		err = c.subs.Unsubscribe()
+	}
+	c.streams.Range(func(key, value interface{}) bool {
+		value.(*rpcStream).cancel()
+		return true
+	})
+	c.chunks.close()
 	//清理 callinfos 列表
 	for key, clinetCallInfo := range c.callinfos.Items() {
 		if clinetCallInfo != nil {
@@ -79,8 +85,6 @@ func (c *NatsClient) Done() (err error) {
 		}
 	}
 	c.callinfos = nil
-	c.done <- nil
-	c.isClose = true
 	return
 }
 
@@ -105,7 +109,27 @@ func (c *NatsClient) Call(callInfo *mqrpc.CallInfo, callback chan *rpcpb.ResultI
 	if err != nil {
 		return err
 	}
-	return c.app.Transport().Publish(c.session.GetNode().Address, body)
+	return c.publish(callInfo.RPCInfo, body)
+}
+
+/**
+打开一个流,服务端的应答按Cid投递给stream
+*/
+func (c *NatsClient) Stream(callInfo *mqrpc.CallInfo, stream *rpcStream) error {
+	if c.callinfos == nil {
+		return fmt.Errorf("AMQPClient is closed")
+	}
+	callInfo.RPCInfo.ReplyTo = c.callbackqueueName
+	c.streams.Store(callInfo.RPCInfo.Cid, stream)
+	err := c.CallNR(callInfo)
+	if err != nil {
+		c.streams.Delete(callInfo.RPCInfo.Cid)
+	}
+	return err
+}
+
+func (c *NatsClient) DeleteStream(key string) {
+	c.streams.Delete(key)
 }
 
 /**
@@ -116,13 +140,27 @@ func (c *NatsClient) CallNR(callInfo *mqrpc.CallInfo) error {
 	if err != nil {
 		return err
 	}
-	return c.app.Transport().Publish(c.session.GetNode().Address, body)
+	return c.publish(callInfo.RPCInfo, body)
+}
+
+// publish 发送请求,超过最大消息大小时分块发送
+func (c *NatsClient) publish(rpcInfo *rpcpb.RPCInfo, body []byte) error {
+	return publish(c.app, c.session.GetNode().Address, body, func(id string, index, total int32, data []byte) ([]byte, error) {
+		return proto.Marshal(&rpcpb.RPCInfo{
+			Cid:        rpcInfo.Cid,
+			ReplyTo:    rpcInfo.ReplyTo,
+			ChunkId:    id,
+			ChunkIndex: index,
+			ChunkTotal: total,
+			ChunkData:  data,
+		})
+	})
 }
 
 /**
 接收应答信息
 */
-func (c *NatsClient) on_request_handle() (err error) {
+func (c *NatsClient) on_request_handle(data []byte) {
 	defer func() {
 		if r := recover(); r != nil {
 			var rn = ""
@@ -137,68 +175,56 @@ func (c *NatsClient) on_request_handle() (err error) {
 			l := runtime.Stack(buf, false)
 			errstr := string(buf[:l])
 			log.Error("%s\n ----Stack----\n%s", rn, errstr)
-			fmt.Println(errstr)
 		}
 	}()
-	c.subs, err = c.app.Transport().SubscribeSync(c.callbackqueueName)
+	resultInfo, err := c.UnmarshalResult(data)
 	if err != nil {
-		return err
+		log.Error("Unmarshal faild", err)
+		return
 	}
-
-	go func() {
-		<-c.done
-		c.subs.Unsubscribe()
-	}()
-
-	for !c.isClose {
-		m, err := c.subs.NextMsg(time.Minute)
-		if err != nil && err == nats.ErrTimeout {
-			//fmt.Println(err.Error())
-			//log.Warning("NatsServer error with '%v'",err)
-			if !c.subs.IsValid() {
-				//订阅已关闭，需要重新订阅
-				c.subs, err = c.app.Transport().SubscribeSync(c.callbackqueueName)
-				if err != nil {
-					log.Error("NatsClient SubscribeSync[1] error with '%v'", err)
-					continue
-				}
-			}
-			continue
-		} else if err != nil {
-			fmt.Println(fmt.Sprintf("%v rpcclient error: %v", time.Now().String(), err.Error()))
-			log.Error("NatsClient error with '%v'", err)
-			if !c.subs.IsValid() {
-				//订阅已关闭，需要重新订阅
-				c.subs, err = c.app.Transport().SubscribeSync(c.callbackqueueName)
-				if err != nil {
-					log.Error("NatsClient SubscribeSync[2] error with '%v'", err)
-					continue
-				}
-			}
-			continue
-		}
-
-		resultInfo, err := c.UnmarshalResult(m.Data)
+	if resultInfo.ChunkTotal > 0 {
+		full, err := c.chunks.add(resultInfo.ChunkId, resultInfo.ChunkIndex, resultInfo.ChunkTotal, resultInfo.ChunkData)
 		if err != nil {
+			log.Warning("rpc result %v", err)
+			//无法重组时直接通知调用方
+			resultInfo = rpcpb.NewResultInfo(resultInfo.Cid, "", argsutil.NULL, nil)
+			mqrpc.SetResultError(resultInfo, mqrpc.Unavailable("%v", err))
+		} else if full == nil {
+			return
+		} else if resultInfo, err = c.UnmarshalResult(full); err != nil {
 			log.Error("Unmarshal faild", err)
-		} else {
-			correlation_id := resultInfo.Cid
-			clinetCallInfo := c.callinfos.Get(correlation_id)
-			//删除
-			c.callinfos.Delete(correlation_id)
-			if clinetCallInfo != nil {
-				if clinetCallInfo.(ClinetCallInfo).call != nil {
-					clinetCallInfo.(ClinetCallInfo).call <- resultInfo
-					c.CloseFch(clinetCallInfo.(ClinetCallInfo).call)
-				}
-			} else {
-				//可能客户端已超时了，但服务端处理完还给回调了
-				log.Warning("rpc callback no found : [%s]", correlation_id)
-			}
+			return
 		}
 	}
-
-	return nil
+	correlation_id := resultInfo.Cid
+	if resultInfo.StreamType != mqrpc.StreamNone {
+		stream, ok := c.streams.Load(correlation_id)
+		if !ok {
+			//流已经结束或被取消
+			return
+		}
+		stream.(*rpcStream).onChunk(&streamChunk{
+			typ:      resultInfo.StreamType,
+			seq:      resultInfo.Seq,
+			credit:   resultInfo.Credit,
+			argsType: resultInfo.ResultType,
+			data:     resultInfo.Result,
+			err:      mqrpc.ResultError(resultInfo),
+		})
+		return
+	}
+	clinetCallInfo := c.callinfos.Get(correlation_id)
+	//删除
+	c.callinfos.Delete(correlation_id)
+	if clinetCallInfo != nil {
+		if clinetCallInfo.(ClinetCallInfo).call != nil {
+			clinetCallInfo.(ClinetCallInfo).call <- resultInfo
+			c.CloseFch(clinetCallInfo.(ClinetCallInfo).call)
+		}
+	} else {
+		//可能客户端已超时了，但服务端处理完还给回调了
+		log.Warning("rpc callback no found : [%s]", correlation_id)
+	}
 }
 
 func (c *NatsClient) UnmarshalResult(data []byte) (*rpcpb.ResultInfo, error) {
@@ -208,9 +234,15 @@ func (c *NatsClient) UnmarshalResult(data []byte) (*rpcpb.ResultInfo, error) {
 	err := proto.Unmarshal(data, &resultInfo)
 	if err != nil {
 		return nil, err
-	} else {
-		return &resultInfo, err
 	}
+	if resultInfo.Compression != "" {
+		result, err := decompressArgs(resultInfo.Compression, [][]byte{resultInfo.Result}, chunkMemory(c.app))
+		if err != nil {
+			return nil, err
+		}
+		resultInfo.Result, resultInfo.Compression = result[0], ""
+	}
+	return &resultInfo, nil
 }
 
 func (c *NatsClient) Unmarshal(data []byte) (*rpcpb.RPCInfo, error) {
@@ -223,13 +255,25 @@ func (c *NatsClient) Unmarshal(data []byte) (*rpcpb.RPCInfo, error) {
 	} else {
 		return &rpcInfo, err
 	}
-
-	panic("bug")
 }
 
 // goroutine safe
+// 设置rpcInfo.AcceptCompression为本节点能够解压的算法
+// 服务端能够解压并且Args达到 Options.CompressThreshold 时压缩Args, 序列化后rpcInfo的Args恢复为压缩前的数据
 func (c *NatsClient) Marshal(rpcInfo *rpcpb.RPCInfo) ([]byte, error) {
 	//map2:= structs.Map(callInfo)
+	rpcInfo.AcceptCompression = acceptCompression()
+	name := compression(c.app, c.session.GetNode().Metadata[mqrpc.CompressionsMetadataKey], argsSize(rpcInfo.Args))
+	if name == "" || len(rpcInfo.Args) == 0 {
+		return proto.Marshal(rpcInfo)
+	}
+	args, err := compressArgs(name, rpcInfo.Args)
+	if err != nil {
+		return nil, err
+	}
+	raw := rpcInfo.Args
+	rpcInfo.Args, rpcInfo.Compression = args, name
 	b, err := proto.Marshal(rpcInfo)
+	rpcInfo.Args, rpcInfo.Compression = raw, ""
 	return b, err
 }
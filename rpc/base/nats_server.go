@@ -14,100 +14,84 @@
 package defaultrpc
 
 import (
-	"fmt"
 	"google.golang.org/protobuf/proto"
 	"github.com/liangdas/mqant/log"
 	"github.com/liangdas/mqant/module"
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/rpc/pb"
-	"github.com/nats-io/nats.go"
+	"github.com/liangdas/mqant/rpc/util"
 	"runtime"
-	"strings"
-	"time"
 )
 
 type NatsServer struct {
-	call_chan chan mqrpc.CallInfo
-	addr      string
-	app       module.App
-	server    *RPCServer
-	done      chan bool
-	stopeds   chan bool
-	subs      *nats.Subscription
-	isClose   bool
-}
-
-func setAddrs(addrs []string) []string {
-	var cAddrs []string
-	for _, addr := range addrs {
-		if len(addr) == 0 {
-			continue
-		}
-		if !strings.HasPrefix(addr, "nats://") {
-			addr = "nats://" + addr
-		}
-		cAddrs = append(cAddrs, addr)
-	}
-	if len(cAddrs) == 0 {
-		cAddrs = []string{nats.DefaultURL}
-	}
-	return cAddrs
+	addr    string
+	app     module.App
+	server  *RPCServer
+	subs    mqrpc.Subscription
+	isClose bool
+	chunks  *chunkAssembler
 }
 
 func NewNatsServer(app module.App, s *RPCServer) (*NatsServer, error) {
 	server := new(NatsServer)
 	server.server = s
-	server.done = make(chan bool)
-	server.stopeds = make(chan bool)
 	server.isClose = false
 	server.app = app
-	server.addr = nats.NewInbox()
-	go func() {
-		server.on_request_handle()
-		safeClose(server.stopeds)
-	}()
+	server.chunks = newChunkAssembler(app)
+	server.addr = app.Transport().NewInbox()
+	subs, err := app.Transport().Subscribe(server.addr, server.on_request_handle)
+	if err != nil {
+		return nil, err
+	}
+	server.subs = subs
 	return server, nil
 }
 func (s *NatsServer) Addr() string {
 	return s.addr
 }
 
-func safeClose(ch chan bool) {
-	defer func() {
-		if recover() != nil {
-			// close(ch) panic occur
-		}
-	}()
-
-	close(ch) // panic if ch is closed
-}
-
 /**
 注销消息队列
 */
 func (s *NatsServer) Shutdown() (err error) {
-	safeClose(s.done)
-	s.isClose = true
-	select {
-	case <-s.stopeds:
-		//等待nats注销完成
+	if s.isClose {
+		return
 	}
-	return
+	s.isClose = true
+	s.chunks.close()
+	return s.subs.Unsubscribe()
 }
 
 func (s *NatsServer) Callback(callinfo *mqrpc.CallInfo) error {
-	body, err := s.MarshalResult(callinfo.Result)
+	var accept string
+	if callinfo.RPCInfo != nil {
+		accept = callinfo.RPCInfo.AcceptCompression
+	}
+	body, err := s.marshalResult(callinfo.Result, accept)
 	if err != nil {
 		return err
 	}
 	reply_to := callinfo.Props["reply_to"].(string)
-	return s.app.Transport().Publish(reply_to, body)
+	return s.publish(reply_to, callinfo.Result.Cid, body)
+}
+
+// publish 发送应答,超过最大消息大小时分块发送
+func (s *NatsServer) publish(replyTo, cid string, body []byte) error {
+	return publish(s.app, replyTo, body, func(id string, index, total int32, data []byte) ([]byte, error) {
+		return proto.Marshal(&rpcpb.ResultInfo{
+			Cid:        cid,
+			ChunkId:    id,
+			ChunkIndex: index,
+			ChunkTotal: total,
+			ChunkData:  data,
+		})
+	})
 }
 
 /**
 接收请求信息
 */
-func (s *NatsServer) on_request_handle() (err error) {
+func (s *NatsServer) on_request_handle(data []byte) {
 	defer func() {
 		if r := recover(); r != nil {
 			var rn = ""
@@ -122,66 +106,61 @@ func (s *NatsServer) on_request_handle() (err error) {
 			l := runtime.Stack(buf, false)
 			errstr := string(buf[:l])
 			log.Error("%s\n ----Stack----\n%s", rn, errstr)
-			fmt.Println(errstr)
 		}
 	}()
-	s.subs, err = s.app.Transport().SubscribeSync(s.addr)
+	rpcInfo, err := s.Unmarshal(data)
 	if err != nil {
-		return err
+		log.Error("NatsServer Unmarshal error with '%v'", err)
+		return
 	}
-
-	go func() {
-		select {
-		case <-s.done:
-			//服务关闭
+	if rpcInfo.ChunkTotal > 0 {
+		full, err := s.chunks.add(rpcInfo.ChunkId, rpcInfo.ChunkIndex, rpcInfo.ChunkTotal, rpcInfo.ChunkData)
+		if err != nil {
+			log.Warning("NatsServer %v", err)
+			s.replyError(rpcInfo, mqrpc.Unavailable("%v", err))
+			return
 		}
-		s.subs.Unsubscribe()
-	}()
-
-	for !s.isClose {
-		m, err := s.subs.NextMsg(time.Minute)
-		if err != nil && err == nats.ErrTimeout {
-			//fmt.Println(err.Error())
-			//log.Warning("NatsServer error with '%v'",err)
-			if !s.subs.IsValid() {
-				//订阅已关闭，需要重新订阅
-				s.subs, err = s.app.Transport().SubscribeSync(s.addr)
-				if err != nil {
-					log.Error("NatsServer SubscribeSync[1] error with '%v'", err)
-					continue
-				}
-			}
-			continue
-		} else if err != nil {
-			log.Warning("NatsServer error with '%v'", err)
-			if !s.subs.IsValid() {
-				//订阅已关闭，需要重新订阅
-				s.subs, err = s.app.Transport().SubscribeSync(s.addr)
-				if err != nil {
-					log.Error("NatsServer SubscribeSync[2] error with '%v'", err)
-					continue
-				}
-			}
-			continue
+		if full == nil {
+			return
+		}
+		if rpcInfo, err = s.Unmarshal(full); err != nil {
+			log.Error("NatsServer Unmarshal error with '%v'", err)
+			return
 		}
+	}
+	if rpcInfo.StreamType > mqrpc.StreamOpen {
+		//已经打开的流的后续消息
+		s.server.onStreamMessage(rpcInfo)
+		return
+	}
+	callInfo := &mqrpc.CallInfo{
+		RPCInfo: rpcInfo,
+	}
+	callInfo.Props = map[string]interface{}{
+		"reply_to": rpcInfo.ReplyTo,
+	}
 
-		rpcInfo, err := s.Unmarshal(m.Data)
-		if err == nil {
-			callInfo := &mqrpc.CallInfo{
-				RPCInfo: rpcInfo,
-			}
-			callInfo.Props = map[string]interface{}{
-				"reply_to": rpcInfo.ReplyTo,
-			}
+	callInfo.Agent = s //设置代理为NatsServer
 
-			callInfo.Agent = s //设置代理为NatsServer
+	s.server.dispatchMu.Lock()
+	defer s.server.dispatchMu.Unlock()
+	s.server.Call(callInfo)
+}
 
-			s.server.Call(callInfo)
-		} else {
-			fmt.Println("error ", err)
-		}
+// replyError 请求无法处理时直接应答错误
+func (s *NatsServer) replyError(rpcInfo *rpcpb.RPCInfo, err error) {
+	if rpcInfo.ReplyTo == "" {
+		return
+	}
+	resultInfo := rpcpb.NewResultInfo(rpcInfo.Cid, "", argsutil.NULL, nil)
+	mqrpc.SetResultError(resultInfo, err)
+	body, err := s.MarshalResult(resultInfo)
+	if err == nil {
+		err = s.app.Transport().Publish(rpcInfo.ReplyTo, body)
+	}
+	if err != nil {
+		log.Warning("NatsServer reply error %v", err)
 	}
-	return nil
 }
 
 func (s *NatsServer) Unmarshal(data []byte) (*rpcpb.RPCInfo, error) {
@@ -191,11 +170,15 @@ func (s *NatsServer) Unmarshal(data []byte) (*rpcpb.RPCInfo, error) {
 	err := proto.Unmarshal(data, &rpcInfo)
 	if err != nil {
 		return nil, err
-	} else {
-		return &rpcInfo, err
 	}
-
-	panic("bug")
+	if rpcInfo.Compression != "" {
+		rpcInfo.Args, err = decompressArgs(rpcInfo.Compression, rpcInfo.Args, chunkMemory(s.app))
+		if err != nil {
+			return nil, err
+		}
+		rpcInfo.Compression = ""
+	}
+	return &rpcInfo, nil
 }
 
 // goroutine safe
@@ -204,3 +187,20 @@ func (s *NatsServer) MarshalResult(resultInfo *rpcpb.ResultInfo) ([]byte, error)
 	b, err := proto.Marshal(resultInfo)
 	return b, err
 }
+
+// marshalResult 调用方能够解压并且Result达到 Options.CompressThreshold 时压缩Result, resultInfo本身不会被修改
+func (s *NatsServer) marshalResult(resultInfo *rpcpb.ResultInfo, accept string) ([]byte, error) {
+	name := compression(s.app, accept, len(resultInfo.Result))
+	if name == "" || len(resultInfo.Result) == 0 {
+		return s.MarshalResult(resultInfo)
+	}
+	result, err := compressArgs(name, [][]byte{resultInfo.Result})
+	if err != nil {
+		return nil, err
+	}
+	raw := resultInfo.Result
+	resultInfo.Result, resultInfo.Compression = result[0], name
+	b, err := s.MarshalResult(resultInfo)
+	resultInfo.Result, resultInfo.Compression = raw, ""
+	return b, err
+}
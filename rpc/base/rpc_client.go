@@ -15,7 +15,6 @@ package defaultrpc
 
 import (
 	"context"
-	"fmt"
 	"github.com/liangdas/mqant/log"
 	"github.com/liangdas/mqant/module"
 	"github.com/liangdas/mqant/rpc"
@@ -30,6 +29,7 @@ import (
 type RPCClient struct {
 	app         module.App
 	nats_client *NatsClient
+	invoker     mqrpc.Invoker //经过客户端拦截器包装后的调用
 }
 
 func NewRPCClient(app module.App, session module.ServerSession) (mqrpc.RPCClient, error) {
@@ -41,6 +41,7 @@ func NewRPCClient(app module.App, session module.ServerSession) (mqrpc.RPCClient
 		return nil, err
 	}
 	rpc_client.nats_client = nats_client
+	rpc_client.invoker = mqrpc.ChainClientInterceptors(app.Options().ClientInterceptors, rpc_client.invoke)
 	return rpc_client, nil
 }
 
@@ -51,63 +52,193 @@ func (c *RPCClient) Done() (err error) {
 	return
 }
 
-func (c *RPCClient) CallArgs(ctx context.Context, _func string, ArgsType []string, args [][]byte) (r interface{}, e string) {
-	caller, _ := os.Hostname()
+func (c *RPCClient) CallArgs(ctx context.Context, _func string, ArgsType []string, args [][]byte) (interface{}, string) {
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), c.app.Options().RPCExpired)
+		defer cancel()
+	}
+	r, err := c.retry(ctx, _func, func(ctx context.Context) (interface{}, error) {
+		inv := c.newInvocation(_func, true)
+		inv.ArgsType = ArgsType
+		inv.Args = args
+		return c.invoker(ctx, inv)
+	})
+	return r, errString(err)
+}
+
+// retry 对幂等的handler按重试策略重新调用当前节点
+func (c *RPCClient) retry(ctx context.Context, _func string, call func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	policy, ok := mqrpc.RetryFromContext(ctx)
+	if !ok {
+		policy = c.app.Options().RetryPolicy
+	}
+	if policy.MaxAttempts <= 1 || !(policy.Force || mqrpc.IsIdempotent(c.nats_client.session.GetNode().Metadata, _func)) {
+		return call(ctx)
+	}
+	return mqrpc.Retry(ctx, policy, func(ctx context.Context, attempt int) (interface{}, error) {
+		if attempt > 0 {
+			log.Warning("rpc Call ServerId = %v Func = %v retry %d", c.nats_client.session.GetID(), _func, attempt)
+		}
+		return call(ctx)
+	})
+}
+
+func (c *RPCClient) newInvocation(_func string, reply bool) *mqrpc.Invocation {
+	return &mqrpc.Invocation{
+		ServerID: c.nats_client.session.GetID(),
+		Service:  c.nats_client.session.GetName(),
+		Method:   _func,
+		Reply:    reply,
+	}
+}
+
+// invoke 拦截器链的最内层,编码参数并发出请求
+func (c *RPCClient) invoke(ctx context.Context, inv *mqrpc.Invocation) (interface{}, error) {
+	codec := c.codec(ctx)
 	if ctx != nil {
-		cr, ok := ctx.Value("caller").(string)
-		if ok {
-			caller = cr
+		//服务端使用相同的编解码器编码结果
+		ctx = mqrpc.WithMetadata(ctx, mqrpc.CodecMetadataKey, codec)
+	}
+	ArgsType, args := inv.ArgsType, inv.Args
+	local := c.local()
+	var input []interface{}
+	if local != nil && args == nil && !inv.Stream && passthrough(c.app, inv.Params) {
+		//本地调用并且参数都是可信的类型,不需要序列化
+		input = inv.Params
+	} else if args == nil && len(inv.Params) > 0 {
+		ArgsType = make([]string, len(inv.Params))
+		args = make([][]byte, len(inv.Params))
+		for k, param := range inv.Params {
+			var err error
+			ArgsType[k], args[k], err = argsutil.ArgsTypeAnd2BytesWithCodec(c.app, codec, param)
+			if err != nil {
+				return nil, mqrpc.Serialization("args[%d] error %s", k, err.Error())
+			}
+		}
+	}
+	if inv.Stream {
+		//流的双方都使用这个编解码器
+		return c.openStream(ctx, local, inv.Method, ArgsType, args, inv.Params)
+	}
+	if !inv.Reply {
+		return nil, c.callNRArgs(ctx, local, inv.Method, ArgsType, args, input)
+	}
+	return c.callArgs(ctx, local, inv.Method, ArgsType, args, input)
+}
+
+// local 服务节点在当前进程中时返回它的RPCServer,请求不再经过传输层
+func (c *RPCClient) local() *RPCServer {
+	return lookupLocal(c.app, c.nats_client.session.GetNode().Address)
+}
+
+// newCallInfo input不为nil时为不经过序列化的参数,只能用于本地调用
+func newCallInfo(rpcInfo *rpcpb.RPCInfo, input []interface{}) *mqrpc.CallInfo {
+	callInfo := &mqrpc.CallInfo{
+		RPCInfo: rpcInfo,
+	}
+	if input != nil {
+		callInfo.Props = map[string]interface{}{
+			localArgsKey: input,
 		}
 	}
+	return callInfo
+}
+
+// codec 本次调用使用的编解码器: ctx中声明的优先,否则按优先级选择服务端支持的编解码器
+func (c *RPCClient) codec(ctx context.Context) string {
+	if name := mqrpc.CodecFromContext(ctx); name != "" {
+		return name
+	}
+	return mqrpc.NegotiateCodec(c.nats_client.session.GetNode().Metadata[mqrpc.CodecsMetadataKey])
+}
+
+// callArgs 发起请求,返回的错误为 *mqrpc.Error, local不为nil时直接交给本进程中的服务节点
+func (c *RPCClient) callArgs(ctx context.Context, local *RPCServer, _func string, ArgsType []string, args [][]byte, input []interface{}) (r interface{}, e error) {
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), c.app.Options().RPCExpired)
+		defer cancel()
+	}
+	caller, _ := os.Hostname()
+	cr, ok := ctx.Value("caller").(string)
+	if ok {
+		caller = cr
+	}
 	start := time.Now()
+	//ctx中的超时时间会传递给服务端
+	expired := start.Add(c.app.Options().RPCExpired)
+	if deadline, ok := ctx.Deadline(); ok {
+		expired = deadline
+	}
+	md, _ := mqrpc.FromContext(ctx)
 	var correlation_id = uuid.Rand().Hex()
 	rpcInfo := &rpcpb.RPCInfo{
 		Fn:       *proto.String(_func),
 		Reply:    *proto.Bool(true),
-		Expired:  *proto.Int64((start.UTC().Add(c.app.Options().RPCExpired).UnixNano()) / 1000000),
+		Expired:  *proto.Int64((expired.UTC().UnixNano()) / 1000000),
 		Cid:      *proto.String(correlation_id),
 		Args:     args,
 		ArgsType: ArgsType,
 		Caller:   *proto.String(caller),
 		Hostname: *proto.String(caller),
+		Headers:  md,
 	}
 	defer func() {
 		//异常日志都应该打印
 		if c.app.Options().ClientRPChandler != nil {
 			exec_time := time.Since(start).Nanoseconds()
-			c.app.Options().ClientRPChandler(c.app, *c.nats_client.session.GetNode(), rpcInfo, r, e, exec_time)
+			c.app.Options().ClientRPChandler(c.app, *c.nats_client.session.GetNode(), rpcInfo, r, errString(e), exec_time)
 		}
 	}()
-	callInfo := &mqrpc.CallInfo{
-		RPCInfo: rpcInfo,
-	}
+	callInfo := newCallInfo(rpcInfo, input)
 	callback := make(chan *rpcpb.ResultInfo, 1)
+	agent := &localAgent{callback: callback}
 	var err error
 	//优先使用本地rpc
-	//if c.local_client != nil {
-	//	err = c.local_client.Call(*callInfo, callback)
-	//} else
-	err = c.nats_client.Call(callInfo, callback)
-	if err != nil {
-		return nil, err.Error()
+	if local != nil {
+		err = local.callLocal(callInfo, agent)
+	} else {
+		err = c.nats_client.Call(callInfo, callback)
 	}
-	if ctx == nil {
-		ctx, _ = context.WithTimeout(context.TODO(), c.app.Options().RPCExpired)
+	if err != nil {
+		return nil, mqrpc.NewError(mqrpc.CodeUnavailable, err.Error())
 	}
 	select {
 	case resultInfo, ok := <-callback:
 		if !ok {
-			return nil, "client closed"
+			return nil, mqrpc.NewError(mqrpc.CodeUnavailable, "client closed")
+		}
+		if agent.result != nil {
+			return agent.result, mqrpc.ResultError(resultInfo)
 		}
 		result, err := argsutil.Bytes2Args(c.app, resultInfo.ResultType, resultInfo.Result)
 		if err != nil {
-			return nil, err.Error()
+			return nil, mqrpc.NewError(mqrpc.CodeSerialization, err.Error())
 		}
-		return result, resultInfo.Error
+		return result, mqrpc.ResultError(resultInfo)
 	case <-ctx.Done():
 		_ = c.nats_client.Delete(rpcInfo.Cid)
 		c.close_callback_chan(callback)
-		return nil, "deadline exceeded"
+		//通知服务端取消handler的ctx
+		cancelInfo := &mqrpc.CallInfo{
+			RPCInfo: &rpcpb.RPCInfo{
+				Fn:         rpcInfo.Fn,
+				Cid:        rpcInfo.Cid,
+				Caller:     rpcInfo.Caller,
+				Hostname:   rpcInfo.Hostname,
+				StreamType: mqrpc.StreamCancel,
+			},
+		}
+		if local != nil {
+			_ = local.callLocal(cancelInfo, nil)
+		} else {
+			_ = c.nats_client.CallNR(cancelInfo)
+		}
+		if ctx.Err() == context.Canceled {
+			return nil, mqrpc.NewError(mqrpc.CodeCanceled, ctx.Err().Error())
+		}
+		return nil, mqrpc.NewError(mqrpc.CodeTimeout, "deadline exceeded")
 		//case <-time.After(time.Second * time.Duration(c.app.GetSettings().rpc.RPCExpired)):
 		//	close(callback)
 		//	c.nats_client.Delete(rpcInfo.Cid)
@@ -124,7 +255,16 @@ func (c *RPCClient) close_callback_chan(ch chan *rpcpb.ResultInfo) {
 	close(ch) // panic if ch is closed
 }
 func (c *RPCClient) CallNRArgs(_func string, ArgsType []string, args [][]byte) (err error) {
+	inv := c.newInvocation(_func, false)
+	inv.ArgsType = ArgsType
+	inv.Args = args
+	_, err = c.invoker(context.Background(), inv)
+	return err
+}
+
+func (c *RPCClient) callNRArgs(ctx context.Context, local *RPCServer, _func string, ArgsType []string, args [][]byte, input []interface{}) (err error) {
 	caller, _ := os.Hostname()
+	md, _ := mqrpc.FromContext(ctx)
 	var correlation_id = uuid.Rand().Hex()
 	rpcInfo := &rpcpb.RPCInfo{
 		Fn:       *proto.String(_func),
@@ -135,14 +275,13 @@ func (c *RPCClient) CallNRArgs(_func string, ArgsType []string, args [][]byte) (
 		ArgsType: ArgsType,
 		Caller:   *proto.String(caller),
 		Hostname: *proto.String(caller),
+		Headers:  md,
 	}
-	callInfo := &mqrpc.CallInfo{
-		RPCInfo: rpcInfo,
-	}
+	callInfo := newCallInfo(rpcInfo, input)
 	//优先使用本地rpc
-	//if c.local_client != nil {
-	//	err = c.local_client.CallNR(*callInfo)
-	//} else
+	if local != nil {
+		return local.callLocal(callInfo, nil)
+	}
 	return c.nats_client.CallNR(callInfo)
 }
 
@@ -150,51 +289,186 @@ func (c *RPCClient) CallNRArgs(_func string, ArgsType []string, args [][]byte) (
 消息请求 需要回复
 */
 func (c *RPCClient) Call(ctx context.Context, _func string, params ...interface{}) (interface{}, string) {
-	var ArgsType []string = make([]string, len(params))
-	var args [][]byte = make([][]byte, len(params))
+	r, err := c.CallWithError(ctx, _func, params...)
+	return r, errString(err)
+}
+
+/**
+消息请求 需要回复,返回的错误为 *mqrpc.Error
+*/
+func (c *RPCClient) CallWithError(ctx context.Context, _func string, params ...interface{}) (interface{}, error) {
 	var span log.TraceSpan = nil
-	for k, param := range params {
-		var err error = nil
-		ArgsType[k], args[k], err = argsutil.ArgsTypeAnd2Bytes(c.app, param)
-		if err != nil {
-			return nil, fmt.Sprintf("args[%d] error %s", k, err.Error())
-		}
+	for _, param := range params {
 		switch v2 := param.(type) { //多选语句switch
 		case log.TraceSpan:
 			//如果参数是这个需要拷贝一份新的再传
 			span = v2
 		}
 	}
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.TODO(), c.app.Options().RPCExpired)
+		defer cancel()
+	}
+	if span == nil {
+		span = mqrpc.SpanFromContext(ctx)
+	} else if mqrpc.SpanFromContext(ctx) == nil {
+		//参数中的链路追踪信息同样随ctx传递
+		ctx = mqrpc.ContextWithSpan(ctx, span)
+	}
 	start := time.Now()
-	r, errstr := c.CallArgs(ctx, _func, ArgsType, args)
+	r, err := c.retry(ctx, _func, func(ctx context.Context) (interface{}, error) {
+		inv := c.newInvocation(_func, true)
+		inv.Params = params
+		return c.invoker(ctx, inv)
+	})
 	if c.app.GetSettings().RPC.Log {
-		log.TInfo(span, "rpc Call ServerId = %v Func = %v Elapsed = %v Result = %v ERROR = %v", c.nats_client.session.GetID(), _func, time.Since(start), r, errstr)
+		log.TInfo(span, "rpc Call ServerId = %v Func = %v Elapsed = %v Result = %v ERROR = %v", c.nats_client.session.GetID(), _func, time.Since(start), r, errString(err))
 	}
-	return r, errstr
+	return r, err
 }
 
 /**
 消息请求 不需要回复
 */
 func (c *RPCClient) CallNR(_func string, params ...interface{}) (err error) {
-	var ArgsType []string = make([]string, len(params))
-	var args [][]byte = make([][]byte, len(params))
 	var span log.TraceSpan = nil
-	for k, param := range params {
-		ArgsType[k], args[k], err = argsutil.ArgsTypeAnd2Bytes(c.app, param)
-		if err != nil {
-			return fmt.Errorf("args[%d] error %s", k, err.Error())
-		}
-
+	for _, param := range params {
 		switch v2 := param.(type) { //多选语句switch
 		case log.TraceSpan:
 			span = v2
 		}
 	}
+	inv := c.newInvocation(_func, false)
+	inv.Params = params
 	start := time.Now()
-	err = c.CallNRArgs(_func, ArgsType, args)
+	_, err = c.invoker(mqrpc.ContextWithSpan(context.Background(), span), inv)
 	if c.app.GetSettings().RPC.Log {
 		log.TInfo(span, "rpc CallNR ServerId = %v Func = %v Elapsed = %v ERROR = %v", c.nats_client.session.GetID(), _func, time.Since(start), err)
 	}
 	return err
 }
+
+/**
+流式请求,ctx取消时会通知服务端取消
+返回的Stream Recv 接收服务端的数据,Send/Close 向服务端发送数据(双向流)
+ctx为nil时流的超时时间为RPCExpired, 与Call相同经过客户端拦截器并优先使用本地rpc
+*/
+func (c *RPCClient) Stream(ctx context.Context, _func string, params ...interface{}) (mqrpc.Stream, error) {
+	cancel := context.CancelFunc(func() {})
+	if ctx == nil {
+		ctx, cancel = context.WithTimeout(context.TODO(), c.app.Options().RPCExpired)
+	}
+	inv := c.newInvocation(_func, true)
+	inv.Stream = true
+	inv.Params = params
+	r, err := c.invoker(ctx, inv)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stream, ok := r.(mqrpc.Stream)
+	if !ok {
+		cancel()
+		return nil, mqrpc.Errorf(mqrpc.CodeInternal, "rpc stream(%s) invoker returned %T", _func, r)
+	}
+	go func() {
+		<-stream.Context().Done()
+		cancel()
+	}()
+	return stream, nil
+}
+
+// openStream 打开一个流, local不为nil时直接交给本进程中的服务节点
+func (c *RPCClient) openStream(ctx context.Context, local *RPCServer, _func string, ArgsType []string, args [][]byte, params []interface{}) (*rpcStream, error) {
+	caller, _ := os.Hostname()
+	if cr, ok := ctx.Value("caller").(string); ok {
+		caller = cr
+	}
+	var expired int64
+	if deadline, ok := ctx.Deadline(); ok {
+		expired = deadline.UTC().UnixNano() / 1000000
+	}
+	md, _ := mqrpc.FromContext(ctx)
+	var correlation_id = uuid.Rand().Hex()
+	rpcInfo := &rpcpb.RPCInfo{
+		Fn:         *proto.String(_func),
+		Reply:      *proto.Bool(true),
+		Expired:    *proto.Int64(expired),
+		Cid:        *proto.String(correlation_id),
+		Args:       args,
+		ArgsType:   ArgsType,
+		Caller:     *proto.String(caller),
+		Hostname:   *proto.String(caller),
+		StreamType: mqrpc.StreamOpen,
+		Credit:     mqrpc.DefaultStreamWindow,
+		Headers:    md,
+	}
+	request := &streamRequest{
+		service: c.nats_client.session.GetName(),
+		method:  _func,
+		params:  params,
+	}
+	stream := newRPCStream(ctx, c.app, request, mqrpc.DefaultStreamWindow, func(chunk *streamChunk) error {
+		info := &rpcpb.RPCInfo{
+			Fn:         rpcInfo.Fn,
+			Cid:        rpcInfo.Cid,
+			Expired:    rpcInfo.Expired,
+			Caller:     rpcInfo.Caller,
+			Hostname:   rpcInfo.Hostname,
+			StreamType: chunk.typ,
+			Seq:        chunk.seq,
+			Credit:     chunk.credit,
+		}
+		if chunk.typ == mqrpc.StreamData {
+			info.ArgsType = []string{chunk.argsType}
+			info.Args = [][]byte{chunk.data}
+		}
+		if local != nil {
+			return local.streamLocal(info)
+		}
+		return c.nats_client.CallNR(&mqrpc.CallInfo{RPCInfo: info})
+	})
+	//服务端结束发送即整个流结束
+	stream.onEnd = stream.done
+	stream.finish = func() {
+		c.nats_client.DeleteStream(correlation_id)
+	}
+	var err error
+	if local != nil {
+		c.nats_client.streams.Store(correlation_id, stream)
+		if err = local.callLocal(&mqrpc.CallInfo{RPCInfo: rpcInfo}, &streamAgent{stream: stream}); err != nil {
+			c.nats_client.DeleteStream(correlation_id)
+		}
+	} else {
+		err = c.nats_client.Stream(&mqrpc.CallInfo{RPCInfo: rpcInfo}, stream)
+	}
+	if err != nil {
+		stream.cancel()
+		return nil, mqrpc.NewError(mqrpc.CodeUnavailable, err.Error())
+	}
+	go func() {
+		select {
+		case <-stream.ctx.Done():
+			stream.mu.Lock()
+			finished := stream.finished
+			stream.mu.Unlock()
+			if !finished {
+				//通知服务端取消
+				if err := stream.write(&streamChunk{typ: mqrpc.StreamCancel}); err != nil {
+					log.Warning("rpc stream(%s) cancel error %v", _func, err)
+				}
+				stream.done()
+			}
+		case <-stream.doneCh:
+		}
+	}()
+	return stream, nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -14,6 +14,7 @@
 package defaultrpc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"google.golang.org/protobuf/proto"
@@ -22,9 +23,12 @@ import (
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/rpc/pb"
 	"github.com/liangdas/mqant/rpc/util"
+	"github.com/liangdas/mqant/utils/uuid"
 	"reflect"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,6 +36,7 @@ type RPCServer struct {
 	module         module.Module
 	app            module.App
 	functions      map[string]*mqrpc.FunctionInfo
+	functionsMu    sync.RWMutex
 	nats_server    *NatsServer
 	mq_chan        chan mqrpc.CallInfo //接收到请求信息的队列
 	wg             sync.WaitGroup      //任务阻塞
@@ -39,6 +44,15 @@ type RPCServer struct {
 	listener       mqrpc.RPCListener
 	control        mqrpc.GoroutineControl //控制模块可同时开启的最大协程数
 	executing      int64                  //正在执行的goroutine数量
+	streams        sync.Map               //正在执行的流式调用 Cid -> *rpcStream
+	calls          sync.Map               //正在执行的请求 Cid -> context.CancelFunc
+	middlewares    []mqrpc.Middleware     //handler中间件,按添加顺序执行
+	limiter        *mqrpc.Limiter         //模块的并发限制,为nil时不限制
+	keyed          keyedExecutor          //RegisterKeyed的handler按key顺序执行
+	serial         keyedExecutor          //Register的handler等待执行许可时按handler排队,不阻塞其他请求的分发
+	deadLetters    mqrpc.DeadLetterSink   //保存执行失败的CallNR消息
+	local          *localQueue            //同一个进程中的调用方直接投递的请求
+	dispatchMu     sync.Mutex             //传输层与本地请求依次分发,同一个Register的handler不会并发执行
 }
 
 func NewRPCServer(app module.App, module module.Module) (mqrpc.RPCServer, error) {
@@ -52,8 +66,12 @@ func NewRPCServer(app module.App, module module.Module) (mqrpc.RPCServer, error)
 	nats_server, err := NewNatsServer(app, rpc_server)
 	if err != nil {
 		log.Error("AMQPServer Dial: %s", err)
+		return nil, err
 	}
 	rpc_server.nats_server = nats_server
+	rpc_server.local = newLocalQueue()
+	registerLocal(nats_server.Addr(), rpc_server)
+	rpc_server.middlewares = append(rpc_server.middlewares, app.Options().ServerMiddlewares...)
 
 	//go rpc_server.on_call_handle(rpc_server.mq_chan, rpc_server.call_chan_done)
 
@@ -75,41 +93,165 @@ func (s *RPCServer) SetGoroutineControl(control mqrpc.GoroutineControl) {
 获取当前正在执行的goroutine 数量
 */
 func (s *RPCServer) GetExecuting() int64 {
-	return s.executing
+	return atomic.LoadInt64(&s.executing)
 }
 
-// you must call the function before calling Open and Go
-func (s *RPCServer) Register(id string, f interface{}) {
+// SetLimit 限制整个模块的并发数量,需要在收到请求前调用
+func (s *RPCServer) SetLimit(policy mqrpc.LimitPolicy) {
+	s.limiter = mqrpc.NewLimiter(policy)
+}
 
-	if _, ok := s.functions[id]; ok {
-		panic(fmt.Sprintf("function id %v: already registered", id))
+// GetLimitStats 模块与各个handler并发限制的统计
+func (s *RPCServer) GetLimitStats() (module mqrpc.LimitStats, handlers map[string]mqrpc.LimitStats) {
+	if s.limiter != nil {
+		module = s.limiter.Stats()
 	}
-	finfo := &mqrpc.FunctionInfo{
-		Function:  reflect.ValueOf(f),
-		FuncType:  reflect.ValueOf(f).Type(),
-		Goroutine: false,
+	handlers = map[string]mqrpc.LimitStats{}
+	s.functionsMu.RLock()
+	defer s.functionsMu.RUnlock()
+	for id, finfo := range s.functions {
+		if finfo.Limiter != nil {
+			handlers[id] = finfo.Limiter.Stats()
+		}
 	}
+	return
+}
 
-	finfo.InType = []reflect.Type{}
-	for i := 0; i < finfo.FuncType.NumIn(); i++ {
-		rv := finfo.FuncType.In(i)
-		finfo.InType = append(finfo.InType, rv)
+// SetDeadLetterSink 保存执行失败的CallNR消息,需要在收到请求前调用
+func (s *RPCServer) SetDeadLetterSink(sink mqrpc.DeadLetterSink) {
+	s.deadLetters = sink
+}
+
+// DeadLetters 按时间顺序列出保存的死信
+func (s *RPCServer) DeadLetters() ([]*mqrpc.DeadLetter, error) {
+	if s.deadLetters == nil {
+		return nil, nil
 	}
-	s.functions[id] = finfo
+	return s.deadLetters.List()
+}
 
+// Redrive 从sink中取出一条死信并在当前模块重新执行,超时时间从现在开始重新计算
+// 执行是异步的,与传输层和本地请求一样依次分发, Register 的handler不会并发执行; 再次失败时作为新的死信保存
+func (s *RPCServer) Redrive(id string) error {
+	if s.deadLetters == nil {
+		return mqrpc.Unavailable("dead letter sink not set")
+	}
+	letter, err := s.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+	//删除成功的才执行,避免并发的Redrive重复执行
+	if err := s.deadLetters.Remove(id); err != nil {
+		return err
+	}
+	rpcInfo := proto.Clone(letter.Request).(*rpcpb.RPCInfo)
+	rpcInfo.Reply = false
+	rpcInfo.Expired = 0
+	if expired := s.app.Options().RPCExpired; expired > 0 {
+		rpcInfo.Expired = time.Now().Add(expired).UnixNano() / int64(time.Millisecond)
+	}
+	callInfo := &mqrpc.CallInfo{
+		RPCInfo: rpcInfo,
+		Props:   map[string]interface{}{},
+	}
+	if err := s.local.push(func() {
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+		s.Call(callInfo)
+	}); err != nil {
+		//没有执行的死信放回sink
+		if e := s.deadLetters.Put(letter); e != nil {
+			log.Warning("rpc dead letter %s error %v", letter.Request.Fn, e)
+		}
+		return mqrpc.Unavailable("%v", err)
+	}
+	return nil
+}
+
+// putDeadLetter 保存执行失败的CallNR消息
+func (s *RPCServer) putDeadLetter(callInfo *mqrpc.CallInfo) {
+	err := mqrpc.ResultError(callInfo.Result)
+	if err == nil || s.deadLetters == nil {
+		return
+	}
+	letter := &mqrpc.DeadLetter{
+		ID:      uuid.Rand().Hex(),
+		Module:  s.module.GetType(),
+		Time:    time.Now(),
+		Request: proto.Clone(callInfo.RPCInfo).(*rpcpb.RPCInfo),
+		Error:   mqrpc.FromError(err),
+	}
+	if err := s.deadLetters.Put(letter); err != nil {
+		log.Warning("rpc dead letter %s error %v", callInfo.RPCInfo.Fn, err)
+	}
+}
+
+// Use 添加handler中间件,需要在收到请求前调用
+func (s *RPCServer) Use(middlewares ...mqrpc.Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
 }
 
 // you must call the function before calling Open and Go
-func (s *RPCServer) RegisterGO(id string, f interface{}) {
+// handler的参数或返回值不能被序列化时会panic
+func (s *RPCServer) Register(id string, f interface{}, opts ...mqrpc.RegisterOption) {
+	s.register(id, f, false, opts...)
+}
+
+// you must call the function before calling Open and Go
+// handler的参数或返回值不能被序列化时会panic
+func (s *RPCServer) RegisterGO(id string, f interface{}, opts ...mqrpc.RegisterOption) {
+	s.register(id, f, true, opts...)
+}
+
+// RegisterKeyed 注册按key顺序执行的handler: key相同的请求按到达顺序依次执行,key不同的请求并发执行
+// key为nil时使用 mqrpc.SessionKey (参数中gate.Session的用户ID)
+func (s *RPCServer) RegisterKeyed(id string, f interface{}, key mqrpc.KeyFunc, opts ...mqrpc.RegisterOption) {
+	if key == nil {
+		key = mqrpc.SessionKey
+	}
+	s.register(id, f, false, append([]mqrpc.RegisterOption{func(finfo *mqrpc.FunctionInfo) {
+		finfo.Key = key
+	}}, opts...)...)
+}
 
+func (s *RPCServer) register(id string, f interface{}, goroutine bool, opts ...mqrpc.RegisterOption) {
+	finfo, err := newFunctionInfo(f, goroutine, opts...)
+	if err == nil {
+		err = s.checkFunction(finfo)
+	}
+	if err == nil && finfo.Key != nil && finfo.Stream {
+		err = fmt.Errorf("stream func can not be keyed")
+	}
+	if err != nil {
+		panic(fmt.Sprintf("function id %v: %v", id, err))
+	}
+	s.functionsMu.Lock()
+	defer s.functionsMu.Unlock()
 	if _, ok := s.functions[id]; ok {
 		panic(fmt.Sprintf("function id %v: already registered", id))
 	}
+	s.functions[id] = finfo
+}
 
+// GetFunctions 已注册的handler
+func (s *RPCServer) GetFunctions() map[string]*mqrpc.FunctionInfo {
+	s.functionsMu.RLock()
+	defer s.functionsMu.RUnlock()
+	functions := make(map[string]*mqrpc.FunctionInfo, len(s.functions))
+	for id, finfo := range s.functions {
+		functions[id] = finfo
+	}
+	return functions
+}
+
+func newFunctionInfo(f interface{}, goroutine bool, opts ...mqrpc.RegisterOption) (*mqrpc.FunctionInfo, error) {
+	if f == nil || reflect.TypeOf(f).Kind() != reflect.Func {
+		return nil, fmt.Errorf("%T is not a function", f)
+	}
 	finfo := &mqrpc.FunctionInfo{
 		Function:  reflect.ValueOf(f),
 		FuncType:  reflect.ValueOf(f).Type(),
-		Goroutine: true,
+		Goroutine: goroutine,
 	}
 
 	finfo.InType = []reflect.Type{}
@@ -117,14 +259,81 @@ func (s *RPCServer) RegisterGO(id string, f interface{}) {
 		rv := finfo.FuncType.In(i)
 		finfo.InType = append(finfo.InType, rv)
 	}
-	s.functions[id] = finfo
+	if len(finfo.InType) > 0 {
+		//第一个参数为mqrpc.Stream的是流式handler
+		finfo.Stream = finfo.InType[0] == mqrpc.StreamType
+		//第一个参数为context.Context的handler会收到调用方的ctx
+		finfo.Context = finfo.InType[0] == mqrpc.ContextType
+	}
+	for _, o := range opts {
+		o(finfo)
+	}
+	return finfo, nil
+}
+
+// checkFunction 检查handler的参数与返回值能否被 argsutil 或 app.AddRPCSerialize 注册的序列化器处理
+//
+//	普通handler: func([ctx context.Context,] args...) (result, err error|string)
+//	流式handler: func(stream mqrpc.Stream, args...) [error|string]
+func (s *RPCServer) checkFunction(finfo *mqrpc.FunctionInfo) error {
+	in := finfo.InType
+	if finfo.Stream || finfo.Context {
+		in = in[1:]
+	}
+	for i, t := range in {
+		if err := argsutil.CheckArgType(s.app, t); err != nil {
+			return fmt.Errorf("params[%d] %v", i, err)
+		}
+	}
+	ft := finfo.FuncType
+	if finfo.Stream {
+		if ft.NumOut() > 1 || (ft.NumOut() == 1 && !isErrorType(ft.Out(0))) {
+			return fmt.Errorf("stream func must return nothing or error, got %v", ft)
+		}
+		return nil
+	}
+	if ft.NumOut() != 2 || !isErrorType(ft.Out(1)) {
+		return fmt.Errorf("func must return (result interface{}, err error), got %v", ft)
+	}
+	if err := argsutil.CheckType(s.app, ft.Out(0)); err != nil {
+		return fmt.Errorf("result %v", err)
+	}
+	return nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// isErrorType handler的错误返回值可以是error、string或interface{}
+func isErrorType(t reflect.Type) bool {
+	return t.Implements(errorType) || t == reflect.TypeOf("") || (t.Kind() == reflect.Interface && t.NumMethod() == 0)
+}
+
+// newContext 根据请求还原调用方的ctx: 超时时间、元数据(含链路追踪信息)
+func (s *RPCServer) newContext(rpcInfo *rpcpb.RPCInfo) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if len(rpcInfo.Headers) > 0 {
+		ctx = mqrpc.NewContext(ctx, rpcInfo.Headers)
+	}
+	if rpcInfo.Expired > 0 {
+		return context.WithDeadline(ctx, time.Unix(0, rpcInfo.Expired*int64(time.Millisecond)))
+	}
+	return context.WithCancel(ctx)
 }
 
 func (s *RPCServer) Done() (err error) {
+	if s.nats_server != nil {
+		unregisterLocal(s.nats_server.Addr(), s)
+	}
 	//等待正在执行的请求完成
 	//close(s.mq_chan)   //关闭mq_chan通道
 	//<-s.call_chan_done //mq_chan通道的信息都已处理完
+	s.streams.Range(func(key, value interface{}) bool {
+		//通知正在执行的流式handler退出
+		value.(*rpcStream).cancel()
+		return true
+	})
 	s.wg.Wait()
+	s.local.close()
 	//s.call_chan_done <- nil
 	//关闭队列链接
 	if s.nats_server != nil {
@@ -176,41 +385,56 @@ func (s *RPCServer) doCallback(callInfo *mqrpc.CallInfo) {
 		if callInfo.Result.Error != "" {
 			log.Warning("rpc callback erro :\n%s", callInfo.Result.Error)
 		}
+		s.putDeadLetter(callInfo)
+	}
+	if s.app.Options().RPCRecorder != nil {
+		s.app.Options().RPCRecorder.Record(s.module.GetType(), callInfo.RPCInfo, callInfo.Result, time.Duration(callInfo.ExecTime))
 	}
 	if s.app.Options().ServerRPCHandler != nil {
 		s.app.Options().ServerRPCHandler(s.app, s.module, callInfo)
 	}
 }
 
-func (s *RPCServer) _errorCallback(start time.Time, callInfo *mqrpc.CallInfo, Cid string, Error string) {
+func (s *RPCServer) _errorCallback(start time.Time, callInfo *mqrpc.CallInfo, Cid string, err error) {
 	//异常日志都应该打印
 	//log.TError(span, "rpc Exec ModuleType = %v Func = %v Elapsed = %v ERROR:\n%v", s.module.GetType(), callInfo.RPCInfo.Fn, time.Since(start), Error)
-	resultInfo := rpcpb.NewResultInfo(Cid, Error, argsutil.NULL, nil)
+	resultInfo := rpcpb.NewResultInfo(Cid, "", argsutil.NULL, nil)
+	mqrpc.SetResultError(resultInfo, err)
 	callInfo.Result = resultInfo
 	callInfo.ExecTime = time.Since(start).Nanoseconds()
 	s.doCallback(callInfo)
 	if s.listener != nil {
-		s.listener.OnError(callInfo.RPCInfo.Fn, callInfo, fmt.Errorf(Error))
+		s.listener.OnError(callInfo.RPCInfo.Fn, callInfo, err)
 	}
 }
 
-func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo) {
+// _runFunc 执行handler, input为已经解码的参数,为nil时从请求中解码
+func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, input []interface{}, release func()) {
+	defer release()
 	f := functionInfo.Function
-	fType := functionInfo.FuncType
 	fInType := functionInfo.InType
 	params := callInfo.RPCInfo.Args
-	ArgsType := callInfo.RPCInfo.ArgsType
-	if len(params) != fType.NumIn() {
+	if functionInfo.Context {
+		fInType = fInType[1:]
+	}
+	if input == nil {
+		input = localArgs(callInfo)
+	}
+	if input != nil && len(params) == 0 {
+		//本地调用没有经过序列化的参数
+		params = make([][]byte, len(input))
+	}
+	if len(params) != len(fInType) {
 		//因为在调研的 _func的时候还会额外传递一个回调函数 cb
-		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, fmt.Sprintf("The number of params %v is not adapted.%v", params, f.String()))
+		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.InvalidArgs("The number of params %v is not adapted.%v", params, f.String()))
 		return
 	}
 
 	s.wg.Add(1)
-	s.executing++
+	atomic.AddInt64(&s.executing, 1)
 	defer func() {
 		s.wg.Add(-1)
-		s.executing--
+		atomic.AddInt64(&s.executing, -1)
 		if s.control != nil {
 			s.control.Finish()
 		}
@@ -228,13 +452,119 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 			errstr := string(buf[:l])
 			allError := fmt.Sprintf("%s rpc func(%s) error %s\n ----Stack----\n%s", s.module.GetType(), callInfo.RPCInfo.Fn, rn, errstr)
 			log.Error(allError)
-			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, allError)
+			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.NewError(mqrpc.CodeInternal, allError))
+		}
+	}()
+
+	if input == nil {
+		var err error
+		if _, input, err = s.decodeArgs(fInType, callInfo); err != nil {
+			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.NewError(mqrpc.CodeSerialization, err.Error()))
+			return
 		}
+	}
+	//调用方取消或超时时handler的ctx同步取消
+	ctx, cancel := s.newContext(callInfo.RPCInfo)
+	s.calls.Store(callInfo.RPCInfo.Cid, cancel)
+	defer func() {
+		s.calls.Delete(callInfo.RPCInfo.Cid)
+		cancel()
 	}()
 
-	//t:=RandInt64(2,3)
-	//time.Sleep(time.Second*time.Duration(t))
-	// f 为函数地址
+	//called handler是否被执行,未执行时的错误(BeforeHandle、中间件拒绝)按调用失败处理
+	called := false
+	handler := func(ctx context.Context, req *mqrpc.HandlerRequest) (interface{}, error) {
+		if s.listener != nil {
+			errs := s.listener.BeforeHandle(callInfo.RPCInfo.Fn, callInfo)
+			if errs != nil {
+				return nil, errs
+			}
+		}
+		in, err := argsValues(fInType, req.Args)
+		if err != nil {
+			return nil, err
+		}
+		if functionInfo.Context {
+			in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+		}
+		out := f.Call(in)
+		var rs []interface{}
+		if len(out) != 2 {
+			return nil, mqrpc.Internal("%s rpc func(%s) return error %s\n", s.module.GetType(), callInfo.RPCInfo.Fn, "func(....)(result interface{}, err error)")
+		}
+		if len(out) > 0 { //prepare out paras
+			rs = make([]interface{}, len(out), len(out))
+			for i, v := range out {
+				rs[i] = v.Interface()
+			}
+		}
+		if s.app.Options().RpcCompleteHandler != nil {
+			s.app.Options().RpcCompleteHandler(s.app, s.module, callInfo, req.Args, rs, time.Since(start))
+		}
+		var rerr error
+		switch e := rs[1].(type) {
+		case string:
+			if e != "" {
+				rerr = mqrpc.NewError(mqrpc.CodeBusiness, e)
+			}
+		case error:
+			rerr = e
+		case nil:
+			rerr = nil
+		default:
+			return nil, mqrpc.Internal("%s rpc func(%s) return error %s\n", s.module.GetType(), callInfo.RPCInfo.Fn, "func(....)(result interface{}, err error)")
+		}
+		called = true
+		return rs[0], rerr
+	}
+	result, rerr := mqrpc.ChainMiddlewares(s.middlewares, handler)(ctx, &mqrpc.HandlerRequest{
+		Fn:           callInfo.RPCInfo.Fn,
+		CallInfo:     callInfo,
+		FunctionInfo: functionInfo,
+		Args:         input,
+	})
+	if rerr != nil && !called {
+		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, rerr)
+		return
+	}
+	var (
+		argsType = argsutil.NULL
+		args     []byte
+	)
+	if agent, ok := callInfo.Agent.(*localAgent); ok && passthrough(s.app, []interface{}{result}) {
+		//本地调用的结果直接交给调用方
+		agent.result = result
+	} else {
+		//使用与请求相同的编解码器编码结果
+		var err error
+		argsType, args, err = argsutil.ArgsTypeAnd2BytesWithCodec(s.app, mqrpc.MetadataValue(ctx, mqrpc.CodecMetadataKey), result)
+		if err != nil {
+			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.NewError(mqrpc.CodeSerialization, err.Error()))
+			return
+		}
+	}
+	resultInfo := rpcpb.NewResultInfo(
+		callInfo.RPCInfo.Cid,
+		"",
+		argsType,
+		args,
+	)
+	mqrpc.SetResultError(resultInfo, rerr)
+	callInfo.Result = resultInfo
+	callInfo.ExecTime = time.Since(start).Nanoseconds()
+	s.doCallback(callInfo)
+	if s.app.GetSettings().RPC.Log {
+		log.TInfo(nil, "rpc Exec ModuleType = %v Func = %v Elapsed = %v", s.module.GetType(), callInfo.RPCInfo.Fn, time.Since(start))
+	}
+	if s.listener != nil {
+		s.listener.OnComplete(callInfo.RPCInfo.Fn, callInfo, resultInfo, time.Since(start).Nanoseconds())
+	}
+}
+
+// decodeArgs 把请求参数解析为handler的入参
+func (s *RPCServer) decodeArgs(fInType []reflect.Type, callInfo *mqrpc.CallInfo) ([]reflect.Value, []interface{}, error) {
+	params := callInfo.RPCInfo.Args
+	ArgsType := callInfo.RPCInfo.ArgsType
 	var in []reflect.Value
 	var input []interface{}
 	if len(ArgsType) > 0 {
@@ -242,6 +572,20 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 		input = make([]interface{}, len(params))
 		for k, v := range ArgsType {
 			rv := fInType[k]
+			if strings.HasPrefix(v, argsutil.CODEC+"@") && rv.Kind() != reflect.Interface {
+				//使用Codec编码的参数直接解码为handler的参数类型
+				ty, err := argsutil.Bytes2Args(s.app, v, params[k])
+				if err != nil {
+					return nil, nil, err
+				}
+				elemp := reflect.New(rv)
+				if err := ty.(*mqrpc.Encoded).Decode(elemp.Interface()); err != nil {
+					return nil, nil, err
+				}
+				in[k] = elemp.Elem()
+				input[k] = in[k].Interface()
+				continue
+			}
 			var elemp reflect.Value
 			if rv.Kind() == reflect.Ptr {
 				//如果是指针类型就得取到指针所代表的具体类型
@@ -253,8 +597,7 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 			if pb, ok := elemp.Interface().(mqrpc.Marshaler); ok {
 				err := pb.Unmarshal(params[k])
 				if err != nil {
-					s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err.Error())
-					return
+					return nil, nil, err
 				}
 				if pb == nil { //多选语句switch
 					in[k] = reflect.Zero(rv)
@@ -266,12 +609,11 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 					//接收值变量
 					in[k] = elemp.Elem()
 				}
-				input[k] = pb
+				input[k] = in[k].Interface()
 			} else if pb, ok := elemp.Interface().(proto.Message); ok {
 				err := proto.Unmarshal(params[k], pb)
 				if err != nil {
-					s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err.Error())
-					return
+					return nil, nil, err
 				}
 				if pb == nil { //多选语句switch
 					in[k] = reflect.Zero(rv)
@@ -283,13 +625,12 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 					//接收值变量
 					in[k] = elemp.Elem()
 				}
-				input[k] = pb
+				input[k] = in[k].Interface()
 			} else {
 				//不是Marshaler 才尝试用 argsutil 解析
 				ty, err := argsutil.Bytes2Args(s.app, v, params[k])
 				if err != nil {
-					s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err.Error())
-					return
+					return nil, nil, err
 				}
 				switch v2 := ty.(type) { //多选语句switch
 				case nil:
@@ -316,62 +657,26 @@ func (s *RPCServer) _runFunc(start time.Time, functionInfo *mqrpc.FunctionInfo,
 		}
 	}
 
-	if s.listener != nil {
-		errs := s.listener.BeforeHandle(callInfo.RPCInfo.Fn, callInfo)
-		if errs != nil {
-			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, errs.Error())
-			return
-		}
-	}
+	return in, input, nil
+}
 
-	out := f.Call(in)
-	var rs []interface{}
-	if len(out) != 2 {
-		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, fmt.Sprintf("%s rpc func(%s) return error %s\n", s.module.GetType(), callInfo.RPCInfo.Fn, "func(....)(result interface{}, err error)"))
-		return
+// argsValues 把(经过中间件处理的)参数转换为handler的入参
+func argsValues(fInType []reflect.Type, args []interface{}) ([]reflect.Value, error) {
+	if len(args) != len(fInType) {
+		return nil, mqrpc.InvalidArgs("The number of params %v is not adapted.", args)
 	}
-	if len(out) > 0 { //prepare out paras
-		rs = make([]interface{}, len(out), len(out))
-		for i, v := range out {
-			rs[i] = v.Interface()
+	in := make([]reflect.Value, len(args))
+	for k, arg := range args {
+		if arg == nil {
+			in[k] = reflect.Zero(fInType[k])
+			continue
+		}
+		in[k] = reflect.ValueOf(arg)
+		if !in[k].Type().AssignableTo(fInType[k]) {
+			return nil, mqrpc.InvalidArgs("params[%d] %v can not assign to %v", k, in[k].Type(), fInType[k])
 		}
 	}
-	if s.app.Options().RpcCompleteHandler != nil {
-		s.app.Options().RpcCompleteHandler(s.app, s.module, callInfo, input, rs, time.Since(start))
-	}
-	var rerr string
-	switch e := rs[1].(type) {
-	case string:
-		rerr = e
-		break
-	case error:
-		rerr = e.Error()
-	case nil:
-		rerr = ""
-	default:
-		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, fmt.Sprintf("%s rpc func(%s) return error %s\n", s.module.GetType(), callInfo.RPCInfo.Fn, "func(....)(result interface{}, err error)"))
-		return
-	}
-	argsType, args, err := argsutil.ArgsTypeAnd2Bytes(s.app, rs[0])
-	if err != nil {
-		s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err.Error())
-		return
-	}
-	resultInfo := rpcpb.NewResultInfo(
-		callInfo.RPCInfo.Cid,
-		rerr,
-		argsType,
-		args,
-	)
-	callInfo.Result = resultInfo
-	callInfo.ExecTime = time.Since(start).Nanoseconds()
-	s.doCallback(callInfo)
-	if s.app.GetSettings().RPC.Log {
-		log.TInfo(nil, "rpc Exec ModuleType = %v Func = %v Elapsed = %v", s.module.GetType(), callInfo.RPCInfo.Fn, time.Since(start))
-	}
-	if s.listener != nil {
-		s.listener.OnComplete(callInfo.RPCInfo.Fn, callInfo, resultInfo, time.Since(start).Nanoseconds())
-	}
+	return in, nil
 }
 
 //---------------------------------if _func is not a function or para num and type not match,it will cause panic
@@ -388,7 +693,7 @@ func (s *RPCServer) runFunc(callInfo *mqrpc.CallInfo) {
 				rn = r.(error).Error()
 			}
 			log.Error("recover", rn)
-			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, rn)
+			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.NewError(mqrpc.CodeInternal, rn))
 		}
 	}()
 
@@ -396,20 +701,176 @@ func (s *RPCServer) runFunc(callInfo *mqrpc.CallInfo) {
 		//协程数量达到最大限制
 		s.control.Wait()
 	}
+	s.functionsMu.RLock()
 	functionInfo, ok := s.functions[callInfo.RPCInfo.Fn]
+	s.functionsMu.RUnlock()
 	if !ok {
 		if s.listener != nil {
 			fInfo, err := s.listener.NoFoundFunction(callInfo.RPCInfo.Fn)
 			if err != nil {
-				s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err.Error())
+				if _, ok := err.(*mqrpc.Error); !ok {
+					err = mqrpc.NewError(mqrpc.CodeNotFound, err.Error())
+				}
+				s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err)
 				return
 			}
 			functionInfo = fInfo
 		}
+		if functionInfo == nil {
+			s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, mqrpc.NotFound("Remote function(%s) not found", callInfo.RPCInfo.Fn))
+			return
+		}
 	}
-	if functionInfo.Goroutine {
-		go s._runFunc(start, functionInfo, callInfo)
-	} else {
-		s._runFunc(start, functionInfo, callInfo)
+	if functionInfo.Key != nil {
+		s._runKeyed(start, functionInfo, callInfo)
+		return
+	}
+	s.limitFunc(start, functionInfo, callInfo, func(release func()) {
+		if functionInfo.Stream {
+			//流式handler会长时间执行,总是在独立的协程中运行
+			s._runStream(start, functionInfo, callInfo, release)
+		} else if functionInfo.Goroutine {
+			go s._runFunc(start, functionInfo, callInfo, nil, release)
+		} else {
+			s._runFunc(start, functionInfo, callInfo, nil, release)
+		}
+	})
+}
+
+// _runKeyed 相同key的请求(不区分handler)在同一个协程中按到达顺序执行,不同key的请求并发执行
+// key为空或参数无法解码时与 RegisterGO 相同,参数错误由 _runFunc 返回
+func (s *RPCServer) _runKeyed(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo) {
+	fInType := functionInfo.InType
+	if functionInfo.Context {
+		fInType = fInType[1:]
+	}
+	var (
+		key   string
+		input = localArgs(callInfo)
+	)
+	if input != nil {
+		if len(input) == len(fInType) {
+			key = functionInfo.Key(input)
+		}
+	} else if len(callInfo.RPCInfo.Args) == len(fInType) {
+		var err error
+		if _, input, err = s.decodeArgs(fInType, callInfo); err == nil {
+			key = functionInfo.Key(input)
+		} else {
+			input = nil
+		}
+	}
+	s.wg.Add(1)
+	task := func() {
+		defer s.wg.Done()
+		s.limitFunc(start, functionInfo, callInfo, func(release func()) {
+			s._runFunc(start, functionInfo, callInfo, input, release)
+		})
+	}
+	if key == "" {
+		go task()
+		return
+	}
+	s.keyed.submit(key, task)
+}
+
+// limitFunc 依次获取handler与模块的执行许可后调用run, handler执行结束时调用release归还许可
+// 需要排队时在独立的协程中等待(不阻塞后续请求的接收),排队已满或等待超时时返回 CodeOverloaded 错误
+// 按key顺序执行的handler已经在key的执行协程中,直接等待; Register 注册的handler在这个handler的队列中等待,
+// 前面的请求还在排队时后到的请求也进入队列,保证按到达顺序执行
+func (s *RPCServer) limitFunc(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, run func(release func())) {
+	handler, module := functionInfo.Limiter, s.limiter
+	queued := functionInfo.Key == nil && !(functionInfo.Goroutine || functionInfo.Stream) && s.serial.busy(callInfo.RPCInfo.Fn)
+	release := func() {
+		if handler != nil {
+			handler.Release()
+		}
+		if module != nil {
+			module.Release()
+		}
+	}
+	if handler != nil && (queued || !handler.TryAcquire()) {
+		if !handler.Enqueue() {
+			s._rejectFunc(start, functionInfo, callInfo, mqrpc.Overloaded("rpc func(%s) queue is full", callInfo.RPCInfo.Fn))
+			return
+		}
+		s.async(functionInfo, callInfo, func() {
+			ctx, cancel := s.newContext(callInfo.RPCInfo)
+			defer cancel()
+			if err := handler.Wait(ctx); err != nil {
+				s._rejectFunc(start, functionInfo, callInfo, err)
+				return
+			}
+			if module != nil {
+				if err := module.Acquire(ctx); err != nil {
+					handler.Release()
+					s._rejectFunc(start, functionInfo, callInfo, err)
+					return
+				}
+			}
+			run(release)
+		})
+		return
+	}
+	if module != nil && (queued || !module.TryAcquire()) {
+		if !module.Enqueue() {
+			if handler != nil {
+				handler.Release()
+			}
+			s._rejectFunc(start, functionInfo, callInfo, mqrpc.Overloaded("module %s queue is full", s.module.GetType()))
+			return
+		}
+		s.async(functionInfo, callInfo, func() {
+			ctx, cancel := s.newContext(callInfo.RPCInfo)
+			defer cancel()
+			if err := module.Wait(ctx); err != nil {
+				if handler != nil {
+					handler.Release()
+				}
+				s._rejectFunc(start, functionInfo, callInfo, err)
+				return
+			}
+			run(release)
+		})
+		return
+	}
+	if queued {
+		s.async(functionInfo, callInfo, func() {
+			run(release)
+		})
+		return
+	}
+	run(release)
+}
+
+// async 在其他协程中等待执行许可, Register 注册的handler在这个handler的队列中依次执行
+func (s *RPCServer) async(functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, f func()) {
+	if functionInfo.Key != nil {
+		f()
+		return
+	}
+	s.wg.Add(1)
+	if !(functionInfo.Goroutine || functionInfo.Stream) {
+		s.serial.submit(callInfo.RPCInfo.Fn, func() {
+			defer s.wg.Done()
+			f()
+		})
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// _rejectFunc 请求被并发限制拒绝
+func (s *RPCServer) _rejectFunc(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, err error) {
+	if functionInfo.Stream {
+		s._errorStream(start, callInfo, err)
+		return
+	}
+	if s.control != nil {
+		s.control.Finish()
 	}
+	s._errorCallback(start, callInfo, callInfo.RPCInfo.Cid, err)
 }
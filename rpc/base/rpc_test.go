@@ -0,0 +1,1575 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/registry"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/pb"
+	"github.com/liangdas/mqant/rpc/transport"
+)
+
+func init() {
+	//日志在第一次使用时才初始化,并发的测试中提前初始化
+	log.LogBeego()
+}
+
+// testApp 只实现了rpc调用链路用到的方法
+type testApp struct {
+	module.App
+	opts      module.Options
+	serialize map[string]module.RPCSerialize
+}
+
+func (a *testApp) Options() module.Options                         { return a.opts }
+func (a *testApp) Transport() mqrpc.Transport                      { return a.opts.Transport }
+func (a *testApp) GetSettings() conf.Config                        { return conf.Config{} }
+func (a *testApp) GetRPCSerialize() map[string]module.RPCSerialize { return a.serialize }
+
+type testModule struct {
+	module.Module
+}
+
+func (m *testModule) GetType() string { return "test" }
+
+type testSession struct {
+	module.ServerSession
+	node *registry.Node
+}
+
+func (s *testSession) GetID() string           { return s.node.Id }
+func (s *testSession) GetNode() *registry.Node { return s.node }
+func (s *testSession) GetName() string         { return "test" }
+
+func newTestRPC(t *testing.T) (*testApp, mqrpc.RPCServer, mqrpc.RPCClient) {
+	app := &testApp{
+		opts: module.Options{
+			Transport:        transport.NewLocalTransport(),
+			RPCExpired:       time.Second * 3,
+			DisableLocalCall: true, //测试传输层的调用链路
+		},
+	}
+	server, err := NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, server, client
+}
+
+func TestLocalCall(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	notify := make(chan string, 1)
+	server.RegisterGO("hello", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	server.Register("notify", func(name string) (string, error) {
+		notify <- name
+		return "", nil
+	})
+	r, errstr := client.Call(context.Background(), "hello", "mqant")
+	if errstr != "" {
+		t.Fatal(errstr)
+	}
+	if r != "hello mqant" {
+		t.Fatalf("Call got %v", r)
+	}
+	if err := client.CallNR("notify", "mqant"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-notify:
+		if name != "mqant" {
+			t.Fatalf("CallNR got %v", name)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("CallNR timeout")
+	}
+	_ = client.Done()
+	_ = server.Done()
+}
+
+func TestServerStream(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	count := int(mqrpc.DefaultStreamWindow*3 + 1)
+	server.Register("replay", func(stream mqrpc.Stream, n int64) error {
+		for i := int64(0); i < n; i++ {
+			if err := stream.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	stream, err := client.Stream(context.Background(), "replay", int64(count))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		var v int64
+		if err := stream.Recv(&v); err != nil {
+			t.Fatalf("Recv %d error %v", i, err)
+		}
+		if v != int64(i) {
+			t.Fatalf("Recv got %d want %d", v, i)
+		}
+	}
+	var v int64
+	if err := stream.Recv(&v); err != io.EOF {
+		t.Fatalf("Recv want io.EOF got %v", err)
+	}
+}
+
+func TestBidiStream(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("echo", func(stream mqrpc.Stream) error {
+		for {
+			var msg string
+			err := stream.Recv(&msg)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send("echo " + msg); err != nil {
+				return err
+			}
+		}
+	})
+	stream, err := client.Stream(context.Background(), "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := stream.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := stream.Recv(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != "echo "+msg {
+			t.Fatalf("Recv got %q", reply)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := stream.Recv(&reply); err != io.EOF {
+		t.Fatalf("Recv want io.EOF got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	canceled := make(chan error, 1)
+	server.RegisterGO("forever", func(stream mqrpc.Stream) error {
+		for {
+			if err := stream.Send("tick"); err != nil {
+				canceled <- err
+				return err
+			}
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Stream(ctx, "forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := stream.Recv(&v); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("server Send want context.Canceled got %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("server stream not canceled")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("fail", func(stream mqrpc.Stream) error {
+		return fmt.Errorf("replay not found")
+	})
+	server.RegisterGO("denied", func(stream mqrpc.Stream) error {
+		return mqrpc.NewError(mqrpc.CodeUser+1, "forbidden")
+	})
+	stream, err := client.Stream(context.Background(), "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := stream.Recv(&v); err == nil || err.Error() != "replay not found" || mqrpc.ErrorCode(err) != mqrpc.CodeBusiness {
+		t.Fatalf("Recv got %v", err)
+	}
+	//流结束时保留错误码
+	stream, err = client.Stream(context.Background(), "denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(&v); mqrpc.ErrorCode(err) != mqrpc.CodeUser+1 || err.Error() != "forbidden" {
+		t.Fatalf("Recv got %v", err)
+	}
+}
+
+func TestStreamDefaultContext(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("count", func(stream mqrpc.Stream, n int64) error {
+		for i := int64(0); i < n; i++ {
+			if err := stream.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	//ctx为nil时与Call相同使用RPCExpired作为超时时间
+	stream, err := client.Stream(nil, "count", int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deadline, ok := stream.Context().Deadline(); !ok || time.Until(deadline) > app.opts.RPCExpired {
+		t.Fatalf("stream deadline %v %v", deadline, ok)
+	}
+	var v int64
+	for i := 0; i < 2; i++ {
+		if err := stream.Recv(&v); err != nil || v != int64(i) {
+			t.Fatalf("Recv %d got %d %v", i, v, err)
+		}
+	}
+	if err := stream.Recv(&v); err != io.EOF {
+		t.Fatalf("Recv want io.EOF got %v", err)
+	}
+}
+
+// dropTransport drop为true时丢弃所有消息,模拟对端异常退出
+type dropTransport struct {
+	mqrpc.Transport
+	drop int32
+}
+
+func (t *dropTransport) Publish(subject string, data []byte) error {
+	if atomic.LoadInt32(&t.drop) == 1 {
+		return nil
+	}
+	return t.Transport.Publish(subject, data)
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	heartbeat := mqrpc.DefaultStreamHeartbeat
+	mqrpc.DefaultStreamHeartbeat = time.Millisecond * 50
+	defer func() {
+		mqrpc.DefaultStreamHeartbeat = heartbeat
+	}()
+	tr := &dropTransport{Transport: transport.NewLocalTransport()}
+	defer tr.Close()
+	app := &testApp{
+		opts: module.Options{
+			Transport:        tr,
+			RPCExpired:       time.Second * 3,
+			DisableLocalCall: true,
+		},
+	}
+	server, err := NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := make(chan error, 1)
+	server.RegisterGO("forever", func(stream mqrpc.Stream) error {
+		for {
+			if err := stream.Send("tick"); err != nil {
+				idle <- stream.Error()
+				return err
+			}
+		}
+	})
+	//没有超时时间的流,空闲时心跳维持连接
+	stream, err := client.Stream(context.Background(), "forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := stream.Recv(&v); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	select {
+	case err := <-idle:
+		t.Fatalf("stream closed while both sides alive: %v", err)
+	default:
+	}
+	//客户端异常退出,服务端不再收到心跳与确认
+	atomic.StoreInt32(&tr.drop, 1)
+	select {
+	case err := <-idle:
+		if mqrpc.ErrorCode(err) != mqrpc.CodeTimeout {
+			t.Fatalf("server stream error %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("abandoned server stream still blocked in Send")
+	}
+	for {
+		if err := stream.Recv(&v); err != nil {
+			break
+		}
+	}
+	if mqrpc.ErrorCode(stream.Error()) != mqrpc.CodeTimeout {
+		t.Fatalf("client stream error %v", stream.Error())
+	}
+}
+
+func TestContextPropagation(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("inner", func(ctx context.Context) (string, error) {
+		return mqrpc.MetadataValue(ctx, "user"), nil
+	})
+	server.RegisterGO("outer", func(ctx context.Context, name string) (string, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return "", fmt.Errorf("ctx without deadline")
+		}
+		//嵌套调用自动携带元数据
+		r, errstr := client.Call(ctx, "inner")
+		if errstr != "" {
+			return "", fmt.Errorf(errstr)
+		}
+		return name + " " + r.(string), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	ctx = mqrpc.WithMetadata(ctx, "user", "mqant")
+	r, errstr := client.Call(ctx, "outer", "hello")
+	if errstr != "" {
+		t.Fatal(errstr)
+	}
+	if r != "hello mqant" {
+		t.Fatalf("Call got %v", r)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	canceled := make(chan error, 1)
+	server.RegisterGO("block", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return "", ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	_, errstr := client.Call(ctx, "block")
+	if errstr != context.Canceled.Error() {
+		t.Fatalf("Call want %q got %q", context.Canceled.Error(), errstr)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("handler ctx error %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler ctx not canceled")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("business", func() (string, error) {
+		return "", fmt.Errorf("not login")
+	})
+	server.RegisterGO("typed", func() (string, error) {
+		return "", mqrpc.Errorf(mqrpc.CodeUser+1, "balance %d", 0)
+	})
+	server.RegisterGO("slow", func() (string, error) {
+		time.Sleep(time.Millisecond * 500)
+		return "", nil
+	})
+	cases := []struct {
+		fn      string
+		params  []interface{}
+		code    int32
+		message string
+	}{
+		{"business", nil, mqrpc.CodeBusiness, "not login"},
+		{"typed", nil, mqrpc.CodeUser + 1, "balance 0"},
+		{"typed", []interface{}{"extra"}, mqrpc.CodeInvalidArgs, ""},
+		{"missing", nil, mqrpc.CodeNotFound, "Remote function(missing) not found"},
+		{"slow", nil, mqrpc.CodeTimeout, "deadline exceeded"},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		_, err := client.CallWithError(ctx, c.fn, c.params...)
+		cancel()
+		if code := mqrpc.ErrorCode(err); code != c.code {
+			t.Fatalf("%s want code %d got %d (%v)", c.fn, c.code, code, err)
+		}
+		if c.message != "" && err.Error() != c.message {
+			t.Fatalf("%s want message %q got %q", c.fn, c.message, err.Error())
+		}
+	}
+	//旧接口仍然只返回错误信息
+	_, errstr := client.Call(context.Background(), "business")
+	if errstr != "not login" {
+		t.Fatalf("Call got %q", errstr)
+	}
+}
+
+func TestClientInterceptor(t *testing.T) {
+	var order []string
+	trace := func(name string) mqrpc.ClientInterceptor {
+		return func(ctx context.Context, inv *mqrpc.Invocation, invoker mqrpc.Invoker) (interface{}, error) {
+			order = append(order, name)
+			return invoker(ctx, inv)
+		}
+	}
+	auth := func(ctx context.Context, inv *mqrpc.Invocation, invoker mqrpc.Invoker) (interface{}, error) {
+		return invoker(mqrpc.WithMetadata(ctx, "token", "secret"), inv)
+	}
+	var streamed bool
+	cache := func(ctx context.Context, inv *mqrpc.Invocation, invoker mqrpc.Invoker) (interface{}, error) {
+		streamed = inv.Stream
+		if inv.Method == "cached" {
+			return "from cache", nil
+		}
+		return invoker(ctx, inv)
+	}
+	app := &testApp{
+		opts: module.Options{
+			Transport:          transport.NewLocalTransport(),
+			RPCExpired:         time.Second * 3,
+			ClientInterceptors: []mqrpc.ClientInterceptor{trace("a"), trace("b"), auth, cache},
+		},
+	}
+	defer app.Transport().Close()
+	server, err := NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify := make(chan string, 1)
+	server.RegisterGO("token", func(ctx context.Context) (string, error) {
+		return mqrpc.MetadataValue(ctx, "token"), nil
+	})
+	server.RegisterGO("notify", func(ctx context.Context) (string, error) {
+		notify <- mqrpc.MetadataValue(ctx, "token")
+		return "", nil
+	})
+	r, errstr := client.Call(context.Background(), "token")
+	if errstr != "" || r != "secret" {
+		t.Fatalf("Call got %v %v", r, errstr)
+	}
+	if order[0] != "a" || order[1] != "b" {
+		t.Fatalf("interceptor order %v", order)
+	}
+	//流式调用同样经过拦截器
+	server.RegisterGO("tokens", func(stream mqrpc.Stream) error {
+		return stream.Send(mqrpc.MetadataValue(stream.Context(), "token"))
+	})
+	order = nil
+	stream, err := client.Stream(context.Background(), "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	if err := stream.Recv(&token); err != nil || token != "secret" || !streamed || len(order) != 2 {
+		t.Fatalf("stream token %q %v streamed %v order %v", token, err, streamed, order)
+	}
+	r, errstr = client.Call(context.Background(), "cached")
+	if errstr != "" || r != "from cache" {
+		t.Fatalf("Call got %v %v", r, errstr)
+	}
+	if err := client.CallNR("notify"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case token := <-notify:
+		if token != "secret" {
+			t.Fatalf("CallNR token %q", token)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("CallNR timeout")
+	}
+}
+
+func TestServerMiddleware(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	var order []string
+	server.Use(func(ctx context.Context, req *mqrpc.HandlerRequest, next mqrpc.Handler) (interface{}, error) {
+		order = append(order, "auth")
+		if req.Fn == "secret" {
+			return nil, mqrpc.Errorf(mqrpc.CodeUser, "forbidden")
+		}
+		return next(ctx, req)
+	}, func(ctx context.Context, req *mqrpc.HandlerRequest, next mqrpc.Handler) (interface{}, error) {
+		order = append(order, "upper")
+		if name, ok := req.Args[0].(string); ok {
+			req.Args[0] = name + "!"
+		}
+		r, err := next(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("[%v]", r), nil
+	})
+	server.RegisterGO("hello", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	server.RegisterGO("secret", func(name string) (string, error) {
+		return "secret " + name, nil
+	})
+	r, errstr := client.Call(context.Background(), "hello", "mqant")
+	if errstr != "" || r != "[hello mqant!]" {
+		t.Fatalf("Call got %v %v", r, errstr)
+	}
+	if len(order) != 2 || order[0] != "auth" || order[1] != "upper" {
+		t.Fatalf("middleware order %v", order)
+	}
+	_, err := client.CallWithError(context.Background(), "secret", "mqant")
+	if mqrpc.ErrorCode(err) != mqrpc.CodeUser || err.Error() != "forbidden" {
+		t.Fatalf("CallWithError got %v", err)
+	}
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	var flaky, unsafe int32
+	server.RegisterGO("flaky", func() (string, error) {
+		if atomic.AddInt32(&flaky, 1) < 3 {
+			return "", mqrpc.Unavailable("try again")
+		}
+		return "ok", nil
+	}, mqrpc.Idempotent())
+	server.RegisterGO("unsafe", func() (string, error) {
+		atomic.AddInt32(&unsafe, 1)
+		return "", mqrpc.Unavailable("try again")
+	})
+	//客户端从节点元数据得知哪些handler是幂等的
+	var idempotent []string
+	for id, finfo := range server.GetFunctions() {
+		if finfo.Idempotent {
+			idempotent = append(idempotent, id)
+		}
+	}
+	client.(*RPCClient).nats_client.session.GetNode().Metadata = map[string]string{
+		mqrpc.IdempotentMetadataKey: strings.Join(idempotent, ","),
+	}
+	ctx := mqrpc.WithRetry(context.Background(), mqrpc.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond * 10,
+	})
+	r, err := client.CallWithError(ctx, "flaky")
+	if err != nil || r != "ok" {
+		t.Fatalf("CallWithError got %v %v", r, err)
+	}
+	if n := atomic.LoadInt32(&flaky); n != 3 {
+		t.Fatalf("flaky called %d times", n)
+	}
+	_, err = client.CallWithError(ctx, "unsafe")
+	if mqrpc.ErrorCode(err) != mqrpc.CodeUnavailable {
+		t.Fatalf("CallWithError got %v", err)
+	}
+	if n := atomic.LoadInt32(&unsafe); n != 1 {
+		t.Fatalf("non idempotent handler called %d times", n)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := mqrpc.RetryPolicy{
+		Backoff:    time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 50,
+	}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, d := range want {
+		if got := policy.Delay(i + 1); got != d*time.Millisecond {
+			t.Fatalf("Delay(%d) want %v got %v", i+1, d*time.Millisecond, got)
+		}
+	}
+}
+
+func TestCallAllAny(t *testing.T) {
+	app, _, _ := newTestRPC(t)
+	defer app.Transport().Close()
+	clients := map[string]mqrpc.RPCClient{}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		server, err := NewRPCServer(app, &testModule{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("gate@%d", i)
+		holder := i == 2
+		server.RegisterGO("hold", func(user string) (string, error) {
+			if !holder {
+				return "", mqrpc.NotFound("user %s not here", user)
+			}
+			return id, nil
+		})
+		client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: id, Address: server.Addr()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[id] = client
+		ids = append(ids, id)
+	}
+	call := func(ctx context.Context, serverID string) (interface{}, error) {
+		return clients[serverID].CallWithError(ctx, "hold", "u1")
+	}
+	results := mqrpc.CallAll(context.Background(), ids, call)
+	if len(results) != 3 {
+		t.Fatalf("CallAll got %d results", len(results))
+	}
+	for i, r := range results {
+		if r.ServerID != ids[i] {
+			t.Fatalf("CallAll result %d from %s", i, r.ServerID)
+		}
+		if (i == 2) != (r.Err == nil) {
+			t.Fatalf("CallAll result %d error %v", i, r.Err)
+		}
+	}
+	for _, ctx := range []context.Context{context.Background(), mqrpc.WithHedgeDelay(context.Background(), time.Millisecond*10)} {
+		r := mqrpc.CallAny(ctx, ids, call)
+		if r.Err != nil || r.Result != "gate@2" || r.ServerID != "gate@2" {
+			t.Fatalf("CallAny got %+v", r)
+		}
+	}
+	r := mqrpc.CallAny(context.Background(), ids[:2], call)
+	if mqrpc.ErrorCode(r.Err) != mqrpc.CodeNotFound {
+		t.Fatalf("CallAny want NotFound got %+v", r)
+	}
+}
+
+func TestTypedCall(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	err := mqrpc.RegisterTyped(server, "echo", func(ctx context.Context, req *rpcpb.RPCInfo) (*rpcpb.RPCInfo, error) {
+		return &rpcpb.RPCInfo{Fn: req.Fn + "!"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mqrpc.RegisterTypedGO(server, "count", func(ctx context.Context, req string) (int64, error) {
+		return int64(len(req)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mqrpc.RegisterTyped(server, "bad", func(ctx context.Context, req chan int) (string, error) {
+		return "", nil
+	})
+	if mqrpc.ErrorCode(err) != mqrpc.CodeInvalidArgs {
+		t.Fatalf("RegisterTyped chan want InvalidArgs got %v", err)
+	}
+	if _, ok := server.GetFunctions()["bad"]; ok {
+		t.Fatal("invalid handler should not be registered")
+	}
+
+	rsp, err := mqrpc.SessionCallTyped[*rpcpb.RPCInfo, *rpcpb.RPCInfo](context.Background(), client, "echo", &rpcpb.RPCInfo{Fn: "hi"})
+	if err != nil || rsp.Fn != "hi!" {
+		t.Fatalf("echo got %v %v", rsp, err)
+	}
+	n, err := mqrpc.SessionCallTyped[string, int](context.Background(), client, "count", "hello")
+	if err != nil || n != 5 {
+		t.Fatalf("count got %v %v", n, err)
+	}
+	_, err = mqrpc.SessionCallTyped[string, string](context.Background(), client, "count", "hello")
+	if mqrpc.ErrorCode(err) != mqrpc.CodeSerialization {
+		t.Fatalf("count as string want Serialization got %v", err)
+	}
+	_, err = mqrpc.SessionCallTyped[string, int8](context.Background(), client, "count", strings.Repeat("a", 200))
+	if err != strconv.ErrRange {
+		t.Fatalf("count as int8 want ErrRange got %v", err)
+	}
+}
+
+type point struct {
+	X, Y int32
+}
+
+// pointSerialize 只能序列化point
+type pointSerialize struct{}
+
+func (pointSerialize) Serialize(param interface{}) (string, []byte, error) {
+	if p, ok := param.(point); ok {
+		return "point", []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+	}
+	return "", nil, fmt.Errorf("not point")
+}
+
+func (pointSerialize) Deserialize(ptype string, b []byte) (interface{}, error) {
+	p := point{}
+	_, err := fmt.Sscanf(string(b), "%d,%d", &p.X, &p.Y)
+	return p, err
+}
+
+func (pointSerialize) GetTypes() []string { return []string{"point"} }
+
+func TestRegisterValidate(t *testing.T) {
+	app, server, _ := newTestRPC(t)
+	defer app.Transport().Close()
+	register := func(id string, f interface{}) (err interface{}) {
+		defer func() {
+			err = recover()
+		}()
+		server.RegisterGO(id, f)
+		return nil
+	}
+	valid := map[string]interface{}{
+		"basic":   func(a int32, b int64, c string, d []byte, e map[string]string) (map[string]interface{}, error) { return nil, nil },
+		"proto":   func(ctx context.Context, req *rpcpb.RPCInfo) (*rpcpb.ResultInfo, string) { return nil, "" },
+		"json":    func(p struct{ Name string }) (interface{}, error) { return nil, nil },
+		"typed":   func() (bool, *mqrpc.Error) { return false, nil },
+		"stream":  func(stream mqrpc.Stream, n int64) error { return nil },
+		"stream2": func(stream mqrpc.Stream) {},
+		"codec":   func(a int, p point) (point, error) { return point{}, nil },
+	}
+	for id, f := range valid {
+		if err := register(id, f); err != nil {
+			t.Fatalf("register %s: %v", id, err)
+		}
+	}
+	invalid := map[string]interface{}{
+		"notfunc":   "hello",
+		"chan":      func(a chan int) (string, error) { return "", nil },
+		"func":      func(a func()) (string, error) { return "", nil },
+		"result":    func() (complex128, error) { return 0, nil },
+		"noerror":   func() string { return "" },
+		"errortype": func() (string, int) { return "", 0 },
+		"stream":    func(stream mqrpc.Stream) (string, error) { return "", nil },
+		"field":     func(p struct{ C chan int }) (string, error) { return "", nil },
+		"iface":     func(p struct{ Err error }) (string, error) { return "", nil },
+		"mapkey":    func(m map[point]string) (string, error) { return "", nil },
+		"trace":     func(span log.TraceSpanImp) (string, error) { return "", nil },
+		"resultmap": func() (map[[2]int]int, error) { return nil, nil },
+	}
+	for id, f := range invalid {
+		if err := register("invalid_"+id, f); err == nil {
+			t.Fatalf("register %s should panic", id)
+		}
+	}
+	if _, ok := server.GetFunctions()["invalid_chan"]; ok {
+		t.Fatal("invalid handler should not be registered")
+	}
+
+	//注册时不调用序列化器检查类型
+	probe := &probeSerialize{}
+	app.serialize = map[string]module.RPCSerialize{"point": pointSerialize{}, "probe": probe}
+	if err := register("point", func(p point) (point, error) { return point{X: p.Y, Y: p.X}, nil }); err != nil {
+		t.Fatalf("register point: %v", err)
+	}
+	if err := register("invalid_serialize", func(p struct{ C chan int }) (string, error) { return "", nil }); err == nil {
+		t.Fatal("type only a serializer accepts should be rejected")
+	}
+	if n := atomic.LoadInt32(&probe.calls); n != 0 {
+		t.Fatalf("serializer called %d times at register", n)
+	}
+}
+
+// probeSerialize 记录被调用的次数
+type probeSerialize struct {
+	calls int32
+}
+
+func (s *probeSerialize) Serialize(param interface{}) (string, []byte, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return "probe", nil, nil
+}
+
+func (s *probeSerialize) Deserialize(ptype string, b []byte) (interface{}, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, fmt.Errorf("not probe")
+}
+
+func (s *probeSerialize) GetTypes() []string { return []string{"probe"} }
+
+type user struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+func TestCodec(t *testing.T) {
+	app, server, _ := newTestRPC(t)
+	defer app.Transport().Close()
+	server.RegisterGO("older", func(u user, years int) (*user, error) {
+		u.Age += years
+		return &u, nil
+	})
+	server.RegisterGO("any", func(v interface{}) (string, error) {
+		e, ok := v.(*mqrpc.Encoded)
+		if !ok {
+			return "", fmt.Errorf("got %T", v)
+		}
+		return e.Codec, nil
+	})
+	server.RegisterGO("users", func(stream mqrpc.Stream, n int) error {
+		for i := 0; i < n; i++ {
+			if err := stream.Send(user{Name: fmt.Sprint(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, codecs := range []string{"", "gob", "msgpack,gob"} {
+		client, err := NewRPCClient(app, &testSession{node: &registry.Node{
+			Id:       "test@1",
+			Address:  server.Addr(),
+			Metadata: map[string]string{mqrpc.CodecsMetadataKey: codecs},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"": "json", "gob": "gob", "msgpack,gob": "msgpack"}[codecs]
+		result, err := client.CallWithError(context.Background(), "older", user{Name: "a", Age: 1, Tags: []string{"x"}}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := result.(*mqrpc.Encoded); !ok || e.Codec != want || e.Type != "*defaultrpc.user" {
+			t.Fatalf("codecs %q got %#v", codecs, result)
+		}
+		u, err := mqrpc.ResultAs[*user](result, nil)
+		if err != nil || u.Name != "a" || u.Age != 3 || len(u.Tags) != 1 {
+			t.Fatalf("codecs %q got %+v %v", codecs, u, err)
+		}
+		name, err := mqrpc.SessionCallTyped[user, string](mqrpc.WithCodec(context.Background(), "gob"), client, "any", user{})
+		if err != nil || name != "gob" {
+			t.Fatalf("WithCodec got %v %v", name, err)
+		}
+		stream, err := client.Stream(context.Background(), "users", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			var got user
+			if err := stream.Recv(&got); err != nil || got.Name != fmt.Sprint(i) {
+				t.Fatalf("stream got %+v %v", got, err)
+			}
+		}
+		if err := stream.Recv(&user{}); err != io.EOF {
+			t.Fatalf("stream end got %v", err)
+		}
+	}
+}
+
+// sizeTransport 记录发送的最大消息
+type sizeTransport struct {
+	mqrpc.Transport
+	max int64
+}
+
+func (t *sizeTransport) Publish(subject string, data []byte) error {
+	for {
+		max := atomic.LoadInt64(&t.max)
+		if int64(len(data)) <= max || atomic.CompareAndSwapInt64(&t.max, max, int64(len(data))) {
+			break
+		}
+	}
+	return t.Transport.Publish(subject, data)
+}
+
+func TestCompression(t *testing.T) {
+	payload := strings.Repeat("mqant", 20000)
+	for _, name := range []string{"", mqrpc.CompressGzip, mqrpc.CompressSnappy, mqrpc.CompressZstd} {
+		tr := &sizeTransport{Transport: transport.NewLocalTransport()}
+		app := &testApp{
+			opts: module.Options{
+				Transport:         tr,
+				RPCExpired:        time.Second * 3,
+				Compression:       name,
+				CompressThreshold: 1024,
+				DisableLocalCall:  true,
+			},
+		}
+		server, err := NewRPCServer(app, &testModule{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.RegisterGO("echo", func(s string) (string, error) {
+			return s, nil
+		})
+		client, err := NewRPCClient(app, &testSession{node: &registry.Node{
+			Id:       "test@1",
+			Address:  server.Addr(),
+			Metadata: map[string]string{mqrpc.CompressionsMetadataKey: strings.Join(mqrpc.CompressorNames(), ",")},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"small", payload} {
+			r, err := client.CallWithError(context.Background(), "echo", s)
+			if err != nil || r != s {
+				t.Fatalf("%s echo error %v", name, err)
+			}
+		}
+		compressed := atomic.LoadInt64(&tr.max) < int64(len(payload))
+		if compressed != (name != "") {
+			t.Fatalf("%s max message %d", name, tr.max)
+		}
+		tr.Close()
+	}
+}
+
+func TestChunkAssemblerLimit(t *testing.T) {
+	a := newChunkAssembler(&testApp{opts: module.Options{RPCChunkMemory: 64 * 1024}})
+	defer a.close()
+	//分块数过多时不分配重组缓存
+	if _, err := a.add("a", math.MaxInt32-1, math.MaxInt32, []byte("x")); err == nil || len(a.pending) != 0 {
+		t.Fatalf("huge total got %v", err)
+	}
+	//最后一个分块也检查消息大小
+	if _, err := a.add("b", 1, 2, make([]byte, 64*1024)); err == nil {
+		t.Fatal("last chunk over limit accepted")
+	}
+	if _, err := a.add("c", 0, 3, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add("c", 2, 3, make([]byte, 64000)); err == nil {
+		t.Fatal("estimated size over limit accepted")
+	}
+	if _, err := a.add("d", 1, 2, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if full, err := a.add("d", 0, 2, []byte("ab")); err != nil || string(full) != "abc" {
+		t.Fatalf("assemble got %q %v", full, err)
+	}
+	if a.size != 0 {
+		t.Fatalf("pending size %d after assemble", a.size)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for _, name := range []string{mqrpc.CompressGzip, mqrpc.CompressSnappy, mqrpc.CompressZstd} {
+		c := mqrpc.GetCompressor(name)
+		b, err := c.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Decompress(b, 1024); err != mqrpc.ErrDecompressSize {
+			t.Fatalf("%s decompress over limit got %v", name, err)
+		}
+		if r, err := c.Decompress(b, int64(len(data))); err != nil || len(r) != len(data) {
+			t.Fatalf("%s decompress got %d %v", name, len(r), err)
+		}
+		//多个参数的总大小超过上限
+		if _, err := decompressArgs(name, [][]byte{b, b}, int64(len(data))+1); err != mqrpc.ErrDecompressSize {
+			t.Fatalf("%s decompress args got %v", name, err)
+		}
+	}
+}
+
+func TestChunked(t *testing.T) {
+	tr := &sizeTransport{Transport: transport.NewLocalTransport()}
+	defer tr.Close()
+	app := &testApp{
+		opts: module.Options{
+			Transport:        tr,
+			RPCExpired:       time.Second * 3,
+			RPCMaxPayload:    4096,
+			RPCChunkMemory:   64 * 1024,
+			DisableLocalCall: true,
+		},
+	}
+	server, err := NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterGO("echo", func(s string) (string, error) {
+		return s, nil
+	})
+	server.RegisterGO("big", func(n int64) (string, error) {
+		return strings.Repeat("r", int(n)), nil
+	})
+	client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.Repeat("mqant", 10000)
+	r, err := client.CallWithError(context.Background(), "echo", payload)
+	if err != nil || r != payload {
+		t.Fatalf("chunked echo error %v", err)
+	}
+	if max := atomic.LoadInt64(&tr.max); max > 4096 {
+		t.Fatalf("message size %d exceeds max payload", max)
+	}
+	//超过内存上限时立即返回错误
+	start := time.Now()
+	_, err = client.CallWithError(context.Background(), "echo", strings.Repeat("x", 100*1024))
+	if mqrpc.ErrorCode(err) != mqrpc.CodeUnavailable || time.Since(start) > time.Second {
+		t.Fatalf("request over memory limit got %v", err)
+	}
+	_, err = client.CallWithError(context.Background(), "big", int64(100*1024))
+	if mqrpc.ErrorCode(err) != mqrpc.CodeUnavailable || time.Since(start) > time.Second {
+		t.Fatalf("result over memory limit got %v", err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	server.RegisterGO("slow", func() (string, error) {
+		started <- struct{}{}
+		<-release
+		return "ok", nil
+	}, mqrpc.WithLimit(mqrpc.LimitPolicy{MaxConcurrent: 1, MaxQueue: 1}))
+	server.RegisterGO("fast", func() (string, error) {
+		return "ok", nil
+	})
+	waitStats := func(cond func(mqrpc.LimitStats) bool) {
+		for i := 0; i < 300; i++ {
+			_, handlers := server.GetLimitStats()
+			if cond(handlers["slow"]) {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("wait limit stats timeout")
+	}
+	results := make(chan error, 2)
+	call := func() {
+		_, err := client.CallWithError(context.Background(), "slow")
+		results <- err
+	}
+	go call()
+	<-started
+	go call()
+	waitStats(func(s mqrpc.LimitStats) bool { return s.Queued == 1 })
+	//排队已满时立即拒绝
+	if _, err := client.CallWithError(context.Background(), "slow"); mqrpc.ErrorCode(err) != mqrpc.CodeOverloaded {
+		t.Fatalf("queue full got %v", err)
+	}
+	//繁忙的handler不影响其他handler
+	if r, err := client.CallWithError(context.Background(), "fast"); err != nil || r != "ok" {
+		t.Fatalf("fast got %v %v", r, err)
+	}
+	if _, handlers := server.GetLimitStats(); handlers["slow"] != (mqrpc.LimitStats{Executing: 1, Queued: 1, Rejected: 1}) {
+		t.Fatalf("stats %+v", handlers["slow"])
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitStats(func(s mqrpc.LimitStats) bool { return s.Executing == 0 && s.Queued == 0 })
+	_ = client.Done()
+	_ = server.Done()
+}
+
+func TestModuleLimit(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	//模块的限制,排队超时后拒绝
+	server.SetLimit(mqrpc.LimitPolicy{MaxConcurrent: 1, MaxQueue: 1, MaxQueueWait: time.Millisecond * 50})
+	server.RegisterGO("fast", func() (string, error) {
+		return "ok", nil
+	})
+	results := make(chan error, 1)
+	block := make(chan struct{})
+	server.RegisterGO("block", func() (string, error) {
+		<-block
+		return "ok", nil
+	})
+	go func() {
+		_, err := client.CallWithError(context.Background(), "block")
+		results <- err
+	}()
+	for i := 0; i < 300; i++ {
+		if module, _ := server.GetLimitStats(); module.Executing == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err := client.CallWithError(context.Background(), "fast"); mqrpc.ErrorCode(err) != mqrpc.CodeOverloaded {
+		t.Fatalf("queue wait got %v", err)
+	}
+	close(block)
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+	if module, _ := server.GetLimitStats(); module.Rejected != 1 {
+		t.Fatalf("module stats %+v", module)
+	}
+	_ = client.Done()
+	_ = server.Done()
+}
+
+func TestModuleLimitSerial(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.SetLimit(mqrpc.LimitPolicy{MaxConcurrent: 2, MaxQueue: 10})
+	block := make(chan struct{})
+	server.RegisterGO("block", func() (string, error) {
+		<-block
+		return "ok", nil
+	})
+	var (
+		running int32
+		overlap int32
+		mu      sync.Mutex
+		order   []int64
+	)
+	//排队的请求仍然依次执行
+	server.Register("seq", func(n int64) (string, error) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		time.Sleep(time.Millisecond * 20)
+		mu.Lock()
+		order = append(order, n)
+		mu.Unlock()
+		atomic.AddInt32(&running, -1)
+		return "", nil
+	})
+	for i := 0; i < 2; i++ {
+		go client.CallWithError(context.Background(), "block")
+	}
+	for i := 0; i < 300; i++ {
+		if module, _ := server.GetLimitStats(); module.Executing == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := int64(1); i <= 4; i++ {
+		if err := client.CallNR("seq", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(block)
+	for i := 0; i < 300; i++ {
+		mu.Lock()
+		n := len(order)
+		mu.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(order) != "[1 2 3 4]" || atomic.LoadInt32(&overlap) != 0 {
+		t.Fatalf("serial handler order %v overlap %d", order, overlap)
+	}
+}
+
+func TestSerialLimitIsolation(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	done := make(chan int64, 4)
+	server.Register("slow", func(n int64) (string, error) {
+		done <- n
+		return "", nil
+	}, mqrpc.WithLimit(mqrpc.LimitPolicy{MaxConcurrent: 1, MaxQueue: 10}))
+	server.Register("other", func() (string, error) {
+		return "ok", nil
+	})
+	//占满slow的执行许可,之后的请求都需要排队
+	limiter := server.GetFunctions()["slow"].Limiter
+	if !limiter.TryAcquire() {
+		t.Fatal("acquire slow")
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := client.CallNR("slow", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//排队的slow请求不影响其他handler
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	if r, err := client.CallWithError(ctx, "other"); err != nil || r != "ok" {
+		t.Fatalf("other got %v %v", r, err)
+	}
+	limiter.Release()
+	for i := int64(1); i <= 3; i++ {
+		select {
+		case n := <-done:
+			if n != i {
+				t.Fatalf("slow order got %d want %d", n, i)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("slow timeout")
+		}
+	}
+}
+
+type keySession struct {
+	uid, sid string
+}
+
+func (s keySession) GetUserID() string    { return s.uid }
+func (s keySession) GetSessionID() string { return s.sid }
+
+func TestKeyed(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	var (
+		mu       sync.Mutex
+		seqs     = map[string][]int64{}
+		running  int64
+		parallel int64
+		done     = make(chan struct{}, 100)
+	)
+	server.RegisterKeyed("move", func(key string, n int64) (string, error) {
+		if r := atomic.AddInt64(&running, 1); r > 1 {
+			atomic.StoreInt64(&parallel, r)
+		}
+		time.Sleep(time.Millisecond * time.Duration(n%3))
+		mu.Lock()
+		seqs[key] = append(seqs[key], n)
+		mu.Unlock()
+		atomic.AddInt64(&running, -1)
+		done <- struct{}{}
+		return key, nil
+	}, mqrpc.ArgKey(0))
+	keys := []string{"a", "b", "c", "d"}
+	for n := int64(0); n < 25; n++ {
+		for _, key := range keys {
+			if err := client.CallNR("move", key, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 3):
+			t.Fatal("keyed call timeout")
+		}
+	}
+	for _, key := range keys {
+		if len(seqs[key]) != 25 {
+			t.Fatalf("key %s got %v", key, seqs[key])
+		}
+		for i, n := range seqs[key] {
+			if n != int64(i) {
+				t.Fatalf("key %s out of order %v", key, seqs[key])
+			}
+		}
+	}
+	if atomic.LoadInt64(&parallel) == 0 {
+		t.Fatal("different keys should run in parallel")
+	}
+	if r, err := client.CallWithError(context.Background(), "move", "a", int64(0)); err != nil || r != "a" {
+		t.Fatalf("keyed call got %v %v", r, err)
+	}
+	if key := mqrpc.SessionKey([]interface{}{"x", keySession{uid: "u1", sid: "s1"}}); key != "u1" {
+		t.Fatalf("SessionKey got %v", key)
+	}
+	if key := mqrpc.SessionKey([]interface{}{keySession{sid: "s1"}}); key != "s1" {
+		t.Fatalf("SessionKey got %v", key)
+	}
+	_ = client.Done()
+	_ = server.Done()
+}
+
+func TestDeadLetter(t *testing.T) {
+	app, server, client := newTestRPC(t)
+	defer app.Transport().Close()
+	server.SetDeadLetterSink(mqrpc.NewMemoryDeadLetterSink(10))
+	var calls int64
+	done := make(chan struct{}, 1)
+	server.RegisterGO("save", func(n int64) (string, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			panic("db down")
+		}
+		done <- struct{}{}
+		return "", nil
+	})
+	if err := client.CallNR("save", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CallNR("missing"); err != nil {
+		t.Fatal(err)
+	}
+	var letters []*mqrpc.DeadLetter
+	for i := 0; i < 300 && len(letters) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+		letters, _ = server.DeadLetters()
+	}
+	if len(letters) != 2 {
+		t.Fatalf("dead letters %v", letters)
+	}
+	codes := map[string]int32{}
+	for _, letter := range letters {
+		codes[letter.Request.Fn] = letter.Error.Code
+	}
+	if codes["save"] != mqrpc.CodeInternal || codes["missing"] != mqrpc.CodeNotFound {
+		t.Fatalf("dead letter codes %v", codes)
+	}
+	for _, letter := range letters {
+		if letter.Request.Fn != "save" {
+			continue
+		}
+		if err := server.Redrive(letter.ID); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second * 3):
+			t.Fatal("redrive timeout")
+		}
+		if err := server.Redrive(letter.ID); mqrpc.ErrorCode(err) != mqrpc.CodeNotFound {
+			t.Fatalf("redrive twice got %v", err)
+		}
+	}
+	if letters, _ = server.DeadLetters(); len(letters) != 1 || letters[0].Request.Fn != "missing" {
+		t.Fatalf("dead letters after redrive %v", letters)
+	}
+	//Register 的handler中也可以Redrive,重新执行的请求排在当前请求之后,不会并发执行
+	var serialCalls, running, overlap int64
+	server.Register("serial", func(n int64) (string, error) {
+		if atomic.AddInt64(&running, 1) > 1 {
+			atomic.StoreInt64(&overlap, 1)
+		}
+		defer atomic.AddInt64(&running, -1)
+		if atomic.AddInt64(&serialCalls, 1) == 1 {
+			return "", mqrpc.NewError(mqrpc.CodeUnavailable, "retry later")
+		}
+		done <- struct{}{}
+		return "", nil
+	})
+	server.Register("redrive", func(id string) (string, error) {
+		atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		if err := server.Redrive(id); err != nil {
+			return "", err
+		}
+		time.Sleep(time.Millisecond * 20)
+		return "", nil
+	})
+	if err := client.CallNR("serial", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for i := 0; i < 300 && id == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+		letters, _ = server.DeadLetters()
+		for _, letter := range letters {
+			if letter.Request.Fn == "serial" {
+				id = letter.ID
+			}
+		}
+	}
+	if _, err := client.CallWithError(context.Background(), "redrive", id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("redrive timeout")
+	}
+	if atomic.LoadInt64(&overlap) != 0 {
+		t.Fatal("redriven request ran concurrently with a Register handler")
+	}
+	_ = client.Done()
+	_ = server.Done()
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	sink, err := mqrpc.NewFileDeadLetterSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, id := range []string{"b", "a"} {
+		err := sink.Put(&mqrpc.DeadLetter{
+			ID:      id,
+			Module:  "test",
+			Time:    now.Add(time.Duration(i) * time.Second),
+			Request: &rpcpb.RPCInfo{Fn: "save", Args: [][]byte{[]byte(id)}},
+			Error:   mqrpc.FromError(mqrpc.Timeout("timeout")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	letters, err := sink.List()
+	if err != nil || len(letters) != 2 || letters[0].ID != "b" || string(letters[1].Request.Args[0]) != "a" || letters[1].Error.Code != mqrpc.CodeTimeout {
+		t.Fatalf("list got %v %v", letters, err)
+	}
+	if err := sink.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Get("b"); mqrpc.ErrorCode(err) != mqrpc.CodeNotFound {
+		t.Fatalf("get removed got %v", err)
+	}
+	if err := sink.Put(&mqrpc.DeadLetter{ID: "../x"}); mqrpc.ErrorCode(err) != mqrpc.CodeInvalidArgs {
+		t.Fatalf("invalid id got %v", err)
+	}
+}
+
+type localPoint struct {
+	X int
+}
+
+func TestLocalShortCircuit(t *testing.T) {
+	tr := &sizeTransport{Transport: transport.NewLocalTransport()}
+	defer tr.Close()
+	app := &testApp{
+		opts: module.Options{
+			Transport:  tr,
+			RPCExpired: time.Second * 3,
+		},
+	}
+	module.LocalPassthrough(&localPoint{})(&app.opts)
+	server, err := NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterGO("hello", func(name string) (string, error) {
+		return "hello " + name, nil
+	})
+	server.RegisterGO("move", func(p *localPoint) (*localPoint, error) {
+		p.X++
+		return p, nil
+	})
+	notify := make(chan string, 1)
+	server.Register("notify", func(name string) (string, error) {
+		notify <- name
+		return "", nil
+	})
+	canceled := make(chan error, 1)
+	server.RegisterGO("block", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return "", ctx.Err()
+	})
+
+	r, err := client.CallWithError(context.Background(), "hello", "mqant")
+	if err != nil || r != "hello mqant" {
+		t.Fatalf("Call got %v %v", r, err)
+	}
+	//可信的类型不经过序列化,调用方与handler共享同一个值
+	p := &localPoint{X: 1}
+	r, err = client.CallWithError(context.Background(), "move", p)
+	if err != nil || r != p || p.X != 2 {
+		t.Fatalf("passthrough got %v %v", r, err)
+	}
+	if err := client.CallNR("notify", "mqant"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-notify:
+		if name != "mqant" {
+			t.Fatalf("CallNR got %v", name)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("CallNR timeout")
+	}
+	//调用方取消时通知本地的handler
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	if _, err := client.CallWithError(ctx, "block"); mqrpc.ErrorCode(err) != mqrpc.CodeCanceled {
+		t.Fatalf("cancel got %v", err)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("handler ctx error %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler ctx not canceled")
+	}
+	//流式调用同样不经过传输层
+	server.RegisterGO("echo", func(stream mqrpc.Stream) error {
+		for {
+			var msg string
+			if err := stream.Recv(&msg); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if err := stream.Send("echo " + msg); err != nil {
+				return err
+			}
+		}
+	})
+	stream, err := client.Stream(context.Background(), "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := int(mqrpc.DefaultStreamWindow*2 + 1)
+	for i := 0; i < count; i++ {
+		var reply string
+		if err := stream.Send(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Recv(&reply); err != nil || reply != "echo "+strconv.Itoa(i) {
+			t.Fatalf("local stream got %q %v", reply, err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := stream.Recv(&reply); err != io.EOF {
+		t.Fatalf("local stream end got %v", err)
+	}
+	//请求没有经过传输层
+	if max := atomic.LoadInt64(&tr.max); max != 0 {
+		t.Fatalf("transport published %d bytes", max)
+	}
+
+	//服务节点注销后不再本地调用
+	_ = server.Done()
+	if lookupLocal(app, server.Addr()) != nil {
+		t.Fatal("server still registered after Done")
+	}
+	_ = client.Done()
+}
@@ -0,0 +1,562 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package defaultrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/pb"
+	"github.com/liangdas/mqant/rpc/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrStreamClosed 流已经关闭
+var ErrStreamClosed = errors.New("stream closed")
+
+// streamChunk 流中的一个消息,请求方向来自RPCInfo,应答方向来自ResultInfo
+type streamChunk struct {
+	typ      int32
+	seq      int64
+	credit   int64
+	argsType string
+	data     []byte
+	err      error //StreamEnd 携带的错误,保留错误码
+}
+
+// streamRequest mqrpc.Request 实现
+type streamRequest struct {
+	service string
+	method  string
+	params  []interface{}
+}
+
+func (r *streamRequest) Service() string      { return r.service }
+func (r *streamRequest) Method() string       { return r.method }
+func (r *streamRequest) ContentType() string  { return "application/x-mqant" }
+func (r *streamRequest) Request() interface{} { return r.params }
+func (r *streamRequest) Stream() bool         { return true }
+
+// rpcStream 客户端与服务端共用的流实现
+// 每个方向的数据块都带有序号,接收方按序号重排;发送方受对方授予的Credit限制
+type rpcStream struct {
+	lastRecv int64 //最后一次收到对端消息的时间(UnixNano),原子操作
+	ctx      context.Context
+	cancel   context.CancelFunc
+	app      module.App
+	request  *streamRequest
+	window   int64
+	//write 把一个数据块发给对端
+	write func(chunk *streamChunk) error
+	//onEnd 对端结束发送时回调
+	onEnd func()
+	//finish 流结束时回调,用于清理
+	finish func()
+	doneCh chan struct{}
+
+	mu         sync.Mutex
+	sendSeq    int64
+	credit     int64
+	creditCh   chan struct{}
+	sendClosed bool
+	nextSeq    int64
+	pending    map[int64]*streamChunk
+	recvCh     chan *streamChunk
+	consumed   int64
+	recvErr    error
+	err        error
+	finished   bool
+}
+
+func newRPCStream(ctx context.Context, app module.App, request *streamRequest, window int64, write func(chunk *streamChunk) error) *rpcStream {
+	if window <= 0 {
+		window = mqrpc.DefaultStreamWindow
+	}
+	s := &rpcStream{
+		app:      app,
+		request:  request,
+		window:   window,
+		write:    write,
+		credit:   window,
+		creditCh: make(chan struct{}, 1),
+		pending:  map[int64]*streamChunk{},
+		recvCh:   make(chan *streamChunk, window+1),
+		doneCh:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.lastRecv = time.Now().UnixNano()
+	go s.keepalive(mqrpc.DefaultStreamHeartbeat)
+	return s
+}
+
+// keepalive 定时向对端发送心跳,超过3个间隔没有收到对端的消息时认为对端已经退出并取消流
+// 没有超时时间的流不会因为对端异常退出而一直阻塞在Send或Recv中
+func (s *rpcStream) keepalive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.doneCh:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > interval*3 {
+			s.setError(mqrpc.NewError(mqrpc.CodeTimeout, "stream idle timeout"))
+			s.cancel()
+			return
+		}
+		if err := s.write(&streamChunk{typ: mqrpc.StreamAck}); err != nil {
+			log.Warning("rpc stream(%s) heartbeat error %v", s.request.method, err)
+		}
+	}
+}
+
+func (s *rpcStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *rpcStream) Request() mqrpc.Request {
+	return s.request
+}
+
+func (s *rpcStream) Error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *rpcStream) setError(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
+
+// Send 发送一个数据块,对端未确认的数量达到窗口上限时阻塞
+func (s *rpcStream) Send(v interface{}) error {
+	argsType, data, err := argsutil.ArgsTypeAnd2BytesWithCodec(s.app, mqrpc.MetadataValue(s.ctx, mqrpc.CodecMetadataKey), v)
+	if err != nil {
+		return err
+	}
+	for {
+		s.mu.Lock()
+		if s.sendClosed {
+			s.mu.Unlock()
+			return ErrStreamClosed
+		}
+		if s.credit > 0 {
+			s.credit--
+			seq := s.sendSeq
+			s.sendSeq++
+			s.mu.Unlock()
+			err = s.write(&streamChunk{
+				typ:      mqrpc.StreamData,
+				seq:      seq,
+				argsType: argsType,
+				data:     data,
+			})
+			if err != nil {
+				s.setError(err)
+			}
+			return err
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.creditCh:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// Recv 接收一个数据块并解析到v(指针), 对端正常结束时返回io.EOF
+func (s *rpcStream) Recv(v interface{}) error {
+	s.mu.Lock()
+	if s.recvErr != nil {
+		err := s.recvErr
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+	var chunk *streamChunk
+	select {
+	case chunk = <-s.recvCh:
+	default:
+		//已经收到的数据优先于取消
+		select {
+		case chunk = <-s.recvCh:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	if chunk.typ == mqrpc.StreamEnd {
+		err := io.EOF
+		if chunk.err != nil {
+			err = chunk.err
+			s.setError(err)
+		}
+		s.mu.Lock()
+		s.recvErr = err
+		finished := s.finished
+		s.mu.Unlock()
+		if finished {
+			//流已经结束且数据都已读取
+			s.cancel()
+		}
+		return err
+	}
+	s.mu.Lock()
+	s.consumed++
+	credit := int64(0)
+	if s.consumed >= (s.window+1)/2 {
+		//把已经消费的数量还给对端
+		credit = s.consumed
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+	if credit > 0 {
+		if err := s.write(&streamChunk{typ: mqrpc.StreamAck, credit: credit}); err != nil {
+			log.Warning("rpc stream(%s) ack error %v", s.request.method, err)
+		}
+	}
+	return decodeValue(s.app, chunk.argsType, chunk.data, v)
+}
+
+// Close 结束发送方向,对端Recv会得到io.EOF
+func (s *rpcStream) Close() error {
+	return s.closeSend(nil)
+}
+
+// closeSend 结束发送方向
+func (s *rpcStream) closeSend(err error) error {
+	s.mu.Lock()
+	if s.sendClosed {
+		s.mu.Unlock()
+		return ErrStreamClosed
+	}
+	s.sendClosed = true
+	seq := s.sendSeq
+	s.sendSeq++
+	s.mu.Unlock()
+	return s.write(&streamChunk{typ: mqrpc.StreamEnd, seq: seq, err: err})
+}
+
+// onChunk 收到对端的消息
+func (s *rpcStream) onChunk(chunk *streamChunk) {
+	atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+	switch chunk.typ {
+	case mqrpc.StreamAck:
+		s.mu.Lock()
+		s.credit += chunk.credit
+		s.mu.Unlock()
+		select {
+		case s.creditCh <- struct{}{}:
+		default:
+		}
+		return
+	case mqrpc.StreamCancel:
+		s.setError(context.Canceled)
+		s.cancel()
+		return
+	}
+	s.mu.Lock()
+	if chunk.seq < s.nextSeq {
+		//重复的消息
+		s.mu.Unlock()
+		return
+	}
+	if chunk.seq > s.nextSeq {
+		if int64(len(s.pending)) > s.window {
+			s.protocolError(fmt.Errorf("rpc stream(%s) out of order chunks exceed the window", s.request.method))
+		} else {
+			s.pending[chunk.seq] = chunk
+		}
+		s.mu.Unlock()
+		return
+	}
+	ended := s.push(chunk)
+	for {
+		next, ok := s.pending[s.nextSeq]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.nextSeq)
+		ended = s.push(next) || ended
+	}
+	s.mu.Unlock()
+	if ended && s.onEnd != nil {
+		s.onEnd()
+	}
+}
+
+// push 按顺序投递,返回对端是否已经结束发送
+func (s *rpcStream) push(chunk *streamChunk) bool {
+	s.nextSeq++
+	select {
+	case s.recvCh <- chunk:
+	default:
+		s.protocolError(fmt.Errorf("rpc stream(%s) receive buffer overflow", s.request.method))
+	}
+	return chunk.typ == mqrpc.StreamEnd
+}
+
+func (s *rpcStream) protocolError(err error) {
+	log.Warning("%v", err)
+	if s.err == nil {
+		s.err = err
+	}
+	s.cancel()
+}
+
+// done 流彻底结束,不会再收到对端的消息
+func (s *rpcStream) done() {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.mu.Unlock()
+	close(s.doneCh)
+	if s.finish != nil {
+		s.finish()
+	}
+}
+
+// decodeValue 把收到的数据解析到v中,v必须为指针
+func decodeValue(app module.App, argsType string, data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	if pb, ok := v.(mqrpc.Marshaler); ok {
+		return pb.Unmarshal(data)
+	}
+	if pb, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, pb)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Recv(non-pointer %v)", reflect.TypeOf(v))
+	}
+	ty, err := argsutil.Bytes2Args(app, argsType, data)
+	if err != nil {
+		return err
+	}
+	elem := rv.Elem()
+	switch v2 := ty.(type) {
+	case *mqrpc.Encoded:
+		if _, ok := v.(*interface{}); !ok {
+			return v2.Decode(v)
+		}
+	case nil:
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	case []uint8:
+		if !reflect.TypeOf(ty).AssignableTo(elem.Type()) {
+			return json.Unmarshal(v2, v)
+		}
+	}
+	val := reflect.ValueOf(ty)
+	if !val.Type().AssignableTo(elem.Type()) {
+		return fmt.Errorf("Recv %v can not assign to %v", val.Type(), elem.Type())
+	}
+	elem.Set(val)
+	return nil
+}
+
+// _runStream 执行流式handler  func(stream mqrpc.Stream, params...) error
+// 流在当前协程中登记,保证后续消息能找到它, handler在独立的协程中执行
+func (s *RPCServer) _runStream(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, release func()) {
+	rpcInfo := callInfo.RPCInfo
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
+	if len(rpcInfo.Args) != functionInfo.FuncType.NumIn()-1 {
+		s._errorStream(start, callInfo, mqrpc.InvalidArgs("The number of params %v is not adapted.%v", rpcInfo.Args, functionInfo.Function.String()))
+		return
+	}
+	_, input, err := s.decodeArgs(functionInfo.InType[1:], callInfo)
+	if err != nil {
+		s._errorStream(start, callInfo, mqrpc.NewError(mqrpc.CodeSerialization, err.Error()))
+		return
+	}
+	if s.listener != nil {
+		errs := s.listener.BeforeHandle(rpcInfo.Fn, callInfo)
+		if errs != nil {
+			s._errorStream(start, callInfo, errs)
+			return
+		}
+	}
+	request := &streamRequest{
+		service: s.module.GetType(),
+		method:  rpcInfo.Fn,
+		params:  input,
+	}
+	ctx, cancel := s.newContext(rpcInfo)
+	stream := newRPCStream(ctx, s.app, request, rpcInfo.Credit, func(chunk *streamChunk) error {
+		result := &rpcpb.ResultInfo{
+			Cid:        rpcInfo.Cid,
+			ResultType: chunk.argsType,
+			Result:     chunk.data,
+			StreamType: chunk.typ,
+			Seq:        chunk.seq,
+			Credit:     chunk.credit,
+		}
+		mqrpc.SetResultError(result, chunk.err)
+		return callInfo.Agent.(mqrpc.MQServer).Callback(&mqrpc.CallInfo{
+			RPCInfo: rpcInfo,
+			Props:   callInfo.Props,
+			Agent:   callInfo.Agent,
+			Result:  result,
+		})
+	})
+	stream.finish = func() {
+		s.streams.Delete(rpcInfo.Cid)
+		cancel()
+	}
+	s.streams.Store(rpcInfo.Cid, stream)
+
+	s.wg.Add(1)
+	atomic.AddInt64(&s.executing, 1)
+	started = true
+	go s._execStream(start, functionInfo, callInfo, stream, input, release)
+}
+
+func (s *RPCServer) _execStream(start time.Time, functionInfo *mqrpc.FunctionInfo, callInfo *mqrpc.CallInfo, stream *rpcStream, input []interface{}, release func()) {
+	rpcInfo := callInfo.RPCInfo
+	var rerr error
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 1024)
+			l := runtime.Stack(buf, false)
+			rerr = mqrpc.Errorf(mqrpc.CodeInternal, "%s rpc stream func(%s) error %v\n ----Stack----\n%s", s.module.GetType(), rpcInfo.Fn, r, string(buf[:l]))
+			log.Error(rerr.Error())
+		}
+		if err := stream.closeSend(rerr); err != nil && err != ErrStreamClosed {
+			log.Warning("rpc stream(%s) close error %v", rpcInfo.Fn, err)
+		}
+		stream.done()
+		stream.cancel()
+		release()
+		s.wg.Add(-1)
+		atomic.AddInt64(&s.executing, -1)
+		if s.control != nil {
+			s.control.Finish()
+		}
+		resultInfo := rpcpb.NewResultInfo(rpcInfo.Cid, "", argsutil.NULL, nil)
+		mqrpc.SetResultError(resultInfo, rerr)
+		resultInfo.StreamType = mqrpc.StreamEnd
+		callInfo.Result = resultInfo
+		callInfo.ExecTime = time.Since(start).Nanoseconds()
+		if s.app.Options().ServerRPCHandler != nil {
+			s.app.Options().ServerRPCHandler(s.app, s.module, callInfo)
+		}
+		if s.listener != nil {
+			if rerr != nil {
+				s.listener.OnError(rpcInfo.Fn, callInfo, rerr)
+			} else {
+				s.listener.OnComplete(rpcInfo.Fn, callInfo, resultInfo, callInfo.ExecTime)
+			}
+		}
+	}()
+
+	handler := func(ctx context.Context, req *mqrpc.HandlerRequest) (interface{}, error) {
+		in, err := argsValues(functionInfo.InType[1:], req.Args)
+		if err != nil {
+			return nil, err
+		}
+		out := functionInfo.Function.Call(append([]reflect.Value{reflect.ValueOf(stream)}, in...))
+		if len(out) > 0 {
+			switch e := out[len(out)-1].Interface().(type) {
+			case string:
+				if e != "" {
+					return nil, mqrpc.NewError(mqrpc.CodeBusiness, e)
+				}
+			case error:
+				return nil, e
+			}
+		}
+		return nil, nil
+	}
+	_, err := mqrpc.ChainMiddlewares(s.middlewares, handler)(stream.ctx, &mqrpc.HandlerRequest{
+		Fn:           rpcInfo.Fn,
+		CallInfo:     callInfo,
+		FunctionInfo: functionInfo,
+		Args:         input,
+	})
+	if err != nil {
+		rerr = err
+	}
+}
+
+// _errorStream 流式handler无法执行时直接结束流
+func (s *RPCServer) _errorStream(start time.Time, callInfo *mqrpc.CallInfo, err error) {
+	resultInfo := rpcpb.NewResultInfo(callInfo.RPCInfo.Cid, "", argsutil.NULL, nil)
+	mqrpc.SetResultError(resultInfo, err)
+	resultInfo.StreamType = mqrpc.StreamEnd
+	callInfo.Result = resultInfo
+	callInfo.ExecTime = time.Since(start).Nanoseconds()
+	s.doCallback(callInfo)
+	if s.control != nil {
+		s.control.Finish()
+	}
+	if s.listener != nil {
+		s.listener.OnError(callInfo.RPCInfo.Fn, callInfo, err)
+	}
+}
+
+// onStreamMessage 客户端发来的流数据/流控/取消消息
+func (s *RPCServer) onStreamMessage(rpcInfo *rpcpb.RPCInfo) {
+	stream, ok := s.streams.Load(rpcInfo.Cid)
+	if !ok {
+		if rpcInfo.StreamType == mqrpc.StreamCancel {
+			//普通请求的取消
+			if cancel, ok := s.calls.Load(rpcInfo.Cid); ok {
+				cancel.(context.CancelFunc)()
+			}
+		}
+		//流已经结束
+		return
+	}
+	chunk := &streamChunk{
+		typ:    rpcInfo.StreamType,
+		seq:    rpcInfo.Seq,
+		credit: rpcInfo.Credit,
+	}
+	if len(rpcInfo.Args) > 0 && len(rpcInfo.ArgsType) > 0 {
+		chunk.argsType = rpcInfo.ArgsType[0]
+		chunk.data = rpcInfo.Args[0]
+	}
+	stream.(*rpcStream).onChunk(chunk)
+}
@@ -0,0 +1,277 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// 内置的编解码器
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecGob     = "gob"
+)
+
+const (
+	// CodecMetadataKey 请求头中记录本次调用使用的编解码器,服务端使用相同的编解码器编码结果
+	CodecMetadataKey = "mqant-codec"
+	// CodecsMetadataKey 节点元数据中记录服务端支持的编解码器,值为逗号分隔的名称
+	CodecsMetadataKey = "codecs"
+)
+
+// Codec 参数编解码器,用于传递没有实现 Marshaler/proto.Message 也没有注册 RPCSerialize 的普通类型
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type codecEntry struct {
+	codec    Codec
+	priority int
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   []codecEntry
+)
+
+func init() {
+	RegisterCodec(jsonCodec{}, 100)
+	RegisterCodec(msgpackCodec{}, 200)
+	RegisterCodec(gobCodec{}, 300)
+}
+
+// RegisterCodec 注册编解码器, priority越小越优先,相同时先注册的优先; 同名的编解码器会被替换
+func RegisterCodec(c Codec, priority int) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for i, e := range codecs {
+		if e.codec.Name() == c.Name() {
+			codecs = append(codecs[:i], codecs[i+1:]...)
+			break
+		}
+	}
+	codecs = append(codecs, codecEntry{codec: c, priority: priority})
+	sort.SliceStable(codecs, func(i, j int) bool {
+		return codecs[i].priority < codecs[j].priority
+	})
+}
+
+// GetCodec 获取编解码器,不存在时返回nil
+func GetCodec(name string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, e := range codecs {
+		if e.codec.Name() == name {
+			return e.codec
+		}
+	}
+	return nil
+}
+
+// CodecNames 按优先级排序的编解码器名称
+func CodecNames() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, len(codecs))
+	for i, e := range codecs {
+		names[i] = e.codec.Name()
+	}
+	return names
+}
+
+// NegotiateCodec 按本地的优先级选择对端也支持的编解码器
+// supported为对端节点元数据中的 CodecsMetadataKey, 为空(旧版本节点)或没有共同支持的编解码器时返回本地优先级最高的
+func NegotiateCodec(supported string) string {
+	names := CodecNames()
+	if len(names) == 0 {
+		return ""
+	}
+	if supported != "" {
+		remote := strings.Split(supported, ",")
+		for _, name := range names {
+			for _, r := range remote {
+				if r == name {
+					return name
+				}
+			}
+		}
+	}
+	return names[0]
+}
+
+type codecKey struct{}
+
+// WithCodec 声明这次调用使用的编解码器,优先于协商的结果
+func WithCodec(ctx context.Context, name string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, codecKey{}, name)
+}
+
+// CodecFromContext 获取ctx中声明的编解码器
+func CodecFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	name, _ := ctx.Value(codecKey{}).(string)
+	return name
+}
+
+// Codecable 类型能否使用 Codec 编码, chan、func、complex等类型不能编码
+func Codecable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128, reflect.Invalid:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return Codecable(t.Elem())
+	case reflect.Map:
+		return Codecable(t.Key()) && Codecable(t.Elem())
+	}
+	return true
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// CheckCodecType 检查类型的值能否使用 Codec 编码后还原为同一个类型
+// 规则与 encoding/json 一致: 结构体只检查导出的字段, map的key必须是字符串、整数或 encoding.TextUnmarshaler,
+// 非空的interface不知道具体类型,不能解码
+func CheckCodecType(t reflect.Type) error {
+	return checkCodecType(t, map[reflect.Type]bool{})
+}
+
+func checkCodecType(t reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		//递归的类型
+		return nil
+	}
+	seen[t] = true
+	if pt := reflect.PtrTo(t); pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return nil
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return nil
+		}
+		return fmt.Errorf("interface %v can not be decoded", t)
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkCodecType(t.Elem(), seen)
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !reflect.PtrTo(t.Key()).Implements(textUnmarshalerType) {
+				return fmt.Errorf("map key %v can not be decoded", t.Key())
+			}
+		}
+		return checkCodecType(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.PkgPath != "" && !(f.Anonymous && ft.Kind() == reflect.Struct) {
+				//未导出的字段不会被编码
+				continue
+			}
+			if f.Tag.Get("json") == "-" {
+				continue
+			}
+			if err := checkCodecType(f.Type, seen); err != nil {
+				return fmt.Errorf("field %v.%s: %v", t, f.Name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%v can not be encoded", t)
+}
+
+// Encoded 使用Codec编码的值,不知道目标类型时(例如调用结果)保持编码状态,使用 Decode 或 ResultAs 解码
+type Encoded struct {
+	Codec string //编解码器名称
+	Type  string //发送方的类型名称
+	Data  []byte
+}
+
+// Decode 把数据解码到v中,v必须为指针
+func (e *Encoded) Decode(v interface{}) error {
+	c := GetCodec(e.Codec)
+	if c == nil {
+		return fmt.Errorf("codec [%s] not registered", e.Codec)
+	}
+	return c.Unmarshal(e.Data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return CodecJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return CodecMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+	return b, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return CodecGob }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,204 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 内置的压缩算法
+const (
+	CompressGzip   = "gzip"
+	CompressSnappy = "snappy"
+	CompressZstd   = "zstd"
+)
+
+// CompressionsMetadataKey 节点元数据中记录服务端能够解压的算法,值为逗号分隔的名称
+const CompressionsMetadataKey = "compressions"
+
+// ErrDecompressSize 解压后的数据超过上限
+var ErrDecompressSize = NewError(CodeSerialization, "decompressed data exceeds the limit")
+
+// Compressor 消息压缩算法, 压缩 rpcpb.RPCInfo 的Args与 rpcpb.ResultInfo 的Result
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压, 解压后超过max字节时返回 ErrDecompressSize, max<=0 不限制
+	Decompress(data []byte, max int64) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
+
+// RegisterCompressor 注册压缩算法,同名的算法会被替换
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// GetCompressor 获取压缩算法,不存在时返回nil
+func GetCompressor(name string) Compressor {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	return compressors[name]
+}
+
+// CompressorNames 按名称排序的压缩算法
+func CompressorNames() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AcceptCompression 对端是否能够解压name算法, accept为逗号分隔的名称
+func AcceptCompression(accept, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, a := range strings.Split(accept, ",") {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return CompressGzip }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, ErrDecompressSize
+	}
+	return b, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return CompressSnappy }
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte, max int64) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(n) > max {
+		return nil, ErrDecompressSize
+	}
+	return snappy.Decode(nil, data)
+}
+
+// zstdCompressor 编码器与解码器都可以并发使用
+// 解码器的输出上限在创建时指定,每个上限缓存一个解码器
+type zstdCompressor struct {
+	encoder  *zstd.Encoder
+	mu       sync.Mutex
+	decoders map[int64]*zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	encoder, _ := zstd.NewWriter(nil)
+	return &zstdCompressor{encoder: encoder, decoders: map[int64]*zstd.Decoder{}}
+}
+
+func (c *zstdCompressor) decoder(max int64) (*zstd.Decoder, error) {
+	if max <= 0 {
+		max = 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d, ok := c.decoders[max]; ok {
+		return d, nil
+	}
+	var opts []zstd.DOption
+	if max > 0 {
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(max)))
+	}
+	d, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.decoders[max] = d
+	return d, nil
+}
+
+func (c *zstdCompressor) Name() string { return CompressZstd }
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte, max int64) ([]byte, error) {
+	d, err := c.decoder(max)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.DecodeAll(data, nil)
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, ErrDecompressSize
+	}
+	return b, err
+}
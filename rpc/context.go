@@ -0,0 +1,101 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/liangdas/mqant/log"
+)
+
+// 框架保留的元数据key
+const (
+	TraceIDKey = "mqant-trace-id"
+	SpanIDKey  = "mqant-span-id"
+)
+
+// ContextType handler中context参数的类型
+var ContextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Metadata 随调用链传递的元数据,对应 RPCInfo.Headers
+type Metadata map[string]string
+
+// Copy 复制一份元数据
+func (md Metadata) Copy() Metadata {
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+type metadataKey struct{}
+
+// NewContext 把元数据放入ctx,会与ctx中已有的元数据合并
+// 使用该ctx发起的Call会把元数据带给服务端,服务端handler收到的ctx中再发起的Call会继续传递
+func NewContext(ctx context.Context, md Metadata) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	old, _ := FromContext(ctx)
+	merged := old.Copy()
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// FromContext 获取ctx中的元数据,返回值不应被修改
+func FromContext(ctx context.Context) (Metadata, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	return md, ok
+}
+
+// WithMetadata 在ctx中设置一个元数据
+func WithMetadata(ctx context.Context, key, value string) context.Context {
+	return NewContext(ctx, Metadata{key: value})
+}
+
+// MetadataValue 获取ctx中的一个元数据
+func MetadataValue(ctx context.Context, key string) string {
+	md, _ := FromContext(ctx)
+	return md[key]
+}
+
+// ContextWithSpan 把链路追踪信息放入ctx的元数据
+func ContextWithSpan(ctx context.Context, span log.TraceSpan) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return NewContext(ctx, Metadata{
+		TraceIDKey: span.TraceId(),
+		SpanIDKey:  span.SpanId(),
+	})
+}
+
+// SpanFromContext 获取ctx中的链路追踪信息,没有时返回nil
+func SpanFromContext(ctx context.Context) log.TraceSpan {
+	md, _ := FromContext(ctx)
+	if md[TraceIDKey] == "" {
+		return nil
+	}
+	return &log.TraceSpanImp{
+		Trace: md[TraceIDKey],
+		Span:  md[SpanIDKey],
+	}
+}
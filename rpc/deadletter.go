@@ -0,0 +1,194 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/rpc/pb"
+)
+
+// DeadLetter 执行失败的CallNR消息(handler不存在、panic、超时或返回错误)
+type DeadLetter struct {
+	ID      string         `json:"id"`
+	Module  string         `json:"module"`
+	Time    time.Time      `json:"time"`
+	Request *rpcpb.RPCInfo `json:"request"`
+	Error   *Error         `json:"error"`
+}
+
+// DeadLetterSink 保存执行失败的CallNR消息, 实现需要支持并发调用
+type DeadLetterSink interface {
+	Put(letter *DeadLetter) error
+	// Get 获取一条消息,不存在时返回 CodeNotFound 错误
+	Get(id string) (*DeadLetter, error)
+	// List 按时间顺序列出所有消息
+	List() ([]*DeadLetter, error)
+	// Remove 删除一条消息,不存在时返回 CodeNotFound 错误
+	Remove(id string) error
+}
+
+// MemoryDeadLetterSink 保存在内存中,超过上限时丢弃最早的消息
+type MemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	max     int
+	letters []*DeadLetter
+}
+
+// NewMemoryDeadLetterSink 最多保存max条消息,小于等于0时不限制
+func NewMemoryDeadLetterSink(max int) *MemoryDeadLetterSink {
+	return &MemoryDeadLetterSink{max: max}
+}
+
+func (m *MemoryDeadLetterSink) Put(letter *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, letter)
+	if m.max > 0 && len(m.letters) > m.max {
+		m.letters = append(m.letters[:0:0], m.letters[len(m.letters)-m.max:]...)
+	}
+	return nil
+}
+
+func (m *MemoryDeadLetterSink) Get(id string) (*DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, letter := range m.letters {
+		if letter.ID == id {
+			return letter, nil
+		}
+	}
+	return nil, NotFound("dead letter %s not found", id)
+}
+
+func (m *MemoryDeadLetterSink) List() ([]*DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*DeadLetter(nil), m.letters...), nil
+}
+
+func (m *MemoryDeadLetterSink) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, letter := range m.letters {
+		if letter.ID == id {
+			m.letters = append(m.letters[:i], m.letters[i+1:]...)
+			return nil
+		}
+	}
+	return NotFound("dead letter %s not found", id)
+}
+
+// FileDeadLetterSink 每条消息保存为dir目录下的一个json文件,进程重启后仍然可以重新投递
+type FileDeadLetterSink struct {
+	dir string
+}
+
+// NewFileDeadLetterSink 目录不存在时自动创建
+func NewFileDeadLetterSink(dir string) (*FileDeadLetterSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{dir: dir}, nil
+}
+
+func (f *FileDeadLetterSink) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", InvalidArgs("invalid dead letter id %q", id)
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+func (f *FileDeadLetterSink) Put(letter *DeadLetter) error {
+	path, err := f.path(letter.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	//先写临时文件再改名,避免读到写了一半的文件
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *FileDeadLetterSink) Get(id string) (*DeadLetter, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, NotFound("dead letter %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err := json.Unmarshal(b, letter); err != nil {
+		return nil, fmt.Errorf("dead letter %s: %v", id, err)
+	}
+	return letter, nil
+}
+
+func (f *FileDeadLetterSink) List() ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var letters []*DeadLetter
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		letter, err := f.Get(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			if ErrorCode(err) == CodeNotFound {
+				//列出时被删除了
+				continue
+			}
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Time.Before(letters[j].Time)
+	})
+	return letters, nil
+}
+
+func (f *FileDeadLetterSink) Remove(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return NotFound("dead letter %s not found", id)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/liangdas/mqant/rpc/pb"
+)
+
+// 框架定义的错误码,业务自定义错误码建议从 CodeUser 开始
+const (
+	CodeOK            int32 = 0
+	CodeBusiness      int32 = 1   //handler返回的普通错误
+	CodeTimeout       int32 = 2   //调用超时
+	CodeCanceled      int32 = 3   //调用方取消
+	CodeNotFound      int32 = 4   //handler不存在
+	CodeInvalidArgs   int32 = 5   //参数个数或类型不匹配
+	CodeSerialization int32 = 6   //参数或结果编解码失败
+	CodeInternal      int32 = 7   //handler panic或定义错误
+	CodeUnavailable   int32 = 8   //没有可用的服务节点或消息发送失败
+	CodeOverloaded    int32 = 9   //服务端并发已满,请求被拒绝
+	CodeUser          int32 = 100 //业务自定义错误码的起始值
+)
+
+// Error rpc调用的错误,通过 rpcpb.ResultInfo 的 Error/ErrorCode/ErrorDetail 传递
+// handler可以直接返回 *Error 来指定错误码
+type Error struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Error 返回错误信息,与旧版本字符串形式的错误保持一致
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// String 包含错误码的完整描述
+func (e *Error) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// NewError 创建一个错误
+func NewError(code int32, message string) error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Errorf 创建一个错误
+func Errorf(code int32, format string, a ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// WithDetail 创建一个带详情的错误
+func WithDetail(code int32, message, detail string) error {
+	return &Error{
+		Code:    code,
+		Message: message,
+		Detail:  detail,
+	}
+}
+
+// FromError 把任意error转换为 *Error, 非 *Error 的错误视为业务错误
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{
+		Code:    CodeBusiness,
+		Message: err.Error(),
+	}
+}
+
+// ErrorCode 获取错误码,err为nil时返回CodeOK
+func ErrorCode(err error) int32 {
+	if err == nil {
+		return CodeOK
+	}
+	return FromError(err).Code
+}
+
+// ResultError 从调用结果中解析错误,没有错误时返回nil
+func ResultError(result *rpcpb.ResultInfo) error {
+	if result == nil || (result.Error == "" && result.ErrorCode == CodeOK) {
+		return nil
+	}
+	code := result.ErrorCode
+	if code == CodeOK {
+		//旧版本的服务端没有错误码
+		code = CodeBusiness
+	}
+	return &Error{
+		Code:    code,
+		Message: result.Error,
+		Detail:  result.ErrorDetail,
+	}
+}
+
+// SetResultError 把错误写入调用结果
+func SetResultError(result *rpcpb.ResultInfo, err error) {
+	e := FromError(err)
+	if e == nil {
+		return
+	}
+	result.Error = e.Message
+	result.ErrorCode = e.Code
+	result.ErrorDetail = e.Detail
+}
+
+// NotFound handler不存在
+func NotFound(format string, a ...interface{}) error {
+	return Errorf(CodeNotFound, format, a...)
+}
+
+// Timeout 调用超时
+func Timeout(format string, a ...interface{}) error {
+	return Errorf(CodeTimeout, format, a...)
+}
+
+// Canceled 调用方取消
+func Canceled(format string, a ...interface{}) error {
+	return Errorf(CodeCanceled, format, a...)
+}
+
+// InvalidArgs 参数个数或类型不匹配
+func InvalidArgs(format string, a ...interface{}) error {
+	return Errorf(CodeInvalidArgs, format, a...)
+}
+
+// Serialization 参数或结果编解码失败
+func Serialization(format string, a ...interface{}) error {
+	return Errorf(CodeSerialization, format, a...)
+}
+
+// Internal handler panic或定义错误
+func Internal(format string, a ...interface{}) error {
+	return Errorf(CodeInternal, format, a...)
+}
+
+// Unavailable 没有可用的服务节点或消息发送失败
+func Unavailable(format string, a ...interface{}) error {
+	return Errorf(CodeUnavailable, format, a...)
+}
+
+// Overloaded 服务端并发已满,请求被拒绝
+func Overloaded(format string, a ...interface{}) error {
+	return Errorf(CodeOverloaded, format, a...)
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"time"
+)
+
+// NodeResult 一个节点的调用结果
+type NodeResult struct {
+	ServerID string
+	Result   interface{}
+	Err      error
+}
+
+type hedgeKey struct{}
+
+// WithHedgeDelay 设置CallAny的对冲间隔: 先调用一个节点,每隔delay或上一个节点失败时再调用下一个节点
+// 未设置时同时调用所有节点
+func WithHedgeDelay(ctx context.Context, delay time.Duration) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, hedgeKey{}, delay)
+}
+
+// HedgeDelayFromContext 获取ctx中的对冲间隔
+func HedgeDelayFromContext(ctx context.Context) time.Duration {
+	if ctx == nil {
+		return 0
+	}
+	delay, _ := ctx.Value(hedgeKey{}).(time.Duration)
+	return delay
+}
+
+// CallAll 并发调用所有节点,共用ctx的超时时间,返回结果的顺序与servers一致
+func CallAll(ctx context.Context, servers []string, call func(ctx context.Context, serverID string) (interface{}, error)) []NodeResult {
+	results := make([]NodeResult, len(servers))
+	done := make(chan struct{}, len(servers))
+	for i, serverID := range servers {
+		go func(i int, serverID string) {
+			r, err := call(ctx, serverID)
+			results[i] = NodeResult{ServerID: serverID, Result: r, Err: err}
+			done <- struct{}{}
+		}(i, serverID)
+	}
+	for range servers {
+		<-done
+	}
+	return results
+}
+
+// CallAny 调用节点直到有一个成功,返回第一个成功的结果并取消其他调用
+// 所有节点都失败时返回最后一个失败的结果
+func CallAny(ctx context.Context, servers []string, call func(ctx context.Context, serverID string) (interface{}, error)) NodeResult {
+	if len(servers) == 0 {
+		return NodeResult{Err: Unavailable("no server available")}
+	}
+	delay := HedgeDelayFromContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resultCh := make(chan NodeResult, len(servers))
+	launch := func(serverID string) {
+		go func() {
+			r, err := call(ctx, serverID)
+			resultCh <- NodeResult{ServerID: serverID, Result: r, Err: err}
+		}()
+	}
+	next, pending := 0, 0
+	launchNext := func() {
+		launch(servers[next])
+		next++
+		pending++
+	}
+	if delay <= 0 {
+		for next < len(servers) {
+			launchNext()
+		}
+	} else {
+		launchNext()
+	}
+	var timer *time.Timer
+	if delay > 0 {
+		timer = time.NewTimer(delay)
+		defer timer.Stop()
+	}
+	var last NodeResult
+	for {
+		var hedge <-chan time.Time
+		if timer != nil && next < len(servers) {
+			hedge = timer.C
+		}
+		select {
+		case result := <-resultCh:
+			pending--
+			if result.Err == nil {
+				return result
+			}
+			last = result
+			if next < len(servers) && ctx.Err() == nil {
+				//失败后立即调用下一个节点
+				launchNext()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			} else if pending == 0 {
+				return last
+			}
+		case <-hedge:
+			//对冲: 已调用的节点还没有返回,再调用下一个节点
+			launchNext()
+			timer.Reset(delay)
+		}
+	}
+}
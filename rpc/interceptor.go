@@ -0,0 +1,48 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+)
+
+// Invocation 一次客户端调用的信息,拦截器可以修改其中的字段
+type Invocation struct {
+	ServerID string        //目标节点ID
+	Service  string        //目标服务名称
+	Method   string        //调用的handler
+	Reply    bool          //是否需要回复, CallNR 为false
+	Stream   bool          //流式调用,invoker返回 Stream
+	Params   []interface{} //Call/CallNR 的原始参数, CallArgs 时为nil
+	ArgsType []string      //已编码的参数, Call/CallNR 在最终发送前才编码
+	Args     [][]byte
+}
+
+// Invoker 发起一次调用, CallNR 的结果总是nil, 流式调用的结果为 Stream
+type Invoker func(ctx context.Context, inv *Invocation) (interface{}, error)
+
+// ClientInterceptor 客户端拦截器,可以修改请求、直接返回结果或者多次调用invoker
+// 返回的错误建议使用 *Error
+type ClientInterceptor func(ctx context.Context, inv *Invocation, invoker Invoker) (interface{}, error)
+
+// ChainClientInterceptors 把多个拦截器按顺序包装在invoker外层,第一个拦截器最先执行
+func ChainClientInterceptors(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, inv *Invocation) (interface{}, error) {
+			return interceptor(ctx, inv, next)
+		}
+	}
+	return invoker
+}
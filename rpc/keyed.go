@@ -0,0 +1,51 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import "fmt"
+
+// KeyFunc 从handler的参数(不含context.Context)中提取key, key相同的请求按到达顺序依次执行
+type KeyFunc func(args []interface{}) string
+
+// sessionKeyer gate.Session 中用于提取key的方法
+type sessionKeyer interface {
+	GetUserID() string
+	GetSessionID() string
+}
+
+// SessionKey 使用第一个gate.Session参数的用户ID作为key,未登录时使用SessionID
+func SessionKey(args []interface{}) string {
+	for _, arg := range args {
+		if session, ok := arg.(sessionKeyer); ok {
+			if uid := session.GetUserID(); uid != "" {
+				return uid
+			}
+			return session.GetSessionID()
+		}
+	}
+	return ""
+}
+
+// ArgKey 使用第index个参数作为key, gate.Session参数与 SessionKey 相同
+func ArgKey(index int) KeyFunc {
+	return func(args []interface{}) string {
+		if index < 0 || index >= len(args) || args[index] == nil {
+			return ""
+		}
+		if session, ok := args[index].(sessionKeyer); ok {
+			return SessionKey([]interface{}{session})
+		}
+		return fmt.Sprint(args[index])
+	}
+}
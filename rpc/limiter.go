@@ -0,0 +1,131 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// LimitPolicy 并发限制策略,可以作用于单个handler( WithLimit )或整个模块( RPCServer.SetLimit )
+type LimitPolicy struct {
+	MaxConcurrent int           //同时执行的最大数量,小于等于0时不限制
+	MaxQueue      int           //达到MaxConcurrent后最多排队等待的数量,超过时直接拒绝; 为0时不排队
+	MaxQueueWait  time.Duration //排队的最长时间,超过时拒绝; 为0时只受调用方的超时时间限制
+}
+
+// LimitStats 并发限制的统计
+type LimitStats struct {
+	Executing int64 //正在执行的数量
+	Queued    int64 //正在排队的数量
+	Rejected  int64 //累计拒绝(排队已满或排队超时)的数量
+}
+
+// Limiter 并发限制器,拒绝时返回 CodeOverloaded 错误
+type Limiter struct {
+	queued   int64 //放在开头保证32位平台上原子操作的对齐
+	rejected int64
+	policy   LimitPolicy
+	sem      chan struct{}
+}
+
+// NewLimiter 创建并发限制器, MaxConcurrent小于等于0时返回nil(不限制)
+func NewLimiter(policy LimitPolicy) *Limiter {
+	if policy.MaxConcurrent <= 0 {
+		return nil
+	}
+	return &Limiter{
+		policy: policy,
+		sem:    make(chan struct{}, policy.MaxConcurrent),
+	}
+}
+
+// Policy 限制策略
+func (l *Limiter) Policy() LimitPolicy {
+	return l.policy
+}
+
+// TryAcquire 不排队直接获取执行许可,成功后必须调用 Release
+func (l *Limiter) TryAcquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Enqueue 占用一个排队位置,队列已满时记为拒绝并返回false; 返回true后必须调用 Wait
+func (l *Limiter) Enqueue() bool {
+	if atomic.AddInt64(&l.queued, 1) > int64(l.policy.MaxQueue) {
+		atomic.AddInt64(&l.queued, -1)
+		atomic.AddInt64(&l.rejected, 1)
+		return false
+	}
+	return true
+}
+
+// Wait 已排队的请求等待执行许可,超过MaxQueueWait或ctx结束时返回 CodeOverloaded 错误
+func (l *Limiter) Wait(ctx context.Context) error {
+	defer atomic.AddInt64(&l.queued, -1)
+	var timeout <-chan time.Time
+	if l.policy.MaxQueueWait > 0 {
+		timer := time.NewTimer(l.policy.MaxQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-timeout:
+		atomic.AddInt64(&l.rejected, 1)
+		return Overloaded("queue wait exceeded %v", l.policy.MaxQueueWait)
+	case <-ctx.Done():
+		atomic.AddInt64(&l.rejected, 1)
+		return Overloaded("queue wait %v", ctx.Err())
+	}
+}
+
+// Acquire 获取执行许可,需要时排队等待,成功后必须调用 Release
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l.TryAcquire() {
+		return nil
+	}
+	if !l.Enqueue() {
+		return Overloaded("queue is full (%d)", l.policy.MaxQueue)
+	}
+	return l.Wait(ctx)
+}
+
+// Release 归还执行许可
+func (l *Limiter) Release() {
+	<-l.sem
+}
+
+// Stats 当前的统计
+func (l *Limiter) Stats() LimitStats {
+	return LimitStats{
+		Executing: int64(len(l.sem)),
+		Queued:    atomic.LoadInt64(&l.queued),
+		Rejected:  atomic.LoadInt64(&l.rejected),
+	}
+}
+
+// WithLimit 限制handler的并发数量,避免一个繁忙的handler占满整个模块
+func WithLimit(policy LimitPolicy) RegisterOption {
+	return func(f *FunctionInfo) {
+		f.Limiter = NewLimiter(policy)
+	}
+}
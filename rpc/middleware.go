@@ -0,0 +1,44 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+)
+
+// HandlerRequest 服务端一次handler调用的信息
+type HandlerRequest struct {
+	Fn           string
+	CallInfo     *CallInfo
+	FunctionInfo *FunctionInfo
+	Args         []interface{} //解码后的参数,不包含ctx与stream参数,中间件可以修改
+}
+
+// Handler 执行handler, 流式handler的结果总是nil
+type Handler func(ctx context.Context, req *HandlerRequest) (interface{}, error)
+
+// Middleware 服务端handler中间件,可以在handler前后做处理、修改参数与结果或者直接返回
+// 直接返回错误(没有调用next)时按调用失败处理,会触发 RPCListener.OnError
+type Middleware func(ctx context.Context, req *HandlerRequest, next Handler) (interface{}, error)
+
+// ChainMiddlewares 把多个中间件按顺序包装在handler外层,第一个中间件最先执行
+func ChainMiddlewares(middlewares []Middleware, handler Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, next := middlewares[i], handler
+		handler = func(ctx context.Context, req *HandlerRequest) (interface{}, error) {
+			return middleware(ctx, req, next)
+		}
+	}
+	return handler
+}
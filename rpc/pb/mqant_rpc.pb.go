@@ -25,16 +25,26 @@ type RPCInfo struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Cid      string   `protobuf:"bytes,1,opt,name=Cid,proto3" json:"Cid,omitempty"`
-	Fn       string   `protobuf:"bytes,2,opt,name=Fn,proto3" json:"Fn,omitempty"`
-	ReplyTo  string   `protobuf:"bytes,3,opt,name=ReplyTo,proto3" json:"ReplyTo,omitempty"`
-	Track    string   `protobuf:"bytes,4,opt,name=track,proto3" json:"track,omitempty"`
-	Expired  int64    `protobuf:"varint,5,opt,name=Expired,proto3" json:"Expired,omitempty"`
-	Reply    bool     `protobuf:"varint,6,opt,name=Reply,proto3" json:"Reply,omitempty"`
-	ArgsType []string `protobuf:"bytes,7,rep,name=ArgsType,proto3" json:"ArgsType,omitempty"`
-	Args     [][]byte `protobuf:"bytes,8,rep,name=Args,proto3" json:"Args,omitempty"`
-	Caller   string   `protobuf:"bytes,9,opt,name=caller,proto3" json:"caller,omitempty"`
-	Hostname string   `protobuf:"bytes,10,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Cid               string            `protobuf:"bytes,1,opt,name=Cid,proto3" json:"Cid,omitempty"`
+	Fn                string            `protobuf:"bytes,2,opt,name=Fn,proto3" json:"Fn,omitempty"`
+	ReplyTo           string            `protobuf:"bytes,3,opt,name=ReplyTo,proto3" json:"ReplyTo,omitempty"`
+	Track             string            `protobuf:"bytes,4,opt,name=track,proto3" json:"track,omitempty"`
+	Expired           int64             `protobuf:"varint,5,opt,name=Expired,proto3" json:"Expired,omitempty"`
+	Reply             bool              `protobuf:"varint,6,opt,name=Reply,proto3" json:"Reply,omitempty"`
+	ArgsType          []string          `protobuf:"bytes,7,rep,name=ArgsType,proto3" json:"ArgsType,omitempty"`
+	Args              [][]byte          `protobuf:"bytes,8,rep,name=Args,proto3" json:"Args,omitempty"`
+	Caller            string            `protobuf:"bytes,9,opt,name=caller,proto3" json:"caller,omitempty"`
+	Hostname          string            `protobuf:"bytes,10,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	StreamType        int32             `protobuf:"varint,11,opt,name=StreamType,proto3" json:"StreamType,omitempty"`
+	Seq               int64             `protobuf:"varint,12,opt,name=Seq,proto3" json:"Seq,omitempty"`
+	Credit            int64             `protobuf:"varint,13,opt,name=Credit,proto3" json:"Credit,omitempty"`
+	Headers           map[string]string `protobuf:"bytes,14,rep,name=Headers,proto3" json:"Headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Compression       string            `protobuf:"bytes,15,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	AcceptCompression string            `protobuf:"bytes,16,opt,name=AcceptCompression,proto3" json:"AcceptCompression,omitempty"`
+	ChunkId           string            `protobuf:"bytes,17,opt,name=ChunkId,proto3" json:"ChunkId,omitempty"`
+	ChunkIndex        int32             `protobuf:"varint,18,opt,name=ChunkIndex,proto3" json:"ChunkIndex,omitempty"`
+	ChunkTotal        int32             `protobuf:"varint,19,opt,name=ChunkTotal,proto3" json:"ChunkTotal,omitempty"`
+	ChunkData         []byte            `protobuf:"bytes,20,opt,name=ChunkData,proto3" json:"ChunkData,omitempty"`
 }
 
 func (x *RPCInfo) Reset() {
@@ -139,15 +149,95 @@ func (x *RPCInfo) GetHostname() string {
 	return ""
 }
 
+func (x *RPCInfo) GetStreamType() int32 {
+	if x != nil {
+		return x.StreamType
+	}
+	return 0
+}
+
+func (x *RPCInfo) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *RPCInfo) GetCredit() int64 {
+	if x != nil {
+		return x.Credit
+	}
+	return 0
+}
+
+func (x *RPCInfo) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *RPCInfo) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+func (x *RPCInfo) GetAcceptCompression() string {
+	if x != nil {
+		return x.AcceptCompression
+	}
+	return ""
+}
+
+func (x *RPCInfo) GetChunkId() string {
+	if x != nil {
+		return x.ChunkId
+	}
+	return ""
+}
+
+func (x *RPCInfo) GetChunkIndex() int32 {
+	if x != nil {
+		return x.ChunkIndex
+	}
+	return 0
+}
+
+func (x *RPCInfo) GetChunkTotal() int32 {
+	if x != nil {
+		return x.ChunkTotal
+	}
+	return 0
+}
+
+func (x *RPCInfo) GetChunkData() []byte {
+	if x != nil {
+		return x.ChunkData
+	}
+	return nil
+}
+
 type ResultInfo struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Cid        string `protobuf:"bytes,1,opt,name=Cid,proto3" json:"Cid,omitempty"`
-	Error      string `protobuf:"bytes,2,opt,name=Error,proto3" json:"Error,omitempty"`
-	ResultType string `protobuf:"bytes,4,opt,name=ResultType,proto3" json:"ResultType,omitempty"`
-	Result     []byte `protobuf:"bytes,5,opt,name=Result,proto3" json:"Result,omitempty"`
+	Cid         string `protobuf:"bytes,1,opt,name=Cid,proto3" json:"Cid,omitempty"`
+	Error       string `protobuf:"bytes,2,opt,name=Error,proto3" json:"Error,omitempty"`
+	ResultType  string `protobuf:"bytes,4,opt,name=ResultType,proto3" json:"ResultType,omitempty"`
+	Result      []byte `protobuf:"bytes,5,opt,name=Result,proto3" json:"Result,omitempty"`
+	StreamType  int32  `protobuf:"varint,6,opt,name=StreamType,proto3" json:"StreamType,omitempty"`
+	Seq         int64  `protobuf:"varint,7,opt,name=Seq,proto3" json:"Seq,omitempty"`
+	Credit      int64  `protobuf:"varint,8,opt,name=Credit,proto3" json:"Credit,omitempty"`
+	ErrorCode   int32  `protobuf:"varint,9,opt,name=ErrorCode,proto3" json:"ErrorCode,omitempty"`
+	ErrorDetail string `protobuf:"bytes,10,opt,name=ErrorDetail,proto3" json:"ErrorDetail,omitempty"`
+	Compression string `protobuf:"bytes,11,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	ChunkId     string `protobuf:"bytes,12,opt,name=ChunkId,proto3" json:"ChunkId,omitempty"`
+	ChunkIndex  int32  `protobuf:"varint,13,opt,name=ChunkIndex,proto3" json:"ChunkIndex,omitempty"`
+	ChunkTotal  int32  `protobuf:"varint,14,opt,name=ChunkTotal,proto3" json:"ChunkTotal,omitempty"`
+	ChunkData   []byte `protobuf:"bytes,15,opt,name=ChunkData,proto3" json:"ChunkData,omitempty"`
 }
 
 func (x *ResultInfo) Reset() {
@@ -210,11 +300,81 @@ func (x *ResultInfo) GetResult() []byte {
 	return nil
 }
 
+func (x *ResultInfo) GetStreamType() int32 {
+	if x != nil {
+		return x.StreamType
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetCredit() int64 {
+	if x != nil {
+		return x.Credit
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetErrorCode() int32 {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetErrorDetail() string {
+	if x != nil {
+		return x.ErrorDetail
+	}
+	return ""
+}
+
+func (x *ResultInfo) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+func (x *ResultInfo) GetChunkId() string {
+	if x != nil {
+		return x.ChunkId
+	}
+	return ""
+}
+
+func (x *ResultInfo) GetChunkIndex() int32 {
+	if x != nil {
+		return x.ChunkIndex
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetChunkTotal() int32 {
+	if x != nil {
+		return x.ChunkTotal
+	}
+	return 0
+}
+
+func (x *ResultInfo) GetChunkData() []byte {
+	if x != nil {
+		return x.ChunkData
+	}
+	return nil
+}
+
 var File_mqant_rpc_proto protoreflect.FileDescriptor
 
 var file_mqant_rpc_proto_rawDesc = []byte{
 	0x0a, 0x0f, 0x6d, 0x71, 0x61, 0x6e, 0x74, 0x5f, 0x72, 0x70, 0x63, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x12, 0x05, 0x72, 0x70, 0x63, 0x70, 0x62, 0x22, 0xef, 0x01, 0x0a, 0x07, 0x52, 0x50, 0x43,
+	0x6f, 0x12, 0x05, 0x72, 0x70, 0x63, 0x70, 0x62, 0x22, 0xf4, 0x04, 0x0a, 0x07, 0x52, 0x50, 0x43,
 	0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10, 0x0a, 0x03, 0x43, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x09, 0x52, 0x03, 0x43, 0x69, 0x64, 0x12, 0x0e, 0x0a, 0x02, 0x46, 0x6e, 0x18, 0x02, 0x20, 0x01,
 	0x28, 0x09, 0x52, 0x02, 0x46, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x52, 0x65, 0x70, 0x6c, 0x79, 0x54,
@@ -229,17 +389,60 @@ var file_mqant_rpc_proto_rawDesc = []byte{
 	0x52, 0x04, 0x41, 0x72, 0x67, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x63, 0x61, 0x6c, 0x6c, 0x65, 0x72,
 	0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x63, 0x61, 0x6c, 0x6c, 0x65, 0x72, 0x12, 0x1a,
 	0x0a, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x6c, 0x0a, 0x0a, 0x52, 0x65,
-	0x73, 0x75, 0x6c, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10, 0x0a, 0x03, 0x43, 0x69, 0x64, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x43, 0x69, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x45, 0x72,
-	0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x45, 0x72, 0x72, 0x6f, 0x72,
-	0x12, 0x1e, 0x0a, 0x0a, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x54, 0x79, 0x70, 0x65, 0x18, 0x04,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x54, 0x79, 0x70, 0x65,
-	0x12, 0x16, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x42, 0x25, 0x5a, 0x23, 0x67, 0x69, 0x74, 0x68,
-	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6c, 0x69, 0x61, 0x6e, 0x67, 0x64, 0x61, 0x73, 0x2f,
-	0x6d, 0x71, 0x61, 0x6e, 0x74, 0x2f, 0x72, 0x70, 0x63, 0x2f, 0x72, 0x70, 0x63, 0x70, 0x62, 0x62,
-	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x52, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x53, 0x74,
+	0x72, 0x65, 0x61, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x53, 0x65,
+	0x71, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x03, 0x52, 0x03, 0x53, 0x65, 0x71, 0x12, 0x16, 0x0a, 0x06,
+	0x43, 0x72, 0x65, 0x64, 0x69, 0x74, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x43, 0x72,
+	0x65, 0x64, 0x69, 0x74, 0x12, 0x35, 0x0a, 0x07, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x18,
+	0x0e, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x72, 0x70, 0x63, 0x70, 0x62, 0x2e, 0x52, 0x50,
+	0x43, 0x49, 0x6e, 0x66, 0x6f, 0x2e, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x52, 0x07, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x43,
+	0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2c, 0x0a,
+	0x11, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x10, 0x20, 0x01, 0x28, 0x09, 0x52, 0x11, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74,
+	0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x49, 0x64, 0x18, 0x11, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x43, 0x68,
+	0x75, 0x6e, 0x6b, 0x49, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x49, 0x6e,
+	0x64, 0x65, 0x78, 0x18, 0x12, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b,
+	0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x54, 0x6f,
+	0x74, 0x61, 0x6c, 0x18, 0x13, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b,
+	0x54, 0x6f, 0x74, 0x61, 0x6c, 0x12, 0x1c, 0x0a, 0x09, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x61,
+	0x74, 0x61, 0x18, 0x14, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44,
+	0x61, 0x74, 0x61, 0x1a, 0x3a, 0x0a, 0x0c, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x45, 0x6e,
+	0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22,
+	0x90, 0x03, 0x0a, 0x0a, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10,
+	0x0a, 0x03, 0x43, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x43, 0x69, 0x64,
+	0x12, 0x14, 0x0a, 0x05, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x1e, 0x0a, 0x0a, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x54, 0x79, 0x70, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x52, 0x65, 0x73, 0x75,
+	0x6c, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x1e,
+	0x0a, 0x0a, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x0a, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10,
+	0x0a, 0x03, 0x53, 0x65, 0x71, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x03, 0x53, 0x65, 0x71,
+	0x12, 0x16, 0x0a, 0x06, 0x43, 0x72, 0x65, 0x64, 0x69, 0x74, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x06, 0x43, 0x72, 0x65, 0x64, 0x69, 0x74, 0x12, 0x1c, 0x0a, 0x09, 0x45, 0x72, 0x72, 0x6f,
+	0x72, 0x43, 0x6f, 0x64, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x45, 0x72, 0x72,
+	0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x20, 0x0a, 0x0b, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x44,
+	0x65, 0x74, 0x61, 0x69, 0x6c, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x45, 0x72, 0x72,
+	0x6f, 0x72, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x12, 0x20, 0x0a, 0x0b, 0x43, 0x6f, 0x6d, 0x70,
+	0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x43,
+	0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x43, 0x68,
+	0x75, 0x6e, 0x6b, 0x49, 0x64, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x43, 0x68, 0x75,
+	0x6e, 0x6b, 0x49, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x49, 0x6e, 0x64,
+	0x65, 0x78, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x49,
+	0x6e, 0x64, 0x65, 0x78, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x54, 0x6f, 0x74,
+	0x61, 0x6c, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x54,
+	0x6f, 0x74, 0x61, 0x6c, 0x12, 0x1c, 0x0a, 0x09, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x61, 0x74,
+	0x61, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x44, 0x61,
+	0x74, 0x61, 0x42, 0x25, 0x5a, 0x23, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x6c, 0x69, 0x61, 0x6e, 0x67, 0x64, 0x61, 0x73, 0x2f, 0x6d, 0x71, 0x61, 0x6e, 0x74, 0x2f,
+	0x72, 0x70, 0x63, 0x2f, 0x72, 0x70, 0x63, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x33,
 }
 
 var (
@@ -254,17 +457,19 @@ func file_mqant_rpc_proto_rawDescGZIP() []byte {
 	return file_mqant_rpc_proto_rawDescData
 }
 
-var file_mqant_rpc_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_mqant_rpc_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_mqant_rpc_proto_goTypes = []interface{}{
 	(*RPCInfo)(nil),    // 0: rpcpb.RPCInfo
 	(*ResultInfo)(nil), // 1: rpcpb.ResultInfo
+	nil,                // 2: rpcpb.RPCInfo.HeadersEntry
 }
 var file_mqant_rpc_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2, // 0: rpcpb.RPCInfo.Headers:type_name -> rpcpb.RPCInfo.HeadersEntry
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_mqant_rpc_proto_init() }
@@ -304,7 +509,7 @@ func file_mqant_rpc_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_mqant_rpc_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,197 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpcrecord 记录服务方处理的rpc请求与结果,并在本地模块上回放、比对结果
+//
+//	recorder, _ := rpcrecord.NewFileRecorder("rpc.record", rpcrecord.Modules("Login"))
+//	app := mqant.CreateApp(module.SetRPCRecorder(recorder))
+//	defer recorder.Close()
+package rpcrecord
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Record 一次调用的请求与结果,文件中每行一条JSON
+type Record struct {
+	Time     time.Time         `json:"time"`
+	Module   string            `json:"module"`
+	ExecTime time.Duration     `json:"exec_time"`
+	Request  *rpcpb.RPCInfo    `json:"request"`
+	Result   *rpcpb.ResultInfo `json:"result"`
+}
+
+// Option 记录的过滤条件
+type Option func(*Recorder)
+
+// Modules 只记录这些模块的调用,默认记录所有模块
+func Modules(moduleTypes ...string) Option {
+	return func(r *Recorder) {
+		r.modules = toSet(moduleTypes)
+	}
+}
+
+// Handlers 只记录这些handler的调用,默认记录所有handler
+func Handlers(fns ...string) Option {
+	return func(r *Recorder) {
+		r.handlers = toSet(fns)
+	}
+}
+
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// Recorder 把调用写入文件, 实现了 module.RPCRecorder
+type Recorder struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	closer   io.Closer
+	modules  map[string]bool
+	handlers map[string]bool
+}
+
+// NewRecorder 把调用写入w
+func NewRecorder(w io.Writer, opts ...Option) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w)}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+// NewFileRecorder 把调用追加到path文件中
+func NewFileRecorder(path string, opts ...Option) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f, opts...), nil
+}
+
+// Record 记录一次调用,流式调用不会被记录
+func (r *Recorder) Record(moduleType string, rpcInfo *rpcpb.RPCInfo, result *rpcpb.ResultInfo, execTime time.Duration) {
+	if rpcInfo == nil || result == nil || rpcInfo.StreamType != mqrpc.StreamNone {
+		return
+	}
+	if (r.modules != nil && !r.modules[moduleType]) || (r.handlers != nil && !r.handlers[rpcInfo.Fn]) {
+		return
+	}
+	b, err := json.Marshal(&Record{
+		Time:     time.Now(),
+		Module:   moduleType,
+		ExecTime: execTime,
+		Request:  rpcInfo,
+		Result:   result,
+	})
+	if err != nil {
+		log.Warning("rpc record %s error %v", rpcInfo.Fn, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	r.w.Write(b)
+	r.w.WriteByte('\n')
+}
+
+// Flush 把缓存的记录写入文件
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+// Close 写入缓存的记录并关闭文件,之后的调用不再记录
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	r.w = nil
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Reader 按顺序读取记录
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader 从r中读取 Recorder 写入的记录
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Next 读取下一条记录,没有更多记录时返回io.EOF
+func (r *Reader) Next() (*Record, error) {
+	record := new(Record)
+	if err := r.dec.Decode(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadFile 读取path文件中的所有记录
+func ReadFile(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*Record
+	reader := NewReader(f)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func cloneRPCInfo(rpcInfo *rpcpb.RPCInfo) *rpcpb.RPCInfo {
+	return proto.Clone(rpcInfo).(*rpcpb.RPCInfo)
+}
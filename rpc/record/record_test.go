@@ -0,0 +1,138 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rpcrecord
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/registry"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/base"
+	"github.com/liangdas/mqant/rpc/transport"
+)
+
+func init() {
+	log.LogBeego()
+}
+
+type testApp struct {
+	module.App
+	opts module.Options
+}
+
+func (a *testApp) Options() module.Options                         { return a.opts }
+func (a *testApp) Transport() mqrpc.Transport                      { return a.opts.Transport }
+func (a *testApp) GetSettings() conf.Config                        { return conf.Config{} }
+func (a *testApp) GetRPCSerialize() map[string]module.RPCSerialize { return nil }
+
+type testModule struct {
+	module.Module
+}
+
+func (m *testModule) GetType() string { return "test" }
+
+type testSession struct {
+	module.ServerSession
+	node *registry.Node
+}
+
+func (s *testSession) GetID() string           { return s.node.Id }
+func (s *testSession) GetNode() *registry.Node { return s.node }
+func (s *testSession) GetName() string         { return "test" }
+
+// nopCloser 测试中保留写入的内容
+type nopCloser struct {
+	io.Writer
+}
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := NewRecorder(nopCloser{&buf}, Handlers("add", "stats"))
+	app := &testApp{opts: module.Options{
+		Transport:   transport.NewLocalTransport(),
+		RPCExpired:  time.Second * 3,
+		RPCRecorder: recorder,
+	}}
+	defer app.Transport().Close()
+	server, err := defaultrpc.NewRPCServer(app, &testModule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int64
+	server.RegisterGO("add", func(a, b int64) (int64, error) {
+		return a + b, nil
+	})
+	server.Register("stats", func() (map[string]interface{}, error) {
+		//回放时结果不同
+		return map[string]interface{}{"calls": atomic.AddInt64(&calls, 1), "name": "test"}, nil
+	})
+	server.Register("ignored", func() (string, error) {
+		return "", nil
+	})
+	client, err := defaultrpc.NewRPCClient(app, &testSession{node: &registry.Node{Id: "test@1", Address: server.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := client.CallWithError(context.Background(), "add", int64(1), int64(2)); err != nil || r != int64(3) {
+		t.Fatalf("add got %v %v", r, err)
+	}
+	if _, err := client.CallWithError(context.Background(), "add", "x", int64(2)); err == nil {
+		t.Fatalf("add got %v", err)
+	}
+	if _, err := client.CallWithError(context.Background(), "stats"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CallWithError(context.Background(), "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*Record
+	reader := NewReader(&buf)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 || records[0].Module != "test" || records[0].Request.Fn != "add" || records[2].Request.Fn != "stats" {
+		t.Fatalf("records %+v", records)
+	}
+
+	results := Replay(server.(Target), records, ReplayOptions{Concurrency: 2})
+	for i, r := range results[:2] {
+		if r.Err != nil || r.Diff != "" {
+			t.Fatalf("replay %d got %v %q", i, r.Err, r.Diff)
+		}
+	}
+	if results[2].Err != nil || results[2].Diff == "" {
+		t.Fatalf("replay stats should differ, got %v %q", results[2].Err, results[2].Diff)
+	}
+	_ = client.Done()
+	_ = server.Done()
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rpcrecord
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/pb"
+	"github.com/liangdas/mqant/rpc/util"
+	"github.com/liangdas/mqant/utils/uuid"
+)
+
+// Target 回放的目标, defaultrpc.RPCServer 实现了该接口
+type Target interface {
+	Call(callInfo *mqrpc.CallInfo) error
+}
+
+// ReplayOptions 回放选项
+type ReplayOptions struct {
+	App         module.App    //解码结果时使用app注册的RPCSerialize,可以为nil
+	Timeout     time.Duration //每个请求的超时时间,默认3秒
+	Concurrency int           //同时回放的请求数,小于等于1时按记录的顺序依次回放
+	Speed       float64       //大于0时按记录的时间间隔发送(2为两倍速),用于复现线上负载; 为0时尽快发送
+}
+
+// ReplayResult 一条记录的回放结果
+type ReplayResult struct {
+	Record *Record
+	Result *rpcpb.ResultInfo //回放得到的结果,超时时为nil
+	Err    error             //回放失败的原因
+	Diff   string            //与记录的结果不一致的描述,一致时为空
+}
+
+// Replay 把记录的请求发送给target并与记录的结果比较,返回结果的顺序与records一致
+// 请求总是需要回复(CallNR的请求也会等待结果),超时时间按回放时的时间重新计算
+func Replay(target Target, records []*Record, opts ReplayOptions) []ReplayResult {
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 3
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]ReplayResult, len(records))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, record := range records {
+		if opts.Speed > 0 && i > 0 {
+			offset := time.Duration(float64(record.Time.Sub(records[0].Time)) / opts.Speed)
+			if d := time.Until(start.Add(offset)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, record *Record) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = replay(target, record, opts)
+		}(i, record)
+	}
+	wg.Wait()
+	return results
+}
+
+// replayAgent 代替NatsServer接收handler的结果
+type replayAgent struct {
+	result chan *rpcpb.ResultInfo
+}
+
+func (a *replayAgent) Callback(callInfo *mqrpc.CallInfo) error {
+	select {
+	case a.result <- callInfo.Result:
+	default:
+	}
+	return nil
+}
+
+func replay(target Target, record *Record, opts ReplayOptions) ReplayResult {
+	rr := ReplayResult{Record: record}
+	rpcInfo := cloneRPCInfo(record.Request)
+	rpcInfo.Cid = uuid.Rand().Hex()
+	rpcInfo.Reply = true
+	rpcInfo.ReplyTo = ""
+	rpcInfo.Expired = time.Now().Add(opts.Timeout).UnixNano() / int64(time.Millisecond)
+	agent := &replayAgent{result: make(chan *rpcpb.ResultInfo, 1)}
+	if err := target.Call(&mqrpc.CallInfo{
+		RPCInfo: rpcInfo,
+		Props:   map[string]interface{}{"reply_to": ""},
+		Agent:   agent,
+	}); err != nil {
+		rr.Err = err
+		return rr
+	}
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	select {
+	case rr.Result = <-agent.result:
+		rr.Diff = Diff(opts.App, record.Result, rr.Result)
+	case <-timer.C:
+		rr.Err = mqrpc.Timeout("replay %s timeout", rpcInfo.Fn)
+	}
+	return rr
+}
+
+// Diff 比较记录的结果与回放的结果,一致时返回空字符串
+// 结果的字节不同时会解码后再比较,避免map等编码顺序不同的误报
+func Diff(app module.App, recorded, replayed *rpcpb.ResultInfo) string {
+	var diffs []string
+	if recorded.ErrorCode != replayed.ErrorCode {
+		diffs = append(diffs, fmt.Sprintf("error code %d != %d", recorded.ErrorCode, replayed.ErrorCode))
+	}
+	if recorded.Error != replayed.Error {
+		diffs = append(diffs, fmt.Sprintf("error %q != %q", recorded.Error, replayed.Error))
+	}
+	if recorded.ResultType != replayed.ResultType {
+		diffs = append(diffs, fmt.Sprintf("result type %s != %s", recorded.ResultType, replayed.ResultType))
+	} else if !bytes.Equal(recorded.Result, replayed.Result) {
+		r1, err1 := decodeResult(app, recorded)
+		r2, err2 := decodeResult(app, replayed)
+		if err1 != nil || err2 != nil || !reflect.DeepEqual(r1, r2) {
+			diffs = append(diffs, fmt.Sprintf("result %v != %v", r1, r2))
+		}
+	}
+	return strings.Join(diffs, "; ")
+}
+
+func decodeResult(app module.App, result *rpcpb.ResultInfo) (interface{}, error) {
+	r, err := argsutil.Bytes2Args(app, result.ResultType, result.Result)
+	if err != nil {
+		return result.Result, err
+	}
+	if encoded, ok := r.(*mqrpc.Encoded); ok {
+		var v interface{}
+		if err := encoded.Decode(&v); err != nil {
+			return result.Result, err
+		}
+		return v, nil
+	}
+	return r, nil
+}
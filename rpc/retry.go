@@ -0,0 +1,143 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// IdempotentMetadataKey 节点元数据中记录幂等handler的key,值为逗号分隔的handler名称
+const IdempotentMetadataKey = "idempotent"
+
+// RegisterOption 注册handler时的选项
+type RegisterOption func(*FunctionInfo)
+
+// Idempotent 标记handler为幂等的,调用失败时客户端可以自动重试
+func Idempotent() RegisterOption {
+	return func(f *FunctionInfo) {
+		f.Idempotent = true
+	}
+}
+
+// IsIdempotent 根据节点元数据判断handler是否为幂等的
+func IsIdempotent(metadata map[string]string, fn string) bool {
+	for _, name := range strings.Split(metadata[IdempotentMetadataKey], ",") {
+		if name == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPolicy 重试策略,只有幂等的handler(或Force)才会重试
+type RetryPolicy struct {
+	MaxAttempts       int           //最多调用次数(包含第一次), 小于等于1时不重试
+	PerAttemptTimeout time.Duration //每次调用的超时时间,为0时每次调用共用ctx的超时时间
+	Backoff           time.Duration //第一次重试前的等待时间
+	MaxBackoff        time.Duration //最大等待时间,为0时不限制
+	Multiplier        float64       //每次重试等待时间的增长倍数,小于1时为2
+	Codes             []int32       //可以重试的错误码,为空时为 CodeTimeout,CodeUnavailable
+	Force             bool          //非幂等的handler也重试
+}
+
+// Retryable 错误是否可以重试
+func (p RetryPolicy) Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := ErrorCode(err)
+	if len(p.Codes) == 0 {
+		return code == CodeTimeout || code == CodeUnavailable
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay 第attempt次重试前的等待时间,attempt从1开始
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(delay)
+}
+
+type retryKey struct{}
+
+// WithRetry 为这次调用设置重试策略,优先于 module.Options 中的默认策略
+func WithRetry(ctx context.Context, policy RetryPolicy) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, retryKey{}, policy)
+}
+
+// RetryFromContext 获取ctx中的重试策略
+func RetryFromContext(ctx context.Context) (RetryPolicy, bool) {
+	if ctx == nil {
+		return RetryPolicy{}, false
+	}
+	policy, ok := ctx.Value(retryKey{}).(RetryPolicy)
+	return policy, ok
+}
+
+// Retry 按策略调用fn直到成功、错误不可重试、次数用完或ctx结束, attempt从0开始
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context, attempt int) (interface{}, error)) (interface{}, error) {
+	var (
+		result interface{}
+		err    error
+	)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if delay := policy.Delay(attempt); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return result, err
+				case <-timer.C:
+				}
+			}
+		}
+		result, err = retryAttempt(ctx, policy, attempt, fn)
+		if err == nil || attempt+1 >= policy.MaxAttempts || !policy.Retryable(err) || ctx.Err() != nil {
+			return result, err
+		}
+	}
+}
+
+func retryAttempt(ctx context.Context, policy RetryPolicy, attempt int, fn func(ctx context.Context, attempt int) (interface{}, error)) (interface{}, error) {
+	if policy.PerAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.PerAttemptTimeout)
+		defer cancel()
+	}
+	return fn(ctx, attempt)
+}
@@ -23,10 +23,15 @@ import (
 
 // FunctionInfo handler接口信息
 type FunctionInfo struct {
-	Function  reflect.Value
-	FuncType  reflect.Type
-	InType    []reflect.Type
-	Goroutine bool
+	Function   reflect.Value
+	FuncType   reflect.Type
+	InType     []reflect.Type
+	Goroutine  bool
+	Stream     bool     //第一个参数为Stream的流式handler
+	Context    bool     //第一个参数为context.Context,携带调用方的超时、取消与元数据
+	Idempotent bool     //幂等的handler,客户端可以自动重试
+	Limiter    *Limiter //handler的并发限制,为nil时不限制
+	Key        KeyFunc  //不为nil时按key顺序执行,见 RPCServer.RegisterKeyed
 }
 
 //MQServer 代理者
@@ -79,19 +84,60 @@ type RPCServer interface {
 	Addr() string
 	SetListener(listener RPCListener)
 	SetGoroutineControl(control GoroutineControl)
+	// Use 添加handler中间件,按添加顺序执行
+	Use(middlewares ...Middleware)
 	GetExecuting() int64
-	Register(id string, f interface{})
-	RegisterGO(id string, f interface{})
+	// SetLimit 限制整个模块的并发数量,需要在收到请求前调用
+	SetLimit(policy LimitPolicy)
+	// GetLimitStats 模块与各个handler并发限制的统计,没有限制的handler不会出现在handlers中
+	GetLimitStats() (module LimitStats, handlers map[string]LimitStats)
+	Register(id string, f interface{}, opts ...RegisterOption)
+	RegisterGO(id string, f interface{}, opts ...RegisterOption)
+	// RegisterKeyed 注册按key顺序执行的handler,key为nil时使用 SessionKey
+	RegisterKeyed(id string, f interface{}, key KeyFunc, opts ...RegisterOption)
+	// SetDeadLetterSink 保存执行失败的CallNR消息,为nil时只打印日志
+	SetDeadLetterSink(sink DeadLetterSink)
+	// DeadLetters 按时间顺序列出保存的死信
+	DeadLetters() ([]*DeadLetter, error)
+	// Redrive 在当前模块重新执行一条死信,再次失败时作为新的死信保存
+	Redrive(id string) error
+	// GetFunctions 已注册的handler
+	GetFunctions() map[string]*FunctionInfo
 	Done() (err error)
 }
 
+// Subscription 传输层订阅
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Transport RPC消息传输层,默认实现为nats,也可以替换为进程内通道或直连tcp
+type Transport interface {
+	// NewInbox 生成一个只会投递到当前Transport的唯一地址
+	NewInbox() string
+	// Publish 向subject投递一条消息,没有订阅者时消息将被丢弃
+	Publish(subject string, data []byte) error
+	// Subscribe 订阅subject,同一个订阅内的消息按顺序回调handler
+	Subscribe(subject string, handler func(data []byte)) (Subscription, error)
+	Close() error
+}
+
+// PayloadLimiter 传输层单条消息的大小限制,超过限制的rpc消息会被分块发送
+type PayloadLimiter interface {
+	MaxPayload() int64
+}
+
 // RPCClient 客户端定义
 type RPCClient interface {
 	Done() (err error)
 	CallArgs(ctx context.Context, _func string, ArgsType []string, args [][]byte) (interface{}, string)
 	CallNRArgs(_func string, ArgsType []string, args [][]byte) (err error)
 	Call(ctx context.Context, _func string, params ...interface{}) (interface{}, string)
+	// CallWithError 与Call相同,返回的错误为 *Error,可以通过 ErrorCode 区分超时、handler不存在等错误
+	CallWithError(ctx context.Context, _func string, params ...interface{}) (interface{}, error)
 	CallNR(_func string, params ...interface{}) (err error)
+	// Stream 流式调用,服务端handler的第一个参数需要为 mqrpc.Stream
+	Stream(ctx context.Context, _func string, params ...interface{}) (Stream, error)
 }
 
 // Marshaler is a simple encoding interface used for the broker/transport
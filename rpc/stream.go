@@ -0,0 +1,66 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// 流式调用的消息类型,对应 RPCInfo.StreamType / ResultInfo.StreamType
+const (
+	StreamNone   int32 = iota //普通请求
+	StreamOpen                //客户端打开一个流,携带调用参数
+	StreamData                //数据块
+	StreamEnd                 //结束当前方向的发送,ResultInfo中可以携带Error
+	StreamCancel              //客户端取消,普通请求也用它通知服务端取消handler的ctx
+	StreamAck                 //流控,Credit为对方新增的可发送数量,为0时是心跳
+)
+
+// DefaultStreamWindow 流式调用默认的流控窗口,即未确认的最大数据块数量
+var DefaultStreamWindow int64 = 64
+
+// DefaultStreamHeartbeat 流的双方按这个间隔发送心跳,超过3个间隔没有收到对端的消息时取消流
+var DefaultStreamHeartbeat = time.Second * 5
+
+// StreamType handler中流参数的类型
+var StreamType = reflect.TypeOf((*Stream)(nil)).Elem()
+
+// Request 流式调用的请求信息
+type Request interface {
+	Service() string
+	Method() string
+	ContentType() string
+	Request() interface{}
+	// indicates whether the request will be streamed
+	Stream() bool
+}
+
+// Stream represents a stream established with a client.
+// A stream can be bidirectional which is indicated by the request.
+// The last error will be left in Error().
+// EOF indicated end of the stream.
+//
+// 服务端handler的第一个参数声明为mqrpc.Stream即为流式handler:
+//	func(stream mqrpc.Stream, req *Request) error
+// 服务端 Close 结束流; 客户端 Close 表示不再Send(半关闭),取消请使用context
+type Stream interface {
+	Context() context.Context
+	Request() Request
+	Send(interface{}) error
+	Recv(interface{}) error
+	Error() error
+	Close() error
+}
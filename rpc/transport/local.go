@@ -0,0 +1,98 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/utils/uuid"
+)
+
+// LocalTransport 进程内的传输层,适用于单进程部署和单元测试
+type LocalTransport struct {
+	mu     sync.RWMutex
+	subs   map[string][]*subscription
+	closed bool
+}
+
+// NewLocalTransport 创建进程内传输层
+func NewLocalTransport() *LocalTransport {
+	return &LocalTransport{
+		subs: map[string][]*subscription{},
+	}
+}
+
+// NewInbox NewInbox
+func (t *LocalTransport) NewInbox() string {
+	return "_INBOX." + uuid.Rand().Hex()
+}
+
+// Publish Publish
+func (t *LocalTransport) Publish(subject string, data []byte) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("transport closed")
+	}
+	for _, sub := range t.subs[subject] {
+		sub.deliver(data)
+	}
+	return nil
+}
+
+// Subscribe Subscribe
+func (t *LocalTransport) Subscribe(subject string, handler func(data []byte)) (mqrpc.Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("transport closed")
+	}
+	sub := newSubscription(subject, handler, t.remove)
+	t.subs[subject] = append(t.subs[subject], sub)
+	return sub, nil
+}
+
+func (t *LocalTransport) remove(sub *subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subs := t.subs[sub.subject]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(t.subs, sub.subject)
+	} else {
+		t.subs[sub.subject] = subs
+	}
+}
+
+// Close 关闭传输层并注销所有订阅
+func (t *LocalTransport) Close() error {
+	t.mu.Lock()
+	subs := t.subs
+	t.subs = map[string][]*subscription{}
+	t.closed = true
+	t.mu.Unlock()
+	for _, list := range subs {
+		for _, sub := range list {
+			_ = sub.Unsubscribe()
+		}
+	}
+	return nil
+}
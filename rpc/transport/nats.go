@@ -0,0 +1,79 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transport mqrpc.Transport 的几种实现
+package transport
+
+import (
+	"fmt"
+
+	"github.com/liangdas/mqant/rpc"
+	"github.com/nats-io/nats.go"
+)
+
+// NatsTransport 基于nats的传输层
+type NatsTransport struct {
+	nc *nats.Conn
+}
+
+// NewNatsTransport 使用已建立的nats连接创建传输层
+func NewNatsTransport(nc *nats.Conn) *NatsTransport {
+	return &NatsTransport{
+		nc: nc,
+	}
+}
+
+// Conn 底层nats连接
+func (t *NatsTransport) Conn() *nats.Conn {
+	return t.nc
+}
+
+// NewInbox NewInbox
+func (t *NatsTransport) NewInbox() string {
+	return nats.NewInbox()
+}
+
+// Publish Publish
+func (t *NatsTransport) Publish(subject string, data []byte) error {
+	if t.nc == nil {
+		return fmt.Errorf("nats not connected")
+	}
+	return t.nc.Publish(subject, data)
+}
+
+// Subscribe Subscribe
+func (t *NatsTransport) Subscribe(subject string, handler func(data []byte)) (mqrpc.Subscription, error) {
+	if t.nc == nil {
+		return nil, fmt.Errorf("nats not connected")
+	}
+	return t.nc.Subscribe(subject, func(m *nats.Msg) {
+		handler(m.Data)
+	})
+}
+
+// MaxPayload nats服务端允许的最大消息
+func (t *NatsTransport) MaxPayload() int64 {
+	if t.nc == nil {
+		return 0
+	}
+	return t.nc.MaxPayload()
+}
+
+// Close Close
+func (t *NatsTransport) Close() error {
+	if t.nc != nil {
+		t.nc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/liangdas/mqant/log"
+)
+
+// DefaultPendingLimit 每个订阅最多缓存的未处理消息数,与nats默认值保持一致
+var DefaultPendingLimit = 65536
+
+// subscription 本地订阅,消息在独立的协程中按顺序回调
+type subscription struct {
+	subject string
+	handler func(data []byte)
+	pending chan []byte
+	done    chan struct{}
+	once    sync.Once
+	remove  func(sub *subscription)
+}
+
+func newSubscription(subject string, handler func(data []byte), remove func(sub *subscription)) *subscription {
+	sub := &subscription{
+		subject: subject,
+		handler: handler,
+		pending: make(chan []byte, DefaultPendingLimit),
+		done:    make(chan struct{}),
+		remove:  remove,
+	}
+	go sub.run()
+	return sub
+}
+
+func (sub *subscription) deliver(data []byte) {
+	select {
+	case <-sub.done:
+	case sub.pending <- data:
+	default:
+		//与nats的slow consumer一致,队列满了直接丢弃
+		log.Warning("transport subscription(%s) slow consumer, message dropped", sub.subject)
+	}
+}
+
+func (sub *subscription) run() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case data := <-sub.pending:
+			sub.call(data)
+		}
+	}
+}
+
+func (sub *subscription) call(data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 1024)
+			l := runtime.Stack(buf, false)
+			log.Error("transport subscription(%s) %v\n ----Stack----\n%s", sub.subject, r, string(buf[:l]))
+		}
+	}()
+	sub.handler(data)
+}
+
+// Unsubscribe Unsubscribe
+func (sub *subscription) Unsubscribe() error {
+	err := fmt.Errorf("subscription(%s) already closed", sub.subject)
+	sub.once.Do(func() {
+		close(sub.done)
+		if sub.remove != nil {
+			sub.remove(sub)
+		}
+		err = nil
+	})
+	return err
+}
@@ -0,0 +1,344 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/utils/lib/addr"
+	"github.com/liangdas/mqant/utils/uuid"
+)
+
+const tcpScheme = "tcp://"
+
+var (
+	// DefaultDialTimeout 建立tcp连接的超时时间
+	DefaultDialTimeout = time.Second * 5
+	// DefaultMaxFrameSize 单条消息的最大字节数
+	DefaultMaxFrameSize = 64 * 1024 * 1024
+)
+
+// TCPTransport 节点之间直连的tcp传输层,不需要消息中间件
+// 地址格式为 tcp://host:port/id ,每个节点都需要监听一个其他节点可以访问的端口
+type TCPTransport struct {
+	listener  net.Listener
+	advertise string
+	mu        sync.RWMutex
+	subs      map[string][]*subscription
+	connMu    sync.Mutex
+	conns     map[string]*tcpConn
+	accepted  map[net.Conn]struct{}
+	closed    bool
+	dial      func(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+type tcpConn struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+// NewTCPTransport 监听address并创建tcp传输层
+// advertise 为其他节点访问本节点使用的地址,为空时使用监听地址
+func NewTCPTransport(address string, advertise string) (*TCPTransport, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if advertise == "" {
+		host, port, err := net.SplitHostPort(l.Addr().String())
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+			host = ""
+		}
+		host, err = addr.Extract(host)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		advertise = net.JoinHostPort(host, port)
+	}
+	t := &TCPTransport{
+		listener:  l,
+		advertise: advertise,
+		subs:      map[string][]*subscription{},
+		conns:     map[string]*tcpConn{},
+		accepted:  map[net.Conn]struct{}{},
+		dial:      net.DialTimeout,
+	}
+	go t.accept()
+	return t, nil
+}
+
+// Addr 本节点对外的地址 host:port
+func (t *TCPTransport) Addr() string {
+	return t.advertise
+}
+
+// NewInbox NewInbox
+func (t *TCPTransport) NewInbox() string {
+	return fmt.Sprintf("%s%s/%s", tcpScheme, t.advertise, uuid.Rand().Hex())
+}
+
+// Publish Publish
+func (t *TCPTransport) Publish(subject string, data []byte) error {
+	if !strings.HasPrefix(subject, tcpScheme) {
+		return fmt.Errorf("invalid tcp subject %s", subject)
+	}
+	hostport := subject[len(tcpScheme):]
+	if i := strings.Index(hostport, "/"); i >= 0 {
+		hostport = hostport[:i]
+	}
+	if hostport == t.advertise {
+		//本节点的地址无需经过网络
+		t.dispatch(subject, data)
+		return nil
+	}
+	frame, err := encodeFrame(subject, data)
+	if err != nil {
+		return err
+	}
+	c, err := t.getConn(hostport)
+	if err != nil {
+		return err
+	}
+	err = c.write(frame)
+	if err != nil {
+		//连接可能已经失效,重新建立一次
+		t.dropConn(hostport, c)
+		c, err = t.getConn(hostport)
+		if err != nil {
+			return err
+		}
+		err = c.write(frame)
+		if err != nil {
+			t.dropConn(hostport, c)
+		}
+	}
+	return err
+}
+
+// Subscribe Subscribe
+func (t *TCPTransport) Subscribe(subject string, handler func(data []byte)) (mqrpc.Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("transport closed")
+	}
+	sub := newSubscription(subject, handler, t.remove)
+	t.subs[subject] = append(t.subs[subject], sub)
+	return sub, nil
+}
+
+// MaxPayload 单条消息的最大字节数
+func (t *TCPTransport) MaxPayload() int64 {
+	return int64(DefaultMaxFrameSize)
+}
+
+// Close 关闭监听和所有连接
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	subs := t.subs
+	t.subs = map[string][]*subscription{}
+	t.mu.Unlock()
+	err := t.listener.Close()
+	t.connMu.Lock()
+	for hostport, c := range t.conns {
+		c.conn.Close()
+		delete(t.conns, hostport)
+	}
+	for conn := range t.accepted {
+		conn.Close()
+		delete(t.accepted, conn)
+	}
+	t.connMu.Unlock()
+	for _, list := range subs {
+		for _, sub := range list {
+			_ = sub.Unsubscribe()
+		}
+	}
+	return err
+}
+
+func (t *TCPTransport) isClosed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.closed
+}
+
+func (t *TCPTransport) remove(sub *subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subs := t.subs[sub.subject]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(t.subs, sub.subject)
+	} else {
+		t.subs[sub.subject] = subs
+	}
+}
+
+func (t *TCPTransport) dispatch(subject string, data []byte) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, sub := range t.subs[subject] {
+		sub.deliver(data)
+	}
+}
+
+// getConn 在锁外建立连接,一个无法访问的节点不会阻塞发往其他节点的消息
+func (t *TCPTransport) getConn(hostport string) (*tcpConn, error) {
+	if t.isClosed() {
+		return nil, fmt.Errorf("transport closed")
+	}
+	t.connMu.Lock()
+	c, ok := t.conns[hostport]
+	t.connMu.Unlock()
+	if ok {
+		return c, nil
+	}
+	conn, err := t.dial("tcp", hostport, DefaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if c, ok := t.conns[hostport]; ok {
+		//其他goroutine已经建立了连接
+		conn.Close()
+		return c, nil
+	}
+	if t.isClosed() {
+		conn.Close()
+		return nil, fmt.Errorf("transport closed")
+	}
+	c = &tcpConn{conn: conn}
+	t.conns[hostport] = c
+	return c, nil
+}
+
+func (t *TCPTransport) dropConn(hostport string, c *tcpConn) {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if t.conns[hostport] == c {
+		delete(t.conns, hostport)
+	}
+	c.conn.Close()
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return
+			}
+			log.Warning("TCPTransport accept error with '%v'", err)
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		t.connMu.Lock()
+		t.accepted[conn] = struct{}{}
+		t.connMu.Unlock()
+		go t.serve(conn)
+	}
+}
+
+func (t *TCPTransport) serve(conn net.Conn) {
+	defer func() {
+		t.connMu.Lock()
+		delete(t.accepted, conn)
+		t.connMu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		subject, data, err := decodeFrame(r)
+		if err != nil {
+			if err != io.EOF && !t.isClosed() {
+				log.Warning("TCPTransport read %s error with '%v'", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		t.dispatch(subject, data)
+	}
+}
+
+func (c *tcpConn) write(frame []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// encodeFrame |subject len(4)|subject|data len(4)|data|
+func encodeFrame(subject string, data []byte) ([]byte, error) {
+	if len(data) > DefaultMaxFrameSize {
+		return nil, fmt.Errorf("message size %d exceeds the limit %d", len(data), DefaultMaxFrameSize)
+	}
+	frame := make([]byte, 8+len(subject)+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(subject)))
+	copy(frame[4:], subject)
+	binary.BigEndian.PutUint32(frame[4+len(subject):], uint32(len(data)))
+	copy(frame[8+len(subject):], data)
+	return frame, nil
+}
+
+func decodeFrame(r io.Reader) (string, []byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", nil, err
+	}
+	l := binary.BigEndian.Uint32(head[:])
+	if int(l) > DefaultMaxFrameSize {
+		return "", nil, fmt.Errorf("invalid subject length %d", l)
+	}
+	subject := make([]byte, l)
+	if _, err := io.ReadFull(r, subject); err != nil {
+		return "", nil, err
+	}
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", nil, err
+	}
+	l = binary.BigEndian.Uint32(head[:])
+	if int(l) > DefaultMaxFrameSize {
+		return "", nil, fmt.Errorf("message size %d exceeds the limit %d", l, DefaultMaxFrameSize)
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, err
+	}
+	return string(subject), data, nil
+}
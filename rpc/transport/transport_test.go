@@ -0,0 +1,154 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/rpc"
+)
+
+func roundTrip(t *testing.T, server, client mqrpc.Transport) {
+	addr := server.NewInbox()
+	_, err := server.Subscribe(addr, func(data []byte) {
+		reply := string(data[:len(data)-5])
+		server.Publish(reply, append([]byte("pong:"), data[len(data)-5:]...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := client.NewInbox()
+	got := make(chan string, 10)
+	sub, err := client.Subscribe(inbox, func(data []byte) {
+		got <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	for _, msg := range []string{"hello", "world"} {
+		if err := client.Publish(addr, []byte(inbox+msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"pong:hello", "pong:world"} {
+		select {
+		case v := <-got:
+			if v != want {
+				t.Fatalf("got %q want %q", v, want)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+}
+
+func TestLocalTransport(t *testing.T) {
+	tr := NewLocalTransport()
+	defer tr.Close()
+	roundTrip(t, tr, tr)
+}
+
+func TestLocalTransportUnsubscribe(t *testing.T) {
+	tr := NewLocalTransport()
+	defer tr.Close()
+	got := make(chan []byte, 1)
+	sub, _ := tr.Subscribe("a", func(data []byte) {
+		got <- data
+	})
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Unsubscribe(); err == nil {
+		t.Fatal("second Unsubscribe should fail")
+	}
+	tr.Publish("a", []byte("x"))
+	select {
+	case <-got:
+		t.Fatal("message delivered after Unsubscribe")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	server, err := NewTCPTransport("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewTCPTransport("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, server, client)
+	roundTrip(t, server, server)
+}
+
+func TestTCPTransportSlowDial(t *testing.T) {
+	server, err := NewTCPTransport("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewTCPTransport("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//一个节点建立连接一直没有返回
+	release := make(chan struct{})
+	client.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if address == "10.255.255.1:9" {
+			<-release
+			return nil, &net.OpError{Op: "dial", Net: network}
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- client.Publish("tcp://10.255.255.1:9/a", []byte("x"))
+	}()
+	time.Sleep(time.Millisecond * 50)
+	//发往其他节点的消息不受影响
+	timer := time.AfterFunc(time.Second*2, func() { close(release) })
+	start := time.Now()
+	roundTrip(t, server, client)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publish blocked by a slow dial for %v", elapsed)
+	}
+	if timer.Stop() {
+		close(release)
+	}
+	if err := <-blocked; err == nil {
+		t.Fatal("publish to unreachable peer should fail")
+	}
+}
+
+func TestTCPFrame(t *testing.T) {
+	frame, err := encodeFrame("tcp://127.0.0.1:1/a", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, data, err := decodeFrame(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "tcp://127.0.0.1:1/a" || string(data) != "data" {
+		t.Fatalf("decodeFrame got %q %q", subject, data)
+	}
+}
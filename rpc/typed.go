@@ -0,0 +1,162 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mqrpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/liangdas/mqant/selector"
+	"google.golang.org/protobuf/proto"
+)
+
+// Caller 按模块类型发起调用, module.App 与 module.RPCModule 都实现了该接口
+type Caller interface {
+	CallWithError(ctx context.Context, moduleType, _func string, param ParamOption, opts ...selector.SelectOption) (interface{}, error)
+}
+
+// SessionCaller 向指定节点发起调用, RPCClient 与 module.ServerSession 都实现了该接口
+type SessionCaller interface {
+	CallWithError(ctx context.Context, _func string, params ...interface{}) (interface{}, error)
+}
+
+// Registrar 注册handler, RPCServer 与 server.Server 都实现了该接口
+type Registrar interface {
+	Register(id string, f interface{}, opts ...RegisterOption)
+	RegisterGO(id string, f interface{}, opts ...RegisterOption)
+}
+
+var (
+	marshalerType    = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+)
+
+// CallTyped 调用moduleType模块的handler并把结果转换为Rsp类型
+func CallTyped[Req any, Rsp any](ctx context.Context, caller Caller, moduleType, _func string, req Req, opts ...selector.SelectOption) (Rsp, error) {
+	return ResultAs[Rsp](caller.CallWithError(ctx, moduleType, _func, Param(req), opts...))
+}
+
+// SessionCallTyped 调用指定节点的handler并把结果转换为Rsp类型
+func SessionCallTyped[Req any, Rsp any](ctx context.Context, caller SessionCaller, _func string, req Req) (Rsp, error) {
+	return ResultAs[Rsp](caller.CallWithError(ctx, _func, req))
+}
+
+// ResultAs 把 CallWithError 的结果转换为Rsp类型
+//
+//  Reply type                 Rsp                              Result
+//  Rsp                        -                                reply, nil
+//  []byte                     *T (T实现Marshaler/proto.Message) 解码后的*T, nil
+//  *Encoded                   -                                使用对应的Codec解码, nil
+//  int32/int64/float32/...    可以转换的数值类型                  转换后的值, nil (溢出时返回strconv.ErrRange)
+//  nil                        指针/map/slice/interface          零值, nil
+//  nil                        其他                              零值, ErrNil
+//  other                      -                                零值, CodeSerialization错误
+func ResultAs[Rsp any](reply interface{}, err error) (Rsp, error) {
+	var rsp Rsp
+	if err != nil {
+		return rsp, err
+	}
+	rt := reflect.TypeOf(&rsp).Elem()
+	if reply == nil {
+		switch rt.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+			return rsp, nil
+		}
+		return rsp, ErrNil
+	}
+	if r, ok := reply.(Rsp); ok {
+		return r, nil
+	}
+	if e, ok := reply.(*Encoded); ok {
+		if err := e.Decode(&rsp); err != nil {
+			return rsp, Serialization("mqrpc: %s unmarshal %v error %v", e.Codec, rt, err)
+		}
+		return rsp, nil
+	}
+	if b, ok := reply.([]byte); ok && rt.Kind() == reflect.Ptr {
+		v := reflect.New(rt.Elem())
+		switch m := v.Interface().(type) {
+		case Marshaler:
+			if err := m.Unmarshal(b); err != nil {
+				return rsp, Serialization("mqrpc: unmarshal %v error %v", rt, err)
+			}
+			return v.Interface().(Rsp), nil
+		case proto.Message:
+			if err := proto.Unmarshal(b, m); err != nil {
+				return rsp, Serialization("mqrpc: unmarshal %v error %v", rt, err)
+			}
+			return v.Interface().(Rsp), nil
+		}
+	}
+	rv := reflect.ValueOf(reply)
+	if isNumber(rv.Kind()) && isNumber(rt.Kind()) {
+		cv := rv.Convert(rt)
+		if cv.Convert(rv.Type()).Interface() != reply {
+			return rsp, strconv.ErrRange
+		}
+		return cv.Interface().(Rsp), nil
+	}
+	return rsp, Serialization("mqrpc: unexpected type for %v, got type %T", rt, reply)
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// RegisterTyped 注册一个类型安全的handler,注册时检查Req与Rsp是否可以在rpc中传递
+func RegisterTyped[Req any, Rsp any](r Registrar, id string, f func(ctx context.Context, req Req) (Rsp, error), opts ...RegisterOption) error {
+	if err := checkTyped[Req, Rsp](id); err != nil {
+		return err
+	}
+	r.Register(id, f, opts...)
+	return nil
+}
+
+// RegisterTypedGO 与 RegisterTyped 相同,handler在单独的goroutine中执行
+func RegisterTypedGO[Req any, Rsp any](r Registrar, id string, f func(ctx context.Context, req Req) (Rsp, error), opts ...RegisterOption) error {
+	if err := checkTyped[Req, Rsp](id); err != nil {
+		return err
+	}
+	r.RegisterGO(id, f, opts...)
+	return nil
+}
+
+func checkTyped[Req any, Rsp any](id string) error {
+	if err := checkType(reflect.TypeOf((*Req)(nil)).Elem()); err != nil {
+		return InvalidArgs("function id %v: request %v", id, err)
+	}
+	if err := checkType(reflect.TypeOf((*Rsp)(nil)).Elem()); err != nil {
+		return InvalidArgs("function id %v: response %v", id, err)
+	}
+	return nil
+}
+
+// checkType 检查类型是否可以被 argsutil 编解码, 没有注册序列化器的类型使用 Codec 编码
+func checkType(t reflect.Type) error {
+	if t.Kind() == reflect.Interface || t.Implements(marshalerType) || t.Implements(protoMessageType) {
+		return nil
+	}
+	if err := CheckCodecType(t); err != nil {
+		return fmt.Errorf("type %v can not be serialized: %v", t, err)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/utils"
 	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -39,9 +40,34 @@ var (
 	TRACE   = "trace"   //log.TraceSpanImp
 	Marshal = "marshal" //mqrpc.Marshaler
 	Proto   = "proto"   //proto.Message
+	CODEC   = "codec"   //mqrpc.Codec  codec@编解码器名称@类型名称
 )
 
+// serializers 按名称排序的 RPCSerialize, 保证尝试的顺序是确定的
+func serializers(app module.App) []module.RPCSerialize {
+	if app == nil {
+		return nil
+	}
+	m := app.GetRPCSerialize()
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]module.RPCSerialize, len(names))
+	for i, name := range names {
+		list[i] = m[name]
+	}
+	return list
+}
+
 func ArgsTypeAnd2Bytes(app module.App, arg interface{}) (string, []byte, error) {
+	return ArgsTypeAnd2BytesWithCodec(app, "", arg)
+}
+
+// ArgsTypeAnd2BytesWithCodec 与 ArgsTypeAnd2Bytes 相同,其他方式都不能序列化的值使用codec编码
+// 优先级: 内置类型 > RPCSerialize(按名称) > Marshaler > proto.Message > codec, codec为空时使用优先级最高的编解码器
+func ArgsTypeAnd2BytesWithCodec(app module.App, codec string, arg interface{}) (string, []byte, error) {
 	if arg == nil {
 		return NULL, nil, nil
 	}
@@ -91,7 +117,7 @@ func ArgsTypeAnd2Bytes(app module.App, arg interface{}) (string, []byte, error)
 		}
 		return TRACE, bytes, nil
 	default:
-		for _, v := range app.GetRPCSerialize() {
+		for _, v := range serializers(app) {
 			ptype, vk, err := v.Serialize(arg)
 			if err == nil {
 				//解析成功了
@@ -100,10 +126,7 @@ func ArgsTypeAnd2Bytes(app module.App, arg interface{}) (string, []byte, error)
 		}
 
 		rv := reflect.ValueOf(arg)
-		if rv.Kind() != reflect.Ptr {
-			//不是指针
-			return "", nil, fmt.Errorf("Args2Bytes [%v] not registered to app.addrpcserialize(...) structure type or not *mqrpc.marshaler pointer type", reflect.TypeOf(arg))
-		} else {
+		if rv.Kind() == reflect.Ptr {
 			if rv.IsNil() {
 				//如果是nil则直接返回
 				return NULL, nil, nil
@@ -128,12 +151,36 @@ func ArgsTypeAnd2Bytes(app module.App, arg interface{}) (string, []byte, error)
 				return fmt.Sprintf("%v@%v", Proto, reflect.TypeOf(arg)), b, nil
 			}
 		}
+		if mqrpc.Codecable(rv.Type()) {
+			if codec == "" {
+				codec = mqrpc.NegotiateCodec("")
+			}
+			c := mqrpc.GetCodec(codec)
+			if c == nil {
+				return "", nil, fmt.Errorf("Args2Bytes [%s] codec [%s] not registered", reflect.TypeOf(arg), codec)
+			}
+			b, err := c.Marshal(arg)
+			if err != nil {
+				return "", nil, fmt.Errorf("args [%s] %s marshal error %v", reflect.TypeOf(arg), codec, err)
+			}
+			return fmt.Sprintf("%v@%v@%v", CODEC, codec, reflect.TypeOf(arg)), b, nil
+		}
 
 		return "", nil, fmt.Errorf("Args2Bytes [%s] not registered to app.addrpcserialize(...) structure type", reflect.TypeOf(arg))
 	}
 }
 
 func Bytes2Args(app module.App, argsType string, args []byte) (interface{}, error) {
+	if strings.HasPrefix(argsType, CODEC+"@") {
+		//不知道目标类型,保持编码状态
+		encoded := &mqrpc.Encoded{Data: args}
+		names := strings.SplitN(argsType, "@", 3)
+		encoded.Codec = names[1]
+		if len(names) == 3 {
+			encoded.Type = names[2]
+		}
+		return encoded, nil
+	}
 	if strings.HasPrefix(argsType, Marshal) {
 		return args, nil
 	}
@@ -177,7 +224,7 @@ func Bytes2Args(app module.App, argsType string, args []byte) (interface{}, erro
 		}
 		return trace.ExtractSpan(), nil
 	default:
-		for _, v := range app.GetRPCSerialize() {
+		for _, v := range serializers(app) {
 			vk, err := v.Deserialize(argsType, args)
 			if err == nil {
 				//解析成功了
@@ -187,3 +234,52 @@ func Bytes2Args(app module.App, argsType string, args []byte) (interface{}, erro
 		return nil, fmt.Errorf("Bytes2Args [%s] not registered to app.addrpcserialize(...)", argsType)
 	}
 }
+
+var (
+	marshalerType    = reflect.TypeOf((*mqrpc.Marshaler)(nil)).Elem()
+	protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	builtinTypes     = map[reflect.Type]string{
+		reflect.TypeOf(false):                    BOOL,
+		reflect.TypeOf(int32(0)):                 INT,
+		reflect.TypeOf(int64(0)):                 LONG,
+		reflect.TypeOf(float32(0)):               FLOAT,
+		reflect.TypeOf(float64(0)):               DOUBLE,
+		reflect.TypeOf(""):                       STRING,
+		reflect.TypeOf([]byte(nil)):              BYTES,
+		reflect.TypeOf(map[string]interface{}{}): MAP,
+		reflect.TypeOf(map[string]string{}):      MAPSTR,
+		reflect.TypeOf(log.TraceSpanImp{}):       TRACE,
+		reflect.TypeOf(&log.TraceSpanImp{}):      TRACE,
+	}
+)
+
+// CheckType 检查类型的值能否被 ArgsTypeAnd2Bytes 序列化并还原为同一个类型, interface类型只能在运行时检查
+// 内置类型、Marshaler、proto.Message 以外的类型使用 mqrpc.Codec 编码, 必须能被 mqrpc.CheckCodecType 还原
+func CheckType(app module.App, t reflect.Type) error {
+	if _, ok := builtinTypes[t]; ok || t.Kind() == reflect.Interface {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr && (t.Implements(marshalerType) || t.Implements(protoMessageType)) {
+		return nil
+	}
+	if err := mqrpc.CheckCodecType(t); err != nil {
+		return fmt.Errorf("type [%v] can not be serialized: %v", t, err)
+	}
+	return nil
+}
+
+// CheckArgType 检查handler的参数类型能否被解析
+// 除了 CheckType 支持的类型外,值类型的Marshaler/proto.Message 也可以作为参数
+// log.TraceSpanImp 解析为 *log.TraceSpanImp, 参数必须使用指针或 log.TraceSpan
+func CheckArgType(app module.App, t reflect.Type) error {
+	if t == reflect.TypeOf(log.TraceSpanImp{}) {
+		return fmt.Errorf("type [%v] can not be used as an argument, use *log.TraceSpanImp or log.TraceSpan", t)
+	}
+	if t.Kind() != reflect.Ptr {
+		pt := reflect.PtrTo(t)
+		if pt.Implements(marshalerType) || pt.Implements(protoMessageType) {
+			return nil
+		}
+	}
+	return CheckType(app, t)
+}
@@ -70,3 +70,44 @@ func FilterVersion(version string) Filter {
 		return services
 	}
 }
+
+// FilterExclude is a Select Filter which will exclude the nodes
+// specified, e.g. the nodes already failed in a retry. If every
+// node is excluded the original services are returned.
+func FilterExclude(ids ...string) Filter {
+	return func(old []*registry.Service) []*registry.Service {
+		if len(ids) == 0 {
+			return old
+		}
+		exclude := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			exclude[id] = true
+		}
+
+		var services []*registry.Service
+
+		for _, service := range old {
+			serv := new(registry.Service)
+			var nodes []*registry.Node
+
+			for _, node := range service.Nodes {
+				if !exclude[node.Id] {
+					nodes = append(nodes, node)
+				}
+			}
+
+			// only add service if there's some nodes
+			if len(nodes) > 0 {
+				// copy
+				*serv = *service
+				serv.Nodes = nodes
+				services = append(services, serv)
+			}
+		}
+
+		if len(services) == 0 {
+			return old
+		}
+		return services
+	}
+}
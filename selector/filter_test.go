@@ -237,3 +237,49 @@ func TestFilterVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterExclude(t *testing.T) {
+	services := []*registry.Service{
+		&registry.Service{
+			Name:    "test",
+			Version: "1.0.0",
+			Nodes: []*registry.Node{
+				&registry.Node{
+					Id:      "test-1",
+					Address: "localhost",
+				},
+				&registry.Node{
+					Id:      "test-2",
+					Address: "localhost",
+				},
+			},
+		},
+	}
+	testData := []struct {
+		exclude []string
+		nodes   []string
+	}{
+		{nil, []string{"test-1", "test-2"}},
+		{[]string{"test-1"}, []string{"test-2"}},
+		{[]string{"test-1", "test-2"}, []string{"test-1", "test-2"}},
+	}
+
+	for _, data := range testData {
+		filter := FilterExclude(data.exclude...)
+		result := filter(services)
+		if len(result) != 1 {
+			t.Fatalf("Expected 1 service, got %d", len(result))
+		}
+		if len(result[0].Nodes) != len(data.nodes) {
+			t.Fatalf("Expected %d nodes, got %d", len(data.nodes), len(result[0].Nodes))
+		}
+		for i, node := range result[0].Nodes {
+			if node.Id != data.nodes[i] {
+				t.Fatalf("Expected node %s, got %s", data.nodes[i], node.Id)
+			}
+		}
+	}
+	if len(services[0].Nodes) != 2 {
+		t.Fatal("FilterExclude modified the original services")
+	}
+}
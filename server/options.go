@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"github.com/liangdas/mqant/registry"
+	"github.com/liangdas/mqant/rpc"
 	"time"
 )
 
@@ -19,6 +20,11 @@ type Options struct {
 	RegisterInterval time.Duration
 	RegisterTTL      time.Duration
 
+	// Limit 模块的并发限制, MaxConcurrent为0时不限制
+	Limit mqrpc.LimitPolicy
+	// DeadLetterSink 保存执行失败的CallNR消息
+	DeadLetterSink mqrpc.DeadLetterSink
+
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
@@ -127,6 +133,20 @@ func RegisterInterval(t time.Duration) Option {
 	}
 }
 
+// Limit 限制模块同时执行的请求数量,超出时按策略排队或拒绝
+func Limit(policy mqrpc.LimitPolicy) Option {
+	return func(o *Options) {
+		o.Limit = policy
+	}
+}
+
+// DeadLetter 保存模块执行失败的CallNR消息,可以通过 Server.Redrive 重新执行
+func DeadLetter(sink mqrpc.DeadLetterSink) Option {
+	return func(o *Options) {
+		o.DeadLetterSink = sink
+	}
+}
+
 // Wait tells the server to wait for requests to finish before exiting
 func Wait(b bool) Option {
 	return func(o *Options) {
@@ -8,6 +8,7 @@ import (
 	"github.com/liangdas/mqant/rpc"
 	"github.com/liangdas/mqant/rpc/base"
 	"github.com/liangdas/mqant/utils/lib/addr"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,8 +21,10 @@ type rpcServer struct {
 	opts Options
 	// used for first registration
 	registered bool
-	server     mqrpc.RPCServer
-	id         string
+	// 定时注册与注册handler后的重新发布共用节点元数据
+	regMu  sync.Mutex
+	server mqrpc.RPCServer
+	id     string
 	// graceful exit
 	wg sync.WaitGroup
 }
@@ -56,32 +59,102 @@ func (s *rpcServer) OnInit(module module.Module, app module.App, settings *conf.
 	server, err := defaultrpc.NewRPCServer(app, module) //默认会创建一个本地的RPC
 	if err != nil {
 		log.Warning("Dial: %s", err)
+		return err
 	}
 	s.server = server
 	s.opts.Address = server.Addr()
-	if err := s.ServiceRegister(); err != nil {
-		return err
+	if s.opts.Limit.MaxConcurrent > 0 {
+		server.SetLimit(s.opts.Limit)
 	}
+	if s.opts.DeadLetterSink != nil {
+		server.SetDeadLetterSink(s.opts.DeadLetterSink)
+	}
+	//handler还没有注册,由 service.Start 发布到注册中心
 	return nil
 }
 func (s *rpcServer) SetListener(listener mqrpc.RPCListener) {
 	s.server.SetListener(listener)
 }
-func (s *rpcServer) Register(id string, f interface{}) {
+func (s *rpcServer) Use(middlewares ...mqrpc.Middleware) {
+	if s.server == nil {
+		panic("invalid RPCServer")
+	}
+	s.server.Use(middlewares...)
+}
+func (s *rpcServer) Register(id string, f interface{}, opts ...mqrpc.RegisterOption) {
+	if s.server == nil {
+		panic("invalid RPCServer")
+	}
+	s.server.Register(id, f, opts...)
+	s.republish()
+}
+
+func (s *rpcServer) RegisterGO(id string, f interface{}, opts ...mqrpc.RegisterOption) {
+	if s.server == nil {
+		panic("invalid RPCServer")
+	}
+	s.server.RegisterGO(id, f, opts...)
+	s.republish()
+}
+
+func (s *rpcServer) RegisterKeyed(id string, f interface{}, key mqrpc.KeyFunc, opts ...mqrpc.RegisterOption) {
+	if s.server == nil {
+		panic("invalid RPCServer")
+	}
+	s.server.RegisterKeyed(id, f, key, opts...)
+	s.republish()
+}
+
+func (s *rpcServer) GetLimitStats() (module mqrpc.LimitStats, handlers map[string]mqrpc.LimitStats) {
 	if s.server == nil {
 		panic("invalid RPCServer")
 	}
-	s.server.Register(id, f)
+	return s.server.GetLimitStats()
 }
 
-func (s *rpcServer) RegisterGO(id string, f interface{}) {
+func (s *rpcServer) DeadLetters() ([]*mqrpc.DeadLetter, error) {
 	if s.server == nil {
 		panic("invalid RPCServer")
 	}
-	s.server.RegisterGO(id, f)
+	return s.server.DeadLetters()
+}
+
+func (s *rpcServer) Redrive(id string) error {
+	if s.server == nil {
+		panic("invalid RPCServer")
+	}
+	return s.server.Redrive(id)
+}
+
+// republish 已经发布到注册中心后, 注册新的handler需要更新Endpoints等元数据
+func (s *rpcServer) republish() {
+	s.RLock()
+	registered := s.registered
+	s.RUnlock()
+	if !registered {
+		return
+	}
+	if err := s.ServiceRegister(); err != nil {
+		log.Warning("ServiceRegister id(%s) error(%s)", s.id, err)
+	}
+}
+
+// splitAdvertise 拆分 host:port, 传输层地址(如 tcp://host:port/id)原样作为host返回
+func splitAdvertise(advt string) (host string, port int) {
+	parts := strings.Split(advt, ":")
+	if len(parts) > 1 {
+		p, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			return advt, 0
+		}
+		return strings.Join(parts[:len(parts)-1], ":"), p
+	}
+	return parts[0], 0
 }
 
 func (s *rpcServer) ServiceRegister() error {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
 	// parse address for host, port
 	config := s.Options()
 	var advt, host string
@@ -96,19 +169,19 @@ func (s *rpcServer) ServiceRegister() error {
 		advt = config.Address
 	}
 
-	parts := strings.Split(advt, ":")
-	if len(parts) > 1 {
-		host = strings.Join(parts[:len(parts)-1], ":")
-		port, _ = strconv.Atoi(parts[len(parts)-1])
-	} else {
-		host = parts[0]
-	}
+	host, port = splitAdvertise(advt)
 
 	addr, err := addr.Extract(host)
 	if err != nil {
 		return err
 	}
 
+	//先标记为已注册,之后注册的handler会重新发布
+	s.Lock()
+	registered := s.registered
+	s.registered = true
+	s.Unlock()
+
 	// register service
 	node := &registry.Node{
 		Id:       config.Name + "@" + config.ID,
@@ -119,11 +192,33 @@ func (s *rpcServer) ServiceRegister() error {
 	s.id = node.Id
 	node.Metadata["server"] = s.String()
 	node.Metadata["registry"] = config.Registry.String()
+	if s.server != nil {
+		//客户端根据这里的记录判断失败的调用能否自动重试
+		var idempotent []string
+		for id, finfo := range s.server.GetFunctions() {
+			if finfo.Idempotent {
+				idempotent = append(idempotent, id)
+			}
+		}
+		sort.Strings(idempotent)
+		node.Metadata[mqrpc.IdempotentMetadataKey] = strings.Join(idempotent, ",")
+	}
+	//客户端根据这里的记录协商参数的编解码器
+	node.Metadata[mqrpc.CodecsMetadataKey] = strings.Join(mqrpc.CodecNames(), ",")
+	node.Metadata[mqrpc.CompressionsMetadataKey] = strings.Join(mqrpc.CompressorNames(), ",")
 
 	s.RLock()
 	// Maps are ordered randomly, sort the keys for consistency
 
 	var endpoints []*registry.Endpoint
+	if s.server != nil {
+		for id, finfo := range s.server.GetFunctions() {
+			endpoints = append(endpoints, newEndpoint(id, finfo))
+		}
+		sort.Slice(endpoints, func(i, j int) bool {
+			return endpoints[i].Name < endpoints[j].Name
+		})
+	}
 
 	s.RUnlock()
 
@@ -134,10 +229,6 @@ func (s *rpcServer) ServiceRegister() error {
 		Endpoints: endpoints,
 	}
 
-	s.Lock()
-	registered := s.registered
-	s.Unlock()
-
 	if !registered {
 		log.Info("Registering node: %s", node.Id)
 	}
@@ -146,19 +237,14 @@ func (s *rpcServer) ServiceRegister() error {
 	rOpts := []registry.RegisterOption{registry.RegisterTTL(config.RegisterTTL)}
 
 	if err := config.Registry.Register(service, rOpts...); err != nil {
+		if !registered {
+			s.Lock()
+			s.registered = false
+			s.Unlock()
+		}
 		return err
 	}
 
-	// already registered? don't need to register subscribers
-	if registered {
-		return nil
-	}
-
-	s.Lock()
-	defer s.Unlock()
-
-	s.registered = true
-
 	return nil
 }
 
@@ -176,13 +262,7 @@ func (s *rpcServer) ServiceDeregister() error {
 		advt = config.Address
 	}
 
-	parts := strings.Split(advt, ":")
-	if len(parts) > 1 {
-		host = strings.Join(parts[:len(parts)-1], ":")
-		port, _ = strconv.Atoi(parts[len(parts)-1])
-	} else {
-		host = parts[0]
-	}
+	host, port = splitAdvertise(advt)
 
 	addr, err := addr.Extract(host)
 	if err != nil {
@@ -261,3 +341,46 @@ func (s *rpcServer) ID() string {
 func (s *rpcServer) String() string {
 	return "rpc"
 }
+
+// newEndpoint 根据handler的签名生成服务发现中的Endpoint
+func newEndpoint(id string, finfo *mqrpc.FunctionInfo) *registry.Endpoint {
+	in := finfo.InType
+	if finfo.Stream || finfo.Context {
+		in = in[1:]
+	}
+	request := &registry.Value{
+		Name: id,
+		Type: "request",
+	}
+	for i, t := range in {
+		request.Values = append(request.Values, &registry.Value{
+			Name: "params[" + strconv.Itoa(i) + "]",
+			Type: t.String(),
+		})
+	}
+	response := &registry.Value{
+		Name: id,
+		Type: "response",
+	}
+	for i := 0; i < finfo.FuncType.NumOut(); i++ {
+		name := "result"
+		if i == finfo.FuncType.NumOut()-1 {
+			name = "err"
+		}
+		response.Values = append(response.Values, &registry.Value{
+			Name: name,
+			Type: finfo.FuncType.Out(i).String(),
+		})
+	}
+	return &registry.Endpoint{
+		Name:     id,
+		Request:  request,
+		Response: response,
+		Metadata: map[string]string{
+			"stream":     strconv.FormatBool(finfo.Stream),
+			"goroutine":  strconv.FormatBool(finfo.Goroutine),
+			"idempotent": strconv.FormatBool(finfo.Idempotent),
+			"keyed":      strconv.FormatBool(finfo.Key != nil),
+		},
+	}
+}
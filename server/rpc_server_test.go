@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liangdas/mqant/conf"
+	"github.com/liangdas/mqant/log"
+	"github.com/liangdas/mqant/module"
+	"github.com/liangdas/mqant/registry"
+	"github.com/liangdas/mqant/rpc"
+	"github.com/liangdas/mqant/rpc/transport"
+)
+
+func init() {
+	log.LogBeego()
+}
+
+// testApp 只实现了RPCServer用到的方法
+type testApp struct {
+	module.App
+	opts module.Options
+}
+
+func (a *testApp) Options() module.Options                         { return a.opts }
+func (a *testApp) Transport() mqrpc.Transport                      { return a.opts.Transport }
+func (a *testApp) GetSettings() conf.Config                        { return conf.Config{} }
+func (a *testApp) GetRPCSerialize() map[string]module.RPCSerialize { return nil }
+
+type testModule struct {
+	module.Module
+}
+
+func (m *testModule) GetType() string { return "test" }
+
+// recordRegistry 记录最后一次注册的服务
+type recordRegistry struct {
+	registry.Registry
+	mu      sync.Mutex
+	service *registry.Service
+	count   int
+}
+
+func (r *recordRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.service = s
+	r.count++
+	return nil
+}
+
+func (r *recordRegistry) last() (*registry.Service, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.service, r.count
+}
+
+func (r *recordRegistry) String() string { return "record" }
+
+func endpointNames(service *registry.Service) []string {
+	var names []string
+	for _, e := range service.Endpoints {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestServiceRegisterEndpoints(t *testing.T) {
+	app := &testApp{opts: module.Options{
+		Transport:  transport.NewLocalTransport(),
+		RPCExpired: time.Second,
+	}}
+	defer app.Transport().Close()
+	reg := &recordRegistry{}
+	s := newRPCServer(Registry(reg), Name("test"), ID("1"))
+	if err := s.OnInit(&testModule{}, app, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	//handler注册之前不发布
+	if _, n := reg.last(); n != 0 {
+		t.Fatalf("published %d times before handlers were registered", n)
+	}
+	s.Register("hello", func(name string) (string, error) { return name, nil })
+	if _, n := reg.last(); n != 0 {
+		t.Fatalf("published %d times before service start", n)
+	}
+	if err := s.ServiceRegister(); err != nil {
+		t.Fatal(err)
+	}
+	//启动之后注册的handler重新发布
+	s.RegisterGO("retry", func() (string, error) { return "", nil }, mqrpc.Idempotent())
+	s.RegisterKeyed("room", func(id string) (string, error) { return id, nil }, func(args []interface{}) string { return "" })
+	service, _ := reg.last()
+	var want []string
+	for id := range s.(*rpcServer).server.GetFunctions() {
+		want = append(want, id)
+	}
+	sort.Strings(want)
+	got := endpointNames(service)
+	if len(got) != len(want) {
+		t.Fatalf("endpoints %v want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("endpoints %v want %v", got, want)
+		}
+	}
+	if v := service.Nodes[0].Metadata[mqrpc.IdempotentMetadataKey]; v != "retry" {
+		t.Fatalf("idempotent metadata %q", v)
+	}
+}
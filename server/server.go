@@ -2,7 +2,6 @@
 package server
 
 import (
-	"context"
 	"github.com/liangdas/mqant/conf"
 	"github.com/liangdas/mqant/module"
 	"github.com/liangdas/mqant/rpc"
@@ -15,8 +14,18 @@ type Server interface {
 	OnInit(module module.Module, app module.App, settings *conf.ModuleSettings) error
 	Init(...Option) error
 	SetListener(listener mqrpc.RPCListener)
-	Register(id string, f interface{})
-	RegisterGO(id string, f interface{})
+	// Use 添加handler中间件,需要在OnInit之后调用
+	Use(middlewares ...mqrpc.Middleware)
+	Register(id string, f interface{}, opts ...mqrpc.RegisterOption)
+	RegisterGO(id string, f interface{}, opts ...mqrpc.RegisterOption)
+	// RegisterKeyed 注册按key顺序执行的handler,key为nil时使用 mqrpc.SessionKey
+	RegisterKeyed(id string, f interface{}, key mqrpc.KeyFunc, opts ...mqrpc.RegisterOption)
+	// GetLimitStats 模块与各个handler并发限制的统计
+	GetLimitStats() (module mqrpc.LimitStats, handlers map[string]mqrpc.LimitStats)
+	// DeadLetters 按时间顺序列出保存的死信
+	DeadLetters() ([]*mqrpc.DeadLetter, error)
+	// Redrive 重新执行一条死信
+	Redrive(id string) error
 	ServiceRegister() error
 	ServiceDeregister() error
 	Start() error
@@ -36,27 +45,11 @@ type Message interface {
 }
 
 // Request Request
-type Request interface {
-	Service() string
-	Method() string
-	ContentType() string
-	Request() interface{}
-	// indicates whether the request will be streamed
-	Stream() bool
-}
+type Request = mqrpc.Request
 
 // Stream represents a stream established with a client.
-// A stream can be bidirectional which is indicated by the request.
-// The last error will be left in Error().
-// EOF indicated end of the stream.
-type Stream interface {
-	Context() context.Context
-	Request() Request
-	Send(interface{}) error
-	Recv(interface{}) error
-	Error() error
-	Close() error
-}
+// 具体定义见 mqrpc.Stream
+type Stream = mqrpc.Stream
 
 // Option Option
 type Option func(*Options)